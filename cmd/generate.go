@@ -65,7 +65,7 @@ This command must be rerun after each source code modification, including module
 	},
 }
 
-var symlinkDirs = []string{"static", "data", "demo", "resources", "i18n"}
+var symlinkDirs = []string{"static", "data", "demo", "resources", "security", "i18n"}
 
 var (
 	generateEmptyPool bool
@@ -327,6 +327,74 @@ func main() {
 		},
 	}
 	hexyaCmd.AddCommand(updateDBCmd)
+	cmd.SetUpdateDBFlags(updateDBCmd)
+
+	var migrateCmd = &cobra.Command{
+		Use:   "migrate",
+		Short: "Manage versioned database migrations",
+		Long: "Manage versioned database migrations",
+	}
+	hexyaCmd.AddCommand(migrateCmd)
+	migrateCmd.AddCommand(&cobra.Command{
+		Use:   "plan NAME",
+		Short: "Generate a migration from the differences between the models and the database",
+		Long: "Generate a migration from the differences between the models and the database",
+		Args:  cobra.ExactArgs(1),
+		Run: func(c *cobra.Command, args []string) {
+			cmd.MigratePlan(args[0])
+		},
+	})
+	migrateCmd.AddCommand(&cobra.Command{
+		Use:   "apply",
+		Short: "Apply pending migrations",
+		Long: "Apply pending migrations",
+		Run: func(c *cobra.Command, args []string) {
+			cmd.MigrateApply()
+		},
+	})
+	migrateCmd.AddCommand(&cobra.Command{
+		Use:   "rollback MODULE",
+		Short: "Roll back the last applied migration of a module",
+		Long: "Roll back the last applied migration of a module",
+		Args:  cobra.ExactArgs(1),
+		Run: func(c *cobra.Command, args []string) {
+			cmd.MigrateRollback(args[0])
+		},
+	})
+
+	var moduleCmd = &cobra.Command{
+		Use:   "module",
+		Short: "Manage the modules installed in the database",
+		Long: "Manage the modules installed in the database",
+	}
+	hexyaCmd.AddCommand(moduleCmd)
+	moduleCmd.AddCommand(&cobra.Command{
+		Use:   "install MODULE",
+		Short: "Install a module in the database",
+		Long: "Install a module in the database",
+		Args:  cobra.ExactArgs(1),
+		Run: func(c *cobra.Command, args []string) {
+			cmd.ModuleInstall(args[0])
+		},
+	})
+	moduleCmd.AddCommand(&cobra.Command{
+		Use:   "upgrade MODULE",
+		Short: "Upgrade a module in the database",
+		Long: "Upgrade a module in the database",
+		Args:  cobra.ExactArgs(1),
+		Run: func(c *cobra.Command, args []string) {
+			cmd.ModuleUpgrade(args[0])
+		},
+	})
+	moduleCmd.AddCommand(&cobra.Command{
+		Use:   "uninstall MODULE",
+		Short: "Uninstall a module from the database",
+		Long: "Uninstall a module from the database",
+		Args:  cobra.ExactArgs(1),
+		Run: func(c *cobra.Command, args []string) {
+			cmd.ModuleUninstall(args[0])
+		},
+	})
 
 	cobra.OnInitialize(cmd.InitConfig)
 
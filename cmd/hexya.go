@@ -56,6 +56,8 @@ func SetHexyaFlags(c *cobra.Command) {
 	viper.BindPFlag("DataDir", c.PersistentFlags().Lookup("data-dir"))
 	c.PersistentFlags().String("resource-dir", "./res", "Path to the directory where Hexya should read its resources. Defaults to 'res' subdirectory of current directory")
 	viper.BindPFlag("ResourceDir", c.PersistentFlags().Lookup("resource-dir"))
+	c.PersistentFlags().String("migrations-dir", "./migrations", "Path to the directory where Hexya should read and write database migrations. Defaults to 'migrations' subdirectory of current directory")
+	viper.BindPFlag("MigrationsDir", c.PersistentFlags().Lookup("migrations-dir"))
 	c.PersistentFlags().String("db-driver", "postgres", "Database driver to use")
 	viper.BindPFlag("DB.Driver", c.PersistentFlags().Lookup("db-driver"))
 	c.PersistentFlags().String("db-host", "/var/run/postgresql",
@@ -0,0 +1,149 @@
+// Copyright 2019 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/server"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var migrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Manage versioned database migrations",
+	Long: `Manage versioned database migrations of the project in the current directory.
+
+Migrations are SQL files stored in a subdirectory per module of the migrations directory.
+They are generated by 'hexya migrate plan' or written by hand,
+can be reviewed and edited, and are applied in version order by 'hexya migrate apply'.`,
+}
+
+var migratePlanCmd = &cobra.Command{
+	Use:   "plan NAME",
+	Short: "Generate a migration from the differences between the models and the database",
+	Long: `Compare the database schema with the models definitions and write the statements
+needed to synchronize them in a new migration file of each module declaring changed models,
+fields or constraints. Changes not bound to a module, such as those of Hexya models, are
+written in migrations of the 'schema' pseudo module. Nothing is written if the database
+is up to date.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		runProject(".", "migrate", append([]string{"plan"}, args...))
+	},
+}
+
+var migrateApplyCmd = &cobra.Command{
+	Use:   "apply",
+	Short: "Apply pending migrations",
+	Long: `Apply all migrations that have not been applied yet to the database, in version order.
+Each migration is applied in its own transaction.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		runProject(".", "migrate", []string{"apply"})
+	},
+}
+
+var migrateRollbackCmd = &cobra.Command{
+	Use:   "rollback MODULE",
+	Short: "Roll back the last applied migration of a module",
+	Long:  `Execute the Down section of the last applied migration of the given module.`,
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		runProject(".", "migrate", append([]string{"rollback"}, args...))
+	},
+}
+
+// initMigrate prepares the models for a migrate command
+func initMigrate() {
+	setupLogger()
+	setupDebug()
+	connectToDB()
+	server.PreInit()
+	models.BootStrap()
+}
+
+// loadMigrations returns the migrations of the migrations directory.
+// It exits on error.
+func loadMigrations() []*models.Migration {
+	migrations, err := models.LoadMigrations(viper.GetString("MigrationsDir"))
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	return migrations
+}
+
+// MigratePlan writes new migrations with the statements needed to synchronize
+// the database schema with the models, one per module owning changed models.
+// It is meant to be called from a project start file which imports all the
+// project's module.
+func MigratePlan(name string) {
+	initMigrate()
+	migrations := models.PlanMigrations(name, server.MigrationModules())
+	if len(migrations) == 0 {
+		fmt.Println("Database schema is up to date")
+		return
+	}
+	for _, migration := range migrations {
+		fileName, err := migration.WriteFile(viper.GetString("MigrationsDir"))
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Printf("Migration written to %s\n", fileName)
+	}
+}
+
+// MigrateApply applies the pending migrations, then updates the modules
+// as updatedb does. It is meant to be called
+// from a project start file which imports all the project's module.
+//
+// Models are not initialized if the database schema still differs from
+// the models after applying the migrations.
+func MigrateApply() {
+	initMigrate()
+	applied, err := models.ApplyMigrations(loadMigrations())
+	for _, m := range applied {
+		fmt.Printf("Applied migration %s\n", m)
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if changes := models.SchemaChanges(); len(changes) > 0 {
+		fmt.Println("Database schema still differs from the models. Run 'hexya migrate plan' to generate the missing statements:")
+		fmt.Println(strings.Join(changes, ";\n") + ";")
+		os.Exit(1)
+	}
+	updateModules()
+	log.Info("Migrations applied successfully")
+}
+
+// MigrateRollback rolls back the last applied migration of the given module.
+// It is meant to be called from a project start file which imports all the
+// project's module.
+func MigrateRollback(module string) {
+	initMigrate()
+	m, err := models.RollbackMigration(loadMigrations(), module)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if m == nil {
+		fmt.Printf("No migration to roll back for module %s\n", module)
+		return
+	}
+	fmt.Printf("Rolled back migration %s\n", m)
+}
+
+func init() {
+	HexyaCmd.AddCommand(migrateCmd)
+	migrateCmd.AddCommand(migratePlanCmd)
+	migrateCmd.AddCommand(migrateApplyCmd)
+	migrateCmd.AddCommand(migrateRollbackCmd)
+}
@@ -11,13 +11,14 @@ import (
 	"path/filepath"
 	"text/template"
 
+	"github.com/hexya-erp/hexya/src/server"
 	"github.com/spf13/cobra"
 )
 
 var moduleCmd = &cobra.Command{
 	Use:   "module",
-	Short: "Module development utilities",
-	Long:  `Hexya utilities for module development.`,
+	Short: "Module development and management utilities",
+	Long:  `Hexya utilities for module development and for managing the modules installed in the database.`,
 }
 
 var moduleInitCmd = &cobra.Command{
@@ -131,11 +132,86 @@ You should use this command before committing your work.`,
 	},
 }
 
+var moduleInstallCmd = &cobra.Command{
+	Use:   "install MODULE",
+	Short: "Install a module in the database",
+	Long: `Install the given module and its dependencies in the database of the project in the current directory.
+The module's PreMigrate and PostMigrate hooks are run and its data is loaded.
+
+Modules that have never been installed in the database are also installed by 'hexya updatedb',
+so that this command is only needed for modules that have been uninstalled.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		runProject(".", "module", append([]string{"install"}, args...))
+	},
+}
+
+var moduleUpgradeCmd = &cobra.Command{
+	Use:   "upgrade MODULE",
+	Short: "Upgrade a module in the database",
+	Long: `Upgrade the given installed module in the database of the project in the current directory.
+The module's PreMigrate and PostMigrate hooks are run and its data is reloaded.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		runProject(".", "module", append([]string{"upgrade"}, args...))
+	},
+}
+
+var moduleUninstallCmd = &cobra.Command{
+	Use:   "uninstall MODULE",
+	Short: "Uninstall a module from the database",
+	Long: `Uninstall the given module from the database of the project in the current directory.
+The module's Uninstall hook is run and the module is not loaded anymore by the server.
+A module cannot be uninstalled while another installed module depends on it.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		runProject(".", "module", append([]string{"uninstall"}, args...))
+	},
+}
+
+// ModuleInstall installs the given module and its dependencies in the database.
+// It is meant to be called from a project start file which imports all the project's module.
+func ModuleInstall(name string) {
+	initMigrate()
+	if err := server.InstallModule(name); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	updateModules()
+	fmt.Printf("Module %s installed\n", name)
+}
+
+// ModuleUpgrade upgrades the given module in the database.
+// It is meant to be called from a project start file which imports all the project's module.
+func ModuleUpgrade(name string) {
+	initMigrate()
+	if err := server.UpgradeModule(name); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	updateModules()
+	fmt.Printf("Module %s upgraded\n", name)
+}
+
+// ModuleUninstall uninstalls the given module from the database.
+// It is meant to be called from a project start file which imports all the project's module.
+func ModuleUninstall(name string) {
+	initMigrate()
+	if err := server.UninstallModule(name); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Printf("Module %s uninstalled\n", name)
+}
+
 func init() {
 	HexyaCmd.AddCommand(moduleCmd)
 	moduleCmd.AddCommand(moduleInitCmd)
 	moduleCmd.AddCommand(moduleNewCmd)
 	moduleCmd.AddCommand(moduleCleanCmd)
+	moduleCmd.AddCommand(moduleInstallCmd)
+	moduleCmd.AddCommand(moduleUpgradeCmd)
+	moduleCmd.AddCommand(moduleUninstallCmd)
 }
 
 var hexyaGoTmpl = template.Must(template.New("").Parse(`
@@ -151,6 +227,8 @@ const MODULE_NAME string = {{ .ModuleName }}
 func init() {
 	server.RegisterModule(&server.Module{
 		Name:     MODULE_NAME,
+		Version:  "0.1.0",
+		Depends:  []string{},
 		PostInit: func() {},
 	})
 }
@@ -15,10 +15,16 @@
 package cmd
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"syscall"
+	"time"
 
 	"github.com/gin-contrib/pprof"
 	"github.com/gin-gonic/gin"
@@ -62,11 +68,16 @@ func runProject(projectDir, cmd string, args []string) {
 	if err = runCommand("go", "build", "-o", cmdName, absProjectDir); err != nil {
 		os.Exit(1)
 	}
-	runCommand(filepath.Join(absProjectDir, cmdName), append([]string{cmd}, args...)...)
+	if err = runCommand(filepath.Join(absProjectDir, cmdName), append([]string{cmd}, args...)...); err != nil {
+		os.Exit(1)
+	}
 }
 
 // StartServer starts the Hexya server. It is meant to be called from
 // a project start file which imports all the project's module.
+//
+// It returns when the server receives SIGINT or SIGTERM, after shutting it
+// down, and exits with a non-zero status if the server stopped by itself.
 func StartServer() {
 	setupLogger()
 	defer log.Sync()
@@ -76,13 +87,15 @@ func StartServer() {
 		log.Panic("Unable to find Resource directory", "error", err)
 	}
 	server.ResourceDir = resourceDir
-	server.PreInit()
 	connectToDB()
+	server.PreInit()
 	i18n.BootStrap()
 	models.BootStrap()
+	server.ActivateInstalledModules()
 	models.RunWorkerLoop()
 	server.LoadTranslations(resourceDir, i18n.Langs)
 	server.LoadInternalResources(resourceDir)
+	server.LoadAccessControls(resourceDir)
 	views.BootStrap()
 	templates.BootStrap()
 	actions.BootStrap()
@@ -94,14 +107,61 @@ func StartServer() {
 	cert := viper.GetString("Server.Certificate")
 	key := viper.GetString("Server.PrivateKey")
 	domain := viper.GetString("Server.Domain")
-	switch {
-	case cert != "":
-		srv.RunTLS(address, cert, key)
-	case domain != "":
-		srv.RunAutoTLS(domain)
-	default:
-		srv.Run(address)
+	// Signals are registered before the server starts so that none is missed,
+	// and a server started after Shutdown stops right away.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	stopped := make(chan error, 1)
+	go func() {
+		switch {
+		case cert != "":
+			stopped <- srv.RunTLS(address, cert, key)
+		case domain != "":
+			stopped <- srv.RunAutoTLS(domain)
+		default:
+			stopped <- srv.Run(address)
+		}
+	}()
+	err = waitForStop(signals, stopped)
+	shutdownServer(srv)
+	if err != nil {
+		log.Sync()
+		os.Exit(1)
+	}
+}
+
+// waitForStop waits until a signal is received on signals or the server
+// sends the error it stopped with on stopped. It returns the error of the
+// server if it stopped by itself, or nil if a signal has been received.
+func waitForStop(signals <-chan os.Signal, stopped <-chan error) error {
+	select {
+	case sig := <-signals:
+		log.Info("Received signal, shutting down", "signal", sig)
+		return nil
+	case err := <-stopped:
+		if err == nil || err == http.ErrServerClosed {
+			err = errors.New("server stopped unexpectedly")
+		}
+		log.Error("Server stopped, shutting down", "error", err)
+		return err
+	}
+}
+
+// shutdownServer gracefully stops the given server and the worker loop,
+// runs the modules shutdown hooks and closes the database.
+func shutdownServer(srv *server.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), viper.GetDuration("Server.ShutdownTimeout"))
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Warn("Requests in progress did not complete before shutdown timeout", "error", err)
+	}
+	log.Info("Waiting for worker functions to return")
+	if err := models.StopWorkerLoop(ctx); err != nil {
+		log.Warn("Worker functions did not return before shutdown timeout", "error", err)
 	}
+	server.PreShutdown()
+	models.DBClose()
+	log.Info("Hexya server stopped")
 }
 
 // setupLogger initializes the logger
@@ -148,6 +208,14 @@ func SetServerFlags(c *cobra.Command) {
 	viper.BindPFlag("Server.Certificate", c.PersistentFlags().Lookup("certificate"))
 	c.PersistentFlags().StringP("private-key", "K", "", "Private key file for HTTPS.")
 	viper.BindPFlag("Server.PrivateKey", c.PersistentFlags().Lookup("private-key"))
+	c.PersistentFlags().Duration("shutdown-timeout", 30*time.Second, "Maximum time to wait for requests in progress and worker functions to complete when the server is stopped.")
+	viper.BindPFlag("Server.ShutdownTimeout", c.PersistentFlags().Lookup("shutdown-timeout"))
+	c.PersistentFlags().StringSlice("session-keys", []string{}, "Comma separated list of secrets used to sign and encrypt session cookies. The first one is used for new cookies and the others only to read existing ones. Random secrets are used if empty.")
+	viper.BindPFlag("Server.SessionKeys", c.PersistentFlags().Lookup("session-keys"))
+	c.PersistentFlags().String("session-store", "cookie", "Where session values are stored. Must be 'cookie' to store them in the session cookie or 'postgres' to store them in the database.")
+	viper.BindPFlag("Server.SessionStore", c.PersistentFlags().Lookup("session-store"))
+	c.PersistentFlags().Duration("session-max-age", 30*24*time.Hour, "Duration after which an unused session expires.")
+	viper.BindPFlag("Server.SessionMaxAge", c.PersistentFlags().Lookup("session-max-age"))
 }
 
 func runCommand(c string, args ...string) error {
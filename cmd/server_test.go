@@ -0,0 +1,33 @@
+// Copyright 2019 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package cmd
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestWaitForStop(t *testing.T) {
+	Convey("Testing waiting for the server to stop", t, func() {
+		signals := make(chan os.Signal, 1)
+		stopped := make(chan error, 1)
+		Convey("Receiving a signal should not be an error", func() {
+			signals <- syscall.SIGTERM
+			So(waitForStop(signals, stopped), ShouldBeNil)
+		})
+		Convey("The error of the server should be returned", func() {
+			stopped <- errors.New("address already in use")
+			So(waitForStop(signals, stopped), ShouldResemble, errors.New("address already in use"))
+		})
+		Convey("A server stopping without signal should be an error", func() {
+			stopped <- http.ErrServerClosed
+			So(waitForStop(signals, stopped), ShouldNotBeNil)
+		})
+	})
+}
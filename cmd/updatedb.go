@@ -4,7 +4,11 @@
 package cmd
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/hexya-erp/hexya/src/models"
 	"github.com/hexya-erp/hexya/src/server"
@@ -15,38 +19,83 @@ import (
 var updateDBCmd = &cobra.Command{
 	Use:   "updatedb",
 	Short: "Update the database schema",
-	Long:  `Synchronize the database schema with the models definitions.`,
+	Long: `Synchronize the database schema with the models definitions.
+
+With --dry-run, the SQL statements that would be executed are printed instead,
+or written to the file given by --output, so that they can be reviewed and applied by hand.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		projectDir := "."
 		if len(args) > 0 {
 			projectDir = args[0]
 		}
+		// Flags are not passed on to the project command otherwise
+		if viper.GetBool("UpdateDB.DryRun") {
+			args = append(args, "--dry-run")
+		}
+		if output := viper.GetString("UpdateDB.Output"); output != "" {
+			args = append(args, "--output", output)
+		}
 		runProject(projectDir, "updatedb", args)
 	},
 }
 
+// SetUpdateDBFlags adds the updatedb flags to the given command.
+func SetUpdateDBFlags(c *cobra.Command) {
+	c.Flags().Bool("dry-run", false, "Print the SQL statements that would be executed instead of executing them")
+	viper.BindPFlag("UpdateDB.DryRun", c.Flags().Lookup("dry-run"))
+	c.Flags().String("output", "", "Write the SQL statements that would be executed to the given file instead of executing them. Implies --dry-run")
+	viper.BindPFlag("UpdateDB.Output", c.Flags().Lookup("output"))
+}
+
 // UpdateDB updates the database schema. It is meant to be called from
 // a project start file which imports all the project's module.
 func UpdateDB() {
 	setupLogger()
 	setupDebug()
-	server.PreInit()
 	connectToDB()
+	server.PreInit()
 	models.BootStrap()
-	models.SyncDatabase()
+	if viper.GetBool("UpdateDB.DryRun") || viper.GetString("UpdateDB.Output") != "" {
+		writeSchemaChanges(viper.GetString("UpdateDB.Output"))
+		return
+	}
+	updateModules()
+	log.Info("Database updated successfully")
+}
+
+// updateModules synchronizes the database with the active modules,
+// installing and upgrading the modules that need to be. It exits on error.
+func updateModules() {
 	resourceDir, err := filepath.Abs(viper.GetString("ResourceDir"))
 	if err != nil {
 		log.Panic("Unable to find Resource directory", "error", err)
 	}
 	server.ResourceDir = resourceDir
-	server.LoadDataRecords(resourceDir)
-	if viper.GetBool("Demo") {
-		log.Info("Demo mode detected: loading demo data")
-		server.LoadDemoRecords(resourceDir)
+	if err := server.UpdateModules(resourceDir, viper.GetBool("Demo")); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
 	}
-	log.Info("Database updated successfully")
+}
+
+// writeSchemaChanges writes the SQL statements needed to synchronize the database
+// schema with the models to the given file, or to stdout if fileName is empty.
+func writeSchemaChanges(fileName string) {
+	changes := models.SchemaChanges()
+	script := "-- Database schema is up to date\n"
+	if len(changes) > 0 {
+		script = strings.Join(changes, ";\n\n") + ";\n"
+	}
+	if fileName == "" {
+		fmt.Print(script)
+		return
+	}
+	if err := ioutil.WriteFile(fileName, []byte(script), 0644); err != nil {
+		log.Panic("Unable to write SQL file", "file", fileName, "error", err)
+	}
+	log.Info("SQL statements written", "file", fileName, "count", len(changes))
 }
 
 func init() {
+	SetUpdateDBFlags(updateDBCmd)
 	HexyaCmd.AddCommand(updateDBCmd)
 }
@@ -139,6 +139,22 @@ func TestControllers(t *testing.T) {
 		Convey("Overriding a controller that does not exist should fail", func() {
 			So(func() { registry.OverrideController(http.MethodGet, "/nonexistent", func(ctx *server.Context) {}) }, ShouldPanic)
 		})
+		Convey("Testing REST API controllers", func() {
+			grp := registry.MustGetGroup("/test")
+			addRESTControllers(grp)
+			So(grp.HasController(http.MethodGet, "/"), ShouldBeTrue)
+			So(grp.HasController(http.MethodGet, "/:model"), ShouldBeTrue)
+			So(grp.HasController(http.MethodPost, "/:model"), ShouldBeTrue)
+			So(grp.HasController(http.MethodGet, "/:model/:id"), ShouldBeTrue)
+			So(grp.HasController(http.MethodPatch, "/:model/:id"), ShouldBeTrue)
+			So(grp.HasController(http.MethodDelete, "/:model/:id"), ShouldBeTrue)
+			So(grp.HasController(http.MethodPost, "/:model/:id/:method"), ShouldBeTrue)
+			srv := newServer()
+			So(func() { registry.createRoutes(srv.Group("/")) }, ShouldNotPanic)
+			r := performRequest(srv, http.MethodGet, "/test/NonExistentModel")
+			So(r.Code, ShouldEqual, http.StatusNotFound)
+			So(r.Body.String(), ShouldContainSubstring, `"type":"not_found"`)
+		})
 		Convey("Boostrap should not panic", func() {
 			So(BootStrap, ShouldNotPanic)
 		})
@@ -0,0 +1,283 @@
+// Copyright 2019 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package controllers
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/models/fieldtype"
+	"github.com/hexya-erp/hexya/src/models/security"
+	"github.com/hexya-erp/hexya/src/server"
+)
+
+// restOpenAPI serves the OpenAPI 3 document of the REST API for the
+// authenticated user of the request.
+func restOpenAPI(c *server.Context) {
+	uid := restUID(c)
+	if uid == 0 {
+		restAbortUnauthorized(c)
+		return
+	}
+	c.JSON(http.StatusOK, openAPIDocument(strings.TrimSuffix(c.Request.URL.Path, "/"), uid))
+}
+
+// openAPIDocument returns the OpenAPI 3 document of the REST API served at
+// basePath for the user with the given uid. Only the models this user can
+// read and the fields this user can access are documented.
+func openAPIDocument(basePath string, uid int64) map[string]interface{} {
+	paths := make(map[string]interface{})
+	schemas := map[string]interface{}{
+		"Error": map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"error": map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"type":    map[string]interface{}{"type": "string"},
+						"message": map[string]interface{}{"type": "string"},
+					},
+				},
+			},
+		},
+	}
+	for _, model := range models.Registry.BusinessModels() {
+		if !model.CheckAccess(uid, security.Read) {
+			continue
+		}
+		name := model.Name()
+		schemas[name] = openAPIModelSchema(model, uid)
+		for path, item := range openAPIModelPaths(name) {
+			paths[path] = item
+		}
+	}
+	return map[string]interface{}{
+		"openapi": "3.0.0",
+		"info": map[string]interface{}{
+			"title":   "Hexya REST API",
+			"version": "1",
+		},
+		"servers": []interface{}{
+			map[string]interface{}{"url": basePath},
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				"basicAuth": map[string]interface{}{"type": "http", "scheme": "basic"},
+			},
+		},
+		"security": []interface{}{
+			map[string]interface{}{"basicAuth": []string{}},
+		},
+	}
+}
+
+// openAPIModelSchema returns the schema of the records of the given model
+// with the fields the user with the given uid can access.
+func openAPIModelSchema(model *models.Model, uid int64) map[string]interface{} {
+	properties := make(map[string]interface{})
+	var required []string
+	for jsonName, fInfo := range model.AccessibleFieldsGet(uid) {
+		properties[jsonName] = openAPIFieldSchema(fInfo)
+		if fInfo.Required {
+			required = append(required, jsonName)
+		}
+	}
+	res := map[string]interface{}{
+		"type":       "object",
+		"properties": properties,
+	}
+	if len(required) > 0 {
+		sort.Strings(required)
+		res["required"] = required
+	}
+	return res
+}
+
+// openAPIFieldSchema returns the schema of the values of the given field
+func openAPIFieldSchema(fInfo *models.FieldInfo) map[string]interface{} {
+	res := make(map[string]interface{})
+	switch fInfo.Type {
+	case fieldtype.Boolean:
+		res["type"] = "boolean"
+	case fieldtype.Integer:
+		res["type"], res["format"] = "integer", "int64"
+	case fieldtype.Float:
+		res["type"] = "number"
+	case fieldtype.Char, fieldtype.Text, fieldtype.HTML, fieldtype.Reference:
+		res["type"] = "string"
+	case fieldtype.Date:
+		res["type"], res["format"] = "string", "date"
+	case fieldtype.DateTime:
+		res["type"], res["format"] = "string", "date-time"
+	case fieldtype.Binary:
+		res["type"], res["format"] = "string", "byte"
+	case fieldtype.UUID:
+		res["type"], res["format"] = "string", "uuid"
+	case fieldtype.Selection:
+		res["type"] = "string"
+		var values []string
+		for value := range fInfo.Selection {
+			values = append(values, value)
+		}
+		sort.Strings(values)
+		res["enum"] = values
+	case fieldtype.Many2One, fieldtype.One2One, fieldtype.Rev2One:
+		res["type"], res["format"], res["nullable"] = "integer", "int64", true
+	case fieldtype.One2Many, fieldtype.Many2Many:
+		res["type"] = "array"
+		res["items"] = map[string]interface{}{"type": "integer", "format": "int64"}
+	}
+	description := fInfo.String
+	if fInfo.Relation != "" {
+		description += " (" + fInfo.Relation + " ids)"
+	}
+	if fInfo.Help != "" {
+		description += "\n\n" + fInfo.Help
+	}
+	res["description"] = description
+	if fInfo.ReadOnly {
+		res["readOnly"] = true
+	}
+	return res
+}
+
+// openAPIModelPaths returns the path items of the endpoints of the model with the given name
+func openAPIModelPaths(name string) map[string]interface{} {
+	schemaRef := map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	recordContent := map[string]interface{}{
+		"application/json": map[string]interface{}{"schema": schemaRef},
+	}
+	recordResponse := map[string]interface{}{"description": "The " + name + " record", "content": recordContent}
+	recordBody := map[string]interface{}{"required": true, "content": recordContent}
+	idParam := openAPIParameter("id", "path", "ID of the record", map[string]interface{}{"type": "integer", "format": "int64"})
+	readParams := []interface{}{
+		openAPIParameter("fields", "query", "Comma separated list of fields to return", map[string]interface{}{"type": "string"}),
+		openAPIParameter("relations", "query", "Serialization of relations: ids (default) or nested objects with id and display_name",
+			map[string]interface{}{"type": "string", "enum": []string{"ids", "nested"}}),
+	}
+	return map[string]interface{}{
+		"/" + name: map[string]interface{}{
+			"get": map[string]interface{}{
+				"operationId": "search" + name,
+				"summary":     "Search " + name + " records",
+				"parameters": append([]interface{}{
+					openAPIParameter("filter", "query", `JSON array of [field, operator, value] terms in polish notation with "&", "|" and "!"`, map[string]interface{}{"type": "string"}),
+					openAPIParameter("limit", "query", "Maximum number of records to return", map[string]interface{}{"type": "integer", "default": restDefaultLimit}),
+					openAPIParameter("offset", "query", "Number of records to skip", map[string]interface{}{"type": "integer"}),
+					openAPIParameter("order", "query", `Comma separated list of order expressions such as "Name desc"`, map[string]interface{}{"type": "string"}),
+				}, readParams...),
+				"responses": openAPIResponses(http.StatusOK, map[string]interface{}{
+					"description": "The matching records",
+					"content": map[string]interface{}{
+						"application/json": map[string]interface{}{
+							"schema": map[string]interface{}{
+								"type": "object",
+								"properties": map[string]interface{}{
+									"count":   map[string]interface{}{"type": "integer"},
+									"records": map[string]interface{}{"type": "array", "items": schemaRef},
+								},
+							},
+						},
+					},
+				}),
+			},
+			"post": map[string]interface{}{
+				"operationId": "create" + name,
+				"summary":     "Create a " + name + " record",
+				"parameters":  readParams,
+				"requestBody": recordBody,
+				"responses":   openAPIResponses(http.StatusCreated, recordResponse),
+			},
+		},
+		"/" + name + "/{id}": map[string]interface{}{
+			"parameters": []interface{}{idParam},
+			"get": map[string]interface{}{
+				"operationId": "read" + name,
+				"summary":     "Read a " + name + " record",
+				"parameters":  readParams,
+				"responses":   openAPIResponses(http.StatusOK, recordResponse),
+			},
+			"patch": map[string]interface{}{
+				"operationId": "write" + name,
+				"summary":     "Update a " + name + " record",
+				"parameters":  readParams,
+				"requestBody": recordBody,
+				"responses":   openAPIResponses(http.StatusOK, recordResponse),
+			},
+			"delete": map[string]interface{}{
+				"operationId": "unlink" + name,
+				"summary":     "Delete a " + name + " record",
+				"responses":   openAPIResponses(http.StatusNoContent, map[string]interface{}{"description": "The record has been deleted"}),
+			},
+		},
+		"/" + name + "/{id}/{method}": map[string]interface{}{
+			"post": map[string]interface{}{
+				"operationId": "call" + name,
+				"summary":     "Call a method on a " + name + " record",
+				"parameters": []interface{}{
+					idParam,
+					openAPIParameter("method", "path", "Name of the method", map[string]interface{}{"type": "string"}),
+				},
+				"requestBody": map[string]interface{}{
+					"content": map[string]interface{}{
+						"application/json": map[string]interface{}{
+							"schema": map[string]interface{}{"type": "array", "items": map[string]interface{}{}},
+						},
+					},
+				},
+				"responses": openAPIResponses(http.StatusOK, map[string]interface{}{
+					"description": "The result of the method",
+					"content": map[string]interface{}{
+						"application/json": map[string]interface{}{
+							"schema": map[string]interface{}{
+								"type":       "object",
+								"properties": map[string]interface{}{"result": map[string]interface{}{}},
+							},
+						},
+					},
+				}),
+			},
+		},
+	}
+}
+
+// openAPIParameter returns an OpenAPI parameter object
+func openAPIParameter(name, in, description string, schema map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"name":        name,
+		"in":          in,
+		"description": description,
+		"required":    in == "path",
+		"schema":      schema,
+	}
+}
+
+// openAPIResponses returns the responses object of an operation with the given
+// success status and response, and the error responses common to all operations.
+func openAPIResponses(status int, response map[string]interface{}) map[string]interface{} {
+	errorResponse := func(description string) map[string]interface{} {
+		return map[string]interface{}{
+			"description": description,
+			"content": map[string]interface{}{
+				"application/json": map[string]interface{}{
+					"schema": map[string]interface{}{"$ref": "#/components/schemas/Error"},
+				},
+			},
+		}
+	}
+	return map[string]interface{}{
+		strconv.Itoa(status): response,
+		"400":                errorResponse("Invalid request or user error"),
+		"401":                errorResponse("Authentication required"),
+		"403":                errorResponse("Access denied"),
+		"404":                errorResponse("Unknown model, record or method"),
+		"409":                errorResponse("Concurrent update"),
+		"422":                errorResponse("Validation error"),
+	}
+}
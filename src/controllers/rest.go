@@ -0,0 +1,496 @@
+// Copyright 2019 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package controllers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/models/operator"
+	"github.com/hexya-erp/hexya/src/models/security"
+	"github.com/hexya-erp/hexya/src/models/types"
+	"github.com/hexya-erp/hexya/src/server"
+	"github.com/hexya-erp/hexya/src/tools/exceptions"
+)
+
+// restDefaultLimit is the maximum number of records returned by a
+// search if no limit is given in the request.
+const restDefaultLimit = 80
+
+var (
+	// restModels maps the names and table names of the models exposed
+	// by the REST API to their Model
+	restModels     map[string]*models.Model
+	restModelsOnce sync.Once
+)
+
+// AddRESTGroup adds a group at the given relativePath to the Registry that
+// exposes a REST/JSON API for all the business models:
+//
+//	GET    /<model>?filter=&fields=&limit=&offset=&order=&relations=
+//	POST   /<model>
+//	GET    /<model>/<id>?fields=&relations=
+//	PATCH  /<model>/<id>
+//	DELETE /<model>/<id>
+//	POST   /<model>/<id>/<method>
+//
+// An OpenAPI 3 document of the API for the authenticated user is served
+// at the root of the group.
+//
+// Requests are executed as the user of the session or the user given by
+// HTTP Basic authentication, so that access rights, method execution
+// permissions and record rules apply. The API is not available unless
+// this function is called, typically in a module's init function:
+//
+//	controllers.AddRESTGroup("/api/v1")
+func AddRESTGroup(relativePath string) *Group {
+	grp := Registry.AddGroup(relativePath)
+	addRESTControllers(grp)
+	return grp
+}
+
+// addRESTControllers adds the controllers of the REST API to the given group
+func addRESTControllers(grp *Group) {
+	grp.AddController(http.MethodGet, "/", restOpenAPI)
+	grp.AddController(http.MethodGet, "/:model", restSearch)
+	grp.AddController(http.MethodPost, "/:model", restCreate)
+	grp.AddController(http.MethodGet, "/:model/:id", restRead)
+	grp.AddController(http.MethodPatch, "/:model/:id", restWrite)
+	grp.AddController(http.MethodDelete, "/:model/:id", restUnlink)
+	grp.AddController(http.MethodPost, "/:model/:id/:method", restCallMethod)
+}
+
+// getRESTModel returns the Model exposed by the REST API with the given name or table name.
+func getRESTModel(name string) (*models.Model, bool) {
+	restModelsOnce.Do(func() {
+		restModels = make(map[string]*models.Model)
+		for _, model := range models.Registry.BusinessModels() {
+			restModels[model.Name()] = model
+			restModels[model.TableName()] = model
+		}
+	})
+	model, ok := restModels[name]
+	return model, ok
+}
+
+// restUID returns the ID of the user of the given request, authenticated
+// either by the session or by HTTP Basic authentication.
+//
+// It returns 0 if the user is not authenticated.
+func restUID(c *server.Context) int64 {
+	switch uid := c.Session().Get(server.SessionUIDKey).(type) {
+	case int64:
+		return uid
+	case int:
+		return int64(uid)
+	}
+	login, secret, ok := c.Request.BasicAuth()
+	if !ok {
+		return 0
+	}
+	uid, err := security.AuthenticationRegistry.Authenticate(login, secret, types.NewContext())
+	if err != nil {
+		return 0
+	}
+	return uid
+}
+
+// restErrorBody returns the body of an error response with the given type and message
+func restErrorBody(errType, message string) map[string]interface{} {
+	return map[string]interface{}{
+		"error": map[string]interface{}{
+			"type":    errType,
+			"message": message,
+		},
+	}
+}
+
+// restAbortUnauthorized aborts the request with a 401 status asking for HTTP Basic authentication
+func restAbortUnauthorized(c *server.Context) {
+	c.Header("WWW-Authenticate", `Basic realm="Hexya"`)
+	c.AbortWithStatusJSON(http.StatusUnauthorized, restErrorBody("unauthorized", "Authentication required"))
+}
+
+// restAbortWithError aborts the request with the HTTP status and error body of the given error
+func restAbortWithError(c *server.Context, err error) {
+	status, errType, message := http.StatusBadRequest, "user_error", err.Error()
+	switch e := err.(type) {
+	case exceptions.AccessError:
+		status, errType = http.StatusForbidden, "access_error"
+	case exceptions.ConcurrentUpdateError:
+		status, errType = http.StatusConflict, "concurrent_update_error"
+	case exceptions.ValidationError:
+		status, errType = http.StatusUnprocessableEntity, "validation_error"
+	case exceptions.UserError:
+		message = e.Message
+	}
+	c.AbortWithStatusJSON(status, restErrorBody(errType, message))
+}
+
+// restExecute authenticates the user of the request and calls fnct in a new
+// environment of this user with an empty RecordCollection of the requested model.
+//
+// fnct returns the HTTP status and the body of the response, which is sent as JSON.
+// If the body is nil, only the status is sent.
+func restExecute(c *server.Context, fnct func(*models.RecordCollection) (int, interface{})) {
+	model, ok := getRESTModel(c.Param("model"))
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusNotFound, restErrorBody("not_found", "Unknown model "+c.Param("model")))
+		return
+	}
+	uid := restUID(c)
+	if uid == 0 {
+		restAbortUnauthorized(c)
+		return
+	}
+	var (
+		status int
+		body   interface{}
+	)
+	err := models.ExecuteInNewEnvironment(uid, func(env models.Environment) {
+		status, body = fnct(env.Pool(model.Name()))
+	})
+	if err != nil {
+		restAbortWithError(c, err)
+		return
+	}
+	if body == nil {
+		c.AbortWithStatus(status)
+		return
+	}
+	c.JSON(status, body)
+}
+
+// restExecuteOnRecord calls restExecute with a RecordCollection holding
+// the record of the id of the request, or responds with a 404 status if
+// the user cannot read such a record.
+func restExecuteOnRecord(c *server.Context, fnct func(*models.RecordCollection) (int, interface{})) {
+	restExecute(c, func(rs *models.RecordCollection) (int, interface{}) {
+		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err == nil {
+			rs = rs.Call("BrowseOne", id).(models.RecordSet).Collection().Fetch()
+		}
+		if err != nil || rs.IsEmpty() {
+			return http.StatusNotFound, restErrorBody("not_found", "Record not found")
+		}
+		return fnct(rs)
+	})
+}
+
+// restSearch returns the records matching the query parameters of the request
+func restSearch(c *server.Context) {
+	restExecute(c, func(rs *models.RecordCollection) (int, interface{}) {
+		cond := parseRESTFilter(rs.Model(), c.Query("filter"))
+		if cond.IsEmpty() {
+			rs = rs.Call("SearchAll").(models.RecordSet).Collection()
+		} else {
+			rs = rs.Call("Search", cond).(models.RecordSet).Collection()
+		}
+		count := rs.Call("SearchCount").(int)
+		limit, offset := restDefaultLimit, 0
+		if c.Query("limit") != "" {
+			limit = parseRESTInt("limit", c.Query("limit"))
+		}
+		if c.Query("offset") != "" {
+			offset = parseRESTInt("offset", c.Query("offset"))
+		}
+		rs = rs.Limit(limit).Offset(offset)
+		if order := c.Query("order"); order != "" {
+			rs = rs.OrderBy(strings.Split(order, ",")...)
+		}
+		return http.StatusOK, map[string]interface{}{
+			"count":   count,
+			"records": restReadRecords(c, rs),
+		}
+	})
+}
+
+// restCreate creates a record from the JSON object of the request body
+func restCreate(c *server.Context) {
+	restExecute(c, func(rs *models.RecordCollection) (int, interface{}) {
+		data := restRequestData(c, rs)
+		rs = rs.Call("Create", data).(models.RecordSet).Collection()
+		return http.StatusCreated, restReadRecords(c, rs)[0]
+	})
+}
+
+// restRead returns the record of the request
+func restRead(c *server.Context) {
+	restExecuteOnRecord(c, func(rs *models.RecordCollection) (int, interface{}) {
+		return http.StatusOK, restReadRecords(c, rs)[0]
+	})
+}
+
+// restWrite updates the record of the request with the JSON object of the request body
+func restWrite(c *server.Context) {
+	restExecuteOnRecord(c, func(rs *models.RecordCollection) (int, interface{}) {
+		data := restRequestData(c, rs)
+		rs.Call("Write", data)
+		return http.StatusOK, restReadRecords(c, rs)[0]
+	})
+}
+
+// restUnlink deletes the record of the request
+func restUnlink(c *server.Context) {
+	restExecuteOnRecord(c, func(rs *models.RecordCollection) (int, interface{}) {
+		rs.Call("Unlink")
+		return http.StatusNoContent, nil
+	})
+}
+
+// restCallMethod calls the method of the request on its record with
+// the arguments given as a JSON array in the request body.
+func restCallMethod(c *server.Context) {
+	restExecuteOnRecord(c, func(rs *models.RecordCollection) (int, interface{}) {
+		methName := c.Param("method")
+		if _, ok := rs.Model().Methods().Get(methName); !ok {
+			return http.StatusNotFound, restErrorBody("not_found", "Unknown method "+methName)
+		}
+		args := restMethodArgs(rs, methName, restRequestBody(c))
+		res := rs.Call(methName, args...)
+		return http.StatusOK, map[string]interface{}{
+			"result": restValue(res, c.Query("relations") == "nested"),
+		}
+	})
+}
+
+// restRequestBody returns the raw body of the request
+func restRequestBody(c *server.Context) []byte {
+	body, err := c.GetRawData()
+	if err != nil {
+		log.Panic("Unable to read request body", "error", err)
+	}
+	return bytes.TrimSpace(body)
+}
+
+// restRequestData returns the record data given as a JSON object in the request body
+func restRequestData(c *server.Context, rs *models.RecordCollection) *models.ModelData {
+	var fMap models.FieldMap
+	if err := json.Unmarshal(restRequestBody(c), &fMap); err != nil {
+		log.Panic("Request body must be a JSON object", "error", err)
+	}
+	return models.NewModelDataFromRS(rs, fMap)
+}
+
+// parseRESTInt parses the given query parameter value as an integer
+func parseRESTInt(param, value string) int {
+	res, err := strconv.Atoi(value)
+	if err != nil || res < 0 {
+		log.Panic("Invalid query parameter", "parameter", param, "value", value)
+	}
+	return res
+}
+
+// parseRESTFilter returns the Condition on the given model of the given filter.
+//
+// The filter is a JSON array of [field, operator, value] terms in polish
+// notation with the "&", "|" and "!" operators. Top level terms are joined
+// with "&", for instance:
+//
+//	["|", ["Name", "=", "John"], ["Email", "ilike", "example.com"], ["Age", ">", 18]]
+func parseRESTFilter(model *models.Model, filter string) *models.Condition {
+	cond := &models.Condition{}
+	if filter == "" {
+		return cond
+	}
+	var terms []interface{}
+	if err := json.Unmarshal([]byte(filter), &terms); err != nil {
+		log.Panic("Filter must be a JSON array", "filter", filter, "error", err)
+	}
+	for len(terms) > 0 {
+		var termCond *models.Condition
+		termCond, terms = parseRESTFilterTerm(model, terms)
+		cond = cond.AndCond(termCond)
+	}
+	return cond
+}
+
+// parseRESTFilterTerm returns the Condition of the first term of the given
+// filter terms in polish notation and the remaining terms.
+func parseRESTFilterTerm(model *models.Model, terms []interface{}) (*models.Condition, []interface{}) {
+	if len(terms) == 0 {
+		log.Panic("Missing operand in filter")
+	}
+	switch term := terms[0].(type) {
+	case string:
+		switch term {
+		case "!":
+			cond, rest := parseRESTFilterTerm(model, terms[1:])
+			return models.Condition{}.AndNotCond(cond), rest
+		case "&", "|":
+			left, rest := parseRESTFilterTerm(model, terms[1:])
+			right, rest := parseRESTFilterTerm(model, rest)
+			if term == "|" {
+				return left.OrCond(right), rest
+			}
+			return left.AndCond(right), rest
+		}
+	case []interface{}:
+		if len(term) != 3 {
+			break
+		}
+		field, okField := term[0].(string)
+		op, okOp := term[1].(string)
+		if !okField || !okOp || !operator.Operator(op).IsValid() {
+			break
+		}
+		return model.Field(model.FieldName(field)).AddOperator(operator.Operator(op), term[2]), terms[1:]
+	}
+	log.Panic("Invalid filter term", "term", terms[0])
+	return nil, nil
+}
+
+// restMethodArgs returns the arguments to call the given method with
+// from the given JSON array. Missing arguments are given their zero value.
+func restMethodArgs(rs *models.RecordCollection, methName string, body []byte) []interface{} {
+	var rawArgs []json.RawMessage
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &rawArgs); err != nil {
+			log.Panic("Method arguments must be a JSON array", "method", methName, "error", err)
+		}
+	}
+	methType := rs.MethodType(methName)
+	if len(rawArgs) > methType.NumIn()-1 {
+		log.Panic("Too many arguments", "method", methName, "expected", methType.NumIn()-1, "received", len(rawArgs))
+	}
+	args := make([]interface{}, methType.NumIn()-1)
+	for i, rawArg := range rawArgs {
+		args[i] = restMethodArg(rs, methType.In(i+1), rawArg)
+	}
+	return args
+}
+
+// restMethodArg returns the value of the given raw JSON argument for a method
+// parameter of type argType.
+//
+// Record data are given as JSON objects, record sets as arrays of ids and
+// conditions as filters. The model of typed record sets, data and conditions
+// is taken from their type name, otherwise the model of rs is used.
+func restMethodArg(rs *models.RecordCollection, argType reflect.Type, rawArg json.RawMessage) interface{} {
+	modelName := rs.ModelName()
+	for _, suffix := range []string{"Set", "Data", "Condition"} {
+		if name := argType.Name(); strings.HasSuffix(name, suffix) && name != suffix {
+			if _, ok := models.Registry.Get(strings.TrimSuffix(name, suffix)); ok {
+				modelName = strings.TrimSuffix(name, suffix)
+			}
+		}
+	}
+	switch {
+	case argType.Implements(reflect.TypeOf((*models.RecordSet)(nil)).Elem()):
+		var ids []int64
+		if err := json.Unmarshal(rawArg, &ids); err != nil {
+			log.Panic("Record set arguments must be arrays of ids", "argument", string(rawArg), "error", err)
+		}
+		return rs.Env().Pool(modelName).Call("Browse", ids)
+	case argType.Implements(reflect.TypeOf((*models.RecordData)(nil)).Elem()):
+		var fMap models.FieldMap
+		if err := json.Unmarshal(rawArg, &fMap); err != nil {
+			log.Panic("Record data arguments must be JSON objects", "argument", string(rawArg), "error", err)
+		}
+		return models.NewModelDataFromRS(rs.Env().Pool(modelName), fMap)
+	case argType.Implements(reflect.TypeOf((*models.Conditioner)(nil)).Elem()):
+		return parseRESTFilter(models.Registry.MustGet(modelName), string(rawArg))
+	}
+	val := reflect.New(argType)
+	if err := json.Unmarshal(rawArg, val.Interface()); err != nil {
+		log.Panic("Invalid argument", "argument", string(rawArg), "type", argType, "error", err)
+	}
+	return val.Elem().Interface()
+}
+
+// restReadRecords returns the fields of the request of the records of rs
+func restReadRecords(c *server.Context, rs *models.RecordCollection) []map[string]interface{} {
+	fInfos := rs.Model().AccessibleFieldsGet(rs.Env().Uid())
+	var fields models.FieldNames
+	if c.Query("fields") != "" {
+		for _, f := range strings.Split(c.Query("fields"), ",") {
+			fields = append(fields, rs.Model().FieldName(strings.TrimSpace(f)))
+		}
+	} else {
+		for jsonName := range fInfos {
+			fields = append(fields, rs.Model().FieldName(jsonName))
+		}
+	}
+	var nested bool
+	switch c.Query("relations") {
+	case "", "ids":
+	case "nested":
+		nested = true
+	default:
+		log.Panic("Invalid query parameter", "parameter", "relations", "value", c.Query("relations"))
+	}
+	res := make([]map[string]interface{}, 0, rs.Len())
+	for _, data := range rs.Call("Read", fields).([]models.RecordData) {
+		res = append(res, restRecordData(data.Underlying(), fInfos, nested))
+	}
+	return res
+}
+
+// restRecordData returns the JSON serializable values of the given data.
+// fInfos are the fields definitions of the data's model.
+func restRecordData(data *models.ModelData, fInfos map[string]*models.FieldInfo, nested bool) map[string]interface{} {
+	res := make(map[string]interface{})
+	for field, value := range data.FieldMap {
+		rs, ok := value.(models.RecordSet)
+		if !ok {
+			res[field] = value
+			continue
+		}
+		if fInfo, exists := fInfos[field]; exists && !fInfo.Type.Is2ManyRelationType() {
+			res[field] = restRelation(rs.Collection(), nested)
+			continue
+		}
+		res[field] = restRelations(rs.Collection(), nested)
+	}
+	return res
+}
+
+// restRelation returns the serialized value of the given single record:
+// its id, or its id and display name if nested is true.
+// It returns nil if rs is empty.
+func restRelation(rs *models.RecordCollection, nested bool) interface{} {
+	if rs.IsEmpty() {
+		return nil
+	}
+	if !nested {
+		return rs.Ids()[0]
+	}
+	return map[string]interface{}{
+		"id":           rs.Ids()[0],
+		"display_name": rs.Call("NameGet"),
+	}
+}
+
+// restRelations returns the serialized values of the records of rs
+func restRelations(rs *models.RecordCollection, nested bool) []interface{} {
+	res := make([]interface{}, 0, rs.Len())
+	for _, rec := range rs.Records() {
+		res = append(res, restRelation(rec, nested))
+	}
+	return res
+}
+
+// restValue returns the JSON serializable value of the given method result
+func restValue(value interface{}, nested bool) interface{} {
+	switch val := value.(type) {
+	case models.RecordSet:
+		return restRelations(val.Collection(), nested)
+	case models.RecordData:
+		data := val.Underlying()
+		return restRecordData(data, data.Model.FieldsGet(), nested)
+	case []models.RecordData:
+		res := make([]interface{}, len(val))
+		for i, v := range val {
+			res[i] = restValue(v, nested)
+		}
+		return res
+	}
+	return value
+}
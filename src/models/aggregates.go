@@ -0,0 +1,246 @@
+// Copyright 2019 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/hexya-erp/hexya/src/models/fieldtype"
+	"github.com/hexya-erp/hexya/src/models/types/dates"
+)
+
+// timezoneKey is the context key holding the timezone of the current user,
+// used to group DateTime fields by period.
+const timezoneKey = "tz"
+
+// A DateGranularity is the period by which Date and DateTime fields are
+// grouped in grouped queries.
+type DateGranularity string
+
+// Available date granularities
+const (
+	GranularityDay     DateGranularity = "day"
+	GranularityWeek    DateGranularity = "week"
+	GranularityMonth   DateGranularity = "month"
+	GranularityQuarter DateGranularity = "quarter"
+	GranularityYear    DateGranularity = "year"
+)
+
+// isValid returns true if g is one of the available date granularities
+func (g DateGranularity) isValid() bool {
+	switch g {
+	case GranularityDay, GranularityWeek, GranularityMonth, GranularityQuarter, GranularityYear:
+		return true
+	}
+	return false
+}
+
+// next returns the start of the period following the period starting at t
+func (g DateGranularity) next(t time.Time) time.Time {
+	switch g {
+	case GranularityWeek:
+		return t.AddDate(0, 0, 7)
+	case GranularityMonth:
+		return t.AddDate(0, 1, 0)
+	case GranularityQuarter:
+		return t.AddDate(0, 3, 0)
+	case GranularityYear:
+		return t.AddDate(1, 0, 0)
+	}
+	return t.AddDate(0, 0, 1)
+}
+
+// An AggregateFunction is an SQL aggregate function that can be applied on
+// the fields of the records of a group.
+type AggregateFunction string
+
+// Available aggregate functions
+const (
+	AggregateSum           AggregateFunction = "sum"
+	AggregateCount         AggregateFunction = "count"
+	AggregateCountDistinct AggregateFunction = "count_distinct"
+	AggregateMin           AggregateFunction = "min"
+	AggregateMax           AggregateFunction = "max"
+	AggregateAvg           AggregateFunction = "avg"
+	AggregateArray         AggregateFunction = "array_agg"
+	AggregateBoolAnd       AggregateFunction = "bool_and"
+	AggregateBoolOr        AggregateFunction = "bool_or"
+)
+
+// An Aggregate is an aggregate function applied on a field in a grouped query.
+type Aggregate struct {
+	Field    FieldName
+	Function AggregateFunction
+}
+
+// String returns the string representation of this Aggregate, which is also
+// its key in the Aggregates map of GroupAggregateRow.
+func (a Aggregate) String() string {
+	return fmt.Sprintf("%s:%s", a.Field.Name(), a.Function)
+}
+
+// GroupByDate returns a new RecordSet grouped by the given Date or DateTime
+// field truncated to the given granularity.
+//
+// DateTime fields are truncated in the timezone given by the 'tz' context key,
+// or in UTC if there is none.
+func (rc *RecordCollection) GroupByDate(field FieldName, granularity DateGranularity) *RecordCollection {
+	fi := rc.model.getRelatedFieldInfo(field)
+	if fi.fieldType != fieldtype.Date && fi.fieldType != fieldtype.DateTime {
+		log.Panic("Only Date and DateTime fields can be grouped by date", "model", rc.model.name, "field", field)
+	}
+	if !granularity.isValid() {
+		log.Panic("Unknown date granularity", "granularity", granularity)
+	}
+	rSet := rc.GroupBy(field)
+	periods := make(map[string]DateGranularity)
+	for k, v := range rc.query.periods {
+		periods[k] = v
+	}
+	periods[field.JSON()] = granularity
+	rSet.query.periods = periods
+	return rSet
+}
+
+// WithAggregates returns a new RecordSet which grouped query also computes the
+// given aggregates. Their results are available in the Aggregates map of the
+// GroupAggregateRow returned by Aggregates.
+func (rc *RecordCollection) WithAggregates(aggregates ...Aggregate) *RecordCollection {
+	rSet := *rc
+	rSet.query = rSet.query.clone(&rSet)
+	aggs := make([]Aggregate, len(rc.query.aggs), len(rc.query.aggs)+len(aggregates))
+	copy(aggs, rc.query.aggs)
+	rSet.query.aggs = append(aggs, aggregates...)
+	return &rSet
+}
+
+// Having returns a new RecordSet which grouped query only returns the groups
+// matching the given condition.
+//
+// All the predicates of the condition must apply on aggregates of the fields,
+// selected with the Aggregate method of ConditionField.
+func (rc *RecordCollection) Having(cond Conditioner) *RecordCollection {
+	checkHavingCondition(cond.Underlying())
+	rSet := *rc
+	rSet.query = rSet.query.clone(&rSet)
+	if rSet.query.having == nil {
+		rSet.query.having = newCondition()
+	}
+	rSet.query.having = rSet.query.having.AndCond(cond.Underlying())
+	return &rSet
+}
+
+// checkHavingCondition panics if one of the predicates of the given
+// condition does not apply on an aggregate.
+func checkHavingCondition(cond *Condition) {
+	for _, p := range cond.predicates {
+		if p.isCond {
+			checkHavingCondition(p.cond)
+			continue
+		}
+		if p.aggFunc == "" {
+			log.Panic("Having conditions must apply on aggregates", "field", p.Field().Name())
+		}
+	}
+}
+
+// Aggregate returns a ConditionField on the result of the given aggregate
+// function applied on this field for the records of a group.
+// It can only be used in conditions given to RecordCollection.Having.
+//
+//	cond := userModel.Field(nums).Aggregate(AggregateMax).Greater(3)
+func (c ConditionField) Aggregate(function AggregateFunction) *ConditionField {
+	if c.subquery != nil || len(c.jsonPath) > 0 || c.aggFunc != "" {
+		log.Panic("Aggregate functions can only be applied on fields", "field", c.Name())
+	}
+	c.aggFunc = function
+	return &c
+}
+
+// groupTimezone returns the name and the location of the timezone
+// in which DateTime fields are grouped by this query.
+func (q *Query) groupTimezone() (string, *time.Location) {
+	tz := q.recordSet.env.context.GetString(timezoneKey)
+	if tz == "" || tz == "Local" {
+		return "UTC", time.UTC
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		log.Warn("Unknown timezone in context, grouping in UTC", "tz", tz)
+		return "UTC", time.UTC
+	}
+	return tz, loc
+}
+
+// groupExpressionSQL returns the sql expression of the given group by expression
+// of this query, given the alias of its column in the base query.
+func (q *Query) groupExpressionSQL(exprs []FieldName, alias string) string {
+	granularity, ok := q.periods[joinFieldNames(exprs, ExprSep).JSON()]
+	if !ok {
+		return alias
+	}
+	var tz string
+	if q.recordSet.model.getRelatedFieldInfo(joinFieldNames(exprs, ExprSep)).fieldType == fieldtype.DateTime {
+		tz, _ = q.groupTimezone()
+	}
+	return adapters[db.DriverName()].dateTruncSQL(alias, granularity, tz)
+}
+
+// periodBounds returns the start and end values of the period of the given granularity
+// which start is the given value returned by the database for a field of type fi.
+//
+// Periods of DateTime fields start at midnight in the given location.
+func periodBounds(value interface{}, granularity DateGranularity, fi *Field, loc *time.Location) (interface{}, interface{}) {
+	var start time.Time
+	switch v := value.(type) {
+	case time.Time:
+		start = v
+	case []byte:
+		start = dates.ParseDate(string(v)[:10]).Time
+	case string:
+		start = dates.ParseDate(v[:10]).Time
+	default:
+		return value, nil
+	}
+	if fi.fieldType != fieldtype.DateTime {
+		start = time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, time.UTC)
+		return dates.Date{Time: start}, dates.Date{Time: granularity.next(start)}
+	}
+	start = time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, loc)
+	return dates.DateTime{Time: start.UTC()}, dates.DateTime{Time: granularity.next(start).UTC()}
+}
+
+// aggregateValue returns the Go value of the given result of the given
+// aggregate function returned by the database.
+func aggregateValue(function AggregateFunction, value interface{}) interface{} {
+	if b, ok := value.([]byte); ok {
+		value = string(b)
+	}
+	switch function {
+	case AggregateArray:
+		var res []interface{}
+		if s, ok := value.(string); ok {
+			if err := json.Unmarshal([]byte(s), &res); err != nil {
+				log.Panic("Unable to decode array aggregate", "error", err, "value", s)
+			}
+		}
+		return res
+	case AggregateBoolAnd, AggregateBoolOr:
+		// SQLite returns booleans as integers
+		if i, ok := value.(int64); ok {
+			return i != 0
+		}
+	case AggregateSum, AggregateAvg:
+		// DB can return numeric types as text
+		if s, ok := value.(string); ok {
+			if f, err := strconv.ParseFloat(s, 64); err == nil {
+				return f
+			}
+		}
+	}
+	return value
+}
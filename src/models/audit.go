@@ -0,0 +1,252 @@
+// Copyright 2019 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package models
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"reflect"
+
+	"github.com/hexya-erp/hexya/src/models/security"
+	"github.com/hexya-erp/hexya/src/models/types/dates"
+)
+
+const (
+	// auditModelName is the name of the model storing the audit trail
+	auditModelName = "HexyaAuditLog"
+	// AuditCreate is the operation of audit entries recording a record creation
+	AuditCreate = "create"
+	// AuditWrite is the operation of audit entries recording a record update
+	AuditWrite = "write"
+	// AuditUnlink is the operation of audit entries recording a record deletion
+	AuditUnlink = "unlink"
+)
+
+// auditIgnoredFields are the fields that are never audited
+var auditIgnoredFields = map[string]bool{
+	"id":          true,
+	"create_date": true,
+	"create_uid":  true,
+	"write_date":  true,
+	"write_uid":   true,
+}
+
+// An AuditEntry is the record of the change of a field value of a record.
+//
+// OldValue is empty for AuditCreate entries and NewValue is empty for
+// AuditUnlink entries.
+type AuditEntry struct {
+	ID        int64
+	ResModel  string
+	ResID     int64
+	Operation string
+	Method    string
+	Field     string
+	OldValue  string
+	NewValue  string
+	UID       int64
+	Date      dates.DateTime
+}
+
+// declareAuditModel creates the system model that stores the audit trail
+func declareAuditModel() {
+	model := createModel(auditModelName, SystemModel)
+	model.AddFields(map[string]FieldDefinition{
+		"ResModel":  CharField{Required: true, Index: true},
+		"ResID":     IntegerField{Required: true, Index: true},
+		"Operation": CharField{Required: true},
+		"Method":    CharField{},
+		"Field":     CharField{Required: true},
+		"OldValue":  TextField{},
+		"NewValue":  TextField{},
+		"UID":       IntegerField{},
+		"Date":      DateTimeField{Required: true},
+	})
+	model.InheritModel(Registry.MustGet("CommonMixin"))
+	model.restrictToAdmins()
+}
+
+// EnableAudit records each change of the given fields of this model in the
+// audit trail, with the old and new values, the user, the date and the method
+// that triggered the change. If no fields are given, all stored fields are audited.
+//
+// Audit entries are written in the transaction of the change, so that
+// rolled back changes are not recorded.
+func (m *Model) EnableAudit(fields ...FieldName) {
+	m.auditFields = make(map[string]bool)
+	for _, f := range fields {
+		m.auditFields[f.JSON()] = true
+	}
+	m.audited = true
+}
+
+// DisableAudit stops recording changes of this model in the audit trail.
+// Existing audit entries are kept.
+func (m *Model) DisableAudit() {
+	m.audited = false
+	m.auditFields = nil
+}
+
+// isAudited returns true if changes of the given stored field of this model
+// must be recorded in the audit trail.
+func (m *Model) isAudited(field *Field) bool {
+	if !m.audited || auditIgnoredFields[field.json] || !field.isStored() {
+		return false
+	}
+	if len(m.auditFields) == 0 {
+		return true
+	}
+	return m.auditFields[field.json]
+}
+
+// auditedFields returns the names of the audited fields among the given field names.
+// If fields is empty, the audited fields among all the stored fields are returned.
+func (m *Model) auditedFields(fields ...string) FieldNames {
+	if len(fields) == 0 {
+		for _, fName := range m.fields.storedFieldNames() {
+			fields = append(fields, fName.JSON())
+		}
+	}
+	var res FieldNames
+	for _, f := range fields {
+		fi, ok := m.fields.Get(f)
+		if !ok || !m.isAudited(fi) {
+			continue
+		}
+		res = append(res, m.FieldName(fi.name))
+	}
+	return res
+}
+
+// auditMethodName returns the name of the method that triggered the
+// current change, such as "Partner.Write".
+func (rc *RecordCollection) auditMethodName() string {
+	meth := rc.env.previousMethod
+	if meth == nil && rc.env.currentLayer != nil {
+		meth = rc.env.currentLayer.method
+	}
+	if meth == nil {
+		return ""
+	}
+	return fmt.Sprintf("%s.%s", meth.model.name, meth.name)
+}
+
+// auditOldValues loads the given fields of the records of this RecordCollection
+// and returns their values by record id and field JSON name.
+func (rc *RecordCollection) auditOldValues(fields FieldNames) map[int64]map[string]string {
+	res := make(map[int64]map[string]string)
+	if len(fields) == 0 || rc.hasNegIds {
+		return res
+	}
+	rc.Sudo().Load(fields...)
+	for _, id := range rc.ids {
+		res[id] = make(map[string]string)
+		for _, f := range fields {
+			res[id][f.JSON()] = auditValue(rc.env.cache.get(rc.model, id, f.JSON(), rc.query.ctxArgsSlug()))
+		}
+	}
+	return res
+}
+
+// recordAudit inserts an audit entry for the given record in the current transaction
+func (rc *RecordCollection) recordAudit(id int64, operation, field, oldValue, newValue string) {
+	adapter := adapters[db.DriverName()]
+	query := fmt.Sprintf(`INSERT INTO %s (res_model, res_id, operation, method, field, old_value, new_value, uid, date)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`, adapter.quoteTableName(Registry.MustGet(auditModelName).tableName))
+	rc.env.cr.Execute(query, rc.model.name, id, operation, rc.auditMethodName(), field, oldValue, newValue, rc.env.uid, dates.Now())
+}
+
+// auditCreate records the values of the audited fields of the given
+// FieldMap for the newly created record with the given id.
+func (rc *RecordCollection) auditCreate(id int64, fMap FieldMap) {
+	if !rc.model.audited {
+		return
+	}
+	for _, f := range rc.model.auditedFields(fMap.OrderedKeys()...) {
+		rc.recordAudit(id, AuditCreate, f.Name(), "", auditValue(fMap[f.JSON()]))
+	}
+}
+
+// auditWrite records the changes between the given old values and
+// the values of the given FieldMap for each record of this RecordCollection.
+func (rc *RecordCollection) auditWrite(oldValues map[int64]map[string]string, fMap FieldMap) {
+	if !rc.model.audited {
+		return
+	}
+	for _, f := range rc.model.auditedFields(fMap.OrderedKeys()...) {
+		newValue := auditValue(fMap[f.JSON()])
+		for _, id := range rc.ids {
+			oldValue := oldValues[id][f.JSON()]
+			if oldValue == newValue {
+				continue
+			}
+			rc.recordAudit(id, AuditWrite, f.Name(), oldValue, newValue)
+		}
+	}
+}
+
+// auditUnlink records the values of the audited fields of the records
+// of this RecordCollection before they are deleted.
+func (rc *RecordCollection) auditUnlink(oldValues map[int64]map[string]string) {
+	if !rc.model.audited {
+		return
+	}
+	for _, f := range rc.model.auditedFields() {
+		for _, id := range rc.ids {
+			rc.recordAudit(id, AuditUnlink, f.Name(), oldValues[id][f.JSON()], "")
+		}
+	}
+}
+
+// auditValue returns the given field value formatted for the audit trail
+func auditValue(value interface{}) string {
+	if value == nil {
+		return ""
+	}
+	if val := reflect.ValueOf(value); val.Kind() == reflect.Ptr && val.IsNil() {
+		return ""
+	}
+	switch v := value.(type) {
+	case *interface{}:
+		return auditValue(*v)
+	case []byte:
+		return string(v)
+	case fmt.Stringer:
+		return v.String()
+	case driver.Valuer:
+		dv, err := v.Value()
+		if err != nil {
+			return fmt.Sprintf("%v", v)
+		}
+		return auditValue(dv)
+	}
+	return fmt.Sprintf("%v", value)
+}
+
+// AuditHistory returns the audit entries of the records of this RecordCollection
+// in chronological order.
+//
+// Entries of fields that the current user is not allowed to access are omitted.
+// The audit trail itself is only accessible to admins, so it is read here
+// directly from the database once these field checks are done.
+func (rc *RecordCollection) AuditHistory() []AuditEntry {
+	rc.checkModelAccess(security.Read)
+	rc.Fetch()
+	if len(rc.ids) == 0 {
+		return nil
+	}
+	var entries []AuditEntry
+	adapter := adapters[db.DriverName()]
+	query := fmt.Sprintf(`SELECT id, res_model, res_id, operation, method, field, old_value, new_value, uid, date
+		FROM %s WHERE res_model = ? AND res_id IN (?) ORDER BY id`, adapter.quoteTableName(Registry.MustGet(auditModelName).tableName))
+	rc.env.cr.Select(&entries, query, rc.model.name, rc.ids)
+	res := make([]AuditEntry, 0, len(entries))
+	for _, entry := range entries {
+		if fi, ok := rc.model.fields.Get(entry.Field); ok && !fi.isAccessibleBy(rc.env.uid) {
+			continue
+		}
+		res = append(res, entry)
+	}
+	return res
+}
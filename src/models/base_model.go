@@ -46,6 +46,12 @@ const (
 	ManualModel
 	// SystemModel is a model that is used internally by the Hexya Framework
 	SystemModel
+	// ArchivableModel is a model whose records can be archived instead of
+	// being deleted. Archived records are not returned by searches.
+	ArchivableModel
+	// MultiCompanyModel is a model whose records belong to a company.
+	// It is set by Model.EnableMultiCompany.
+	MultiCompanyModel
 )
 
 //  declareCommonMixin creates the common mixin that is needed for all models
@@ -87,6 +93,28 @@ func declareModelMixin() {
 	modelMixin.InheritModel(Registry.MustGet("BaseMixin"))
 }
 
+// declareArchiveMixin creates the mixin that is inherited by archivable models
+func declareArchiveMixin() {
+	archiveMixin := NewMixinModel("ArchiveMixin")
+	archiveMixin.AddFields(map[string]FieldDefinition{
+		"Active": BooleanField{Index: true, Default: DefaultValue(true),
+			Help: "Archived records are hidden from searches unless the 'active_test' context key is set to false."},
+	})
+
+	archiveMixin.AddMethod("Archive",
+		`Archive sets the records of this RecordSet as inactive, so that they are
+		not returned by searches anymore.`,
+		func(rc *RecordCollection) bool {
+			return rc.Call("Write", NewModelData(rc.model).Set(rc.model.FieldName("Active"), false)).(bool)
+		})
+
+	archiveMixin.AddMethod("Unarchive",
+		`Unarchive sets the records of this RecordSet as active again.`,
+		func(rc *RecordCollection) bool {
+			return rc.Call("Write", NewModelData(rc.model).Set(rc.model.FieldName("Active"), true)).(bool)
+		})
+}
+
 // declareComputeMethods declares methods used to compute fields
 func declareBaseComputeMethods() {
 	model := Registry.MustGet("BaseMixin")
@@ -139,7 +167,7 @@ func declareCRUDMethods() {
 		func(rc *RecordCollection, fields FieldNames) []RecordData {
 			var res []RecordData
 			// Check if we have id in fields, and add it otherwise
-			fields = addIDIfNotPresent(fields)
+			fields = addIDIfNotPresent(rc.filterAccessibleFields(fields))
 			// Do the actual reading
 			for _, rec := range rc.Records() {
 				fData := NewModelData(rc.model)
@@ -277,6 +305,11 @@ func declareRecordSetMethods() {
 		func(rc *RecordCollection, args FieldsGetArgs) map[string]*FieldInfo {
 			// Get the field informations
 			res := rc.model.FieldsGet(args.Fields...)
+			for fName := range res {
+				if !rc.model.fields.MustGet(fName).isAccessibleBy(rc.env.uid) {
+					delete(res, fName)
+				}
+			}
 
 			// Translate attributes when required
 			lang := rc.Env().Context().GetString("lang")
@@ -362,7 +395,7 @@ func declareRecordSetSpecificMethods() {
 				if id, _ := nbutils.CastToInteger(data.Get(ID)); id != 0 {
 					rs = rc.WithEnv(env).withIds([]int64{id})
 					rs = rs.WithContext("hexya_onchange_origin", rs.First().Wrap())
-					rs.WithContext("hexya_force_compute_write", true).update(data)
+					rs.withoutACL().WithContext("hexya_force_compute_write", true).update(data)
 				} else {
 					rs = rc.WithEnv(env).new(data)
 				}
@@ -406,7 +439,7 @@ func declareRecordSetSpecificMethods() {
 								todo = append(todo, f)
 							}
 						}
-						rrs.WithContext("hexya_force_compute_write", true).Call("Write", vals)
+						rrs.withoutACL().WithContext("hexya_force_compute_write", true).Call("Write", vals)
 					}
 					// Warning
 					if fi.onChangeWarning != "" {
@@ -461,26 +494,31 @@ func declareSearchMethods() {
 		`Search returns a new RecordSet filtering on the current one with the
 		additional given Condition`,
 		func(rc *RecordCollection, cond Conditioner) *RecordCollection {
-			return rc.Search(cond.Underlying())
+			return rc.Search(rc.defaultSearchCondition(cond.Underlying()))
 		})
 
 	commonMixin.AddMethod("Browse",
 		`Browse returns a new RecordSet with only the records with the given ids.
-		Note that this function is just a shorcut for Search on a list of ids.`,
+		Note that this function is just a shorcut for Search on a list of ids.
+		Archived records are returned too.`,
 		func(rc *RecordCollection, ids []int64) *RecordCollection {
-			return rc.Call("Search", rc.Model().Field(ID).In(ids)).(RecordSet).Collection()
+			return rc.searchWithArchived(rc.Model().Field(ID).In(ids))
 		})
 
 	commonMixin.AddMethod("BrowseOne",
 		`BrowseOne returns a new RecordSet with only the record with the given id.
-		Note that this function is just a shorcut for Search on a given id.`,
+		Note that this function is just a shorcut for Search on a given id.
+		The record is returned even if it is archived.`,
 		func(rc *RecordCollection, id int64) *RecordCollection {
-			return rc.Call("Search", rc.Model().Field(ID).Equals(id)).(RecordSet).Collection()
+			return rc.searchWithArchived(rc.Model().Field(ID).Equals(id))
 		})
 
 	commonMixin.AddMethod("SearchCount",
 		`SearchCount fetch from the database the number of records that match the RecordSet conditions`,
 		func(rc *RecordCollection) int {
+			if cond := rc.defaultSearchCondition(newCondition()); !cond.IsEmpty() {
+				return rc.search(cond).SearchCount()
+			}
 			return rc.SearchCount()
 		})
 
@@ -497,7 +535,7 @@ func declareSearchMethods() {
 		`SearchAll returns a RecordSet with all items of the table, regardless of the
 		current RecordSet query. It is mainly meant to be used on an empty RecordSet`,
 		func(rc *RecordCollection) *RecordCollection {
-			return rc.SearchAll()
+			return rc.SearchAll().search(rc.defaultSearchCondition(newCondition()))
 		})
 
 	commonMixin.AddMethod("GroupBy",
@@ -506,6 +544,30 @@ func declareSearchMethods() {
 			return rc.GroupBy(exprs...)
 		})
 
+	commonMixin.AddMethod("GroupByDate",
+		`GroupByDate returns a new RecordSet grouped by the given Date or DateTime
+		field truncated to the given granularity.
+
+		DateTime fields are truncated in the timezone given by the 'tz' context key,
+		or in UTC if there is none.`,
+		func(rc *RecordCollection, field FieldName, granularity DateGranularity) *RecordCollection {
+			return rc.GroupByDate(field, granularity)
+		})
+
+	commonMixin.AddMethod("WithAggregates",
+		`WithAggregates returns a new RecordSet which grouped query also computes
+		the given aggregates.`,
+		func(rc *RecordCollection, aggregates ...Aggregate) *RecordCollection {
+			return rc.WithAggregates(aggregates...)
+		})
+
+	commonMixin.AddMethod("Having",
+		`Having returns a new RecordSet which grouped query only returns the groups
+		matching the given condition on aggregates.`,
+		func(rc *RecordCollection, cond Conditioner) *RecordCollection {
+			return rc.Having(cond)
+		})
+
 	commonMixin.AddMethod("Aggregates",
 		`Aggregates returns the result of this RecordSet query, which must by a grouped query.`,
 		func(rc *RecordCollection, exprs ...FieldName) []GroupAggregateRow {
@@ -65,6 +65,9 @@ func BootStrap() {
 	checkComputeMethodsSignature()
 	setupSecurity()
 	RegisterWorker(NewWorkerFunction(FreeTransientModels, freeTransientPeriod))
+	RegisterWorker(NewWorkerFunction(ProcessJobs, jobsPeriod))
+	RegisterWorker(NewWorkerFunction(RunScheduledActions, scheduledActionsPeriod))
+	startSharedCacheListener()
 
 	Registry.bootstrapped = true
 }
@@ -0,0 +1,225 @@
+// Copyright 2019 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package models
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hexya-erp/hexya/src/models/fieldtype"
+	"github.com/hexya-erp/hexya/src/models/security"
+	"github.com/hexya-erp/hexya/src/models/types"
+	"github.com/hexya-erp/hexya/src/tools/exceptions"
+)
+
+const (
+	// CompanyModelName is the name of the model that holds companies.
+	// It must be declared by a module for multi-company models to be used.
+	CompanyModelName = "Company"
+	// companyFieldName is the name of the field added to multi-company models
+	companyFieldName = "Company"
+	// allowedCompaniesKey is the context key holding the ids of the companies
+	// the current user is working with. The first one is the current company.
+	allowedCompaniesKey = "allowed_company_ids"
+	// companyContextName is the name of the context of company dependent fields
+	companyContextName = "company"
+)
+
+// EnableMultiCompany adds a Company field to this model that links each record
+// to the company it belongs to. Records without company are shared between all
+// companies.
+//
+// The Search methods of this model only return the records of the companies
+// of the 'allowed_company_ids' context key that the user is allowed to work with
+// (see SetUserCompaniesFunc), and new records are assigned the first of these
+// companies by default. Relational fields of the records of this model cannot
+// point to records of other multi-company models that belong to another company.
+//
+// EnableMultiCompany must be called before bootstrap.
+func (m *Model) EnableMultiCompany() {
+	if Registry.bootstrapped {
+		log.Panic("Multi company must be enabled before bootstrap", "model", m.name)
+	}
+	if _, exists := m.fields.Get(companyFieldName); !exists {
+		m.AddFields(map[string]FieldDefinition{
+			companyFieldName: Many2OneField{RelationModel: Registry.MustGet(CompanyModelName), Index: true,
+				Default: func(env Environment) interface{} {
+					return env.Pool(CompanyModelName).withIds(currentCompany(env))
+				}},
+		})
+	}
+	m.options |= MultiCompanyModel
+}
+
+// CompanyContexts returns FieldContexts that make the value of a field depend on
+// the current company, i.e. the first allowed company of the 'allowed_company_ids' context key.
+func CompanyContexts() FieldContexts {
+	return FieldContexts{
+		companyContextName: func(rs RecordSet) string {
+			ids := currentCompany(rs.Env())
+			if len(ids) == 0 {
+				return ""
+			}
+			return strconv.FormatInt(ids[0], 10)
+		},
+	}
+}
+
+// SetCompanyDependent makes the value of this Field depend on the current company.
+func (f *Field) SetCompanyDependent(value bool) *Field {
+	f.addUpdate("companyDependent", value)
+	return f
+}
+
+// A UserCompaniesFunc returns the ids of the companies the user with the given
+// uid is allowed to work with, the first one being the company of the user.
+//
+// env is an Environment of the superuser.
+type UserCompaniesFunc func(env Environment, uid int64) []int64
+
+// userCompanies is the UserCompaniesFunc set with SetUserCompaniesFunc
+var userCompanies UserCompaniesFunc
+
+// SetUserCompaniesFunc sets the function that returns the companies a user
+// is allowed to work with. It is typically called by the module that declares
+// users and companies.
+//
+// If no such function is set, users other than the superuser are not allowed to
+// work with any company, so that they only access the records without company
+// of multi-company models.
+func SetUserCompaniesFunc(f UserCompaniesFunc) {
+	userCompanies = f
+}
+
+// allowedCompanies returns the ids of the companies the user of the given
+// environment is working with. The first one is the current company.
+//
+// These are the companies of the 'allowed_company_ids' context key that the user
+// is allowed to work with, or the company of the user if this key is not set or
+// holds none of them. The context key is used as is for the superuser. Other users
+// are not allowed to work with any company if no UserCompaniesFunc has been set.
+func allowedCompanies(env Environment) []int64 {
+	ids := env.context.GetIntegerSlice(allowedCompaniesKey)
+	if env.uid == security.SuperUserID {
+		return ids
+	}
+	if userCompanies == nil {
+		return []int64{}
+	}
+	sudoEnv := env
+	sudoEnv.uid = security.SuperUserID
+	sudoEnv.context = types.NewContext()
+	userIds := userCompanies(sudoEnv, env.uid)
+	userIdsMap := make(map[int64]bool, len(userIds))
+	for _, id := range userIds {
+		userIdsMap[id] = true
+	}
+	res := make([]int64, 0, len(ids))
+	for _, id := range ids {
+		if userIdsMap[id] {
+			res = append(res, id)
+		}
+	}
+	if len(res) == 0 && len(userIds) > 0 {
+		res = userIds[:1]
+	}
+	return res
+}
+
+// currentCompany returns a slice with the id of the current company
+// of the given environment, or an empty slice if there is none.
+func currentCompany(env Environment) []int64 {
+	ids := allowedCompanies(env)
+	if len(ids) == 0 {
+		return []int64{}
+	}
+	return ids[:1]
+}
+
+// companyCondition returns the given condition restricted to the records of the
+// allowed companies and to records without company if this is a multi-company model.
+func (rc *RecordCollection) companyCondition(cond *Condition) *Condition {
+	if !rc.model.isMultiCompany() {
+		return cond
+	}
+	companyField := rc.model.FieldName(companyFieldName)
+	ids := allowedCompanies(*rc.env)
+	if len(ids) == 0 {
+		if rc.env.uid == security.SuperUserID {
+			return cond
+		}
+		// The user is not allowed to work with any company
+		return cond.AndCond(rc.model.Field(companyField).IsNull())
+	}
+	return cond.AndCond(rc.model.Field(companyField).IsNull().Or().Field(companyField).In(ids))
+}
+
+// checkCompanies panics with a UserError if the records of this RecordCollection
+// point to records of another company through one of the given fields.
+//
+// If the Company field is in fields, all relational fields are checked.
+func (rc *RecordCollection) checkCompanies(fields []FieldName) {
+	if !rc.model.isMultiCompany() || rc.hasNegIds {
+		return
+	}
+	checkAll := false
+	toCheck := make(map[string]bool)
+	for _, f := range fields {
+		fi, exists := rc.model.fields.Get(f.Name())
+		if !exists {
+			continue
+		}
+		if fi.name == companyFieldName {
+			checkAll = true
+		}
+		toCheck[fi.name] = true
+	}
+	var relFields []*Field
+	for _, fi := range rc.model.fields.registryByName {
+		if fi.name == companyFieldName || !fi.isStored() {
+			continue
+		}
+		if fi.fieldType != fieldtype.Many2One && fi.fieldType != fieldtype.Many2Many {
+			continue
+		}
+		if !fi.relatedModel.isMultiCompany() || (!checkAll && !toCheck[fi.name]) {
+			continue
+		}
+		relFields = append(relFields, fi)
+	}
+	if len(relFields) == 0 {
+		return
+	}
+	for _, rec := range rc.Records() {
+		company := rec.Get(rc.model.FieldName(companyFieldName)).(RecordSet).Collection()
+		if company.IsEmpty() {
+			continue
+		}
+		for _, fi := range relFields {
+			related := rec.Get(rc.model.FieldName(fi.name)).(RecordSet).Collection()
+			if related.IsEmpty() {
+				continue
+			}
+			var ids []int64
+			rc.env.cr.Select(&ids, fmt.Sprintf(`SELECT id FROM %s WHERE id IN (?) AND %s IS NOT NULL AND %s != ?`,
+				adapters[db.DriverName()].quoteTableName(fi.relatedModel.tableName),
+				fi.relatedModel.fields.MustGet(companyFieldName).json, fi.relatedModel.fields.MustGet(companyFieldName).json),
+				related.Ids(), company.Ids()[0])
+			if len(ids) == 0 {
+				continue
+			}
+			idsStr := make([]string, len(ids))
+			for i, id := range ids {
+				idsStr[i] = strconv.FormatInt(id, 10)
+			}
+			panic(exceptions.UserError{
+				Message: fmt.Sprintf("Incompatible companies on records: %s is linked to %s records of another company",
+					rec.String(), fi.relatedModel.name),
+				Debug: fmt.Sprintf("Field: %s, company: %d, %s ids: %s", fi.name, company.Ids()[0],
+					fi.relatedModel.name, strings.Join(idsStr, ",")),
+			})
+		}
+	}
+}
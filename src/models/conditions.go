@@ -17,6 +17,7 @@ package models
 import (
 	"fmt"
 	"reflect"
+	"strings"
 
 	"github.com/hexya-erp/hexya/src/models/operator"
 )
@@ -37,6 +38,9 @@ type predicate struct {
 	isOr     bool
 	isNot    bool
 	isCond   bool
+	jsonPath []string
+	subquery *aggregateSubquery
+	aggFunc  AggregateFunction
 }
 
 // Field returns the field name of this predicate
@@ -204,7 +208,17 @@ func (c Condition) String() string {
 			res += fmt.Sprintf("(\n%s\n)\n", p.cond.String())
 			continue
 		}
-		res += fmt.Sprintf("%s %s %v\n", joinFieldNames(p.exprs, ExprSep).Name(), p.operator, p.arg)
+		fieldName := joinFieldNames(p.exprs, ExprSep).Name()
+		if len(p.jsonPath) > 0 {
+			fieldName += fmt.Sprintf("[%s]", strings.Join(p.jsonPath, ExprSep))
+		}
+		if p.subquery != nil {
+			fieldName = p.subquery.String(fieldName)
+		}
+		if p.aggFunc != "" {
+			fieldName = fmt.Sprintf("%s(%s)", p.aggFunc, fieldName)
+		}
+		res += fmt.Sprintf("%s %s %v\n", fieldName, p.operator, p.arg)
 	}
 	return res
 }
@@ -249,8 +263,11 @@ func (cs ConditionStart) FilteredOn(field FieldName, condition *Condition) *Cond
 // A ConditionField is a partial Condition when we have set
 // a field name in a predicate and are about to add an operator.
 type ConditionField struct {
-	cs    ConditionStart
-	exprs []FieldName
+	cs       ConditionStart
+	exprs    []FieldName
+	jsonPath []string
+	subquery *aggregateSubquery
+	aggFunc  AggregateFunction
 }
 
 // JSON returns the json field name of this ConditionField
@@ -265,6 +282,23 @@ func (c ConditionField) Name() string {
 
 var _ FieldName = ConditionField{}
 
+// JSONPath returns a ConditionField on the value at the given dot separated
+// path inside this JSON field, e.g. "address.city". Array elements are
+// selected by their index, e.g. "lines.0.name".
+//
+// Values are compared as text, unless the argument of the operator is a
+// number or a boolean.
+func (c ConditionField) JSONPath(path string) *ConditionField {
+	elems := strings.Split(path, ExprSep)
+	for _, elem := range elems {
+		if elem == "" {
+			log.Panic("Invalid JSON path", "field", c.Name(), "path", path)
+		}
+	}
+	c.jsonPath = append(append([]string{}, c.jsonPath...), elems...)
+	return &c
+}
+
 // AddOperator adds a condition value to the condition with the given operator and data
 // If multi is true, a recordset will be converted into a slice of int64
 // otherwise, it will return an int64 and panic if the recordset is not
@@ -290,6 +324,9 @@ func (c ConditionField) AddOperator(op operator.Operator, data interface{}) *Con
 		arg:      data,
 		isNot:    c.cs.nextIsNot,
 		isOr:     c.cs.nextIsOr,
+		jsonPath: c.jsonPath,
+		subquery: c.subquery,
+		aggFunc:  c.aggFunc,
 	})
 	return &cond
 }
@@ -385,11 +422,53 @@ func (c ConditionField) NotIn(data interface{}) *Condition {
 	return c.AddOperator(operator.NotIn, data)
 }
 
+// Search appends the full-text search operator to the current Condition.
+// Records match if the field contains all the words of the given text.
+func (c ConditionField) Search(data interface{}) *Condition {
+	return c.AddOperator(operator.Search, data)
+}
+
+// Between appends the 'BETWEEN' operator to the current Condition.
+// Both bounds are included.
+func (c ConditionField) Between(low, high interface{}) *Condition {
+	return c.AddOperator(operator.Between, []interface{}{low, high})
+}
+
+// Regex appends the regular expression match operator to the current Condition
+func (c ConditionField) Regex(data interface{}) *Condition {
+	return c.AddOperator(operator.Regex, data)
+}
+
+// IRegex appends the case insensitive regular expression match operator
+// to the current Condition
+func (c ConditionField) IRegex(data interface{}) *Condition {
+	return c.AddOperator(operator.IRegex, data)
+}
+
 // ChildOf appends the 'child of' operator to the current Condition
 func (c ConditionField) ChildOf(data interface{}) *Condition {
 	return c.AddOperator(operator.ChildOf, data)
 }
 
+// ParentOf appends the 'parent of' operator to the current Condition
+func (c ConditionField) ParentOf(data interface{}) *Condition {
+	return c.AddOperator(operator.ParentOf, data)
+}
+
+// Overlaps appends the 'overlaps' operator to the current Condition.
+// Records match if at least one of the records of this relation field
+// is in the given data.
+func (c ConditionField) Overlaps(data interface{}) *Condition {
+	return c.AddOperator(operator.Overlaps, data)
+}
+
+// Any appends the 'any' operator to the current Condition.
+// Records match if at least one of the records of this relation field
+// matches the given condition.
+func (c ConditionField) Any(cond Conditioner) *Condition {
+	return c.AddOperator(operator.Any, cond)
+}
+
 // IsNull checks if the current condition field is null
 func (c ConditionField) IsNull() *Condition {
 	return c.AddOperator(operator.Equals, nil)
@@ -442,26 +521,38 @@ func (c *Condition) substituteExprs(mi *Model, substs map[FieldName][]FieldName)
 	}
 }
 
-// substituteChildOfOperator recursively replaces in the condition the
-// predicates with ChildOf operator by the predicates to actually execute.
-func (c *Condition) substituteChildOfOperator(rc *RecordCollection) {
+// substituteOperators recursively replaces in the condition the predicates
+// with ChildOf, ParentOf or Any operators by the predicates to actually execute.
+func (c *Condition) substituteOperators(rc *RecordCollection) {
 	for i, p := range c.predicates {
 		if p.cond != nil {
-			p.cond.substituteChildOfOperator(rc)
-		}
-		if p.operator != operator.ChildOf {
-			continue
+			p.cond.substituteOperators(rc)
 		}
-		recModel := rc.model.getRelatedModelInfo(joinFieldNames(p.exprs, ExprSep))
-		if !recModel.hasParentField() {
-			// If we have no parent field, then we fetch only the "parent" record
-			c.predicates[i].operator = operator.Equals
-			continue
+		switch p.operator {
+		case operator.ChildOf, operator.ParentOf:
+			recModel := rc.model.getRelatedModelInfo(joinFieldNames(p.exprs, ExprSep))
+			if !recModel.hasParentField() {
+				// If we have no parent field, then we fetch only the "parent" record
+				c.predicates[i].operator = operator.Equals
+				continue
+			}
+			query := adapters[db.DriverName()].childrenIdsQuery(recModel.tableName)
+			if p.operator == operator.ParentOf {
+				query = adapters[db.DriverName()].parentIdsQuery(recModel.tableName)
+			}
+			var ids []int64
+			rc.Env().Cr().Select(&ids, query, p.arg)
+			c.predicates[i].operator = operator.In
+			c.predicates[i].arg = ids
+		case operator.Any:
+			cond, ok := p.arg.(Conditioner)
+			if !ok {
+				log.Panic("The argument of the any operator must be a condition", "field", p.Field().Name(), "arg", p.arg)
+			}
+			recModel := rc.model.getRelatedModelInfo(joinFieldNames(p.exprs, ExprSep))
+			c.predicates[i].operator = operator.Overlaps
+			c.predicates[i].arg = rc.Env().Pool(recModel.name).Search(cond.Underlying()).Ids()
 		}
-		var parentIds []int64
-		rc.Env().Cr().Select(&parentIds, adapters[db.DriverName()].childrenIdsQuery(recModel.tableName), p.arg)
-		c.predicates[i].operator = operator.In
-		c.predicates[i].arg = parentIds
 	}
 }
 
@@ -71,7 +71,7 @@ func LoadCSVDataFile(fileName string) {
 			values["hexya_external_id"] = externalID
 			values["hexya_version"] = version
 			// We deliberately call Search directly without Call so as not to be polluted by Search overrides
-			// such as "Active test".
+			// such as the "Active test" of archivable models.
 			rec := rc.Search(rc.Model().Field(rc.model.FieldName("HexyaExternalID")).Equals(externalID)).Limit(1)
 			switch {
 			case rec.Len() == 0:
@@ -4,49 +4,246 @@
 package models
 
 import (
+	"database/sql/driver"
 	"fmt"
+	"hash/fnv"
+	"regexp"
 	"strings"
+	"time"
 
 	"github.com/hexya-erp/hexya/src/models/security"
 )
 
+const (
+	// maxIdentifierLength is the maximum length in bytes of SQL identifiers.
+	// PostgreSQL truncates longer identifiers.
+	maxIdentifierLength = 63
+	// ftsHashLength is the length of the language hash of full-text index names
+	ftsHashLength = 8
+)
+
+// ftsLangRegexp matches the languages that can be used as is in full-text index names
+var ftsLangRegexp = regexp.MustCompile(`^[a-z0-9_]+$`)
+
+// unmanagedTables are tables created by Hexya itself which are not
+// bound to a model and must not be dropped when syncing the database.
+var unmanagedTables = map[string]bool{
+	migrationsTable: true,
+}
+
+// RegisterUnmanagedTable declares that the table with the given name is created
+// and managed outside of models, so that it is not dropped when syncing the database.
+//
+// It must be called before the database is synchronized, typically in an init function.
+func RegisterUnmanagedTable(name string) {
+	unmanagedTables[name] = true
+}
+
+// A schemaStatement is a statement recorded by a schemaRecorder
+type schemaStatement struct {
+	// rank is the index of the module owning the statement in the modules of
+	// the recorder, -1 if it must be applied before the statements of all the
+	// modules and the number of modules if it must be applied after them.
+	rank int
+	up   string
+	// down is the statement reverting up, a comment if up is irreversible
+	// and the empty string if up needs not be reverted.
+	down string
+}
+
+// A schemaRecorder collects the statements that would be executed
+// to synchronize the database schema instead of executing them.
+//
+// Each statement is attributed to the module declaring the models,
+// fields or constraints it changes.
+type schemaRecorder struct {
+	modules    []MigrationModule
+	statements []schemaStatement
+	rank       int
+}
+
+// record adds the given query to the recorder, with its placeholders
+// replaced by the SQL literals of args, and the given down statement.
+func (sr *schemaRecorder) record(query, down string, args ...interface{}) {
+	sr.statements = append(sr.statements, schemaStatement{
+		rank: sr.rank,
+		up:   substitutePlaceholders(strings.TrimSpace(query), args...),
+		down: strings.TrimSpace(down),
+	})
+}
+
+// rankOf returns the rank of the last of the modules of this recorder
+// declared in one of the given packages, or -1 if there is none.
+func (sr *schemaRecorder) rankOf(pkgs ...string) int {
+	res := -1
+	for _, pkg := range pkgs {
+		var pkgLen int
+		rank := -1
+		for i, mod := range sr.modules {
+			if mod.Package == "" || len(mod.Package) <= pkgLen {
+				continue
+			}
+			if pkg == mod.Package || strings.HasPrefix(pkg, mod.Package+"/") {
+				// The module with the longest package wins, in case
+				// a module is a subpackage of another one.
+				pkgLen = len(mod.Package)
+				rank = i
+			}
+		}
+		if rank > res {
+			res = rank
+		}
+	}
+	return res
+}
+
+// setSchemaOwners sets the packages declaring the database objects changed
+// by the next recorded statements, if a schemaRecorder is in use.
+func setSchemaOwners(pkgs ...string) {
+	if schemaRec != nil {
+		schemaRec.rank = schemaRec.rankOf(pkgs...)
+	}
+}
+
+// recordSchemaChanges returns a schemaRecorder with the statements that SyncDatabase
+// would execute, attributed to the given modules. The database is left untouched.
+func recordSchemaChanges(modules []MigrationModule) *schemaRecorder {
+	rec := &schemaRecorder{
+		modules: modules,
+		rank:    -1,
+	}
+	schemaRec = rec
+	defer func() {
+		schemaRec = nil
+	}()
+	syncDatabaseSchema()
+	return rec
+}
+
+// substitutePlaceholders returns the given query with its '?' placeholders
+// replaced by the SQL literals of args in order. Question marks inside
+// string literals and quoted identifiers are left untouched.
+func substitutePlaceholders(query string, args ...interface{}) string {
+	var res strings.Builder
+	var quote rune
+	for _, r := range query {
+		switch {
+		case quote != 0:
+			if r == quote {
+				// A doubled quote is an escaped quote, which closes
+				// and reopens the literal so it needs no special case.
+				quote = 0
+			}
+		case r == '\'' || r == '"':
+			quote = r
+		case r == '?' && len(args) > 0:
+			res.WriteString(sqlLiteral(args[0]))
+			args = args[1:]
+			continue
+		}
+		res.WriteRune(r)
+	}
+	return res.String()
+}
+
+// sqlLiteral returns the given value as an SQL literal
+func sqlLiteral(value interface{}) string {
+	if valuer, ok := value.(driver.Valuer); ok {
+		v, err := valuer.Value()
+		if err != nil {
+			log.Panic("Unable to get SQL value", "value", value, "error", err)
+		}
+		value = v
+	}
+	switch val := value.(type) {
+	case nil:
+		return "NULL"
+	case bool:
+		if val {
+			return "TRUE"
+		}
+		return "FALSE"
+	case string:
+		return fmt.Sprintf("'%s'", strings.Replace(val, "'", "''", -1))
+	case []byte:
+		return fmt.Sprintf("'%s'", strings.Replace(string(val), "'", "''", -1))
+	case time.Time:
+		return fmt.Sprintf("'%s'", val.Format("2006-01-02 15:04:05.999999-07:00"))
+	}
+	return fmt.Sprintf("%v", value)
+}
+
+// schemaRec is the schemaRecorder in use, if any
+var schemaRec *schemaRecorder
+
 // SyncDatabase creates or updates database tables with the data in the model registry
 func SyncDatabase() {
 	log.Info("Updating database schema")
+	syncDatabaseSchema()
+	// Run init method on each model
+	for _, model := range Registry.registryByTableName {
+		if model.isMixin() {
+			continue
+		}
+		runInit(model)
+	}
+}
+
+// SchemaChanges returns the list of SQL statements that SyncDatabase would
+// execute to synchronize the database schema with the model registry.
+//
+// The database is left untouched.
+func SchemaChanges() []string {
+	var res []string
+	for _, statement := range recordSchemaChanges(nil).statements {
+		res = append(res, statement.up)
+	}
+	return res
+}
+
+// syncDatabaseSchema creates, updates or drops tables, columns, indexes,
+// constraints and sequences so that the database matches the model registry.
+func syncDatabaseSchema() {
 	adapter := adapters[db.DriverName()]
 	dbTables := adapter.tables()
 	// Create or update sequences
 	updateDBSequences()
 	// Create or update existing tables
+	newTables := make(map[string]bool)
 	for tableName, model := range Registry.registryByTableName {
 		if model.isMixin() || model.isManual() {
 			continue
 		}
-		if _, ok := dbTables[tableName]; !ok {
+		setSchemaOwners(model.pkgPath)
+		if _, ok := dbTables[tableName]; ok {
+			updateDBColumns(model)
+		} else {
 			createDBTable(model)
+			newTables[tableName] = true
 		}
-		updateDBColumns(model)
 		updateDBIndexes(model)
 	}
 	// Setup constraints
-	for _, model := range Registry.registryByTableName {
+	for tableName, model := range Registry.registryByTableName {
 		if model.isMixin() || model.isManual() {
 			continue
 		}
+		setSchemaOwners(model.pkgPath)
 		buildSQLErrorSubstitutionMap(model)
 		updateDBForeignKeyConstraints(model)
-		updateDBConstraints(model)
-	}
-	// Run init method on each model
-	for _, model := range Registry.registryByTableName {
-		if model.isMixin() {
-			continue
+		if !newTables[tableName] {
+			// Constraints of new tables are created with the table
+			updateDBConstraints(model)
 		}
-		runInit(model)
 	}
-
-	// Drop DB tables that are not in the models
+	// Drop DB tables that are not in the models, after the changes of all modules
+	if schemaRec != nil {
+		schemaRec.rank = len(schemaRec.modules)
+	}
 	for dbTable := range adapter.tables() {
+		if unmanagedTables[dbTable] {
+			continue
+		}
 		var modelExists bool
 		for tableName, model := range Registry.registryByTableName {
 			if dbTable != tableName || model.isMixin() {
@@ -61,6 +258,25 @@ func SyncDatabase() {
 	}
 }
 
+// dbExecuteDDL executes the given irreversible schema modification
+// query, or only records it if a schemaRecorder is in use.
+func dbExecuteDDL(query string, args ...interface{}) {
+	dbExecuteReversibleDDL(query, fmt.Sprintf("-- Irreversible: %s", strings.Join(strings.Fields(query), " ")), args...)
+}
+
+// dbExecuteReversibleDDL executes the given schema modification query, or
+// only records it with the given down statement reverting it if a
+// schemaRecorder is in use. down may be empty if query needs not be reverted,
+// typically because it changes an object that the down statement of a
+// previous query drops.
+func dbExecuteReversibleDDL(query, down string, args ...interface{}) {
+	if schemaRec != nil {
+		schemaRec.record(query, down, args...)
+		return
+	}
+	dbExecuteNoTx(query, args...)
+}
+
 // buildSQLErrorSubstitutionMap populates the sqlErrors map of the
 // model with the appropriate error message substitution
 func buildSQLErrorSubstitutionMap(model *Model) {
@@ -87,17 +303,20 @@ func updateDBSequences() {
 		if !sequence.boot {
 			continue
 		}
-		exists := false
+		var dbSequence *seqData
 		for _, dbSeq := range adapter.sequences("%_bootseq") {
 			if sequence.JSON == dbSeq.Name {
-				exists = true
+				dbSequence = &dbSeq
+				break
 			}
 		}
-		if !exists {
+		if dbSequence == nil {
 			adapter.createSequence(sequence.JSON, sequence.Increment, sequence.Start)
 			continue
 		}
-		adapter.alterSequence(sequence.JSON, sequence.Increment, sequence.Start)
+		if dbSequence.Increment != sequence.Increment || dbSequence.StartValue != sequence.Start {
+			adapter.alterSequence(sequence.JSON, sequence.Increment, sequence.Start)
+		}
 	}
 	// Drop unused boot sequences
 	for _, dbSeq := range adapter.sequences("%_bootseq") {
@@ -116,32 +335,61 @@ func updateDBSequences() {
 
 // createDBTable creates a table in the database from the given Model
 // It only creates the primary key. Call updateDBColumns to create columns.
+//
+// When recording, the columns and constraints declared by modules other than the
+// module of the model are created apart, so that they belong to these modules.
 func createDBTable(m *Model) {
 	adapter := adapters[db.DriverName()]
-	var columns []string
+	var (
+		columns        []string
+		extFields      []*Field
+		extConstraints []string
+	)
 	for colName, fi := range m.fields.registryByJSON {
 		if colName == "id" || !fi.isStored() {
 			continue
 		}
+		if schemaRec != nil && schemaRec.rankOf(m.pkgPath, fi.pkgPath) != schemaRec.rankOf(m.pkgPath) {
+			extFields = append(extFields, fi)
+			continue
+		}
 		col := fmt.Sprintf("%s %s", colName, adapter.columnSQLDefinition(fi, false))
 		columns = append(columns, col)
 	}
+	// Table constraints are declared right away, since some databases
+	// cannot add them to an existing table.
+	for constraintName, constraint := range m.sqlConstraints {
+		if schemaRec != nil && schemaRec.rankOf(m.pkgPath, constraint.pkgPath) != schemaRec.rankOf(m.pkgPath) {
+			extConstraints = append(extConstraints, constraintName)
+			continue
+		}
+		columns = append(columns, fmt.Sprintf("CONSTRAINT %s %s", constraintName, constraint.sql))
+	}
 	query := fmt.Sprintf(`
 CREATE TABLE %s (
-	id serial NOT NULL PRIMARY KEY`,
-		adapter.quoteTableName(m.tableName))
+	id %s`,
+		adapter.quoteTableName(m.tableName), adapter.idColumnSQLDefinition())
 	if len(columns) > 0 {
 		query += ",\n\t" + strings.Join(columns, ",\n\t")
 	}
 	query += "\n)"
-	dbExecuteNoTx(query)
+	dbExecuteReversibleDDL(query, fmt.Sprintf("DROP TABLE %s", adapter.quoteTableName(m.tableName)))
+	for _, fi := range extFields {
+		setSchemaOwners(m.pkgPath, fi.pkgPath)
+		createDBColumn(fi)
+	}
+	for _, constraintName := range extConstraints {
+		setSchemaOwners(m.pkgPath, m.sqlConstraints[constraintName].pkgPath)
+		createConstraint(m.tableName, constraintName, m.sqlConstraints[constraintName].sql)
+	}
+	setSchemaOwners(m.pkgPath)
 }
 
 // dropDBTable drops the given table in the database
 func dropDBTable(tableName string) {
 	adapter := adapters[db.DriverName()]
 	query := fmt.Sprintf(`DROP TABLE %s`, adapter.quoteTableName(tableName))
-	dbExecuteNoTx(query)
+	dbExecuteDDL(query)
 }
 
 // updateDBColumns synchronizes the colums of the database with the
@@ -154,13 +402,14 @@ func updateDBColumns(mi *Model) {
 		if colName == "id" || !fi.isStored() {
 			continue
 		}
+		setSchemaOwners(mi.pkgPath, fi.pkgPath)
 		dbColData, ok := dbColumns[colName]
 		if !ok {
 			createDBColumn(fi)
 			continue
 		}
 		if dbColData.DataType != adapter.typeSQL(fi) {
-			updateDBColumnDataType(fi)
+			updateDBColumnDataType(fi, dbColData.DataType)
 		}
 		if (dbColData.IsNullable == "NO" && !adapter.fieldIsNotNull(fi)) ||
 			(dbColData.IsNullable == "YES" && adapter.fieldIsNotNull(fi)) {
@@ -168,6 +417,7 @@ func updateDBColumns(mi *Model) {
 		}
 	}
 	// drop columns that no longer exist
+	setSchemaOwners(mi.pkgPath)
 	for colName := range dbColumns {
 		if _, ok := mi.fields.registryByJSON[colName]; !ok {
 			dropDBColumn(mi.tableName, colName)
@@ -186,7 +436,7 @@ func createDBColumn(fi *Field) {
 		ALTER TABLE %s
 		ADD COLUMN %s %s
 	`, adapter.quoteTableName(fi.model.tableName), fi.json, adapter.columnSQLDefinition(fi, true))
-	dbExecuteNoTx(query)
+	dbExecuteReversibleDDL(query, fmt.Sprintf("ALTER TABLE %s DROP COLUMN %s", adapter.quoteTableName(fi.model.tableName), fi.json))
 	// Set default value if defined
 	if fi.defaultFunc != nil {
 		updateQuery := fmt.Sprintf(`
@@ -196,39 +446,57 @@ func createDBColumn(fi *Field) {
 		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
 			defaultValue = fi.defaultFunc(env)
 		})
-		dbExecuteNoTx(updateQuery, defaultValue)
+		// Dropping the column reverts the update
+		dbExecuteReversibleDDL(updateQuery, "", defaultValue)
 	}
 	// Add not null if required
-	updateDBColumnNullable(fi)
+	setDBColumnNullable(fi, false)
 }
 
-// updateDBColumnDataType updates the data type in database for the given Field
-func updateDBColumnDataType(fi *Field) {
+// updateDBColumnDataType updates the data type in database for the given Field,
+// whose column has currently the given data type.
+func updateDBColumnDataType(fi *Field, dataType string) {
 	adapter := adapters[db.DriverName()]
-	query := fmt.Sprintf(`
-		ALTER TABLE %s
-		ALTER COLUMN %s SET DATA TYPE %s
-	`, adapter.quoteTableName(fi.model.tableName), fi.json, adapter.typeSQL(fi))
-	dbExecuteNoTx(query)
+	query := adapter.alterColumnTypeQuery(fi.model.tableName, fi.json, adapter.typeSQL(fi))
+	if query == "" {
+		log.Warn("unable to change column data type", "model", fi.model.name, "field", fi.name, "type", adapter.typeSQL(fi))
+		return
+	}
+	if down := adapter.alterColumnTypeQuery(fi.model.tableName, fi.json, dataType); down != "" {
+		dbExecuteReversibleDDL(query, down)
+		return
+	}
+	dbExecuteDDL(query)
 }
 
 // updateDBColumnNullable updates the NULL/NOT NULL data in database for the given Field
 func updateDBColumnNullable(fi *Field) {
+	setDBColumnNullable(fi, true)
+}
+
+// setDBColumnNullable sets the NULL/NOT NULL data in database for the given Field.
+// If revert is false, the change is recorded without down statement, because
+// the column has just been created.
+func setDBColumnNullable(fi *Field, revert bool) {
 	adapter := adapters[db.DriverName()]
-	var verb string
-	if adapter.fieldIsNotNull(fi) {
-		verb = "SET"
-	} else {
-		verb = "DROP"
+	notNull := adapter.fieldIsNotNull(fi)
+	query := adapter.alterColumnNullQuery(fi.model.tableName, fi.json, notNull)
+	if query == "" {
+		log.Warn("unable to change NOT NULL constraint", "model", fi.model.name, "field", fi.name, "notNull", notNull)
+		return
+	}
+	if schemaRec != nil {
+		var down string
+		if revert {
+			down = adapter.alterColumnNullQuery(fi.model.tableName, fi.json, !notNull)
+		}
+		schemaRec.record(query, down)
+		return
 	}
-	query := fmt.Sprintf(`
-		ALTER TABLE %s
-		ALTER COLUMN %s %s NOT NULL
-	`, adapter.quoteTableName(fi.model.tableName), fi.json, verb)
 	query, _ = sanitizeQuery(query)
 	_, err := db.Exec(query)
 	if err != nil {
-		log.Warn("unable to change NOT NULL constraint", "model", fi.model.name, "field", fi.name, "verb", verb)
+		log.Warn("unable to change NOT NULL constraint", "model", fi.model.name, "field", fi.name, "notNull", notNull)
 	}
 }
 
@@ -239,7 +507,7 @@ func dropDBColumn(tableName, colName string) {
 		ALTER TABLE %s
 		DROP COLUMN %s
 	`, adapter.quoteTableName(tableName), colName)
-	dbExecuteNoTx(query)
+	dbExecuteDDL(query)
 }
 
 // updateDBForeignKeyConstraints creates or updates fk constraints
@@ -251,11 +519,14 @@ func updateDBForeignKeyConstraints(m *Model) {
 		fieldIsFK := fi.fieldType.IsFKRelationType() && fi.isStored()
 		switch {
 		case fieldIsFK && !fkContraintInDB:
+			setSchemaOwners(m.pkgPath, fi.pkgPath, fi.relatedModel.pkgPath)
 			createFKConstraint(m.tableName, colName, fi.relatedModel.tableName, string(fi.onDelete))
 		case !fieldIsFK && fkContraintInDB:
+			setSchemaOwners(m.pkgPath, fi.pkgPath)
 			dropFKConstraint(m.tableName, colName)
 		}
 	}
+	setSchemaOwners(m.pkgPath)
 }
 
 // updateDBConstraints creates or updates sql constraints
@@ -264,9 +535,11 @@ func updateDBConstraints(m *Model) {
 	adapter := adapters[db.DriverName()]
 	for constraintName, constraint := range m.sqlConstraints {
 		if !adapter.constraintExists(constraintName) {
+			setSchemaOwners(m.pkgPath, constraint.pkgPath)
 			createConstraint(m.tableName, constraintName, constraint.sql)
 		}
 	}
+	setSchemaOwners(m.pkgPath)
 dbConLoop:
 	for _, dbConstraintName := range adapter.constraints(fmt.Sprintf("%%_%s_mancon", m.tableName)) {
 		for constraintName := range m.sqlConstraints {
@@ -293,26 +566,36 @@ func dropFKConstraint(tableName, colName string) {
 // createConstraint creates a constraint in the given table
 func createConstraint(tableName, constraintName, sql string) {
 	adapter := adapters[db.DriverName()]
-	query := fmt.Sprintf(`
-		ALTER TABLE %s ADD CONSTRAINT %s %s
-	`, adapter.quoteTableName(tableName), constraintName, sql)
-	dbExecuteNoTx(query)
+	query := adapter.addConstraintQuery(tableName, constraintName, sql)
+	if query == "" {
+		log.Warn("unable to add constraint to existing table", "table", tableName, "constraint", constraintName)
+		return
+	}
+	if down := adapter.dropConstraintQuery(tableName, constraintName); down != "" {
+		dbExecuteReversibleDDL(query, down)
+		return
+	}
+	dbExecuteDDL(query)
 }
 
 // dropConstraint drops a constraint with the given name
 func dropConstraint(tableName, constraintName string) {
 	adapter := adapters[db.DriverName()]
-	query := fmt.Sprintf(`
-		ALTER TABLE %s DROP CONSTRAINT IF EXISTS %s
-	`, adapter.quoteTableName(tableName), constraintName)
-	dbExecuteNoTx(query)
+	query := adapter.dropConstraintQuery(tableName, constraintName)
+	if query == "" {
+		log.Warn("unable to drop constraint", "table", tableName, "constraint", constraintName)
+		return
+	}
+	dbExecuteDDL(query)
 }
 
 // updateDBIndexes creates or updates indexes based on the data of
 // the given Model
 func updateDBIndexes(m *Model) {
 	adapter := adapters[db.DriverName()]
+	tableIndexes := adapter.indexes(m.tableName)
 	for colName, fi := range m.fields.registryByJSON {
+		setSchemaOwners(m.pkgPath, fi.pkgPath)
 		indexInDB := adapter.indexExists(m.tableName, fmt.Sprintf("%s_%s_index", m.tableName, colName))
 		switch {
 		case fi.index && !indexInDB:
@@ -320,22 +603,92 @@ func updateDBIndexes(m *Model) {
 		case indexInDB && !fi.index:
 			dropColumnIndex(m.tableName, colName)
 		}
+		updateFullTextIndex(m, fi, tableIndexes)
+	}
+	setSchemaOwners(m.pkgPath)
+}
+
+// updateFullTextIndex creates the full-text index of the given field if needed
+// and drops its full-text indexes that are not needed anymore.
+//
+// The language of a full-text index is part of its name, so that changing
+// the language of a field recreates its index.
+func updateFullTextIndex(m *Model, fi *Field, tableIndexes []string) {
+	adapter := adapters[db.DriverName()]
+	var ftsIndexName string
+	if fi.fullTextLang != "" && fi.isStored() {
+		ftsIndexName = fullTextIndexName(m.tableName, fi.json, fi.fullTextLang)
+	}
+	prefix := fullTextIndexPrefix(m.tableName, fi.json)
+	var ftsIndexInDB bool
+	for _, index := range tableIndexes {
+		if !strings.HasPrefix(index, prefix) || !strings.HasSuffix(index, "_index") {
+			continue
+		}
+		if _, isColumn := m.fields.registryByJSON[strings.TrimSuffix(strings.TrimPrefix(index, m.tableName+"_"), "_index")]; isColumn {
+			// This is the index of another column
+			continue
+		}
+		if index == ftsIndexName {
+			ftsIndexInDB = true
+			continue
+		}
+		dbExecuteDDL(fmt.Sprintf(`DROP INDEX IF EXISTS %s`, index))
+	}
+	if ftsIndexName == "" || ftsIndexInDB {
+		return
+	}
+	if query := adapter.fullTextIndexQuery(ftsIndexName, m.tableName, fi.json, fi.fullTextLang); query != "" {
+		dbExecuteReversibleDDL(query, fmt.Sprintf("DROP INDEX IF EXISTS %s", ftsIndexName))
 	}
 }
 
+// fullTextIndexPrefix returns the prefix of the names of the full-text
+// indexes of the given column of the given table.
+func fullTextIndexPrefix(tableName, colName string) string {
+	prefix := fmt.Sprintf("%s_%s_fts_", tableName, colName)
+	if maxLen := maxIdentifierLength - ftsHashLength - len("_index"); len(prefix) > maxLen {
+		prefix = prefix[:maxLen]
+	}
+	return prefix
+}
+
+// fullTextIndexName returns the name of the full-text index of the given column
+// of the given table for the given language.
+//
+// The language is replaced by its hash if it cannot be used in an identifier as is,
+// such as 'pg_catalog.english', or if the name would be longer than maxIdentifierLength.
+func fullTextIndexName(tableName, colName, lang string) string {
+	name := fmt.Sprintf("%s_%s_fts_%s_index", tableName, colName, lang)
+	if ftsLangRegexp.MatchString(lang) && len(name) <= maxIdentifierLength {
+		return name
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(lang))
+	return fmt.Sprintf("%s%0*x_index", fullTextIndexPrefix(tableName, colName), ftsHashLength, hash.Sum32())
+}
+
 // createColumnIndex creates an column index for colName in the given table
 func createColumnIndex(tableName, colName string) {
+	dbExecuteReversibleDDL(createColumnIndexQuery(tableName, colName), dropColumnIndexQuery(tableName, colName))
+}
+
+// dropColumnIndex drops a column index for colName in the given table
+func dropColumnIndex(tableName, colName string) {
+	dbExecuteReversibleDDL(dropColumnIndexQuery(tableName, colName), createColumnIndexQuery(tableName, colName))
+}
+
+// createColumnIndexQuery returns the query creating the index of colName in the given table
+func createColumnIndexQuery(tableName, colName string) string {
 	adapter := adapters[db.DriverName()]
-	query := fmt.Sprintf(`
+	return fmt.Sprintf(`
 		CREATE INDEX %s ON %s (%s)
 	`, fmt.Sprintf("%s_%s_index", tableName, colName), adapter.quoteTableName(tableName), colName)
-	dbExecuteNoTx(query)
 }
 
-// dropColumnIndex drops a column index for colName in the given table
-func dropColumnIndex(tableName, colName string) {
-	query := fmt.Sprintf(`
+// dropColumnIndexQuery returns the query dropping the index of colName in the given table
+func dropColumnIndexQuery(tableName, colName string) string {
+	return fmt.Sprintf(`
 		DROP INDEX IF EXISTS %s
 	`, fmt.Sprintf("%s_%s_index", tableName, colName))
-	dbExecuteNoTx(query)
 }
@@ -26,6 +26,9 @@ import (
 var (
 	db       *sqlx.DB
 	adapters map[string]dbAdapter
+	// dbConnectionString is the connection string of db, used to open
+	// dedicated connections such as notification listeners.
+	dbConnectionString string
 )
 
 // ConnectionParams are the database agnostic parameters to connect to the database
@@ -59,6 +62,9 @@ type seqData struct {
 type dbAdapter interface {
 	// connectionString returns the connection string for the given parameters
 	connectionString(ConnectionParams) string
+	// connect opens a connection to the database with the given driver name
+	// and connection string and checks that it is alive.
+	connect(driver, connData string) *sqlx.DB
 	// operatorSQL returns the sql string and placeholders for the given DomainOperator
 	operatorSQL(operator.Operator, interface{}) (string, interface{})
 	// typeSQL returns the SQL type string, including columns constraints if any
@@ -78,6 +84,8 @@ type dbAdapter interface {
 	quoteTableName(string) string
 	// indexExists returns true if an index with the given name exists in the given table
 	indexExists(table string, name string) bool
+	// indexes returns the names of the indexes of the given table
+	indexes(table string) []string
 	// constraintExists returns true if a constraint with the given name exists
 	constraintExists(name string) bool
 	// constraints returns a list of all constraints matching the given SQL pattern
@@ -99,11 +107,79 @@ type dbAdapter interface {
 	// a record from table including itself. The query has a placeholder for the
 	// record's ID
 	childrenIdsQuery(table string) string
-	// substituteErrorMessage substitutes the given error's message by newMsg
-	substituteErrorMessage(err error, newMsg string) error
+	// parentIdsQuery returns a query that finds all ancestors of the given
+	// record from table including itself. The query has a placeholder for the
+	// record's ID
+	parentIdsQuery(table string) string
 	// isSerializationError returns true if the given error is a serialization error
 	// and that the failed transaction should be retried.
 	isSerializationError(err error) bool
+	// idColumnSQLDefinition returns the SQL definition of the auto incremented
+	// 'id' primary key column of each table
+	idColumnSQLDefinition() string
+	// alterColumnTypeQuery returns the query to change the data type of the
+	// given column or an empty string if the database does not support it.
+	alterColumnTypeQuery(table, column, typ string) string
+	// alterColumnNullQuery returns the query to set or drop the NOT NULL
+	// constraint of the given column or an empty string if the database
+	// does not support it.
+	alterColumnNullQuery(table, column string, notNull bool) string
+	// addConstraintQuery returns the query to add the given constraint to the table
+	// or an empty string if the database cannot add this constraint to an existing table.
+	addConstraintQuery(table, name, sql string) string
+	// dropConstraintQuery returns the query to drop the given constraint
+	// or an empty string if the database cannot drop this constraint.
+	dropConstraintQuery(table, name string) string
+	// distinctOnIDQuery returns a query selecting the given fields from the given
+	// tables, keeping only the first row of each id of table, as ordered by orderSQL.
+	//
+	// aliases are the aliases of all fields as defined in fieldsSQL.
+	distinctOnIDQuery(table, fieldsSQL string, aliases []string, tablesSQL, whereSQL, orderSQL string) string
+	// limitOffsetSQL returns the LIMIT/OFFSET clause for the given values.
+	// A zero value means no limit or no offset.
+	limitOffsetSQL(limit, offset int) string
+	// skipLockedSQL returns the clause to append to a SELECT query to lock the
+	// selected rows while skipping the rows already locked by other transactions.
+	skipLockedSQL() string
+	// notifyQuery returns the query that sends a notification with the
+	// payload given as second placeholder on the channel given as first
+	// placeholder, or an empty string if the database has no notifications.
+	notifyQuery() string
+	// listen calls handler with the payload of each notification received on
+	// the given channel until the returned function is called. handler is called
+	// with an empty payload when notifications may have been lost.
+	listen(channel string, handler func(payload string)) (func(), error)
+	// cursorQueries returns the queries to declare a server-side cursor with the
+	// given name for the given select query, to fetch the next count rows from it
+	// and to close it. It returns empty strings if the database has no server-side
+	// cursors, in which case the rows of the query must be read while other queries
+	// are executed in the transaction.
+	cursorQueries(name, query string, count int) (declare, fetch, close string)
+	// maxQueryParams returns the maximum number of placeholders in a query
+	maxQueryParams() int
+	// fullTextSearchSQL returns the SQL predicate matching the given field
+	// expression with the search text given as placeholder, using the given
+	// text search configuration.
+	fullTextSearchSQL(field, lang string) string
+	// fullTextRankSQL returns the SQL expression of the relevance of the given field
+	// expression for the search text given as placeholder.
+	fullTextRankSQL(field, lang string) string
+	// fullTextIndexQuery returns the query to create a full-text index with the
+	// given name on the given column, or an empty string if the database does
+	// not support full-text indexes.
+	fullTextIndexQuery(name, table, column, lang string) string
+	// jsonPathSQL returns the SQL expression of the value at the given path
+	// inside the given JSON field expression, with the path given as placeholder,
+	// and the argument for this placeholder. arg is the value the expression is
+	// compared to, so that the expression can be cast to its type.
+	jsonPathSQL(field string, path []string, arg interface{}) (string, interface{})
+	// dateTruncSQL returns the SQL expression of the start of the period of the
+	// given granularity containing the given date expression. If tz is not empty,
+	// the expression is a datetime which is truncated in the tz timezone.
+	dateTruncSQL(field string, granularity DateGranularity, tz string) string
+	// aggregateFunctionSQL returns the SQL expression of the given aggregate
+	// function applied on the given field expression.
+	aggregateFunctionSQL(function string, field string) string
 }
 
 // registerDBAdapter adds a adapter to the adapters registry
@@ -149,13 +225,20 @@ func newCursor(db *sqlx.DB) *Cursor {
 func DBConnect(driver string, params ConnectionParams) {
 	adapter := adapters[driver]
 	connData := adapter.connectionString(params)
-	db = sqlx.MustConnect(driver, connData)
+	db = adapter.connect(driver, connData)
+	dbConnectionString = connData
 	log.Info("Connected to database", "driver", driver, "connData", connData)
 }
 
+// DBDriverName returns the name of the driver of the database connection
+func DBDriverName() string {
+	return db.DriverName()
+}
+
 // DBClose is a wrapper around sqlx.Close
 // It closes the connection to the database
 func DBClose() {
+	stopSharedCacheListener()
 	err := db.Close()
 	log.Info("Closed database", "error", err)
 }
@@ -16,10 +16,14 @@ package models
 
 import (
 	"fmt"
+	"reflect"
+	"strings"
+	"time"
 
 	"github.com/hexya-erp/hexya/src/models/fieldtype"
 	"github.com/hexya-erp/hexya/src/models/operator"
 	"github.com/hexya-erp/hexya/src/tools/nbutils"
+	"github.com/jmoiron/sqlx"
 	"github.com/lib/pq"
 )
 
@@ -40,8 +44,15 @@ var pgOperators = map[operator.Operator]string{
 	operator.LowerOrEqual:   "<= ?",
 	operator.Greater:        "> ?",
 	operator.GreaterOrEqual: ">= ?",
+	operator.Between:        "BETWEEN ? AND ?",
+	operator.Regex:          "~ ?",
+	operator.IRegex:         "~* ?",
+	operator.Overlaps:       "IN (?)",
 }
 
+// pgArrayEscaper escapes the elements of PostgreSQL array literals
+var pgArrayEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
 var pgTypes = map[fieldtype.Type]string{
 	fieldtype.Boolean:   "boolean",
 	fieldtype.Char:      "character varying",
@@ -89,6 +100,12 @@ func (d *postgresAdapter) connectionString(params ConnectionParams) string {
 	return connectString
 }
 
+// connect opens a connection to the database with the given driver name
+// and connection string and checks that it is alive.
+func (d *postgresAdapter) connect(driver, connData string) *sqlx.DB {
+	return sqlx.MustConnect(driver, connData)
+}
+
 // operatorSQL returns the sql string and placeholders for the given DomainOperator
 // Also modifies the given args to match the syntax of the operator.
 func (d *postgresAdapter) operatorSQL(do operator.Operator, arg interface{}) (string, interface{}) {
@@ -191,6 +208,13 @@ func (d *postgresAdapter) indexExists(table string, name string) bool {
 	return cnt > 0
 }
 
+// indexes returns the names of the indexes of the given table
+func (d *postgresAdapter) indexes(table string) []string {
+	var res []string
+	dbSelectNoTx(&res, "SELECT indexname FROM pg_indexes WHERE tablename = ?", table)
+	return res
+}
+
 // constraintExists returns true if a constraint with the given name exists in the given table
 func (d *postgresAdapter) constraintExists(name string) bool {
 	query := fmt.Sprintf("SELECT COUNT(*) FROM pg_constraint WHERE conname = '%s'", name)
@@ -210,13 +234,13 @@ func (d *postgresAdapter) constraints(pattern string) []string {
 // createSequence creates a DB sequence with the given name
 func (d *postgresAdapter) createSequence(name string, increment, start int64) {
 	query := fmt.Sprintf("CREATE SEQUENCE %s INCREMENT BY %d START WITH %d", name, increment, start)
-	dbExecuteNoTx(query)
+	dbExecuteDDL(query)
 }
 
 // dropSequence drops the DB sequence with the given name
 func (d *postgresAdapter) dropSequence(name string) {
 	query := fmt.Sprintf("DROP SEQUENCE IF EXISTS %s", name)
-	dbExecuteNoTx(query)
+	dbExecuteDDL(query)
 }
 
 // alterSequence modifies the DB sequence given by name
@@ -226,9 +250,9 @@ func (d *postgresAdapter) alterSequence(name string, increment, restart int64) {
 		query += fmt.Sprintf(` INCREMENT BY %d`, increment)
 	}
 	if restart != 0 {
-		query += fmt.Sprintf(` RESTART WITH %d`, restart)
+		query += fmt.Sprintf(` START WITH %d RESTART WITH %d`, restart, restart)
 	}
-	dbExecuteNoTx(query)
+	dbExecuteDDL(query)
 }
 
 // nextSequenceValue returns the next value of the given given sequence
@@ -274,14 +298,25 @@ FROM    recursive_query_children_ids`, d.quoteTableName(table), d.quoteTableName
 	return res
 }
 
-// substituteErrorMessage substitutes the given error's message by newMsg
-func (d *postgresAdapter) substituteErrorMessage(err error, newMsg string) error {
-	pgError, ok := err.(*pq.Error)
-	if !ok {
-		return err
-	}
-	pgError.Message = newMsg
-	return pgError
+// parentIdsQuery returns a query that finds all ancestors of the given
+// record from table including itself. The query has a placeholder for the
+// record's ID
+func (d *postgresAdapter) parentIdsQuery(table string) string {
+	res := fmt.Sprintf(`
+WITH RECURSIVE "recursive_query_parent_ids" AS
+(
+	SELECT  id, parent_id
+	FROM    %s "m1"
+	WHERE   id = ?
+UNION ALL
+	SELECT  "m2".id, "m2".parent_id
+	FROM    %s "m2"
+	JOIN    "recursive_query_parent_ids"
+	ON      "m2".id = "recursive_query_parent_ids".parent_id
+)
+SELECT  id
+FROM    recursive_query_parent_ids`, d.quoteTableName(table), d.quoteTableName(table))
+	return res
 }
 
 // isSerializationError returns true if the given error is a serialization error
@@ -293,4 +328,213 @@ func (d *postgresAdapter) isSerializationError(err error) bool {
 	return false
 }
 
+// idColumnSQLDefinition returns the SQL definition of the auto incremented
+// 'id' primary key column of each table
+func (d *postgresAdapter) idColumnSQLDefinition() string {
+	return "serial NOT NULL PRIMARY KEY"
+}
+
+// alterColumnTypeQuery returns the query to change the data type of the
+// given column.
+func (d *postgresAdapter) alterColumnTypeQuery(table, column, typ string) string {
+	return fmt.Sprintf(`
+		ALTER TABLE %s
+		ALTER COLUMN %s SET DATA TYPE %s
+	`, d.quoteTableName(table), column, typ)
+}
+
+// alterColumnNullQuery returns the query to set or drop the NOT NULL
+// constraint of the given column.
+func (d *postgresAdapter) alterColumnNullQuery(table, column string, notNull bool) string {
+	verb := "DROP"
+	if notNull {
+		verb = "SET"
+	}
+	return fmt.Sprintf(`
+		ALTER TABLE %s
+		ALTER COLUMN %s %s NOT NULL
+	`, d.quoteTableName(table), column, verb)
+}
+
+// addConstraintQuery returns the query to add the given constraint to the table
+func (d *postgresAdapter) addConstraintQuery(table, name, sql string) string {
+	return fmt.Sprintf(`
+		ALTER TABLE %s ADD CONSTRAINT %s %s
+	`, d.quoteTableName(table), name, sql)
+}
+
+// dropConstraintQuery returns the query to drop the given constraint
+func (d *postgresAdapter) dropConstraintQuery(table, name string) string {
+	return fmt.Sprintf(`
+		ALTER TABLE %s DROP CONSTRAINT IF EXISTS %s
+	`, d.quoteTableName(table), name)
+}
+
+// distinctOnIDQuery returns a query selecting the given fields from the given
+// tables, keeping only the first row of each id of table, as ordered by orderSQL.
+func (d *postgresAdapter) distinctOnIDQuery(table, fieldsSQL string, aliases []string, tablesSQL, whereSQL, orderSQL string) string {
+	if orderSQL != "" {
+		orderSQL = fmt.Sprintf(", %s", orderSQL)
+	}
+	return fmt.Sprintf(`SELECT DISTINCT ON (%s.id) %s FROM %s %s ORDER BY %s.id %s`,
+		table, fieldsSQL, tablesSQL, whereSQL, table, orderSQL)
+}
+
+// limitOffsetSQL returns the LIMIT/OFFSET clause for the given values.
+func (d *postgresAdapter) limitOffsetSQL(limit, offset int) string {
+	var res string
+	if limit > 0 {
+		res = fmt.Sprintf(`LIMIT %d `, limit)
+	}
+	if offset > 0 {
+		res += fmt.Sprintf(`OFFSET %d`, offset)
+	}
+	return res
+}
+
+// skipLockedSQL returns the clause to lock selected rows, skipping locked rows
+func (d *postgresAdapter) skipLockedSQL() string {
+	return "FOR UPDATE SKIP LOCKED"
+}
+
+// notifyQuery returns the query that sends a notification on a channel
+func (d *postgresAdapter) notifyQuery() string {
+	return "SELECT pg_notify(?, ?)"
+}
+
+// listen calls handler for each notification received on the given channel.
+//
+// The listener uses its own connection, which is reestablished automatically.
+// handler is called with an empty payload after a reconnection since
+// notifications sent in the meantime are lost.
+func (d *postgresAdapter) listen(channel string, handler func(payload string)) (func(), error) {
+	listener := pq.NewListener(dbConnectionString, 10*time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Warn("Database listener error", "channel", channel, "error", err)
+		}
+	})
+	if err := listener.Listen(channel); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case n, ok := <-listener.Notify:
+				if !ok {
+					return
+				}
+				if n == nil {
+					handler("")
+					continue
+				}
+				handler(n.Extra)
+			}
+		}
+	}()
+	stop := func() {
+		close(done)
+		listener.Close()
+	}
+	return stop, nil
+}
+
+// cursorQueries returns the queries to declare, fetch from and close a server-side cursor
+func (d *postgresAdapter) cursorQueries(name, query string, count int) (string, string, string) {
+	return fmt.Sprintf("DECLARE %s NO SCROLL CURSOR FOR %s", name, query),
+		fmt.Sprintf("FETCH FORWARD %d FROM %s", count, name),
+		fmt.Sprintf("CLOSE %s", name)
+}
+
+// maxQueryParams returns the maximum number of placeholders in a query
+func (d *postgresAdapter) maxQueryParams() int {
+	return 65535
+}
+
+// fullTextSearchSQL returns the SQL predicate matching the given field
+// expression with the search text given as placeholder, using the given
+// text search configuration.
+//
+// The tsvector expression is the same as in fullTextIndexQuery so that
+// full-text indexes are used.
+func (d *postgresAdapter) fullTextSearchSQL(field, lang string) string {
+	return fmt.Sprintf("to_tsvector('%s', %s) @@ plainto_tsquery('%s', ?)", lang, field, lang)
+}
+
+// fullTextRankSQL returns the SQL expression of the relevance of the given field
+// expression for the search text given as placeholder.
+func (d *postgresAdapter) fullTextRankSQL(field, lang string) string {
+	return fmt.Sprintf("ts_rank(to_tsvector('%s', %s), plainto_tsquery('%s', ?))", lang, field, lang)
+}
+
+// fullTextIndexQuery returns the query to create a GIN full-text index with the
+// given name on the given column.
+func (d *postgresAdapter) fullTextIndexQuery(name, table, column, lang string) string {
+	return fmt.Sprintf("CREATE INDEX %s ON %s USING GIN (to_tsvector('%s', %s))", name, d.quoteTableName(table), lang, column)
+}
+
+// jsonPathSQL returns the SQL expression of the value at the given path
+// inside the given JSON field expression, with the path given as placeholder.
+//
+// The value is extracted as text and cast to numeric or boolean if arg is
+// a number or a boolean so that it is compared with the right type.
+func (d *postgresAdapter) jsonPathSQL(field string, path []string, arg interface{}) (string, interface{}) {
+	elems := make([]string, len(path))
+	for i, p := range path {
+		elems[i] = fmt.Sprintf(`"%s"`, pgArrayEscaper.Replace(p))
+	}
+	res := fmt.Sprintf("(%s #>> ?::text[])", field)
+	val := reflect.ValueOf(arg)
+	if val.Kind() == reflect.Slice && val.Len() > 0 {
+		// IN or BETWEEN arguments
+		val = reflect.ValueOf(val.Index(0).Interface())
+	}
+	switch val.Kind() {
+	case reflect.Bool:
+		res += "::boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8,
+		reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Float32, reflect.Float64:
+		res += "::numeric"
+	}
+	return res, fmt.Sprintf("{%s}", strings.Join(elems, ","))
+}
+
+// dateTruncSQL returns the SQL expression of the start of the period of the
+// given granularity containing the given date expression. Datetimes are
+// converted to the tz timezone before being truncated.
+func (d *postgresAdapter) dateTruncSQL(field string, granularity DateGranularity, tz string) string {
+	if tz == "" {
+		return fmt.Sprintf("date_trunc('%s', %s::timestamp)::date", granularity, field)
+	}
+	return fmt.Sprintf("date_trunc('%s', %s AT TIME ZONE '%s')", granularity, field, strings.Replace(tz, "'", "''", -1))
+}
+
+// pgAggregateFunctions maps aggregate functions to their SQL expression
+var pgAggregateFunctions = map[string]string{
+	"sum":            "sum(%s)",
+	"count":          "count(%s)",
+	"count_distinct": "count(DISTINCT %s)",
+	"min":            "min(%s)",
+	"max":            "max(%s)",
+	"avg":            "avg(%s)",
+	"array_agg":      "array_to_json(array_agg(%s))",
+	"bool_and":       "bool_and(%s)",
+	"bool_or":        "bool_or(%s)",
+}
+
+// aggregateFunctionSQL returns the SQL expression of the given aggregate
+// function applied on the given field expression.
+//
+// Arrays are returned as JSON arrays.
+func (d *postgresAdapter) aggregateFunctionSQL(function string, field string) string {
+	sql, ok := pgAggregateFunctions[strings.ToLower(function)]
+	if !ok {
+		log.Panic("Unknown aggregate function", "function", function)
+	}
+	return fmt.Sprintf(sql, field)
+}
+
 var _ dbAdapter = new(postgresAdapter)
@@ -0,0 +1,670 @@
+// Copyright 2019 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package models
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hexya-erp/hexya/src/models/fieldtype"
+	"github.com/hexya-erp/hexya/src/models/operator"
+	"github.com/jmoiron/sqlx"
+)
+
+// sqliteSequencesTable is the name of the table in which sequences
+// are emulated, since SQLite has no native sequences.
+const sqliteSequencesTable = "hexya_sequences"
+
+// A sqliteAdapter is a dbAdapter for SQLite databases.
+//
+// No driver is imported by this package. Projects must import either
+// github.com/mattn/go-sqlite3 (driver name "sqlite3") or the pure Go
+// modernc.org/sqlite (driver name "sqlite"). The driver must bundle
+// SQLite 3.35 or later, for RETURNING clauses and window functions.
+//
+// The Regex and IRegex operators need a regexp(pattern, value) SQL function,
+// which is registered on each connection of drivers whose connections have
+// a RegisterFunc method, such as github.com/mattn/go-sqlite3. With
+// modernc.org/sqlite, it must be registered by the project with
+// sqlite.MustRegisterDeterministicScalarFunction.
+type sqliteAdapter struct {
+	// driver is the database/sql driver name this adapter is registered with.
+	driver string
+}
+
+var sqliteOperators = map[operator.Operator]string{
+	operator.Equals:         "= ?",
+	operator.NotEquals:      "!= ?",
+	operator.Contains:       "GLOB ?",
+	operator.NotContains:    "NOT GLOB ?",
+	operator.Like:           "GLOB ?",
+	operator.IContains:      "LIKE ? ESCAPE '\\'",
+	operator.NotIContains:   "NOT LIKE ? ESCAPE '\\'",
+	operator.ILike:          "LIKE ?",
+	operator.In:             "IN (?)",
+	operator.NotIn:          "NOT IN (?)",
+	operator.Lower:          "< ?",
+	operator.LowerOrEqual:   "<= ?",
+	operator.Greater:        "> ?",
+	operator.GreaterOrEqual: ">= ?",
+	operator.Between:        "BETWEEN ? AND ?",
+	operator.Regex:          "REGEXP ?",
+	operator.IRegex:         "REGEXP ?",
+	operator.Overlaps:       "IN (?)",
+}
+
+// sqliteTypes maps field types to SQLite column types. Declared types
+// are chosen so that drivers return the expected Go types (e.g. bool for
+// 'boolean' or time.Time for 'date' and 'datetime').
+var sqliteTypes = map[fieldtype.Type]string{
+	fieldtype.Boolean:   "boolean",
+	fieldtype.Char:      "varchar",
+	fieldtype.Text:      "text",
+	fieldtype.Date:      "date",
+	fieldtype.DateTime:  "datetime",
+	fieldtype.Integer:   "integer",
+	fieldtype.Float:     "real",
+	fieldtype.HTML:      "text",
+	fieldtype.Binary:    "blob",
+	fieldtype.Selection: "varchar",
+	fieldtype.Many2One:  "integer",
+	fieldtype.One2One:   "integer",
+	fieldtype.JSON:      "text",
+	fieldtype.UUID:      "text",
+}
+
+var (
+	// sqliteConstraintRegexp extracts constraint names from a CREATE TABLE statement
+	sqliteConstraintRegexp = regexp.MustCompile(`(?i)CONSTRAINT\s+(\w+)\s`)
+	// sqliteGlobEscaper escapes GLOB special characters
+	sqliteGlobEscaper = strings.NewReplacer("*", "[*]", "?", "[?]", "[", "[[]")
+	// sqliteLikeEscaper escapes LIKE special characters
+	sqliteLikeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+)
+
+// connectionString returns the connection string for the given parameters
+//
+// DBName is the path to the database file. Foreign keys are enabled and
+// transactions take the write lock at once to avoid deadlocks between writers.
+func (d *sqliteAdapter) connectionString(params ConnectionParams) string {
+	if d.driver == "sqlite" {
+		return fmt.Sprintf("file:%s?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_txlock=immediate", params.DBName)
+	}
+	return fmt.Sprintf("file:%s?_foreign_keys=1&_busy_timeout=5000&_txlock=immediate", params.DBName)
+}
+
+// connect opens a connection to the database with the given driver name
+// and connection string and checks that it is alive.
+//
+// The connections of the database are opened by a sqliteConnector so that
+// the regexp function is registered on each of them.
+func (d *sqliteAdapter) connect(driverName, connData string) *sqlx.DB {
+	sqlDB, err := sql.Open(driverName, connData)
+	if err != nil {
+		log.Panic("Unable to open database", "driver", driverName, "error", err)
+	}
+	connector := sqliteConnector{driver: sqlDB.Driver(), dsn: connData}
+	sqlDB.Close()
+	res := sqlx.NewDb(sql.OpenDB(connector), driverName)
+	if err := res.Ping(); err != nil {
+		log.Panic("Unable to connect to database", "driver", driverName, "error", err)
+	}
+	return res
+}
+
+// A sqliteFuncRegisterer is a SQLite connection on which Go functions
+// can be registered as SQL functions, such as those of github.com/mattn/go-sqlite3.
+type sqliteFuncRegisterer interface {
+	RegisterFunc(name string, impl interface{}, pure bool) error
+}
+
+// A sqliteConnector is a driver.Connector that opens connections with
+// the wrapped driver and registers the SQL functions needed by hexya on them.
+type sqliteConnector struct {
+	driver driver.Driver
+	dsn    string
+}
+
+// Connect returns a new connection to the database
+func (c sqliteConnector) Connect(context.Context) (driver.Conn, error) {
+	conn, err := c.driver.Open(c.dsn)
+	if err != nil {
+		return nil, err
+	}
+	if registerer, ok := conn.(sqliteFuncRegisterer); ok {
+		if err := registerer.RegisterFunc("regexp", sqliteRegexp, true); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// Driver returns the wrapped driver
+func (c sqliteConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+// sqliteRegexps caches the compiled patterns of sqliteRegexp
+var sqliteRegexps sync.Map
+
+// sqliteRegexp implements the regexp(pattern, value) SQL function called by
+// the REGEXP operator with Go regular expressions. NULL values never match.
+func sqliteRegexp(pattern string, value interface{}) (bool, error) {
+	var str string
+	switch val := value.(type) {
+	case nil:
+		return false, nil
+	case []byte:
+		if val == nil {
+			return false, nil
+		}
+		str = string(val)
+	case string:
+		str = val
+	default:
+		str = fmt.Sprint(val)
+	}
+	re, ok := sqliteRegexps.Load(pattern)
+	if !ok {
+		compiled, err := regexp.Compile(pattern)
+		if err != nil {
+			return false, err
+		}
+		re, _ = sqliteRegexps.LoadOrStore(pattern, compiled)
+	}
+	return re.(*regexp.Regexp).MatchString(str), nil
+}
+
+// operatorSQL returns the sql string and placeholders for the given DomainOperator
+// Also modifies the given args to match the syntax of the operator.
+//
+// Case sensitive operators are implemented with GLOB, since SQLite's LIKE is
+// case insensitive for ASCII characters.
+func (d *sqliteAdapter) operatorSQL(do operator.Operator, arg interface{}) (string, interface{}) {
+	op := sqliteOperators[do]
+	switch do {
+	case operator.Contains, operator.NotContains:
+		arg = fmt.Sprintf("*%s*", sqliteGlobEscaper.Replace(fmt.Sprintf("%s", arg)))
+	case operator.Like:
+		arg = sqliteLikeToGlob(fmt.Sprintf("%s", arg))
+	case operator.IContains, operator.NotIContains, operator.Search:
+		arg = fmt.Sprintf("%%%s%%", sqliteLikeEscaper.Replace(fmt.Sprintf("%s", arg)))
+	case operator.IRegex:
+		arg = fmt.Sprintf("(?i)%s", arg)
+	}
+	return op, arg
+}
+
+// sqliteLikeToGlob converts the given LIKE pattern to a GLOB pattern
+func sqliteLikeToGlob(pattern string) string {
+	var res strings.Builder
+	for _, r := range pattern {
+		switch r {
+		case '%':
+			res.WriteRune('*')
+		case '_':
+			res.WriteRune('?')
+		default:
+			res.WriteString(sqliteGlobEscaper.Replace(string(r)))
+		}
+	}
+	return res.String()
+}
+
+// typeSQL returns the sql type string for the given Field
+func (d *sqliteAdapter) typeSQL(fi *Field) string {
+	typ, _ := sqliteTypes[fi.fieldType]
+	return typ
+}
+
+// columnSQLDefinition returns the SQL type string, including columns constraints if any
+//
+// If null is true, then the column will be nullable, whatever the field defines.
+// Since null is only true when adding a column to an existing table, UNIQUE is
+// not set in this case as SQLite does not support it.
+func (d *sqliteAdapter) columnSQLDefinition(fi *Field, null bool) string {
+	var res string
+	typ, ok := sqliteTypes[fi.fieldType]
+	res = typ
+	if !ok {
+		log.Panic("Unknown column type", "type", fi.fieldType, "model", fi.model.name, "field", fi.name)
+	}
+	if fi.fieldType == fieldtype.Char && fi.size > 0 {
+		res = fmt.Sprintf("%s(%d)", res, fi.size)
+	}
+	if d.fieldIsNotNull(fi) && !null {
+		res += " NOT NULL"
+	}
+	if (fi.unique || fi.fieldType == fieldtype.One2One) && !null {
+		res += " UNIQUE"
+	}
+	// SQLite cannot add foreign keys to existing tables, so we declare them inline
+	if fi.fieldType.IsFKRelationType() && fi.relatedModel != nil {
+		res += fmt.Sprintf(" CONSTRAINT %s_%s_fkey REFERENCES %s ON DELETE %s",
+			fi.model.tableName, fi.json, d.quoteTableName(fi.relatedModel.tableName), fi.onDelete)
+	}
+	return res
+}
+
+// fieldIsNull returns true if the given Field results in a
+// NOT NULL column in database.
+func (d *sqliteAdapter) fieldIsNotNull(fi *Field) bool {
+	return fi.required
+}
+
+// tables returns a map of table names of the database
+func (d *sqliteAdapter) tables() map[string]bool {
+	var resList []string
+	query := fmt.Sprintf("SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%%' AND name != '%s'", sqliteSequencesTable)
+	if err := db.Select(&resList, query); err != nil {
+		log.Panic("Unable to get list of tables from database", "error", err)
+	}
+	res := make(map[string]bool, len(resList))
+	for _, tableName := range resList {
+		res[tableName] = true
+	}
+	return res
+}
+
+// quoteTableName returns the given table name with sql quotes
+func (d *sqliteAdapter) quoteTableName(tableName string) string {
+	return fmt.Sprintf(`"%s"`, tableName)
+}
+
+// columns returns a list of ColumnData for the given tableName
+//
+// DataType is the declared type of the column without size modifiers,
+// so that it can be compared with typeSQL.
+func (d *sqliteAdapter) columns(tableName string) map[string]ColumnData {
+	query := fmt.Sprintf(`
+		SELECT name AS column_name, lower(type) AS data_type,
+			CASE WHEN "notnull" = 0 THEN 'YES' ELSE 'NO' END AS is_nullable,
+			dflt_value AS column_default
+		FROM pragma_table_info('%s')
+	`, tableName)
+	var colData []ColumnData
+	if err := db.Select(&colData, query); err != nil {
+		log.Panic("Unable to get list of columns for table", "table", tableName, "error", err)
+	}
+	res := make(map[string]ColumnData, len(colData))
+	for _, col := range colData {
+		if i := strings.Index(col.DataType, "("); i >= 0 {
+			col.DataType = strings.TrimSpace(col.DataType[:i])
+		}
+		res[col.ColumnName] = col
+	}
+	return res
+}
+
+// indexExists returns true if an index with the given name exists in the given table
+func (d *sqliteAdapter) indexExists(table string, name string) bool {
+	query := fmt.Sprintf("SELECT COUNT(*) FROM sqlite_master WHERE type = 'index' AND tbl_name = '%s' AND name = '%s'", table, name)
+	var cnt int
+	dbGetNoTx(&cnt, query)
+	return cnt > 0
+}
+
+// indexes returns the names of the indexes of the given table
+func (d *sqliteAdapter) indexes(table string) []string {
+	var res []string
+	dbSelectNoTx(&res, "SELECT name FROM sqlite_master WHERE type = 'index' AND tbl_name = ?", table)
+	return res
+}
+
+// constraintExists returns true if a constraint with the given name exists.
+//
+// Constraints are either named constraints in table definitions
+// or unique indexes created by addConstraintQuery.
+func (d *sqliteAdapter) constraintExists(name string) bool {
+	for _, constraint := range d.constraints(name) {
+		if constraint == name {
+			return true
+		}
+	}
+	return false
+}
+
+// constraints returns a list of all constraints matching the given SQL pattern
+func (d *sqliteAdapter) constraints(pattern string) []string {
+	var res []string
+	dbSelectNoTx(&res, "SELECT name FROM sqlite_master WHERE type = 'index' AND name LIKE ?", pattern)
+	var tableDefs []string
+	dbSelectNoTx(&tableDefs, "SELECT sql FROM sqlite_master WHERE type = 'table' AND sql IS NOT NULL")
+	patternRegexp := regexp.MustCompile(fmt.Sprintf("(?i)^%s$",
+		strings.NewReplacer("%", ".*", "_", ".").Replace(regexp.QuoteMeta(pattern))))
+	for _, tableDef := range tableDefs {
+		for _, match := range sqliteConstraintRegexp.FindAllStringSubmatch(tableDef, -1) {
+			if patternRegexp.MatchString(match[1]) {
+				res = append(res, match[1])
+			}
+		}
+	}
+	return res
+}
+
+// createSequence creates a DB sequence with the given name
+func (d *sqliteAdapter) createSequence(name string, increment, start int64) {
+	dbExecuteDDL(fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s (
+			sequence_name varchar NOT NULL PRIMARY KEY,
+			start_value integer NOT NULL,
+			increment integer NOT NULL,
+			last_value integer NOT NULL
+		)`, sqliteSequencesTable))
+	query := fmt.Sprintf("INSERT INTO %s (sequence_name, start_value, increment, last_value) VALUES (?, ?, ?, ?)", sqliteSequencesTable)
+	dbExecuteDDL(query, name, start, increment, start-increment)
+}
+
+// dropSequence drops the DB sequence with the given name
+func (d *sqliteAdapter) dropSequence(name string) {
+	if !d.sequencesTableExists() {
+		return
+	}
+	query := fmt.Sprintf("DELETE FROM %s WHERE sequence_name = ?", sqliteSequencesTable)
+	dbExecuteDDL(query, name)
+}
+
+// alterSequence modifies the DB sequence given by name
+func (d *sqliteAdapter) alterSequence(name string, increment, restart int64) {
+	if increment != 0 {
+		query := fmt.Sprintf("UPDATE %s SET increment = ? WHERE sequence_name = ?", sqliteSequencesTable)
+		dbExecuteDDL(query, increment, name)
+	}
+	if restart != 0 {
+		query := fmt.Sprintf("UPDATE %s SET start_value = ?, last_value = ? - increment WHERE sequence_name = ?", sqliteSequencesTable)
+		dbExecuteDDL(query, restart, restart, name)
+	}
+}
+
+// nextSequenceValue returns the next value of the given given sequence
+func (d *sqliteAdapter) nextSequenceValue(name string) int64 {
+	query := fmt.Sprintf("UPDATE %s SET last_value = last_value + increment WHERE sequence_name = ? RETURNING last_value", sqliteSequencesTable)
+	var val int64
+	dbGetNoTx(&val, query, name)
+	return val
+}
+
+// sequences returns a list of all sequences matching the given SQL pattern
+func (d *sqliteAdapter) sequences(pattern string) []seqData {
+	var res []seqData
+	if !d.sequencesTableExists() {
+		return res
+	}
+	query := fmt.Sprintf("SELECT sequence_name, start_value, increment FROM %s WHERE sequence_name LIKE ?", sqliteSequencesTable)
+	dbSelectNoTx(&res, query, pattern)
+	return res
+}
+
+// sequencesTableExists returns true if the table emulating sequences exists
+func (d *sqliteAdapter) sequencesTableExists() bool {
+	var cnt int
+	dbGetNoTx(&cnt, "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?", sqliteSequencesTable)
+	return cnt > 0
+}
+
+// setTransactionIsolation returns the SQL string to set the
+// transaction isolation level to serializable
+//
+// SQLite transactions are always serializable, unless reading
+// uncommitted data is allowed in shared cache mode.
+func (d *sqliteAdapter) setTransactionIsolation() string {
+	return "PRAGMA read_uncommitted = 0"
+}
+
+// childrenIdsQuery returns a query that finds all descendant of the given
+// a record from table including itself. The query has a placeholder for the
+// record's ID
+func (d *sqliteAdapter) childrenIdsQuery(table string) string {
+	res := fmt.Sprintf(`
+WITH RECURSIVE "recursive_query_children_ids" AS
+(
+	SELECT  id
+	FROM    %s "m1"
+	WHERE   id = ?
+UNION ALL
+	SELECT  "m2".id
+	FROM    %s "m2"
+	JOIN    "recursive_query_children_ids"
+	ON      "m2".parent_id = "recursive_query_children_ids".id
+)
+SELECT  id
+FROM    recursive_query_children_ids`, d.quoteTableName(table), d.quoteTableName(table))
+	return res
+}
+
+// parentIdsQuery returns a query that finds all ancestors of the given
+// record from table including itself. The query has a placeholder for the
+// record's ID
+func (d *sqliteAdapter) parentIdsQuery(table string) string {
+	res := fmt.Sprintf(`
+WITH RECURSIVE "recursive_query_parent_ids" AS
+(
+	SELECT  id, parent_id
+	FROM    %s "m1"
+	WHERE   id = ?
+UNION ALL
+	SELECT  "m2".id, "m2".parent_id
+	FROM    %s "m2"
+	JOIN    "recursive_query_parent_ids"
+	ON      "m2".id = "recursive_query_parent_ids".parent_id
+)
+SELECT  id
+FROM    recursive_query_parent_ids`, d.quoteTableName(table), d.quoteTableName(table))
+	return res
+}
+
+// isSerializationError returns true if the given error is a serialization error
+// and that the failed transaction should be retried.
+//
+// With SQLite, this happens when the database is locked by another writer
+// for longer than the busy timeout.
+func (d *sqliteAdapter) isSerializationError(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "database is locked") ||
+		strings.Contains(msg, "database table is locked") ||
+		strings.Contains(msg, "SQLITE_BUSY")
+}
+
+// idColumnSQLDefinition returns the SQL definition of the auto incremented
+// 'id' primary key column of each table
+func (d *sqliteAdapter) idColumnSQLDefinition() string {
+	return "integer NOT NULL PRIMARY KEY AUTOINCREMENT"
+}
+
+// alterColumnTypeQuery returns an empty string since SQLite
+// cannot change the type of a column without rebuilding its table.
+func (d *sqliteAdapter) alterColumnTypeQuery(table, column, typ string) string {
+	return ""
+}
+
+// alterColumnNullQuery returns an empty string since SQLite
+// cannot change the NOT NULL constraint of an existing column.
+func (d *sqliteAdapter) alterColumnNullQuery(table, column string, notNull bool) string {
+	return ""
+}
+
+// addConstraintQuery returns the query to add the given constraint to the table.
+//
+// SQLite cannot add constraints to an existing table. UNIQUE constraints are
+// emulated with a unique index and other constraints are not supported.
+func (d *sqliteAdapter) addConstraintQuery(table, name, sql string) string {
+	sql = strings.TrimSpace(sql)
+	if !strings.HasPrefix(strings.ToUpper(sql), "UNIQUE") {
+		return ""
+	}
+	return fmt.Sprintf(`
+		CREATE UNIQUE INDEX %s ON %s %s
+	`, name, d.quoteTableName(table), strings.TrimSpace(sql[len("UNIQUE"):]))
+}
+
+// dropConstraintQuery returns the query to drop the given constraint.
+//
+// Only constraints emulated by an index can be dropped.
+func (d *sqliteAdapter) dropConstraintQuery(table, name string) string {
+	if !d.indexExists(table, name) {
+		return ""
+	}
+	return fmt.Sprintf(`
+		DROP INDEX IF EXISTS %s
+	`, name)
+}
+
+// distinctOnIDQuery returns a query selecting the given fields from the given
+// tables, keeping only the first row of each id of table, as ordered by orderSQL.
+//
+// SQLite has no DISTINCT ON, so that rows are numbered with a window function.
+func (d *sqliteAdapter) distinctOnIDQuery(table, fieldsSQL string, aliases []string, tablesSQL, whereSQL, orderSQL string) string {
+	if orderSQL != "" {
+		orderSQL = fmt.Sprintf("ORDER BY %s", orderSQL)
+	}
+	return fmt.Sprintf(`SELECT %s FROM (SELECT %s, ROW_NUMBER() OVER (PARTITION BY %s.id %s) AS hexya_row_number FROM %s %s) hexya_distinct WHERE hexya_row_number = 1`,
+		strings.Join(aliases, ", "), fieldsSQL, table, orderSQL, tablesSQL, whereSQL)
+}
+
+// limitOffsetSQL returns the LIMIT/OFFSET clause for the given values.
+//
+// SQLite requires a LIMIT clause before OFFSET, -1 meaning no limit.
+func (d *sqliteAdapter) limitOffsetSQL(limit, offset int) string {
+	switch {
+	case limit > 0 && offset > 0:
+		return fmt.Sprintf(`LIMIT %d OFFSET %d`, limit, offset)
+	case limit > 0:
+		return fmt.Sprintf(`LIMIT %d `, limit)
+	case offset > 0:
+		return fmt.Sprintf(`LIMIT -1 OFFSET %d`, offset)
+	}
+	return ""
+}
+
+// skipLockedSQL returns the clause to lock selected rows, skipping locked rows.
+//
+// SQLite has no row locks since writing transactions lock the whole database.
+func (d *sqliteAdapter) skipLockedSQL() string {
+	return ""
+}
+
+// notifyQuery returns an empty string since SQLite has no notifications
+func (d *sqliteAdapter) notifyQuery() string {
+	return ""
+}
+
+// listen does nothing since SQLite has no notifications.
+//
+// SQLite databases are local, so that they are not shared between servers.
+func (d *sqliteAdapter) listen(channel string, handler func(payload string)) (func(), error) {
+	return func() {}, nil
+}
+
+// cursorQueries returns empty strings since SQLite has no server-side cursors.
+//
+// SQLite can execute queries while the rows of another query are being read.
+func (d *sqliteAdapter) cursorQueries(name, query string, count int) (string, string, string) {
+	return "", "", ""
+}
+
+// maxQueryParams returns the maximum number of placeholders in a query,
+// which is the default SQLITE_MAX_VARIABLE_NUMBER since SQLite 3.32.
+func (d *sqliteAdapter) maxQueryParams() int {
+	return 32766
+}
+
+// fullTextSearchSQL returns the SQL predicate matching the given field
+// expression with the search text given as placeholder.
+//
+// SQLite has no built-in full-text search on regular tables, so the field is
+// matched case insensitively with the whole search text. lang is ignored.
+func (d *sqliteAdapter) fullTextSearchSQL(field, lang string) string {
+	return fmt.Sprintf("%s LIKE ? ESCAPE '\\'", field)
+}
+
+// fullTextRankSQL returns 1 if the given field expression contains the search
+// text given as placeholder and 0 otherwise.
+func (d *sqliteAdapter) fullTextRankSQL(field, lang string) string {
+	return fmt.Sprintf("(instr(lower(%s), lower(?)) > 0)", field)
+}
+
+// fullTextIndexQuery returns an empty string since SQLite has no full-text
+// indexes on regular tables.
+func (d *sqliteAdapter) fullTextIndexQuery(name, table, column, lang string) string {
+	return ""
+}
+
+// jsonPathSQL returns the SQL expression of the value at the given path
+// inside the given JSON field expression, with the path given as placeholder.
+//
+// json_extract returns SQL values of the JSON type of the value, so that arg
+// is not needed.
+func (d *sqliteAdapter) jsonPathSQL(field string, path []string, arg interface{}) (string, interface{}) {
+	var res strings.Builder
+	res.WriteString("$")
+	for _, p := range path {
+		if _, err := strconv.Atoi(p); err == nil {
+			fmt.Fprintf(&res, "[%s]", p)
+			continue
+		}
+		fmt.Fprintf(&res, `."%s"`, p)
+	}
+	return fmt.Sprintf("json_extract(%s, ?)", field), res.String()
+}
+
+// dateTruncSQL returns the SQL expression of the start of the period of the
+// given granularity containing the given date expression.
+//
+// Since SQLite has no timezone support, datetimes are shifted by the current
+// offset of the tz timezone, regardless of daylight saving time.
+func (d *sqliteAdapter) dateTruncSQL(field string, granularity DateGranularity, tz string) string {
+	if tz != "" {
+		if loc, err := time.LoadLocation(tz); err == nil {
+			_, offset := time.Now().In(loc).Zone()
+			field = fmt.Sprintf("%s, '%+d minutes'", field, offset/60)
+		}
+	}
+	switch granularity {
+	case GranularityWeek:
+		return fmt.Sprintf("date(%s, 'weekday 0', '-6 days')", field)
+	case GranularityMonth:
+		return fmt.Sprintf("date(%s, 'start of month')", field)
+	case GranularityQuarter:
+		return fmt.Sprintf("date(%s, 'start of month', '-' || ((CAST(strftime('%%m', %s) AS INTEGER) - 1) %% 3) || ' months')",
+			field, field)
+	case GranularityYear:
+		return fmt.Sprintf("date(%s, 'start of year')", field)
+	}
+	return fmt.Sprintf("date(%s)", field)
+}
+
+// sqliteAggregateFunctions maps aggregate functions to their SQL expression
+var sqliteAggregateFunctions = map[string]string{
+	"sum":            "sum(%s)",
+	"count":          "count(%s)",
+	"count_distinct": "count(DISTINCT %s)",
+	"min":            "min(%s)",
+	"max":            "max(%s)",
+	"avg":            "avg(%s)",
+	"array_agg":      "json_group_array(%s)",
+	"bool_and":       "min(%s)",
+	"bool_or":        "max(%s)",
+}
+
+// aggregateFunctionSQL returns the SQL expression of the given aggregate
+// function applied on the given field expression.
+//
+// Arrays are returned as JSON arrays and booleans as integers.
+func (d *sqliteAdapter) aggregateFunctionSQL(function string, field string) string {
+	sql, ok := sqliteAggregateFunctions[strings.ToLower(function)]
+	if !ok {
+		log.Panic("Unknown aggregate function", "function", function)
+	}
+	return fmt.Sprintf(sql, field)
+}
+
+var _ dbAdapter = new(sqliteAdapter)
@@ -45,6 +45,9 @@ type Environment struct {
 	previousMethod *Method
 	recursions     uint8
 	nextNegativeID int64
+	changes        *changeEvents
+	sharedCacheTx  *sharedCacheTx
+	bypassACL      bool
 }
 
 // Cr returns a pointer to the Cursor of the Environment
@@ -67,8 +70,8 @@ func (env Environment) Context() *types.Context {
 // WARNING: Do NOT call Commit on Environment instances that you
 // did not create yourself with NewEnvironment. The framework will
 // automatically commit the Environment.
-func (env Environment) commit() {
-	env.Cr().tx.Commit()
+func (env Environment) commit() error {
+	return env.Cr().tx.Commit()
 }
 
 // rollback the transaction of this environment.
@@ -122,10 +125,12 @@ func (env Environment) DumpCache() string {
 // the database connection.
 func newEnvironment(uid int64) Environment {
 	env := Environment{
-		cr:      newCursor(db),
-		uid:     uid,
-		context: types.NewContext(),
-		cache:   newCache(),
+		cr:            newCursor(db),
+		uid:           uid,
+		context:       types.NewContext(),
+		cache:         newCache(),
+		changes:       new(changeEvents),
+		sharedCacheTx: newSharedCacheTx(),
 	}
 	return env
 }
@@ -137,6 +142,9 @@ func newEnvironment(uid int64) Environment {
 // rolls it back otherwise, returning an arror. Database serialization
 // errors are automatically retried several times before returning an
 // error if they still occur.
+//
+// Change events of the transaction are dispatched to subscribers after
+// the transaction has been committed.
 func ExecuteInNewEnvironment(uid int64, fnct func(Environment)) error {
 	return doExecuteInNewEnvironment(uid, 0, fnct)
 }
@@ -159,9 +167,16 @@ func doExecuteInNewEnvironment(uid int64, retries uint8, fnct func(Environment))
 			rError = logging.LogPanicData(r)
 			return
 		}
-		env.commit()
+		if err := env.commit(); err != nil {
+			log.Warn("Unable to commit transaction", "error", err)
+			rError = err
+			return
+		}
+		env.applySharedCacheInvalidations()
+		env.dispatchChangeEvents()
 	}()
 	fnct(env)
+	env.notifySharedCacheInvalidations()
 	return nil
 }
 
@@ -0,0 +1,412 @@
+// Copyright 2019 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hexya-erp/hexya/src/models/security"
+	"github.com/hexya-erp/hexya/src/models/types/dates"
+)
+
+const (
+	// outboxModelName is the name of the model storing the change events to deliver to sinks
+	outboxModelName = "HexyaEventOutbox"
+	// outboxBatchSize is the maximum number of events delivered by a single DrainOutbox call
+	outboxBatchSize = 100
+	// outboxClaimTimeout is the time after which events claimed by a DrainOutbox call
+	// that did not release them are considered abandoned and can be claimed again.
+	outboxClaimTimeout = 10 * time.Minute
+	// webhookTimeout is the timeout of the requests of WebhookSinks without Client.
+	// It is short enough for a whole batch to be delivered before its claim expires.
+	webhookTimeout = outboxClaimTimeout / (2 * outboxBatchSize)
+)
+
+// webhookClient is the HTTP client of WebhookSinks without Client
+var webhookClient = &http.Client{Timeout: webhookTimeout}
+
+// An EventOperation is the type of change that triggered a ChangeEvent
+type EventOperation string
+
+// Operations of change events
+const (
+	EventCreate EventOperation = "create"
+	EventWrite  EventOperation = "write"
+	EventUnlink EventOperation = "unlink"
+)
+
+// A ChangeEvent describes a change of records of a model
+// in a committed transaction.
+//
+// Fields holds the JSON names of the changed fields. It is empty for EventUnlink events.
+type ChangeEvent struct {
+	Model     string         `json:"model"`
+	IDs       []int64        `json:"ids"`
+	Fields    []string       `json:"fields"`
+	Operation EventOperation `json:"operation"`
+	UID       int64          `json:"uid"`
+	Date      dates.DateTime `json:"date"`
+}
+
+// A ChangeEventHandler is a function called for each ChangeEvent
+// after the transaction of the change has been committed.
+type ChangeEventHandler func(event ChangeEvent)
+
+// An EventSink is a destination of the change events stored in the outbox.
+type EventSink interface {
+	// Send delivers the given event. The event will be sent again
+	// at the next outbox draining if an error is returned.
+	Send(event ChangeEvent) error
+}
+
+// changeEventsRegistry holds the change event subscribers and sinks.
+type changeEventsRegistry struct {
+	sync.RWMutex
+	handlers map[string]ChangeEventHandler
+	sinks    map[string]EventSink
+	outbox   bool
+}
+
+// eventsRegistry is the registry of change event subscribers and sinks
+var eventsRegistry = &changeEventsRegistry{
+	handlers: make(map[string]ChangeEventHandler),
+	sinks:    make(map[string]EventSink),
+}
+
+// enabled returns true if change events must be collected.
+func (cer *changeEventsRegistry) enabled() bool {
+	cer.RLock()
+	defer cer.RUnlock()
+	return cer.outbox || len(cer.handlers) > 0
+}
+
+// SubscribeChangeEvents registers the given handler under the given name
+// so that it is called for each change event once the transaction of the
+// change has been committed. Handlers are not called if the transaction is
+// rolled back or executed with SimulateInNewEnvironment.
+//
+// Handlers are called synchronously in the goroutine that committed the
+// transaction. A handler with the same name is replaced.
+func SubscribeChangeEvents(name string, handler ChangeEventHandler) {
+	eventsRegistry.Lock()
+	defer eventsRegistry.Unlock()
+	eventsRegistry.handlers[name] = handler
+}
+
+// UnsubscribeChangeEvents removes the change event handler with the given name.
+func UnsubscribeChangeEvents(name string) {
+	eventsRegistry.Lock()
+	defer eventsRegistry.Unlock()
+	delete(eventsRegistry.handlers, name)
+}
+
+// RegisterEventSink registers the given EventSink under the given name.
+// Events stored in the outbox are sent to all registered sinks.
+func RegisterEventSink(name string, sink EventSink) {
+	eventsRegistry.Lock()
+	defer eventsRegistry.Unlock()
+	eventsRegistry.sinks[name] = sink
+}
+
+// UnregisterEventSink removes the EventSink with the given name.
+func UnregisterEventSink(name string) {
+	eventsRegistry.Lock()
+	defer eventsRegistry.Unlock()
+	delete(eventsRegistry.sinks, name)
+}
+
+// EnableOutbox persists the change events in an outbox table in the transaction
+// of the change. If period is not zero, a worker function draining the outbox
+// to the registered sinks every period is registered.
+//
+// This function must be called before RunWorkerLoop.
+func EnableOutbox(period time.Duration) {
+	eventsRegistry.Lock()
+	eventsRegistry.outbox = true
+	eventsRegistry.Unlock()
+	if period == 0 {
+		return
+	}
+	RegisterWorker(NewWorkerFunction(func() {
+		if err := DrainOutbox(); err != nil {
+			log.Warn("Error while draining event outbox", "error", err)
+		}
+	}, period))
+}
+
+// DisableOutbox stops persisting change events in the outbox table.
+// Events already in the outbox are still delivered by DrainOutbox.
+func DisableOutbox() {
+	eventsRegistry.Lock()
+	defer eventsRegistry.Unlock()
+	eventsRegistry.outbox = false
+}
+
+// changeEvents holds the change events of a transaction until it is committed.
+type changeEvents struct {
+	events []ChangeEvent
+}
+
+// declareOutboxModel creates the system model that stores the change events to deliver
+func declareOutboxModel() {
+	model := createModel(outboxModelName, SystemModel)
+	model.AddFields(map[string]FieldDefinition{
+		"ResModel":  CharField{Required: true},
+		"Records":   TextField{Required: true},
+		"Fields":    TextField{},
+		"Operation": CharField{Required: true},
+		"UID":       IntegerField{},
+		"Date":      DateTimeField{Required: true},
+		"ClaimedAt": DateTimeField{},
+	})
+	model.InheritModel(Registry.MustGet("CommonMixin"))
+	model.restrictToAdmins()
+}
+
+// addChangeEvent records a change event for the records of this RecordCollection with
+// the given ids. It is sent to subscribers when the transaction is committed.
+func (rc *RecordCollection) addChangeEvent(op EventOperation, ids []int64, fMap FieldMap) {
+	if rc.model.isSystem() || len(ids) == 0 || !eventsRegistry.enabled() {
+		return
+	}
+	event := ChangeEvent{
+		Model:     rc.model.name,
+		IDs:       append([]int64(nil), ids...),
+		Fields:    fMap.OrderedKeys(),
+		Operation: op,
+		UID:       rc.env.uid,
+		Date:      dates.Now(),
+	}
+	rc.env.changes.events = append(rc.env.changes.events, event)
+	eventsRegistry.RLock()
+	outbox := eventsRegistry.outbox
+	eventsRegistry.RUnlock()
+	if outbox {
+		rc.env.cr.writeOutboxEvent(event)
+	}
+}
+
+// writeOutboxEvent inserts the given event in the outbox table in this cursor's transaction
+func (c *Cursor) writeOutboxEvent(event ChangeEvent) {
+	records, _ := json.Marshal(event.IDs)
+	fields, _ := json.Marshal(event.Fields)
+	adapter := adapters[db.DriverName()]
+	query := fmt.Sprintf(`INSERT INTO %s (res_model, records, fields, operation, uid, date) VALUES (?, ?, ?, ?, ?, ?)`,
+		adapter.quoteTableName(Registry.MustGet(outboxModelName).tableName))
+	c.Execute(query, event.Model, string(records), string(fields), string(event.Operation), event.UID, event.Date)
+}
+
+// dispatchChangeEvents calls the change event handlers for each event of this
+// Environment. It must be called after the transaction has been committed.
+func (env Environment) dispatchChangeEvents() {
+	if env.changes == nil || len(env.changes.events) == 0 {
+		return
+	}
+	eventsRegistry.RLock()
+	names := make([]string, 0, len(eventsRegistry.handlers))
+	for name := range eventsRegistry.handlers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	handlers := make([]ChangeEventHandler, len(names))
+	for i, name := range names {
+		handlers[i] = eventsRegistry.handlers[name]
+	}
+	eventsRegistry.RUnlock()
+	for _, event := range env.changes.events {
+		for i, handler := range handlers {
+			callChangeEventHandler(names[i], handler, event)
+		}
+	}
+	env.changes.events = nil
+}
+
+// callChangeEventHandler calls the given handler with the given event.
+// Panics are logged, since the transaction has already been committed.
+func callChangeEventHandler(name string, handler ChangeEventHandler, event ChangeEvent) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Warn("Change event handler panicked", "handler", name, "model", event.Model, "error", r)
+		}
+	}()
+	handler(event)
+}
+
+// DrainOutbox sends the events stored in the outbox to all registered sinks in
+// order and removes them from the outbox. It stops at the first event that a sink
+// failed to deliver, which will be sent again to all sinks at the next call.
+//
+// Events are claimed in a short transaction before being sent, so that concurrent
+// calls do not deliver the same events, and are sent outside of any transaction.
+func DrainOutbox() error {
+	eventsRegistry.RLock()
+	sinkNames := make([]string, 0, len(eventsRegistry.sinks))
+	for name := range eventsRegistry.sinks {
+		sinkNames = append(sinkNames, name)
+	}
+	sort.Strings(sinkNames)
+	sinks := make([]EventSink, len(sinkNames))
+	for i, name := range sinkNames {
+		sinks[i] = eventsRegistry.sinks[name]
+	}
+	eventsRegistry.RUnlock()
+	if len(sinks) == 0 {
+		return nil
+	}
+	rows, err := claimOutboxEvents()
+	if err != nil || len(rows) == 0 {
+		return err
+	}
+	var (
+		sendErr   error
+		delivered []int64
+	)
+	for _, row := range rows {
+		event := ChangeEvent{
+			Model:     row.ResModel,
+			Operation: EventOperation(row.Operation),
+			UID:       row.UID,
+			Date:      row.Date,
+		}
+		json.Unmarshal([]byte(row.Records), &event.IDs)
+		json.Unmarshal([]byte(row.Fields), &event.Fields)
+		for i, sink := range sinks {
+			if err := sink.Send(event); err != nil {
+				sendErr = fmt.Errorf("sink %s failed to send event %d: %s", sinkNames[i], row.ID, err)
+				break
+			}
+		}
+		if sendErr != nil {
+			break
+		}
+		delivered = append(delivered, row.ID)
+	}
+	var released []int64
+	for _, row := range rows[len(delivered):] {
+		released = append(released, row.ID)
+	}
+	err = ExecuteInNewEnvironment(security.SuperUserID, func(env Environment) {
+		table := adapters[db.DriverName()].quoteTableName(Registry.MustGet(outboxModelName).tableName)
+		if len(delivered) > 0 {
+			env.cr.Execute(fmt.Sprintf("DELETE FROM %s WHERE id IN (?)", table), delivered)
+		}
+		if len(released) > 0 {
+			env.cr.Execute(fmt.Sprintf("UPDATE %s SET claimed_at = NULL WHERE id IN (?)", table), released)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sendErr
+}
+
+// An outboxRow is a change event as stored in the outbox
+type outboxRow struct {
+	ID        int64
+	ResModel  string
+	Records   string
+	Fields    string
+	Operation string
+	UID       int64
+	Date      dates.DateTime
+}
+
+// claimOutboxEvents returns the next batch of events of the outbox that are not
+// claimed by another DrainOutbox call and marks them as claimed.
+func claimOutboxEvents() ([]outboxRow, error) {
+	var rows []outboxRow
+	err := ExecuteInNewEnvironment(security.SuperUserID, func(env Environment) {
+		adapter := adapters[db.DriverName()]
+		table := adapter.quoteTableName(Registry.MustGet(outboxModelName).tableName)
+		now := dates.Now()
+		env.cr.Select(&rows, fmt.Sprintf(`SELECT id, res_model, records, fields, operation, uid, date
+			FROM %s WHERE claimed_at IS NULL OR claimed_at < ? ORDER BY id %s %s`,
+			table, adapter.limitOffsetSQL(outboxBatchSize, 0), adapter.skipLockedSQL()), now.Add(-outboxClaimTimeout))
+		if len(rows) == 0 {
+			return
+		}
+		ids := make([]int64, len(rows))
+		for i, row := range rows {
+			ids[i] = row.ID
+		}
+		env.cr.Execute(fmt.Sprintf("UPDATE %s SET claimed_at = ? WHERE id IN (?)", table), now, ids)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+// A ChannelSink is an EventSink that sends change events to a Go channel.
+// Sending blocks until the event is received.
+type ChannelSink chan<- ChangeEvent
+
+// Send the given event to the channel
+func (cs ChannelSink) Send(event ChangeEvent) error {
+	cs <- event
+	return nil
+}
+
+// A FileSink is an EventSink that appends change events as JSON lines to a file.
+type FileSink struct {
+	sync.Mutex
+	FileName string
+}
+
+// Send appends the given event to the file
+func (fs *FileSink) Send(event ChangeEvent) error {
+	fs.Lock()
+	defer fs.Unlock()
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(fs.FileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// A WebhookSink is an EventSink that posts change events as JSON to a URL.
+// Any response status other than 2xx is considered as a delivery failure.
+//
+// If Client is nil, requests time out after 3 seconds. A custom Client should
+// also have a timeout, so that a batch of events is delivered before its claim expires.
+type WebhookSink struct {
+	URL    string
+	Client *http.Client
+}
+
+// Send posts the given event to the webhook URL
+func (ws *WebhookSink) Send(event ChangeEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	client := ws.Client
+	if client == nil {
+		client = webhookClient
+	}
+	resp, err := client.Post(ws.URL, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook %s returned status %s", ws.URL, resp.Status)
+	}
+	return nil
+}
@@ -22,6 +22,7 @@ import (
 	"sync"
 
 	"github.com/hexya-erp/hexya/src/models/fieldtype"
+	"github.com/hexya-erp/hexya/src/models/security"
 	"github.com/hexya-erp/hexya/src/models/types"
 	"github.com/hexya-erp/hexya/src/tools/nbutils"
 	"github.com/hexya-erp/hexya/src/tools/strutils"
@@ -235,7 +236,10 @@ type Field struct {
 	filter           *Condition
 	contexts         FieldContexts
 	ctxType          ctxType
+	groups           map[*security.Group]bool
+	fullTextLang     string
 	updates          []map[string]interface{}
+	pkgPath          string
 }
 
 // isComputedField returns true if this field is computed
@@ -292,6 +296,31 @@ func (f *Field) isReadOnly() bool {
 	return false
 }
 
+// isAccessibleBy returns true if the user with the given uid can read and
+// write this field, that is if this field is not restricted to groups or
+// if the user belongs to one of them. Members of the admin group can
+// access all fields.
+func (f *Field) isAccessibleBy(uid int64) bool {
+	if len(f.groups) == 0 || uid == security.SuperUserID {
+		return true
+	}
+	for group := range security.Registry.UserGroups(uid) {
+		if group == security.GroupAdmin || f.groups[group] {
+			return true
+		}
+	}
+	return false
+}
+
+// textSearchConfig returns the text search configuration used
+// to search this field with the full-text search operator.
+func (f *Field) textSearchConfig() string {
+	if f.fullTextLang == "" {
+		return "simple"
+	}
+	return f.fullTextLang
+}
+
 // isContextedField returns true if the value of this field depends on contexts
 func (f *Field) isContextedField() bool {
 	if f.contexts != nil && len(f.contexts) > 0 {
@@ -377,6 +406,7 @@ func createM2MRelModelInfo(relModelName, model1, model2, field1, field2 string,
 		options:         Many2ManyLinkModel | SystemModel,
 		sqlErrors:       make(map[string]string),
 		defaultOrderStr: []string{"ID"},
+		pkgPath:         declaringPackage(),
 	}
 	if mixin {
 		newMI.options |= MixinModel
@@ -427,6 +457,7 @@ func createContextsModel(fi *Field, contexts FieldContexts) *Model {
 	newModel := Model{
 		name:            name,
 		rulesRegistry:   newRecordRuleRegistry(),
+		aclRegistry:     newAccessControlRegistry(),
 		tableName:       strutils.SnakeCase(name),
 		fields:          newFieldsCollection(),
 		methods:         newMethodsCollection(),
@@ -9,6 +9,7 @@ import (
 	"sort"
 
 	"github.com/hexya-erp/hexya/src/models/fieldtype"
+	"github.com/hexya-erp/hexya/src/models/security"
 	"github.com/hexya-erp/hexya/src/models/types"
 	"github.com/hexya-erp/hexya/src/models/types/dates"
 	"github.com/hexya-erp/hexya/src/tools/nbutils"
@@ -167,7 +168,7 @@ type DateField struct {
 // DeclareField creates a date field for the given FieldsCollection with the given name.
 func (df DateField) DeclareField(fc *FieldsCollection, name string) *Field {
 	fInfo := genericDeclareField(fc, &df, name, fieldtype.Date, new(dates.Date))
-	fInfo.groupOperator = strutils.GetDefaultString(df.GroupOperator, "sum")
+	fInfo.groupOperator = df.GroupOperator
 	return fInfo
 }
 
@@ -204,7 +205,7 @@ type DateTimeField struct {
 // DeclareField creates a datetime field for the given FieldsCollection with the given name.
 func (df DateTimeField) DeclareField(fc *FieldsCollection, name string) *Field {
 	fInfo := genericDeclareField(fc, &df, name, fieldtype.DateTime, new(dates.DateTime))
-	fInfo.groupOperator = strutils.GetDefaultString(df.GroupOperator, "sum")
+	fInfo.groupOperator = df.GroupOperator
 	return fInfo
 }
 
@@ -812,11 +813,13 @@ func getFuncNames(compute, inverse, onchange, onchangeWarning, onchangeFilters,
 
 // AddFields adds the given fields to the model.
 func (m *Model) AddFields(fields map[string]FieldDefinition) {
+	pkgPath := declaringPackage()
 	for name, field := range fields {
 		newField := field.DeclareField(m.fields, name)
 		if _, exists := m.fields.Get(name); exists {
 			log.Panic("Field already exists", "model", m.name, "field", name)
 		}
+		newField.pkgPath = pkgPath
 		m.fields.add(newField)
 	}
 }
@@ -906,8 +909,30 @@ func (f *Field) setProperty(property string, value interface{}) {
 			}
 			delete(f.contexts, "lang")
 		}
+	case "companyDependent":
+		switch value.(bool) {
+		case true:
+			if f.contexts == nil {
+				f.contexts = make(FieldContexts)
+			}
+			for k, v := range CompanyContexts() {
+				f.contexts[k] = v
+			}
+		case false:
+			if f.contexts == nil {
+				return
+			}
+			delete(f.contexts, companyContextName)
+		}
 	case "contexts":
 		f.contexts = value.(FieldContexts)
+	case "fullTextLang":
+		f.fullTextLang = value.(string)
+	case "groups":
+		f.groups = make(map[*security.Group]bool)
+		for _, group := range value.([]*security.Group) {
+			f.groups[group] = true
+		}
 	}
 }
 
@@ -995,6 +1020,15 @@ func (f *Field) SetRequiredFunc(value func(Environment) (bool, Conditioner)) *Fi
 	return f
 }
 
+// SetGroups restricts the access to this Field to the members of the given groups.
+// Other users cannot read or write this field, and it is not returned by FieldsGet.
+//
+// Calling SetGroups without arguments removes the restriction.
+func (f *Field) SetGroups(groups ...*security.Group) *Field {
+	f.addUpdate("groups", groups)
+	return f
+}
+
 // SetInvisibleFunc overrides the value of the InvisibleFunc parameter of this Field
 func (f *Field) SetInvisibleFunc(value func(Environment) (bool, Conditioner)) *Field {
 	f.addUpdate("invisibleFunc", value)
@@ -1043,6 +1077,19 @@ func (f *Field) SetTranslate(value bool) *Field {
 	return f
 }
 
+// SetFullTextIndex creates a full-text index on this Field for the given text
+// search configuration (e.g. "english"), which is also used when searching this
+// Field with the Search operator. An empty lang removes the index.
+func (f *Field) SetFullTextIndex(lang string) *Field {
+	for _, r := range lang {
+		if (r < 'a' || r > 'z') && r != '_' {
+			log.Panic("Invalid text search configuration name", "model", f.model.name, "field", f.name, "lang", lang)
+		}
+	}
+	f.addUpdate("fullTextLang", lang)
+	return f
+}
+
 // SetContexts overrides the value of the Contexts parameter of this Field
 func (f *Field) SetContexts(value FieldContexts) *Field {
 	f.addUpdate("contexts", value)
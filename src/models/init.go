@@ -35,6 +35,8 @@ func init() {
 	// DB drivers
 	adapters = make(map[string]dbAdapter)
 	registerDBAdapter("postgres", new(postgresAdapter))
+	registerDBAdapter("sqlite3", &sqliteAdapter{driver: "sqlite3"})
+	registerDBAdapter("sqlite", &sqliteAdapter{driver: "sqlite"})
 	// model registry
 	Registry = newModelCollection()
 	Views = make(map[*Model][]string)
@@ -44,4 +46,9 @@ func init() {
 	declareCommonMixin()
 	declareBaseMixin()
 	declareModelMixin()
+	declareArchiveMixin()
+	declareAuditModel()
+	declareOutboxModel()
+	declareJobModel()
+	declareScheduledActionModel()
 }
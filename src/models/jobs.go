@@ -0,0 +1,350 @@
+// Copyright 2019 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/hexya-erp/hexya/src/models/security"
+	"github.com/hexya-erp/hexya/src/models/types"
+	"github.com/hexya-erp/hexya/src/models/types/dates"
+)
+
+const (
+	// jobModelName is the name of the model storing the queued jobs
+	jobModelName = "HexyaJob"
+	// DefaultJobChannel is the channel of jobs enqueued without channel
+	DefaultJobChannel = "root"
+	// DefaultJobPriority is the priority of jobs enqueued without priority
+	DefaultJobPriority = 10
+	// DefaultJobMaxRetries is the number of retries of failed jobs enqueued
+	// without MaxRetries
+	DefaultJobMaxRetries = 5
+)
+
+// States of queued jobs
+const (
+	// JobPending jobs are waiting to be executed
+	JobPending = "pending"
+	// JobRunning jobs are being executed by a worker
+	JobRunning = "running"
+	// JobDone jobs have been executed successfully
+	JobDone = "done"
+	// JobDead jobs have failed more than their maximum number of retries
+	JobDead = "dead"
+)
+
+var (
+	// jobsPeriod is the time between two runs of the job queue by the worker loop
+	jobsPeriod = 2 * time.Second
+	// jobRetryDelay is the delay before the first retry of a failed job.
+	// It is doubled at each subsequent retry.
+	jobRetryDelay = 10 * time.Second
+	// jobMaxRetryDelay is the maximum delay before the retry of a failed job
+	jobMaxRetryDelay = time.Hour
+	// staleJobTimeout is the time after which a running job is considered to
+	// have been abandoned by a stopped worker and is set pending again.
+	staleJobTimeout = 6 * time.Hour
+)
+
+// JobOptions are the options of a job given to Enqueue.
+type JobOptions struct {
+	// Channel of the job. Channels limit the number of jobs executed
+	// concurrently. Defaults to DefaultJobChannel.
+	Channel string
+	// Priority of the job. Jobs with a lower priority are executed first.
+	// Defaults to DefaultJobPriority.
+	Priority int
+	// ETA is the date before which the job must not be executed.
+	// Defaults to immediately.
+	ETA dates.DateTime
+	// MaxRetries is the number of times the job is retried if it fails, before
+	// being marked as JobDead. Defaults to DefaultJobMaxRetries. Set a negative
+	// value to never retry.
+	MaxRetries int
+}
+
+// jobChannels holds the maximum number of concurrently running jobs of each channel
+var jobChannels = struct {
+	sync.RWMutex
+	capacities map[string]int
+}{
+	capacities: map[string]int{DefaultJobChannel: 1},
+}
+
+// SetJobChannelCapacity sets the maximum number of jobs of the given channel
+// that can be running at the same time on all the servers of the database.
+//
+// Channels without capacity have a capacity of 1.
+func SetJobChannelCapacity(channel string, capacity int) {
+	if capacity < 1 {
+		log.Panic("Job channel capacity must be at least 1", "channel", channel, "capacity", capacity)
+	}
+	jobChannels.Lock()
+	defer jobChannels.Unlock()
+	jobChannels.capacities[channel] = capacity
+}
+
+// jobChannelCapacity returns the capacity of the given channel
+func jobChannelCapacity(channel string) int {
+	jobChannels.RLock()
+	defer jobChannels.RUnlock()
+	capacity, ok := jobChannels.capacities[channel]
+	if !ok {
+		return 1
+	}
+	return capacity
+}
+
+// A jobRecordSet is the JSON representation of a RecordSet job argument
+type jobRecordSet struct {
+	Model string  `json:"model"`
+	IDs   []int64 `json:"ids"`
+}
+
+// A queuedJob is a job as stored in the database
+type queuedJob struct {
+	ID         int64
+	ResModel   string
+	Records    string
+	Method     string
+	Args       string
+	Context    string
+	UID        int64
+	Channel    string
+	Attempts   int
+	MaxRetries int
+}
+
+// declareJobModel creates the system model that stores the queued jobs
+func declareJobModel() {
+	model := createModel(jobModelName, SystemModel)
+	model.AddFields(map[string]FieldDefinition{
+		"ResModel":    CharField{Required: true},
+		"Records":     TextField{Required: true},
+		"Method":      CharField{Required: true},
+		"Args":        TextField{},
+		"Context":     TextField{},
+		"UID":         IntegerField{},
+		"Channel":     CharField{Required: true, Index: true},
+		"Priority":    IntegerField{},
+		"ETA":         DateTimeField{Required: true},
+		"State":       CharField{Required: true, Index: true},
+		"Attempts":    IntegerField{},
+		"MaxRetries":  IntegerField{},
+		"LastError":   TextField{},
+		"DateStarted": DateTimeField{},
+		"DateDone":    DateTimeField{},
+	})
+	model.InheritModel(Registry.MustGet("CommonMixin"))
+	model.restrictToAdmins()
+}
+
+// jobTable returns the quoted name of the jobs table
+func jobTable() string {
+	return adapters[db.DriverName()].quoteTableName(Registry.MustGet(jobModelName).tableName)
+}
+
+// Enqueue adds a job to the queue that will call the given method on the given
+// records with the given arguments. It returns the ID of the job.
+//
+// The job is stored in the transaction of this Environment, so that it is not
+// executed if the transaction is rolled back. It is executed by the worker loop
+// in a new transaction as the user of this Environment and with the context of
+// records.
+//
+// Arguments must be RecordSets or values that can be encoded in JSON and
+// decoded into the parameter types of the method.
+func (env Environment) Enqueue(method string, records RecordSet, args []interface{}, opts JobOptions) int64 {
+	rc := records.Collection()
+	rc.model.methods.MustGet(method)
+	ids, _ := json.Marshal(rc.Ids())
+	jsonArgs := make([]interface{}, len(args))
+	for i, arg := range args {
+		if rs, ok := arg.(RecordSet); ok {
+			arg = jobRecordSet{Model: rs.ModelName(), IDs: rs.Ids()}
+		}
+		jsonArgs[i] = arg
+	}
+	encodedArgs, err := json.Marshal(jsonArgs)
+	if err != nil {
+		log.Panic("Unable to encode job arguments", "model", rc.model.name, "method", method, "error", err)
+	}
+	ctx, _ := json.Marshal(rc.env.context)
+	if opts.Channel == "" {
+		opts.Channel = DefaultJobChannel
+	}
+	if opts.Priority == 0 {
+		opts.Priority = DefaultJobPriority
+	}
+	if opts.ETA.IsZero() {
+		opts.ETA = dates.Now()
+	}
+	switch {
+	case opts.MaxRetries == 0:
+		opts.MaxRetries = DefaultJobMaxRetries
+	case opts.MaxRetries < 0:
+		opts.MaxRetries = 0
+	}
+	var id int64
+	env.cr.Get(&id, fmt.Sprintf(`INSERT INTO %s (res_model, records, method, args, context, uid, channel, priority, eta, state, attempts, max_retries)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, 0, ?) RETURNING id`, jobTable()),
+		rc.model.name, string(ids), method, string(encodedArgs), string(ctx), env.uid,
+		opts.Channel, opts.Priority, opts.ETA, JobPending, opts.MaxRetries)
+	return id
+}
+
+// RequeueJob sets the job with the given ID pending again with no attempts.
+// It is typically used to run again a JobDead job after the cause of its failure
+// has been fixed.
+func (env Environment) RequeueJob(id int64) {
+	env.cr.Execute(fmt.Sprintf(`UPDATE %s SET state = ?, attempts = 0, eta = ? WHERE id = ?`, jobTable()),
+		JobPending, dates.Now(), id)
+}
+
+// ProcessJobs executes the pending jobs whose ETA is reached, as long as their
+// channel has not reached its capacity. It returns when all the jobs it
+// started are finished. No new job is started once the worker loop is stopping.
+//
+// ProcessJobs is called periodically by the worker loop. Jobs are claimed with
+// row locks so that ProcessJobs can be run by several servers at the same time.
+func ProcessJobs() {
+	var wg sync.WaitGroup
+	for !workerLoopStopping() {
+		job := claimJob()
+		if job == nil {
+			break
+		}
+		wg.Add(1)
+		go func(j *queuedJob) {
+			defer wg.Done()
+			j.run()
+		}(job)
+	}
+	wg.Wait()
+}
+
+// claimJob marks the next job to execute as running and returns it,
+// or nil if there is no job to execute.
+func claimJob() *queuedJob {
+	var job *queuedJob
+	err := ExecuteInNewEnvironment(security.SuperUserID, func(env Environment) {
+		adapter := adapters[db.DriverName()]
+		now := dates.Now()
+		env.cr.Execute(fmt.Sprintf(`UPDATE %s SET state = ? WHERE state = ? AND date_started < ?`, jobTable()),
+			JobPending, JobRunning, now.Add(-staleJobTimeout))
+		var running []struct {
+			Channel string
+			Count   int
+		}
+		env.cr.Select(&running, fmt.Sprintf(`SELECT channel, COUNT(*) AS count FROM %s WHERE state = ? GROUP BY channel`, jobTable()),
+			JobRunning)
+		fullChannels := []string{""}
+		for _, r := range running {
+			if r.Count >= jobChannelCapacity(r.Channel) {
+				fullChannels = append(fullChannels, r.Channel)
+			}
+		}
+		var jobs []queuedJob
+		env.cr.Select(&jobs, fmt.Sprintf(`SELECT id, res_model, records, method, args, context, uid, channel, attempts, max_retries
+			FROM %s WHERE state = ? AND eta <= ? AND channel NOT IN (?) ORDER BY priority, eta, id %s %s`,
+			jobTable(), adapter.limitOffsetSQL(1, 0), adapter.skipLockedSQL()), JobPending, now, fullChannels)
+		if len(jobs) == 0 {
+			return
+		}
+		job = &jobs[0]
+		job.Attempts++
+		env.cr.Execute(fmt.Sprintf(`UPDATE %s SET state = ?, attempts = ?, date_started = ? WHERE id = ?`, jobTable()),
+			JobRunning, job.Attempts, now, job.ID)
+	})
+	if err != nil {
+		log.Warn("Unable to claim job", "error", err)
+		return nil
+	}
+	return job
+}
+
+// run executes this job as its user and updates its state
+func (j *queuedJob) run() {
+	log.Debug("Running job", "id", j.ID, "model", j.ResModel, "method", j.Method, "attempt", j.Attempts)
+	err := ExecuteInNewEnvironment(j.UID, func(env Environment) {
+		var ids []int64
+		json.Unmarshal([]byte(j.Records), &ids)
+		ctx := new(types.Context)
+		json.Unmarshal([]byte(j.Context), ctx)
+		rc := env.Pool(j.ResModel).WithNewContext(ctx).withIds(ids)
+		rc.Call(j.Method, j.decodeArgs(env, rc.model.methods.MustGet(j.Method).methodType)...)
+	})
+	updErr := ExecuteInNewEnvironment(security.SuperUserID, func(env Environment) {
+		now := dates.Now()
+		switch {
+		case err == nil:
+			env.cr.Execute(fmt.Sprintf(`UPDATE %s SET state = ?, date_done = ?, last_error = NULL WHERE id = ?`, jobTable()),
+				JobDone, now, j.ID)
+		case j.Attempts > j.MaxRetries:
+			log.Warn("Job failed too many times", "id", j.ID, "model", j.ResModel, "method", j.Method, "error", err)
+			env.cr.Execute(fmt.Sprintf(`UPDATE %s SET state = ?, date_done = ?, last_error = ? WHERE id = ?`, jobTable()),
+				JobDead, now, err.Error(), j.ID)
+		default:
+			log.Info("Job failed and will be retried", "id", j.ID, "model", j.ResModel, "method", j.Method, "error", err)
+			env.cr.Execute(fmt.Sprintf(`UPDATE %s SET state = ?, eta = ?, last_error = ? WHERE id = ?`, jobTable()),
+				JobPending, now.Add(jobRetryBackoff(j.Attempts)), err.Error(), j.ID)
+		}
+	})
+	if updErr != nil {
+		log.Warn("Unable to update job state", "id", j.ID, "error", updErr)
+	}
+}
+
+// decodeArgs decodes the arguments of this job for a method of the given type
+func (j *queuedJob) decodeArgs(env Environment, methType reflect.Type) []interface{} {
+	var rawArgs []json.RawMessage
+	if err := json.Unmarshal([]byte(j.Args), &rawArgs); err != nil {
+		log.Panic("Unable to decode job arguments", "id", j.ID, "error", err)
+	}
+	recordSetType := reflect.TypeOf((*RecordSet)(nil)).Elem()
+	args := make([]interface{}, len(rawArgs))
+	for i, raw := range rawArgs {
+		var argType reflect.Type
+		switch {
+		case methType.IsVariadic() && i >= methType.NumIn()-2:
+			argType = methType.In(methType.NumIn() - 1).Elem()
+		case i+1 < methType.NumIn():
+			argType = methType.In(i + 1)
+		default:
+			log.Panic("Too many arguments for job method", "id", j.ID, "method", j.Method)
+		}
+		if argType.Implements(recordSetType) {
+			var rs jobRecordSet
+			if err := json.Unmarshal(raw, &rs); err != nil {
+				log.Panic("Unable to decode job RecordSet argument", "id", j.ID, "index", i, "error", err)
+			}
+			args[i] = env.Pool(rs.Model).withIds(rs.IDs)
+			continue
+		}
+		val := reflect.New(argType)
+		if err := json.Unmarshal(raw, val.Interface()); err != nil {
+			log.Panic("Unable to decode job argument", "id", j.ID, "index", i, "error", err)
+		}
+		args[i] = val.Elem().Interface()
+	}
+	return args
+}
+
+// jobRetryBackoff returns the delay before the retry of a
+// job that failed for the given number of attempts.
+func jobRetryBackoff(attempts int) time.Duration {
+	delay := jobRetryDelay
+	for i := 1; i < attempts; i++ {
+		delay *= 2
+		if delay >= jobMaxRetryDelay {
+			return jobMaxRetryDelay
+		}
+	}
+	return delay
+}
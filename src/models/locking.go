@@ -0,0 +1,130 @@
+// Copyright 2019 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package models
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/hexya-erp/hexya/src/models/types/dates"
+	"github.com/hexya-erp/hexya/src/tools/exceptions"
+)
+
+const (
+	// versionFieldName is the name of the field holding the version of
+	// records of models with optimistic locking.
+	versionFieldName = "LockVersion"
+	// versionFieldJSON is the JSON name of the version field
+	versionFieldJSON = "hexya_lock_version"
+	// lastUpdateFieldJSON is the JSON name of the LastUpdate field of BaseMixin
+	lastUpdateFieldJSON = "__last_update"
+)
+
+// EnableOptimisticLocking adds a LockVersion field to this model which is
+// incremented each time a record is updated.
+//
+// Write data may then include the LockVersion or the LastUpdate value read by
+// the client. Write panics with an exceptions.ConcurrentUpdateError if one of the
+// records has been modified since, instead of silently overwriting the changes of
+// another user.
+//
+// EnableOptimisticLocking must be called before bootstrap.
+func (m *Model) EnableOptimisticLocking() {
+	if Registry.bootstrapped {
+		log.Panic("Optimistic locking must be enabled before bootstrap", "model", m.name)
+	}
+	if _, exists := m.fields.Get(versionFieldName); !exists {
+		m.AddFields(map[string]FieldDefinition{
+			versionFieldName: IntegerField{JSON: versionFieldJSON, String: "Version", GoType: new(int64), NoCopy: true, ReadOnly: true},
+		})
+	}
+	m.versioned = true
+}
+
+// versionUpdateSQL returns the SQL assignment that increments the version of
+// updated records or an empty string if this model has no optimistic locking.
+func (m *Model) versionUpdateSQL() string {
+	if !m.versioned {
+		return ""
+	}
+	return fmt.Sprintf("%s = COALESCE(%s, 0) + 1", versionFieldJSON, versionFieldJSON)
+}
+
+// checkConcurrentUpdate panics with a ConcurrentUpdateError if the records of this
+// RecordCollection have been modified since the version or last update given in data.
+//
+// It returns a copy of data without the version and last update values.
+func (rc *RecordCollection) checkConcurrentUpdate(data RecordData) RecordData {
+	if !rc.model.versioned || rc.hasNegIds {
+		return data
+	}
+	md := data.Underlying()
+	versionField := rc.model.FieldName(versionFieldName)
+	version, hasVersion := md.FieldMap.Get(versionField)
+	var lastUpdate interface{}
+	lastUpdateField, hasLastUpdateField := rc.model.fields.Get(lastUpdateFieldJSON)
+	hasLastUpdate := false
+	if hasLastUpdateField {
+		lastUpdate, hasLastUpdate = md.FieldMap.Get(rc.model.FieldName(lastUpdateField.name))
+	}
+	if !hasVersion && !hasLastUpdate {
+		return data
+	}
+	res := md.Copy()
+	table := adapters[db.DriverName()].quoteTableName(rc.model.tableName)
+	staleIds := make(map[int64]bool)
+	if hasVersion {
+		res.Unset(versionField)
+		var ids []int64
+		rc.env.cr.Select(&ids, fmt.Sprintf(`SELECT id FROM %s WHERE id IN (?) AND COALESCE(%s, 0) != ?`, table, versionFieldJSON),
+			rc.Ids(), version)
+		for _, id := range ids {
+			staleIds[id] = true
+		}
+	}
+	if hasLastUpdate {
+		res.Unset(rc.model.FieldName(lastUpdateField.name))
+		expected := lastUpdateValue(lastUpdate)
+		var rows []struct {
+			ID         int64
+			LastUpdate dates.DateTime
+		}
+		rc.env.cr.Select(&rows, fmt.Sprintf(`SELECT id, COALESCE(write_date, create_date) AS last_update FROM %s WHERE id IN (?)`, table),
+			rc.Ids())
+		for _, row := range rows {
+			// Clients get last updates with a precision of one second
+			if row.LastUpdate.Time.Truncate(time.Second).After(expected.Truncate(time.Second)) {
+				staleIds[row.ID] = true
+			}
+		}
+	}
+	if len(staleIds) > 0 {
+		ids := make([]int64, 0, len(staleIds))
+		for id := range staleIds {
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+		log.Info("Concurrent update detected", "model", rc.model.name, "ids", ids, "uid", rc.env.uid)
+		panic(exceptions.ConcurrentUpdateError{
+			Model: rc.model.name,
+			IDs:   ids,
+		})
+	}
+	return res
+}
+
+// lastUpdateValue returns the given LastUpdate value given by a client as a time.Time
+func lastUpdateValue(value interface{}) time.Time {
+	switch val := value.(type) {
+	case dates.DateTime:
+		return val.Time
+	case time.Time:
+		return val
+	case string:
+		return dates.ParseDateTime(val).Time
+	}
+	log.Panic("Invalid last update value", "value", value)
+	return time.Time{}
+}
@@ -0,0 +1,399 @@
+// Copyright 2019 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package models
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hexya-erp/hexya/src/models/security"
+)
+
+const (
+	// migrationsTable is the name of the table recording applied migrations
+	migrationsTable = "hexya_migration"
+	// migrationVersionFormat is the time format of migration versions
+	migrationVersionFormat = "20060102150405"
+	// migrationUpMarker starts the section of statements to apply a migration
+	migrationUpMarker = "-- +hexya Up"
+	// migrationDownMarker starts the section of statements to roll back a migration
+	migrationDownMarker = "-- +hexya Down"
+	// SchemaMigrationsModule is the module of the migrations generated by
+	// PlanMigrations for the schema changes that are not bound to a module,
+	// such as those of the models of Hexya itself.
+	SchemaMigrationsModule = "schema"
+)
+
+// migrationFileRegexp matches migration file names and extracts version and name.
+var migrationFileRegexp = regexp.MustCompile(`^(\d{14})_(\w+)\.sql$`)
+
+// A MigrationHook is a function executed in the transaction of a
+// migration after its SQL statements, typically to migrate data.
+type MigrationHook func(env Environment)
+
+// migrationHooks are the Go hooks of a migration
+type migrationHooks struct {
+	up   MigrationHook
+	down MigrationHook
+}
+
+// registeredMigrationHooks holds the hooks of each migration by module and version
+var registeredMigrationHooks = make(map[string]map[string]migrationHooks)
+
+// RegisterMigrationHooks registers Go hooks for the migration with the given
+// version of the given module. up is executed after the SQL statements when
+// applying the migration, and down after them when rolling it back.
+// Each of them may be nil.
+//
+// This function should be called in the init() function of a module.
+func RegisterMigrationHooks(module, version string, up, down MigrationHook) {
+	if registeredMigrationHooks[module] == nil {
+		registeredMigrationHooks[module] = make(map[string]migrationHooks)
+	}
+	registeredMigrationHooks[module][version] = migrationHooks{up: up, down: down}
+}
+
+// A Migration is a versioned and named set of SQL statements of a module
+// to apply to the database, with the statements to roll them back.
+type Migration struct {
+	Module  string
+	Version string
+	Name    string
+	UpSQL   string
+	DownSQL string
+}
+
+// FileName returns the name of the file of this migration
+func (m *Migration) FileName() string {
+	return fmt.Sprintf("%s_%s.sql", m.Version, m.Name)
+}
+
+// String returns the identifier of this migration
+func (m *Migration) String() string {
+	return fmt.Sprintf("%s/%s", m.Module, strings.TrimSuffix(m.FileName(), ".sql"))
+}
+
+// WriteFile writes this migration in the subdirectory of dir named after the module.
+// It returns the path of the written file.
+func (m *Migration) WriteFile(dir string) (string, error) {
+	modDir := filepath.Join(dir, m.Module)
+	if err := os.MkdirAll(modDir, 0755); err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "-- Migration %s of module %s\n", strings.TrimSuffix(m.FileName(), ".sql"), m.Module)
+	fmt.Fprintf(&buf, "-- Generated by 'hexya migrate plan'. Review it before applying.\n")
+	fmt.Fprintf(&buf, "-- Go hooks can be registered with models.RegisterMigrationHooks(%q, %q, up, down)\n\n", m.Module, m.Version)
+	fmt.Fprintf(&buf, "%s\n%s\n\n", migrationUpMarker, strings.TrimSpace(m.UpSQL))
+	fmt.Fprintf(&buf, "%s\n%s\n", migrationDownMarker, strings.TrimSpace(m.DownSQL))
+	fileName := filepath.Join(modDir, m.FileName())
+	return fileName, ioutil.WriteFile(fileName, buf.Bytes(), 0644)
+}
+
+// apply executes the up statements and hook of this migration and
+// records it as applied, all in the same transaction.
+func (m *Migration) apply() error {
+	log.Info("Applying migration", "migration", m)
+	return ExecuteInNewEnvironment(security.SuperUserID, func(env Environment) {
+		dbExecuteRaw(env.cr, m.UpSQL)
+		if hook := registeredMigrationHooks[m.Module][m.Version].up; hook != nil {
+			hook(env)
+		}
+		env.cr.Execute(fmt.Sprintf("INSERT INTO %s (module, version, name, applied_at) VALUES (?, ?, ?, ?)", migrationsTable),
+			m.Module, m.Version, m.Name, time.Now().UTC())
+	})
+}
+
+// canRollback returns true if this migration has statements or a
+// Go hook to execute when rolling it back.
+func (m *Migration) canRollback() bool {
+	if registeredMigrationHooks[m.Module][m.Version].down != nil {
+		return true
+	}
+	for _, line := range strings.Split(m.DownSQL, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "--") {
+			return true
+		}
+	}
+	return false
+}
+
+// rollback executes the down statements and hook of this migration
+// and removes it from the applied migrations.
+func (m *Migration) rollback() error {
+	log.Info("Rolling back migration", "migration", m)
+	return ExecuteInNewEnvironment(security.SuperUserID, func(env Environment) {
+		dbExecuteRaw(env.cr, m.DownSQL)
+		if hook := registeredMigrationHooks[m.Module][m.Version].down; hook != nil {
+			hook(env)
+		}
+		env.cr.Execute(fmt.Sprintf("DELETE FROM %s WHERE module = ? AND version = ?", migrationsTable),
+			m.Module, m.Version)
+	})
+}
+
+// dbExecuteRaw executes the given SQL statements as is in the given cursor.
+// Contrary to dbExecute, placeholders are not rebound. It panics in case of error.
+func dbExecuteRaw(cr *Cursor, statements string) {
+	if strings.TrimSpace(statements) == "" {
+		return
+	}
+	t := time.Now()
+	_, err := cr.tx.Exec(statements)
+	logSQLResult(err, t, statements)
+}
+
+// A MigrationModule is a module to which PlanMigrations attributes schema changes
+type MigrationModule struct {
+	Name    string
+	Package string // Import path of the Go package of the module
+}
+
+// PlanMigrations returns new migrations with the statements needed to
+// synchronize the database schema with the whole model registry, with
+// the given name.
+//
+// modules must be sorted so that each module comes after its dependencies.
+// Each statement belongs to the migration of the last of these modules whose
+// package declares the model, field or constraint it changes. Other statements
+// belong to a SchemaMigrationsModule migration applied before the migrations
+// of the modules, except for the drops of the tables of removed models which
+// belong to a SchemaMigrationsModule migration applied after them.
+//
+// The down statements of the migrations revert the reversible statements,
+// and irreversible statements are listed as comments.
+// It returns nil if the database is already up to date.
+func PlanMigrations(name string, modules []MigrationModule) []*Migration {
+	// statements are grouped by rank, from -1 to len(modules)
+	byRank := make([][]schemaStatement, len(modules)+2)
+	for _, statement := range recordSchemaChanges(modules).statements {
+		byRank[statement.rank+1] = append(byRank[statement.rank+1], statement)
+	}
+	now := time.Now().UTC()
+	var res []*Migration
+	for i, statements := range byRank {
+		if len(statements) == 0 {
+			continue
+		}
+		module := SchemaMigrationsModule
+		if i > 0 && i <= len(modules) {
+			module = modules[i-1].Name
+		}
+		ups := make([]string, len(statements))
+		downs := make([]string, len(statements))
+		for j, statement := range statements {
+			ups[j] = statement.up
+			downs[len(statements)-1-j] = statement.down
+		}
+		res = append(res, &Migration{
+			Module:  module,
+			Version: now.Add(time.Duration(i) * time.Second).Format(migrationVersionFormat),
+			Name:    name,
+			UpSQL:   joinSQLStatements(ups),
+			DownSQL: joinSQLStatements(downs),
+		})
+	}
+	return res
+}
+
+// joinSQLStatements joins the given SQL statements and comments into a
+// single string, terminating statements with a semicolon. Empty
+// statements are skipped.
+func joinSQLStatements(statements []string) string {
+	var res []string
+	for _, statement := range statements {
+		switch {
+		case statement == "":
+			continue
+		case strings.HasPrefix(statement, "--"):
+			res = append(res, statement)
+		default:
+			res = append(res, statement+";")
+		}
+	}
+	return strings.Join(res, "\n\n")
+}
+
+// ParseMigration returns the Migration of the given module defined by
+// the given file name and content.
+func ParseMigration(module, fileName string, content []byte) (*Migration, error) {
+	parts := migrationFileRegexp.FindStringSubmatch(fileName)
+	if parts == nil {
+		return nil, fmt.Errorf("invalid migration file name %s, should be VERSION_NAME.sql", fileName)
+	}
+	m := Migration{
+		Module:  module,
+		Version: parts[1],
+		Name:    parts[2],
+	}
+	var up, down bytes.Buffer
+	var section *bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch strings.TrimSpace(line) {
+		case migrationUpMarker:
+			section = &up
+			continue
+		case migrationDownMarker:
+			section = &down
+			continue
+		}
+		if section != nil {
+			section.WriteString(line)
+			section.WriteString("\n")
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if section == nil {
+		return nil, fmt.Errorf("migration %s has no '%s' section", fileName, migrationUpMarker)
+	}
+	m.UpSQL = up.String()
+	m.DownSQL = down.String()
+	return &m, nil
+}
+
+// LoadMigrations reads all migrations from dir, which must hold one
+// subdirectory of migration files per module.
+//
+// Migrations are returned sorted by version.
+func LoadMigrations(dir string) ([]*Migration, error) {
+	var res []*Migration
+	modDirs, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return res, nil
+		}
+		return nil, err
+	}
+	for _, modDir := range modDirs {
+		if !modDir.IsDir() {
+			continue
+		}
+		files, err := ioutil.ReadDir(filepath.Join(dir, modDir.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			if file.IsDir() || filepath.Ext(file.Name()) != ".sql" {
+				continue
+			}
+			content, err := ioutil.ReadFile(filepath.Join(dir, modDir.Name(), file.Name()))
+			if err != nil {
+				return nil, err
+			}
+			m, err := ParseMigration(modDir.Name(), file.Name(), content)
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, m)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Version == res[j].Version {
+			return res[i].Module < res[j].Module
+		}
+		return res[i].Version < res[j].Version
+	})
+	return res, nil
+}
+
+// createMigrationsTable creates the table recording applied migrations if it does not exist
+func createMigrationsTable() {
+	adapter := adapters[db.DriverName()]
+	query := fmt.Sprintf(`
+CREATE TABLE IF NOT EXISTS %s (
+	id %s,
+	module varchar NOT NULL,
+	version varchar NOT NULL,
+	name varchar NOT NULL,
+	applied_at timestamp NOT NULL
+)`, adapter.quoteTableName(migrationsTable), adapter.idColumnSQLDefinition())
+	dbExecuteNoTx(query)
+}
+
+// appliedMigrationVersions returns the versions of the applied
+// migrations of each module.
+func appliedMigrationVersions() map[string]map[string]bool {
+	createMigrationsTable()
+	var applied []struct {
+		Module  string
+		Version string
+	}
+	dbSelectNoTx(&applied, fmt.Sprintf("SELECT module, version FROM %s", migrationsTable))
+	res := make(map[string]map[string]bool)
+	for _, a := range applied {
+		if res[a.Module] == nil {
+			res[a.Module] = make(map[string]bool)
+		}
+		res[a.Module][a.Version] = true
+	}
+	return res
+}
+
+// PendingMigrations returns the given migrations which have not been applied yet.
+func PendingMigrations(migrations []*Migration) []*Migration {
+	applied := appliedMigrationVersions()
+	var res []*Migration
+	for _, m := range migrations {
+		if !applied[m.Module][m.Version] {
+			res = append(res, m)
+		}
+	}
+	return res
+}
+
+// ApplyMigrations applies the given migrations that have not been applied
+// yet in order, each one in its own transaction. It stops at the first
+// failing migration and returns its error.
+//
+// It returns the list of applied migrations.
+func ApplyMigrations(migrations []*Migration) ([]*Migration, error) {
+	var res []*Migration
+	for _, m := range PendingMigrations(migrations) {
+		if err := m.apply(); err != nil {
+			return res, fmt.Errorf("migration %s failed: %s", m, err)
+		}
+		res = append(res, m)
+	}
+	return res, nil
+}
+
+// RollbackMigration rolls back the last applied migration of the given module
+// and returns it. migrations must contain the migration to roll back.
+//
+// It returns nil if there is no migration to roll back for this module, and
+// an error if the migration has neither Down statements nor a down hook.
+func RollbackMigration(migrations []*Migration, module string) (*Migration, error) {
+	createMigrationsTable()
+	var versions []string
+	dbSelectNoTx(&versions, fmt.Sprintf("SELECT version FROM %s WHERE module = ? ORDER BY version DESC", migrationsTable), module)
+	if len(versions) == 0 {
+		return nil, nil
+	}
+	for _, m := range migrations {
+		if m.Module != module || m.Version != versions[0] {
+			continue
+		}
+		if !m.canRollback() {
+			return nil, fmt.Errorf("migration %s has no Down statements nor down hook and cannot be rolled back", m)
+		}
+		if err := m.rollback(); err != nil {
+			return nil, fmt.Errorf("rollback of migration %s failed: %s", m, err)
+		}
+		return m, nil
+	}
+	return nil, fmt.Errorf("unable to find migration file of version %s of module %s", versions[0], module)
+}
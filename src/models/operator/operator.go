@@ -23,6 +23,15 @@ const (
 	In             Operator = "in"
 	NotIn          Operator = "not in"
 	ChildOf        Operator = "child_of"
+	ParentOf       Operator = "parent_of"
+	Search         Operator = "@@"
+	Between        Operator = "between"
+	Regex          Operator = "~"
+	IRegex         Operator = "~*"
+	Overlaps       Operator = "overlaps"
+	Any            Operator = "any"
+	Exists         Operator = "exists"
+	NotExists      Operator = "not exists"
 )
 
 var allowedOperators = map[Operator]bool{
@@ -41,6 +50,15 @@ var allowedOperators = map[Operator]bool{
 	In:             true,
 	NotIn:          true,
 	ChildOf:        true,
+	ParentOf:       true,
+	Search:         true,
+	Between:        true,
+	Regex:          true,
+	IRegex:         true,
+	Overlaps:       true,
+	Any:            true,
+	Exists:         true,
+	NotExists:      true,
 }
 
 var negativeOperators = map[Operator]bool{
@@ -48,6 +66,7 @@ var negativeOperators = map[Operator]bool{
 	NotContains:  true,
 	NotIContains: true,
 	NotIn:        true,
+	NotExists:    true,
 }
 
 var positiveOperators = map[Operator]bool{
@@ -57,11 +76,18 @@ var positiveOperators = map[Operator]bool{
 	Contains:  true,
 	Like:      true,
 	In:        true,
+	Search:    true,
+	Regex:     true,
+	IRegex:    true,
+	Overlaps:  true,
+	Any:       true,
+	Exists:    true,
 }
 
 var multiOperator = map[Operator]bool{
-	In:    true,
-	NotIn: true,
+	In:       true,
+	NotIn:    true,
+	Overlaps: true,
 }
 
 // IsMulti returns true if the operator expects a array as arguments
@@ -43,9 +43,13 @@ func (p SQLParams) Extend(p2 SQLParams) SQLParams {
 }
 
 // An orderPredicate in a query. e.g. "name ASC".
+//
+// If rank is set, records are ordered by the full-text
+// search relevance of field for the rank text.
 type orderPredicate struct {
 	field FieldName
 	desc  bool
+	rank  string
 }
 
 // A Query defines the common part an SQL Query, i.e. all that come
@@ -61,6 +65,10 @@ type Query struct {
 	ctxGroups []FieldName
 	orders    []orderPredicate
 	ctxOrders []orderPredicate
+	alias     string
+	periods   map[string]DateGranularity
+	aggs      []Aggregate
+	having    *Condition
 }
 
 // clone returns a pointer to a deep copy of this Query
@@ -71,6 +79,10 @@ func (q Query) clone(rc *RecordCollection) *Query {
 	q.cond = &newCond
 	newCtxCond := *q.ctxCond
 	q.ctxCond = &newCtxCond
+	if q.having != nil {
+		newHaving := *q.having
+		q.having = &newHaving
+	}
 	q.recordSet = rc
 	return &q
 }
@@ -146,8 +158,12 @@ func (q *Query) predicateSQLClause(p predicate) (string, SQLParams) {
 		return q.conditionSQLClause(p.cond)
 	}
 
+	if p.operator == operator.Exists || p.operator == operator.NotExists {
+		return q.existsSQLClause(p)
+	}
+
 	fi := q.recordSet.model.getRelatedFieldInfo(joinFieldNames(p.exprs, ExprSep))
-	if fi.fieldType.IsFKRelationType() {
+	if fi.fieldType.IsFKRelationType() && p.subquery == nil && p.aggFunc == "" {
 		// If we have a relation type with a 0 as foreign key, we substitute for nil
 		if valInt, err := nbutils.CastToInteger(p.arg); err == nil && valInt == 0 {
 			p.arg = nil
@@ -162,6 +178,23 @@ func (q *Query) predicateSQLClause(p predicate) (string, SQLParams) {
 
 	adapter := adapters[db.DriverName()]
 	arg := q.evaluateConditionArgFunctions(p)
+	// Expressions computed from the field only match NULL with a nil argument
+	isExpr := len(p.jsonPath) > 0 || p.subquery != nil || p.aggFunc != ""
+	var fieldArgs SQLParams
+	switch {
+	case p.aggFunc != "":
+		// Having clause of a grouped query on the columns of the base query
+		field = adapter.aggregateFunctionSQL(string(p.aggFunc), joinFieldNames(p.exprs, sqlSep).JSON())
+	case p.subquery != nil:
+		field, fieldArgs = q.aggregateSQL(p.exprs, p.subquery)
+	case len(p.jsonPath) > 0:
+		if fi.fieldType != fieldtype.JSON {
+			log.Panic("JSON paths can only be used on JSON fields", "field", p.Field().Name(), "type", fi.fieldType)
+		}
+		var pathArg interface{}
+		field, pathArg = adapter.jsonPathSQL(field, p.jsonPath, arg)
+		fieldArgs = SQLParams{pathArg}
+	}
 	opSql, arg := adapter.operatorSQL(p.operator, arg)
 
 	var isNull bool
@@ -169,27 +202,76 @@ func (q *Query) predicateSQLClause(p predicate) (string, SQLParams) {
 	case nil:
 		isNull = true
 	case string:
-		if v == "" {
+		if v == "" && !isExpr {
 			isNull = true
 		}
 	case bool:
-		if !v {
+		if !v && !isExpr {
 			isNull = true
 		}
 	}
 	if isNull {
+		if isExpr {
+			return exprNullSQLClause(field, p.operator), fieldArgs
+		}
 		return nullSQLClause(field, p.operator, fi)
 	}
+	switch p.operator {
+	case operator.Search:
+		return adapter.fullTextSearchSQL(field, fi.textSearchConfig()), append(fieldArgs, arg)
+	case operator.Overlaps:
+		if val := reflect.ValueOf(arg); val.Kind() == reflect.Slice && val.Len() == 0 {
+			// No related record can match
+			return "1 = 0", nil
+		}
+		if fi.fieldType == fieldtype.Many2Many {
+			return q.overlapsSQLClause(p.exprs, fi), SQLParams{arg}
+		}
+	}
 
 	sql = fmt.Sprintf(`%s %s`, field, opSql)
+	args = append(args, fieldArgs...)
 	if p.operator.IsNegative() {
 		sql = fmt.Sprintf(`(%s IS NULL OR %s)`, field, sql)
+		args = append(args, fieldArgs...)
 	}
 
+	if p.operator == operator.Between {
+		return sql, append(args, arg.([]interface{})...)
+	}
 	args = append(args, arg)
 	return sql, args
 }
 
+// overlapsSQLClause returns the sql string matching the records that have at least
+// one of the records given as placeholder in the many2many field at the end of exprs.
+func (q *Query) overlapsSQLClause(exprs []FieldName, fi *Field) string {
+	relTable := adapters[db.DriverName()].quoteTableName(fi.m2mRelModel.tableName)
+	return fmt.Sprintf(`EXISTS (SELECT 1 FROM %s rel WHERE rel.%s = %s AND rel.%s IN (?))`,
+		relTable, fi.m2mOurField.json, q.ownerIDExpression(exprs), fi.m2mTheirField.json)
+}
+
+// ownerIDExpression returns the sql expression of the id of the
+// records holding the last field of exprs.
+func (q *Query) ownerIDExpression(exprs []FieldName) string {
+	ownerExprs := append(append([]FieldName{}, exprs[:len(exprs)-1]...), ID)
+	res, _, _ := q.joinedFieldExpression(ownerExprs, false, 0)
+	return res
+}
+
+// exprNullSQLClause returns the sql string for searching the given expression
+// computed from a field (such as a JSON path) with an empty argument
+func exprNullSQLClause(field string, op operator.Operator) string {
+	switch op {
+	case operator.Equals:
+		return fmt.Sprintf(`%s IS NULL`, field)
+	case operator.NotEquals:
+		return fmt.Sprintf(`%s IS NOT NULL`, field)
+	}
+	log.Panic("Null argument can only be used with = and != operators", "operator", op)
+	return ""
+}
+
 //nullSQLClause returns the sql string and arguments for searching the given field with an empty argument
 func nullSQLClause(field string, op operator.Operator, fi *Field) (string, SQLParams) {
 	var (
@@ -197,6 +279,9 @@ func nullSQLClause(field string, op operator.Operator, fi *Field) (string, SQLPa
 		args SQLParams
 	)
 	switch op {
+	case operator.Search:
+		// Searching an empty text matches all records
+		sql = "1 = 1"
 	case operator.Equals, operator.Like, operator.ILike, operator.Contains, operator.IContains:
 		sql = fmt.Sprintf(`%s IS NULL`, field)
 		if !fi.isRelationField() {
@@ -218,30 +303,30 @@ func nullSQLClause(field string, op operator.Operator, fi *Field) (string, SQLPa
 // sqlLimitClause returns the sql string for the LIMIT and OFFSET clauses
 // of this Query
 func (q *Query) sqlLimitOffsetClause() string {
-	var res string
-	if q.limit > 0 {
-		res = fmt.Sprintf(`LIMIT %d `, q.limit)
-	}
-	if q.offset > 0 {
-		res += fmt.Sprintf(`OFFSET %d`, q.offset)
-	}
-	return res
+	adapter := adapters[db.DriverName()]
+	return adapter.limitOffsetSQL(q.limit, q.offset)
 }
 
-// sqlOrderByClause returns the sql string for the ORDER BY clause
-// of this Query
-func (q *Query) sqlOrderByClause() string {
+// sqlOrderByClause returns the sql string and arguments for the
+// ORDER BY clause of this Query
+func (q *Query) sqlOrderByClause() (string, SQLParams) {
+	var args SQLParams
 	resSlice := make([]string, len(q.orders))
 	for i, order := range q.orders {
 		_, _, resSlice[i] = q.joinedFieldExpression(splitFieldNames(order.field, ExprSep), true, i)
+		if order.rank != "" {
+			fi := q.recordSet.model.getRelatedFieldInfo(order.field)
+			resSlice[i] = adapters[db.DriverName()].fullTextRankSQL(resSlice[i], fi.textSearchConfig())
+			args = append(args, order.rank)
+		}
 		if order.desc {
 			resSlice[i] += " DESC"
 		}
 	}
 	if len(resSlice) == 0 {
-		return ""
+		return "", args
 	}
-	return fmt.Sprintf("ORDER BY %s", strings.Join(resSlice, ", "))
+	return fmt.Sprintf("ORDER BY %s", strings.Join(resSlice, ", ")), args
 }
 
 // sqlCtxOrderByClause returns the sql string for the ORDER BY clause of the ctx fields
@@ -265,9 +350,13 @@ func (q *Query) sqlCtxOrderBy() string {
 func (q *Query) sqlOrderByClauseForGroupBy(aggFncts map[string]string) string {
 	resSlice := make([]string, len(q.orders))
 	for i, order := range q.orders {
+		if order.rank != "" {
+			log.Panic("Full-text rank ordering cannot be used in grouped queries", "field", order.field)
+		}
 		aggFnct := aggFncts[order.field.JSON()]
 		if aggFnct == "" {
 			_, _, jfe := q.joinedFieldExpression(splitFieldNames(order.field, ExprSep), true, i)
+			jfe = q.groupExpressionSQL(splitFieldNames(order.field, ExprSep), jfe)
 			if order.desc {
 				jfe += " DESC"
 			}
@@ -275,7 +364,7 @@ func (q *Query) sqlOrderByClauseForGroupBy(aggFncts map[string]string) string {
 			continue
 		}
 		_, _, jfe := q.joinedFieldExpression(splitFieldNames(order.field, ExprSep), true, i)
-		resSlice[i] = fmt.Sprintf("%s(%s)", aggFnct, jfe)
+		resSlice[i] = adapters[db.DriverName()].aggregateFunctionSQL(aggFnct, jfe)
 		if order.desc {
 			resSlice[i] += " DESC"
 		}
@@ -296,7 +385,8 @@ func (q *Query) sqlGroupByClause() string {
 	}
 	resSlice := make([]string, len(q.groups))
 	for i, field := range fExprs {
-		_, _, resSlice[i] = q.joinedFieldExpression(field, true, i)
+		_, _, alias := q.joinedFieldExpression(field, true, i)
+		resSlice[i] = q.groupExpressionSQL(field, alias)
 	}
 	res := strings.Join(resSlice, ", ")
 	ctxStr := strings.TrimSpace(q.sqlCtxGroupByClause())
@@ -362,6 +452,52 @@ func (q *Query) insertQuery(data FieldMap) (string, SQLParams) {
 	return sql, vals
 }
 
+// insertColumns returns the columns to insert for the given data, that is
+// the JSON names of the given fields except null optional foreign keys.
+func (q *Query) insertColumns(data FieldMap) []string {
+	cols := make([]string, 0, len(data))
+	for k, v := range data {
+		fi := q.recordSet.model.fields.MustGet(k)
+		if fi.fieldType.IsFKRelationType() && !fi.required {
+			if _, ok := v.(*interface{}); ok {
+				continue
+			}
+		}
+		cols = append(cols, fi.json)
+	}
+	sort.Strings(cols)
+	return cols
+}
+
+// insertMultiQuery returns the SQL query string and parameters to insert
+// a row for each of the given data in a single query.
+//
+// cols are the columns to insert, which must be keys of each FieldMap of data.
+// The query returns the ids of the inserted rows, in no particular order. If
+// withExternalID is true, it also returns their hexya_external_id column.
+func (q *Query) insertMultiQuery(cols []string, data []FieldMap, withExternalID bool) (string, SQLParams) {
+	adapter := adapters[db.DriverName()]
+	if len(cols) == 0 || len(data) == 0 {
+		log.Panic("No data given for insert")
+	}
+	vals := make(SQLParams, 0, len(cols)*len(data))
+	rows := make([]string, len(data))
+	rowSQL := "(?" + strings.Repeat(", ?", len(cols)-1) + ")"
+	for i, fMap := range data {
+		for _, col := range cols {
+			vals = append(vals, fMap[col])
+		}
+		rows[i] = rowSQL
+	}
+	tableName := adapter.quoteTableName(q.recordSet.model.tableName)
+	returning := "id"
+	if withExternalID {
+		returning = "id, hexya_external_id"
+	}
+	sql := fmt.Sprintf("INSERT INTO %s (%s) VALUES %s RETURNING %s", tableName, strings.Join(cols, ", "), strings.Join(rows, ", "), returning)
+	return sql, vals
+}
+
 // countQuery returns the SQL query string and parameters to count
 // the rows pointed at by this Query object.
 func (q *Query) countQuery() (string, SQLParams) {
@@ -388,11 +524,13 @@ func (q *Query) selectCommonQuery(fields []FieldName) (string, SQLParams, map[st
 	// Where clause and args
 	whereSQL, args := q.sqlWhereClause(true)
 	ctxOrderSQL := q.sqlCtxOrderBy()
-	if ctxOrderSQL != "" {
-		ctxOrderSQL = fmt.Sprintf(", %s", ctxOrderSQL)
+	aliases := make([]string, 0, len(fieldSubsts))
+	for alias := range fieldSubsts {
+		aliases = append(aliases, alias)
 	}
-	selQuery := fmt.Sprintf(`SELECT DISTINCT ON (%s.id) %s FROM %s %s ORDER BY %s.id %s`,
-		q.thisTable(), fieldsSQL, tablesSQL, whereSQL, q.thisTable(), ctxOrderSQL)
+	sort.Strings(aliases)
+	adapter := adapters[db.DriverName()]
+	selQuery := adapter.distinctOnIDQuery(q.thisTable(), fieldsSQL, aliases, tablesSQL, whereSQL, ctxOrderSQL)
 	selQuery = strutils.Substitute(selQuery, joinsMap)
 	return selQuery, args, fieldSubsts
 }
@@ -411,11 +549,11 @@ func (q *Query) selectQuery(fields []FieldName) (string, SQLParams, map[string]s
 		log.Panic("Calling selectQuery on a Group By query")
 	}
 	subQuery, args, substs := q.selectCommonQuery(fields)
-	orderSQL := q.sqlOrderByClause()
+	orderSQL, orderArgs := q.sqlOrderByClause()
 	limitSQL := q.sqlLimitOffsetClause()
 	selQuery := fmt.Sprintf(`SELECT * FROM (%s) foo %s %s`,
 		subQuery, orderSQL, limitSQL)
-	return selQuery, args, substs
+	return selQuery, args.Extend(orderArgs), substs
 }
 
 // selectGroupQuery returns the SQL query string and parameters to retrieve
@@ -433,25 +571,58 @@ func (q *Query) selectGroupQuery(fieldsList []FieldName, aggFncts map[string]str
 	for _, fe := range fieldExprs {
 		fieldsList = append(fieldsList, joinFieldNames(fe, ExprSep))
 	}
-	// Get base query
-	baseQuery, baseArgs, _ := q.selectCommonQuery(fieldsList)
+	// Get base query, which also selects the fields of the aggregates and of the having clause
+	baseFields := fieldsList
+	baseFieldsMap := make(map[string]bool)
+	for _, f := range fieldsList {
+		baseFieldsMap[f.JSON()] = true
+	}
+	extraExprs := make([][]FieldName, len(q.aggs))
+	for i, agg := range q.aggs {
+		extraExprs[i] = splitFieldNames(agg.Field, ExprSep)
+	}
+	if q.having != nil {
+		extraExprs = append(extraExprs, q.having.getAllExpressions(q.recordSet.model)...)
+	}
+	for _, exprs := range extraExprs {
+		f := joinFieldNames(exprs, ExprSep)
+		if !baseFieldsMap[f.JSON()] {
+			baseFields = append(baseFields, f)
+			baseFieldsMap[f.JSON()] = true
+		}
+	}
+	baseQuery, baseArgs, _ := q.selectCommonQuery(baseFields)
 	// Build up the query
 	// Fields
 	fieldsSQL := q.fieldsGroupSQL(fieldExprs, aggFncts)
 	// Group by clause
 	groupSQL := q.sqlGroupByClause()
+	// Having clause
+	var havingSQL string
+	if q.having != nil {
+		sql, args := q.conditionSQLClause(q.having)
+		if sql != "" {
+			havingSQL = fmt.Sprintf("HAVING %s", sql)
+			baseArgs = baseArgs.Extend(args)
+		}
+	}
 	orderSQL := q.sqlOrderByClauseForGroupBy(aggFncts)
 	limitSQL := q.sqlLimitOffsetClause()
-	selQuery := fmt.Sprintf(`SELECT %s, count(1) AS __count FROM (%s) base GROUP BY %s %s %s`,
-		fieldsSQL, baseQuery, groupSQL, orderSQL, limitSQL)
+	selQuery := fmt.Sprintf(`SELECT %s, count(1) AS __count FROM (%s) base GROUP BY %s %s %s %s`,
+		fieldsSQL, baseQuery, groupSQL, havingSQL, orderSQL, limitSQL)
 	return selQuery, baseArgs
 }
 
+// aggregateAlias returns the column alias of the i-th aggregate of a grouped query
+func aggregateAlias(i int) string {
+	return fmt.Sprintf("__agg%d", i)
+}
+
 // selectData returns for this query:
 // - Expressions defined by the given fields and that must appear in the field list of the select clause.
 // - All expressions that also include expressions used in the where clause.
 func (q *Query) selectData(fields []FieldName, withCtx bool) ([][]FieldName, [][]FieldName) {
-	q.substituteChildOfPredicates()
+	q.substituteOperatorPredicates()
 	// Get all expressions, first given by fields
 	fieldExprs := make([][]FieldName, len(fields))
 	fieldsExprsMap := make(map[string][]FieldName)
@@ -479,10 +650,10 @@ func (q *Query) selectData(fields []FieldName, withCtx bool) ([][]FieldName, [][
 	return fieldExprs, allExprs
 }
 
-// substituteChildOfPredicates replaces in the query the predicates with ChildOf
-// operator by the predicates to actually execute.
-func (q *Query) substituteChildOfPredicates() {
-	q.cond.substituteChildOfOperator(q.recordSet)
+// substituteOperatorPredicates replaces in the query the predicates with ChildOf,
+// ParentOf or Any operators by the predicates to actually execute.
+func (q *Query) substituteOperatorPredicates() {
+	q.cond.substituteOperators(q.recordSet)
 }
 
 // updateQuery returns the SQL update string and parameters to update
@@ -504,6 +675,9 @@ func (q *Query) updateQuery(data FieldMap) (string, SQLParams) {
 		vals[i] = v
 		i++
 	}
+	if versionSQL := q.recordSet.model.versionUpdateSQL(); versionSQL != "" {
+		cols = append(cols, versionSQL)
+	}
 	tableName := adapter.quoteTableName(q.recordSet.model.tableName)
 	updates := strings.Join(cols, ", ")
 	whereSQL, args := q.sqlWhereClause(false)
@@ -534,14 +708,23 @@ func (q *Query) fieldsSQL(fieldExprs [][]FieldName) (string, map[string]string)
 // Parameter must be with the following format (column names):
 // [['user_id', 'name'] ['id'] ['profile_id', 'age']]
 func (q *Query) fieldsGroupSQL(fieldExprs [][]FieldName, aggFncts map[string]string) string {
+	adapter := adapters[db.DriverName()]
 	fStr := make([]string, len(fieldExprs))
 	for i, exprs := range fieldExprs {
+		alias := joinFieldNames(exprs, sqlSep).JSON()
 		aggFnct := aggFncts[joinFieldNames(exprs, ExprSep).JSON()]
 		if aggFnct == "" {
-			fStr[i] = joinFieldNames(exprs, sqlSep).JSON()
+			fStr[i] = alias
+			if groupExpr := q.groupExpressionSQL(exprs, alias); groupExpr != alias {
+				fStr[i] = fmt.Sprintf("%s AS %s", groupExpr, alias)
+			}
 			continue
 		}
-		fStr[i] = fmt.Sprintf("%s(%s) AS %s", aggFnct, joinFieldNames(exprs, sqlSep).JSON(), joinFieldNames(exprs, sqlSep).JSON())
+		fStr[i] = fmt.Sprintf("%s AS %s", adapter.aggregateFunctionSQL(aggFnct, alias), alias)
+	}
+	for i, agg := range q.aggs {
+		alias := joinFieldNames(splitFieldNames(agg.Field, ExprSep), sqlSep).JSON()
+		fStr = append(fStr, fmt.Sprintf("%s AS %s", adapter.aggregateFunctionSQL(string(agg.Function), alias), aggregateAlias(i)))
 	}
 	return strings.Join(fStr, ", ")
 }
@@ -579,14 +762,18 @@ func (q *Query) generateTableJoins(fieldExprs []FieldName) []tableJoin {
 	if len(fieldExprs) > 0 {
 		curExpr = fieldExprs[0]
 	}
+	alias := curMI.tableName
+	if q.alias != "" {
+		// Subqueries have their own alias so as not to mask the tables of the main query
+		alias = q.alias
+	}
 	curTJ := &tableJoin{
 		tableName: currentTableName,
 		joined:    false,
-		alias:     currentTableName,
+		alias:     adapter.quoteTableName(alias),
 		expr:      curExpr,
 	}
 	joins = append(joins, *curTJ)
-	alias := curMI.tableName
 	exprsLen := len(fieldExprs)
 	for i, expr := range fieldExprs {
 		fi, ok := curMI.fields.Get(expr.JSON())
@@ -670,7 +857,7 @@ func (q *Query) tablesSQL(fExprs [][]FieldName) (string, map[string]string) {
 		tJoins := q.generateTableJoins(f)
 		for _, j := range tJoins {
 			if _, exists := joinsMap[j.alias]; !exists {
-				joinsMap[j.alias] = adapter.quoteTableName(fmt.Sprintf("T%d", aliasIndex))
+				joinsMap[j.alias] = adapter.quoteTableName(fmt.Sprintf("%sT%d", q.alias, aliasIndex))
 				if aliasIndex == 0 {
 					joinsMap[j.alias] = j.alias
 				}
@@ -745,17 +932,30 @@ func (q *Query) substituteConditionExprs(substMap map[FieldName][]FieldName) {
 //
 // multi should be true if the operator of the predicate is IN
 func (q *Query) evaluateConditionArgFunctions(p predicate) interface{} {
-	fnctVal := reflect.ValueOf(p.arg)
+	if p.operator == operator.Between {
+		bounds, ok := p.arg.([]interface{})
+		if !ok || len(bounds) != 2 {
+			log.Panic("Between operator expects a low and a high value", "field", p.Field().Name(), "arg", p.arg)
+		}
+		return []interface{}{q.evaluateArgFunction(bounds[0], false), q.evaluateArgFunction(bounds[1], false)}
+	}
+	return q.evaluateArgFunction(p.arg, p.operator.IsMulti())
+}
+
+// evaluateArgFunction returns the result of the given arg called with the RecordSet
+// of this query if it is a function, or arg itself otherwise.
+func (q *Query) evaluateArgFunction(arg interface{}, multi bool) interface{} {
+	fnctVal := reflect.ValueOf(arg)
 	if fnctVal.Kind() != reflect.Func {
-		return p.arg
+		return arg
 	}
 	firstArgType := fnctVal.Type().In(0)
 	if !firstArgType.Implements(reflect.TypeOf((*RecordSet)(nil)).Elem()) {
-		return p.arg
+		return arg
 	}
 	argValue := reflect.ValueOf(q.recordSet)
 	res := fnctVal.Call([]reflect.Value{argValue})
-	return sanitizeArgs(res[0].Interface(), p.operator.IsMulti())
+	return sanitizeArgs(res[0].Interface(), multi)
 }
 
 // getAllExpressions returns all expressions used in this query,
@@ -17,6 +17,7 @@ package models
 import (
 	"fmt"
 	"sort"
+	"strings"
 
 	"github.com/hexya-erp/hexya/src/tools/typesutils"
 )
@@ -81,10 +82,11 @@ func (rc *RecordCollection) retrieveComputeData(fields []FieldName) []recomputeP
 	// Compute all that must be computed and store the values
 	for _, key := range toUpdateKeys {
 		cData := toUpdateData[key]
-		recs := rc
+		// Stored computed fields are recomputed whatever the rights on their model
+		recs := rc.withoutACL()
 		if cData.path != "" {
 			cPath := cData.model.FieldName(cData.path)
-			recs = rc.Env().Pool(cData.model.name).Search(rc.Model().Field(cPath).In(rc.Ids()))
+			recs = recs.Env().Pool(cData.model.name).search(rc.Model().Field(cPath).In(recs.Ids()))
 		}
 		if !cData.stored {
 			// Field is not stored, just invalidating cache
@@ -112,7 +114,13 @@ func (rc *RecordCollection) updateStoredFields(compPairs []recomputePair) {
 }
 
 // applyMethod calls the method on this recordset.
+//
+// Records whose computed values changed are updated, with a single
+// Write call for all the records that get the same values.
 func (rc *RecordCollection) applyMethod(methodName string) {
+	var keys []string
+	toWriteIds := make(map[string][]int64)
+	toWriteData := make(map[string]*ModelData)
 	for _, rec := range rc.Records() {
 		retVal := rec.Call(methodName)
 		data := retVal.(RecordData).Underlying()
@@ -134,10 +142,29 @@ func (rc *RecordCollection) applyMethod(methodName string) {
 				break
 			}
 		}
-		if doUpdate {
-			rec.WithContext("hexya_force_compute_write", true).Call("Write", data)
+		if !doUpdate {
+			continue
+		}
+		key := valuesKey(data.FieldMap)
+		if _, exists := toWriteData[key]; !exists {
+			keys = append(keys, key)
+			toWriteData[key] = data
 		}
+		toWriteIds[key] = append(toWriteIds[key], rec.ids[0])
+	}
+	for _, key := range keys {
+		recs := newRecordCollection(rc.Env(), rc.ModelName()).withIds(toWriteIds[key])
+		recs.withoutACL().WithContext("hexya_force_compute_write", true).Call("Write", toWriteData[key])
+	}
+}
+
+// valuesKey returns a string which is the same for FieldMaps with the same values
+func valuesKey(fMap FieldMap) string {
+	var res strings.Builder
+	for _, k := range fMap.OrderedKeys() {
+		fmt.Fprintf(&res, "%s=%T:%v;", k, fMap[k], fMap[k])
 	}
+	return res.String()
 }
 
 // processInverseMethods executes inverse methods of fields in the given
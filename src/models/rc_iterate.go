@@ -0,0 +1,100 @@
+// Copyright 2019 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package models
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/hexya-erp/hexya/src/models/security"
+	"github.com/jmoiron/sqlx"
+)
+
+// iterateCursorsCount is used to give a unique name to the cursors of Iterate
+var iterateCursorsCount uint64
+
+// Iterate calls fnct successively with RecordSets of at most batchSize records
+// matching the query of this RecordCollection, until all records have been
+// processed or fnct returns false.
+//
+// Contrary to Fetch, Iterate does not load all the matching ids into memory.
+// Ids are read in batches from a server-side cursor if the database supports it,
+// and the stored fields of each batch are loaded before fnct is called. Records
+// are evicted from the cache once processed, so that very large RecordSets can be
+// processed in constant memory.
+//
+// Records are iterated in the order of this RecordCollection, or in the default
+// order of the model if none is set. Record rules and Limit/Offset are applied.
+func (rc *RecordCollection) Iterate(batchSize int, fnct func(RecordSet) bool) {
+	rc.CheckExecutionPermission(rc.model.methods.MustGet("Load"))
+	if batchSize < 1 {
+		log.Panic("Batch size must be at least 1", "model", rc.model, "batchSize", batchSize)
+	}
+	if rc.hasNegIds {
+		log.Panic("Trying to iterate over a memory RecordSet created by New", "model", rc.model, "ids", rc.ids)
+	}
+	if rc.query.isEmpty() {
+		return
+	}
+	if len(rc.query.groups) > 0 {
+		log.Panic("Trying to iterate over a grouped query", "model", rc.model, "groups", rc.query.groups)
+	}
+	rSet := rc.addRecordRuleConditions(rc.env.uid, security.Read)
+	rSet.applyDefaultOrder()
+	orders := make([]orderPredicate, len(rSet.query.orders))
+	copy(orders, rSet.query.orders)
+	addNameSearchesToCondition(rSet.model, rSet.query.cond)
+	rSet.applyContexts()
+	rSet = rSet.substituteRelatedInQuery()
+	query, args, substs := rSet.query.selectQuery([]FieldName{ID})
+
+	processBatch := func(ids []int64) bool {
+		batch := newRecordCollection(rc.Env(), rc.ModelName()).withIds(ids)
+		batch.query.orders = orders
+		batch = batch.Load()
+		cont := fnct(batch)
+		for _, id := range ids {
+			rc.env.cache.invalidateRecord(rc.model, id)
+		}
+		return cont
+	}
+
+	adapter := adapters[db.DriverName()]
+	name := fmt.Sprintf("hexya_iterate_%d", atomic.AddUint64(&iterateCursorsCount, 1))
+	declareQuery, fetchQuery, closeQuery := adapter.cursorQueries(name, query, batchSize)
+	if declareQuery == "" {
+		rows := dbQuery(rc.env.cr.tx, query, args...)
+		defer rows.Close()
+		for {
+			ids := rc.model.scanIds(rows, substs, batchSize)
+			if len(ids) == 0 || !processBatch(ids) || len(ids) < batchSize {
+				return
+			}
+		}
+	}
+	rc.env.cr.Execute(declareQuery, args...)
+	for {
+		rows := dbQuery(rc.env.cr.tx, fetchQuery)
+		ids := rc.model.scanIds(rows, substs, batchSize)
+		rows.Close()
+		if len(ids) == 0 || !processBatch(ids) || len(ids) < batchSize {
+			break
+		}
+	}
+	// The cursor is not closed if fnct panics, but it is dropped with the transaction
+	rc.env.cr.Execute(closeQuery)
+}
+
+// scanIds returns the ids of at most count rows of this model read from rows.
+func (m *Model) scanIds(rows *sqlx.Rows, substs map[string]string, count int) []int64 {
+	ids := make([]int64, 0, count)
+	for len(ids) < count && rows.Next() {
+		line := make(FieldMap)
+		if err := m.scanToFieldMap(rows, &line, substs); err != nil {
+			log.Panic(err.Error(), "model", m.name)
+		}
+		ids = append(ids, line["id"].(int64))
+	}
+	return ids
+}
@@ -14,7 +14,10 @@
 
 package models
 
-import "github.com/hexya-erp/hexya/src/models/security"
+import (
+	"github.com/hexya-erp/hexya/src/models/security"
+	"github.com/hexya-erp/hexya/src/tools/exceptions"
+)
 
 // addRecordRuleConditions adds the RecordRule conditions on the query of this
 // RecordSet for the user with the given uid and for the given perm Permission.
@@ -26,7 +29,7 @@ func (rc *RecordCollection) addRecordRuleConditions(uid int64, perm security.Per
 	// Add global rules
 	for _, rule := range rSet.model.rulesRegistry.globalRules {
 		if perm&rule.Perms > 0 {
-			rSet = rSet.Search(rule.Condition)
+			rSet = rSet.search(rule.Condition)
 		}
 	}
 	// Add groups rules
@@ -40,9 +43,41 @@ func (rc *RecordCollection) addRecordRuleConditions(uid int64, perm security.Per
 		}
 	}
 	if !groupCondition.IsEmpty() {
-		rSet = rSet.Search(groupCondition)
+		rSet = rSet.search(groupCondition)
 	}
 	rSet.filtered = true
 	*rc = *rSet
 	return rc
 }
+
+// checkFieldsAccess panics with an AccessError if the user of this RecordCollection
+// is not allowed to access one of the given fields. perm is the permission
+// reported in the error.
+func (rc *RecordCollection) checkFieldsAccess(fields FieldNames, perm security.Permission) {
+	for _, field := range fields {
+		fi := rc.model.getRelatedFieldInfo(field)
+		if fi.isAccessibleBy(rc.env.uid) {
+			continue
+		}
+		log.Warn("Field access denied", "model", fi.model.name, "field", fi.name, "operation", perm, "uid", rc.env.uid)
+		panic(exceptions.AccessError{
+			Model:     fi.model.name,
+			Field:     fi.name,
+			Operation: perm.String(),
+			UID:       rc.env.uid,
+		})
+	}
+}
+
+// filterAccessibleFields returns the given fields without those that the
+// user of this RecordCollection is not allowed to access.
+func (rc *RecordCollection) filterAccessibleFields(fields FieldNames) FieldNames {
+	res := make(FieldNames, 0, len(fields))
+	for _, field := range fields {
+		if !rc.model.getRelatedFieldInfo(field).isAccessibleBy(rc.env.uid) {
+			continue
+		}
+		res = append(res, field)
+	}
+	return res
+}
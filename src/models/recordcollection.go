@@ -25,6 +25,8 @@ import (
 	"github.com/hexya-erp/hexya/src/models/fieldtype"
 	"github.com/hexya-erp/hexya/src/models/security"
 	"github.com/hexya-erp/hexya/src/models/types/dates"
+	"github.com/hexya-erp/hexya/src/tools/exceptions"
+	"github.com/hexya-erp/hexya/src/tools/strutils"
 	"github.com/jmoiron/sqlx"
 )
 
@@ -152,6 +154,8 @@ func (rc *RecordCollection) create(data RecordData) *RecordCollection {
 		}
 	}()
 	rc.CheckExecutionPermission(rc.model.methods.MustGet("Create"))
+	rc.checkModelAccess(security.Create)
+	rc.checkFieldsAccess(data.Underlying().FieldMap.FieldNames(rc.model), security.Create)
 	// process create data for FK relations if any
 	data = rc.createFKRelationRecords(data)
 
@@ -170,6 +174,8 @@ func (rc *RecordCollection) create(data RecordData) *RecordCollection {
 	var createdId int64
 	query, args := rc.query.insertQuery(storedFieldMap)
 	rc.env.cr.Get(&createdId, query, args...)
+	rc.auditCreate(createdId, storedFieldMap)
+	rc.addChangeEvent(EventCreate, []int64{createdId}, storedFieldMap)
 
 	rc.env.cache.addRecord(rc.model, createdId, storedFieldMap, rc.query.ctxArgsSlug())
 	rSet := rc.withIds([]int64{createdId})
@@ -183,9 +189,149 @@ func (rc *RecordCollection) create(data RecordData) *RecordCollection {
 	rSet.processInverseMethods(data)
 	rSet.processTriggers(fMap.FieldNames(rSet.model))
 	rSet.CheckConstraints()
+	rSet.checkCompanies(fMap.FieldNames(rSet.model))
 	return rSet
 }
 
+// CreateMulti inserts a record in the database for each of the given data
+// and returns the created RecordCollection, with records in the order of data.
+//
+// Contrary to calling Create for each record, rows are inserted with multi-row
+// INSERT queries, and stored computed fields and constraints are processed once
+// for all the records. CreateMulti is meant for importing large amounts of data.
+//
+// CreateMulti does not call the Create method, so that overrides of Create are
+// not executed.
+func (rc *RecordCollection) CreateMulti(data []RecordData) *RecordCollection {
+	defer func() {
+		if r := recover(); r != nil {
+			panic(rc.substituteSQLErrorMessage(r))
+		}
+	}()
+	rc.CheckExecutionPermission(rc.model.methods.MustGet("Create"))
+	rc.checkModelAccess(security.Create)
+	if len(data) == 0 {
+		return newRecordCollection(rc.Env(), rc.ModelName()).withIds([]int64{})
+	}
+	rc.applyContexts()
+	recsData := make([]RecordData, len(data))
+	fMaps := make([]FieldMap, len(data))
+	storedFieldMaps := make([]FieldMap, len(data))
+	keysMap := make(map[string]FieldName)
+	for i, d := range data {
+		rc.checkFieldsAccess(d.Underlying().FieldMap.FieldNames(rc.model), security.Create)
+		recsData[i] = rc.createFKRelationRecords(d)
+		newData := recsData[i].Underlying().Copy()
+		rc.applyDefaults(newData, true)
+		fMap := newData.FieldMap
+		rc.addAccessFieldsCreateData(&fMap)
+		fMap = rc.addEmbeddedfields(fMap)
+		rc.model.convertValuesToFieldType(&fMap, true)
+		fMap = rc.addContextsFieldsValues(fMap)
+		fMap.RemovePKIfZero()
+		fMaps[i] = fMap
+		storedFieldMaps[i] = filterMapOnStoredFields(rc.model, fMap)
+		for _, key := range fMap.FieldNames(rc.model) {
+			keysMap[key.JSON()] = key
+		}
+	}
+	ids := rc.insertRecords(storedFieldMaps)
+	for i, id := range ids {
+		rc.auditCreate(id, storedFieldMaps[i])
+		rc.addChangeEvent(EventCreate, []int64{id}, storedFieldMaps[i])
+		rc.env.cache.addRecord(rc.model, id, storedFieldMaps[i], rc.query.ctxArgsSlug())
+	}
+	for i, id := range ids {
+		rec := newRecordCollection(rc.Env(), rc.ModelName()).withIds([]int64{id})
+		rec.updateRelationFields(fMaps[i])
+		rec.updateRelatedFields(fMaps[i])
+		rec.createReverseRelationRecords(recsData[i])
+		rec.processInverseMethods(recsData[i])
+	}
+	keys := make([]FieldName, 0, len(keysMap))
+	for _, key := range keysMap {
+		keys = append(keys, key)
+	}
+	rSet := rc.withIds(ids)
+	rSet.processTriggers(keys)
+	rSet.CheckConstraints()
+	rSet.checkCompanies(keys)
+	return rSet
+}
+
+// insertRecords inserts a row for each of the given FieldMaps in the database
+// and returns the ids of the inserted rows in the same order.
+//
+// Rows with the same columns are inserted together with multi-row INSERT queries.
+// Since the database does not guarantee the order of the returned ids, inserted rows
+// are matched with the given FieldMaps by their external ID. Rows without external
+// ID are inserted one at a time.
+func (rc *RecordCollection) insertRecords(fMaps []FieldMap) []int64 {
+	var colsKeys []string
+	colsByKey := make(map[string][]string)
+	indicesByKey := make(map[string][]int)
+	for i, fMap := range fMaps {
+		cols := rc.query.insertColumns(fMap)
+		key := strings.Join(cols, ",")
+		if _, exists := colsByKey[key]; !exists {
+			colsKeys = append(colsKeys, key)
+			colsByKey[key] = cols
+		}
+		indicesByKey[key] = append(indicesByKey[key], i)
+	}
+	ids := make([]int64, len(fMaps))
+	for _, key := range colsKeys {
+		cols := colsByKey[key]
+		if len(cols) == 0 {
+			log.Panic("No data given for insert", "model", rc.model)
+		}
+		indices := indicesByKey[key]
+		chunkSize := 1
+		if strutils.IsIn("hexya_external_id", cols...) {
+			chunkSize = adapters[db.DriverName()].maxQueryParams() / len(cols)
+		}
+		for start := 0; start < len(indices); start += chunkSize {
+			end := start + chunkSize
+			if end > len(indices) {
+				end = len(indices)
+			}
+			rows := make([]FieldMap, end-start)
+			for j, index := range indices[start:end] {
+				rows[j] = make(FieldMap, len(cols))
+				for field, value := range fMaps[index] {
+					rows[j][rc.model.fields.MustGet(field).json] = value
+				}
+			}
+			if len(rows) == 1 {
+				query, args := rc.query.insertMultiQuery(cols, rows, false)
+				rc.env.cr.Get(&ids[indices[start]], query, args...)
+				continue
+			}
+			query, args := rc.query.insertMultiQuery(cols, rows, true)
+			var created []struct {
+				ID              int64
+				HexyaExternalID string
+			}
+			rc.env.cr.Select(&created, query, args...)
+			if len(created) != len(rows) {
+				log.Panic("Unexpected number of inserted rows", "model", rc.model, "expected", len(rows), "inserted", len(created))
+			}
+			createdIds := make(map[string]int64, len(created))
+			for _, c := range created {
+				createdIds[c.HexyaExternalID] = c.ID
+			}
+			for j, index := range indices[start:end] {
+				id, ok := createdIds[fmt.Sprint(rows[j]["hexya_external_id"])]
+				if !ok {
+					log.Panic("Unable to match inserted row", "model", rc.model, "externalID", rows[j]["hexya_external_id"])
+				}
+				ids[index] = id
+			}
+		}
+	}
+	return ids
+}
+
 // createReverseRelationRecords creates the reverse records of relation fields when
 // the given data contains such directive.
 func (rc *RecordCollection) createReverseRelationRecords(data RecordData) {
@@ -334,27 +480,57 @@ func (rc *RecordCollection) addContextsFieldsValues(fMap FieldMap) FieldMap {
 // CheckConstraints executes the constraint method for each field defined
 // in the given fMap with the corresponding value.
 // Each method is only executed once, even if it is called by several fields.
-// It panics as soon as one constraint fails.
+// It panics with an exceptions.ValidationError as soon as one constraint fails.
 func (rc *RecordCollection) CheckConstraints() {
 	if rc.env.context.GetBool("hexya_skip_check_constraints") {
 		return
 	}
-	methods := make(map[string]bool)
+	methods := make(map[string][]string)
 	for _, fi := range rc.model.fields.registryByJSON {
 		if fi.constraint != "" {
-			methods[fi.constraint] = true
+			methods[fi.constraint] = append(methods[fi.constraint], fi.json)
 		}
 	}
 	if len(methods) == 0 {
 		return
 	}
-	for method := range methods {
+	for method, fields := range methods {
+		var field string
+		if len(fields) == 1 {
+			field = fields[0]
+		}
 		for _, rec := range rc.Records() {
-			rec.Call(method)
+			rec.checkConstraint(method, field)
 		}
 	}
 }
 
+// checkConstraint calls the given constraint method on this RecordCollection.
+//
+// If the method panics with an exceptions.UserError, checkConstraint panics with an
+// exceptions.ValidationError with the same message instead. Other panics, including
+// those of log.Panic, are programming errors and are propagated as is.
+// field is the JSON name of the field the constraint applies on, if any.
+func (rc *RecordCollection) checkConstraint(method, field string) {
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		valErr := exceptions.ValidationError{Model: rc.model.name, Field: field}
+		switch err := r.(type) {
+		case exceptions.ValidationError:
+			panic(err)
+		case exceptions.UserError:
+			valErr.Message = err.Message
+		default:
+			panic(r)
+		}
+		panic(valErr)
+	}()
+	rc.Call(method)
+}
+
 // addAccessFieldsCreateData adds appropriate CreateDate and CreateUID fields to
 // the given FieldMap.
 func (rc *RecordCollection) addAccessFieldsCreateData(fMap *FieldMap) {
@@ -370,9 +546,14 @@ func (rc *RecordCollection) addAccessFieldsCreateData(fMap *FieldMap) {
 // This function is private and low level. It should not be called directly.
 // Instead use rs.Call("Write")
 func (rc *RecordCollection) update(data RecordData) bool {
+	if !rc.env.bypassACL {
+		rc.checkModelAccess(security.Write)
+		rc.checkFieldsAccess(data.Underlying().FieldMap.FieldNames(rc.model), security.Write)
+	}
 	if !rc.hasNegIds && rc.ForceLoad(ID).IsEmpty() {
 		return true
 	}
+	data = rc.checkConcurrentUpdate(data)
 	rSet := rc.addRecordRuleConditions(rc.env.uid, security.Write)
 	// process create data for FK relations if any
 	data = rc.createFKRelationRecords(data)
@@ -398,6 +579,7 @@ func (rc *RecordCollection) update(data RecordData) bool {
 	// compute stored fields
 	rSet.processTriggers(fMap.FieldNames(rSet.model))
 	rSet.CheckConstraints()
+	rSet.checkCompanies(fMap.FieldNames(rSet.model))
 	return true
 }
 
@@ -433,16 +615,24 @@ func (rc *RecordCollection) doUpdate(fMap FieldMap) {
 		}
 	}
 	if !rc.hasNegIds {
+		oldValues := rc.auditOldValues(rc.model.auditedFields(fMap.OrderedKeys()...))
 		query, args := rc.query.updateQuery(fMap)
 		res := rc.env.cr.Execute(query, args...)
 		if num, _ := res.RowsAffected(); num == 0 {
 			log.Panic("Unexpected noop on update (num = 0)", "model", rc.ModelName(), "values", fMap, "query", query, "args", args)
 		}
+		rc.auditWrite(oldValues, fMap)
+		rc.addChangeEvent(EventWrite, rc.ids, fMap)
+		rc.invalidateSharedCache(rc.ids...)
 	}
 	for _, rec := range rc.Records() {
 		for k, v := range fMap {
 			rc.env.cache.updateEntry(rc.model, rec.Ids()[0], k, v, rc.query.ctxArgsSlug())
 		}
+		if rc.model.versioned && !rc.hasNegIds {
+			// The version has been incremented by the database
+			rc.env.cache.removeEntry(rc.model, rec.Ids()[0], versionFieldJSON, rc.query.ctxArgsSlug())
+		}
 	}
 }
 
@@ -459,8 +649,8 @@ func (rc *RecordCollection) updateRelationFields(fMap FieldMap) {
 			if rc.Len() > 1 {
 				log.Warn("Updating one2many relation on multiple record at once", "model", rc.ModelName(), "field", field)
 			}
-			curRS := rc.env.Pool(fi.relatedModelName).Search(fi.relatedModel.Field(ID).In(rc.Get(rc.model.FieldName(fi.name)).(RecordSet).Collection()))
-			newRS := rc.env.Pool(fi.relatedModelName).Search(fi.relatedModel.Field(ID).In(value.([]int64)))
+			curRS := rc.env.Pool(fi.relatedModelName).search(fi.relatedModel.Field(ID).In(rc.Get(rc.model.FieldName(fi.name)).(RecordSet).Collection()))
+			newRS := rc.env.Pool(fi.relatedModelName).search(fi.relatedModel.Field(ID).In(value.([]int64)))
 			// Remove ReverseFK for Records that are no longer our children
 			toRemove := curRS.Subtract(newRS)
 			if toRemove.Len() > 0 {
@@ -626,8 +816,9 @@ func (rc *RecordCollection) relatedRecordMap(fMap FieldMap, field FieldName) (Fi
 	return res, prefix
 }
 
-// substituteSQLErrorMessage changes the message from the given recover data
-// if it comes from the database with the message defined in this model
+// substituteSQLErrorMessage returns an exceptions.ValidationError with the message
+// defined in this model if the given recover data is the error of one of the SQL
+// constraints of this model. Otherwise it returns the given data unchanged.
 func (rc *RecordCollection) substituteSQLErrorMessage(r interface{}) interface{} {
 	err, ok := r.(error)
 	if !ok {
@@ -635,8 +826,10 @@ func (rc *RecordCollection) substituteSQLErrorMessage(r interface{}) interface{}
 	}
 	for constraintName, constraint := range rc.model.sqlConstraints {
 		if strings.Contains(err.Error(), constraintName) {
-			res := adapters[db.DriverName()].substituteErrorMessage(err, constraint.errorString)
-			return res
+			return exceptions.ValidationError{
+				Model:   rc.model.name,
+				Message: constraint.errorString,
+			}
 		}
 	}
 	return r
@@ -647,6 +840,7 @@ func (rc *RecordCollection) substituteSQLErrorMessage(r interface{}) interface{}
 // Instead use rs.Unlink() or rs.Call("Unlink")
 func (rc *RecordCollection) unlink() int64 {
 	rc.CheckExecutionPermission(rc.model.methods.MustGet("Unlink"))
+	rc.checkModelAccess(security.Unlink)
 	rSet := rc.addRecordRuleConditions(rc.env.uid, security.Unlink)
 	ids := rSet.Ids()
 	if rSet.IsEmpty() {
@@ -656,9 +850,12 @@ func (rc *RecordCollection) unlink() int64 {
 	compData := rc.retrieveComputeData(rc.model.fields.allFieldNames())
 	var num int64
 	if !rSet.hasNegIds {
+		rSet.auditUnlink(rSet.auditOldValues(rSet.model.auditedFields()))
 		query, args := rSet.query.deleteQuery()
 		res := rSet.env.cr.Execute(query, args...)
 		num, _ = res.RowsAffected()
+		rSet.addChangeEvent(EventUnlink, ids, nil)
+		rSet.invalidateSharedCacheOnUnlink(ids)
 	}
 	for _, id := range ids {
 		rc.env.cache.invalidateRecord(rc.model, id)
@@ -669,14 +866,59 @@ func (rc *RecordCollection) unlink() int64 {
 }
 
 // Search returns a new RecordSet filtering on the current one with the
-// additional given Condition
+// additional given Condition.
+//
+// It panics with an AccessError if the user is not allowed to read this model.
 func (rc *RecordCollection) Search(cond *Condition) *RecordCollection {
+	rc.checkModelAccess(security.Read)
+	return rc.search(cond)
+}
+
+// search returns a new RecordSet filtering on the current one with the
+// additional given Condition, without checking access rights.
+func (rc *RecordCollection) search(cond *Condition) *RecordCollection {
 	rSetVal := *rc
 	rSetVal.query = rc.query.clone(&rSetVal)
 	rSetVal.query.cond = rSetVal.query.cond.AndCond(cond)
 	return &rSetVal
 }
 
+// defaultSearchCondition returns the given condition completed with the
+// conditions that apply to all searches of this model, such as the active test
+// of archivable models or the allowed companies of multi-company models.
+func (rc *RecordCollection) defaultSearchCondition(cond *Condition) *Condition {
+	return rc.companyCondition(rc.activeTestCondition(cond))
+}
+
+// activeTestCondition returns the given condition restricted to active records
+// if this is an archivable model.
+//
+// The condition is returned unchanged if it already filters on the Active field
+// or if the 'active_test' context key is set to false.
+func (rc *RecordCollection) activeTestCondition(cond *Condition) *Condition {
+	if !rc.model.isArchivable() {
+		return cond
+	}
+	if rc.env.context.HasKey("active_test") && !rc.env.context.GetBool("active_test") {
+		return cond
+	}
+	activeField := rc.model.fields.MustGet("Active")
+	if cond.HasField(activeField) {
+		return cond
+	}
+	return cond.AndCond(rc.model.Field(rc.model.FieldName("Active")).Equals(true))
+}
+
+// searchWithArchived calls the Search method with the given condition and
+// returns matching records including archived ones.
+func (rc *RecordCollection) searchWithArchived(cond *Condition) *RecordCollection {
+	if !rc.model.isArchivable() {
+		return rc.Call("Search", cond).(RecordSet).Collection()
+	}
+	res := rc.WithContext("active_test", false).Call("Search", cond).(RecordSet).Collection()
+	return res.WithEnv(rc.Env())
+}
+
 // Limit returns a new RecordSet with only the first 'limit' records.
 func (rc *RecordCollection) Limit(limit int) *RecordCollection {
 	rSet := *rc
@@ -733,6 +975,7 @@ func (rc *RecordCollection) Fetch() *RecordCollection {
 // SearchAll returns a new RecordSet with all items of the table, regardless of the
 // current RecordSet query. It is mainly meant to be used on an empty RecordSet
 func (rc *RecordCollection) SearchAll() *RecordCollection {
+	rc.checkModelAccess(security.Read)
 	rSet := rc.env.Pool(rc.ModelName())
 	rSet.query.fetchAll = true
 	return rSet
@@ -758,6 +1001,7 @@ func (rc *RecordCollection) Load(fields ...FieldName) *RecordCollection {
 	if len(fields) == 0 {
 		fields = rc.model.fields.storedFieldNames()
 	}
+	fields = rc.filterAccessibleFields(fields)
 	cacheFields := make([]string, len(fields))
 	for i, v := range fields {
 		cacheFields[i] = v.JSON()
@@ -765,6 +1009,10 @@ func (rc *RecordCollection) Load(fields ...FieldName) *RecordCollection {
 	if rc.env.cache.checkIfInCache(rc.model, rc.ids, cacheFields, rc.query.ctxArgsSlug(), true) {
 		return rc
 	}
+	rc.checkReadAccess()
+	if rc.loadFromSharedCache(cacheFields) {
+		return rc
+	}
 	return rc.ForceLoad(fields...)
 }
 
@@ -777,6 +1025,7 @@ func (rc *RecordCollection) Load(fields ...FieldName) *RecordCollection {
 // be explicitly given in fields to be retrieved.
 func (rc *RecordCollection) ForceLoad(fieldNames ...FieldName) *RecordCollection {
 	rc.CheckExecutionPermission(rc.model.methods.MustGet("Load"))
+	rc.checkReadAccess()
 	if rc.query.isEmpty() {
 		// Never load RecordSets without query.
 		return rc
@@ -802,6 +1051,7 @@ func (rc *RecordCollection) ForceLoad(fieldNames ...FieldName) *RecordCollection
 	if len(fields) == 0 {
 		fields = rSet.model.fields.storedFieldNames()
 	}
+	fields = addIDIfNotPresent(rSet.filterAccessibleFields(fields))
 	addNameSearchesToCondition(rSet.model, rSet.query.cond)
 	rSet.applyContexts()
 	subFields, _ := rSet.substituteRelatedFields(fields)
@@ -818,6 +1068,7 @@ func (rc *RecordCollection) ForceLoad(fieldNames ...FieldName) *RecordCollection
 			log.Panic(err.Error(), "model", rSet.ModelName(), "fields", fields)
 		}
 		rSet.env.cache.addRecord(rSet.model, line["id"].(int64), line, rc.query.ctxArgsSlug())
+		rSet.storeInSharedCache(line["id"].(int64), line)
 		ids = append(ids, line["id"].(int64))
 	}
 
@@ -910,6 +1161,10 @@ func (rc *RecordCollection) Get(fieldName FieldName) interface{} {
 	switch {
 	case rc.IsEmpty():
 		res = reflect.Zero(fi.structField.Type).Interface()
+	case !fi.isAccessibleBy(rc.env.uid):
+		// Fields restricted to groups of which the user is not a member
+		// are returned as their zero value.
+		res = nil
 	case fi.isComputedField() && !fi.isStored():
 		prefix := joinFieldNames(exprs[:len(exprs)-1], ExprSep)
 		relRC := rc
@@ -1045,6 +1300,13 @@ func (rc *RecordCollection) Aggregates(fieldNames ...FieldName) []GroupAggregate
 	dbFields := filterOnDBFields(rSet.model, subFields, true)
 
 	rSet = rSet.fixGroupByOrders(subFields...)
+	aggs := make([]Aggregate, len(rSet.query.aggs))
+	for i, agg := range rSet.query.aggs {
+		aggs[i] = Aggregate{Field: rSet.substituteRelatedInPath(agg.Field), Function: agg.Function}
+	}
+	rSet = rSet.clone()
+	rSet.query.aggs = aggs
+	_, loc := rSet.query.groupTimezone()
 
 	query, args := rSet.query.selectGroupQuery(rSet.fieldsGroupOperators(dbFields))
 	var res []GroupAggregateRow
@@ -1059,11 +1321,26 @@ func (rc *RecordCollection) Aggregates(fieldNames ...FieldName) []GroupAggregate
 		}
 		cnt := vals["__count"].(int64)
 		delete(vals, "__count")
+		aggVals := make(map[string]interface{})
+		for i, agg := range rc.query.aggs {
+			aggVals[agg.String()] = aggregateValue(agg.Function, vals[aggregateAlias(i)])
+			delete(vals, aggregateAlias(i))
+		}
 		vals = substituteKeys(vals, substMap)
+		ends := make(map[string]interface{})
+		for _, group := range groups {
+			granularity, ok := rc.query.periods[group.JSON()]
+			if !ok {
+				continue
+			}
+			fi := rc.model.getRelatedFieldInfo(group)
+			vals[group.JSON()], ends[group.JSON()] = periodBounds(vals[group.JSON()], granularity, fi, loc)
+		}
 		line := GroupAggregateRow{
-			Values:    NewModelDataFromRS(rc, vals),
-			Count:     int(cnt),
-			Condition: getGroupCondition(groups, vals, rc.query.cond),
+			Values:     NewModelDataFromRS(rc, vals),
+			Count:      int(cnt),
+			Condition:  getGroupCondition(groups, vals, ends, rc.query.cond),
+			Aggregates: aggVals,
 		}
 		res = append(res, line)
 	}
@@ -1125,7 +1402,7 @@ func (rc *RecordCollection) fieldsGroupOperators(fields []FieldName) ([]FieldNam
 			continue
 		}
 		fi := rc.model.getRelatedFieldInfo(dbf)
-		if fi.fieldType != fieldtype.Float && fi.fieldType != fieldtype.Integer {
+		if fi.groupOperator == "" {
 			continue
 		}
 		res[dbf.JSON()] = fi.groupOperator
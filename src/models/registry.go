@@ -17,6 +17,8 @@ package models
 import (
 	"fmt"
 	"reflect"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -24,6 +26,7 @@ import (
 	"github.com/hexya-erp/hexya/src/models/fieldtype"
 	"github.com/hexya-erp/hexya/src/models/security"
 	"github.com/hexya-erp/hexya/src/models/types/dates"
+	"github.com/hexya-erp/hexya/src/tools"
 	"github.com/hexya-erp/hexya/src/tools/strutils"
 	"github.com/hexya-erp/hexya/src/tools/typesutils"
 	"github.com/jmoiron/sqlx"
@@ -36,6 +39,19 @@ var transientModelTimeout = 30 * time.Minute
 // Registry is the registry of all Model instances.
 var Registry *modelCollection
 
+// poolPackagePath is the import path of the generated pool packages
+const poolPackagePath = "github.com/hexya-erp/pool"
+
+// modelsPackagePath is the import path of this package
+var modelsPackagePath = reflect.TypeOf(Model{}).PkgPath()
+
+// declaringPackage returns the import path of the package calling the
+// models API, that is the first package of the call stack which is
+// neither this package nor the pool.
+func declaringPackage() string {
+	return tools.CallerPackage(modelsPackagePath, poolPackagePath)
+}
+
 // Option describes a optional feature of a model
 type Option int
 
@@ -66,6 +82,23 @@ func (mc *modelCollection) MustGet(nameOrJSON string) *Model {
 	return mi
 }
 
+// BusinessModels returns all the models of the registry that hold business
+// records, sorted by name. Mixins, system models, many2many link models and
+// context models are not returned.
+func (mc *modelCollection) BusinessModels() []*Model {
+	var res []*Model
+	for _, mi := range mc.registryByName {
+		if mi.isMixin() || mi.isSystem() || mi.isM2MLink() || mi.isContext() {
+			continue
+		}
+		res = append(res, mi)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].name < res[j].name
+	})
+	return res
+}
+
 // GetSequence the given Sequence by name or by db name
 func (mc *modelCollection) GetSequence(nameOrJSON string) (s *Sequence, ok bool) {
 	s, ok = mc.sequences[nameOrJSON]
@@ -126,6 +159,7 @@ type Model struct {
 	name            string
 	options         Option
 	rulesRegistry   *recordRuleRegistry
+	aclRegistry     *accessControlRegistry
 	tableName       string
 	fields          *FieldsCollection
 	methods         *MethodsCollection
@@ -134,6 +168,11 @@ type Model struct {
 	sqlErrors       map[string]string
 	defaultOrderStr []string
 	defaultOrder    []orderPredicate
+	audited         bool
+	auditFields     map[string]bool
+	sharedCached    bool
+	versioned       bool
+	pkgPath         string
 }
 
 // An sqlConstraint holds the data needed to create a table constraint in the database
@@ -141,6 +180,7 @@ type sqlConstraint struct {
 	name        string
 	sql         string
 	errorString string
+	pkgPath     string
 }
 
 // getRelatedModelInfo returns the Model of the related model when
@@ -302,8 +342,25 @@ func (m *Model) isM2MLink() bool {
 	return false
 }
 
+// isArchivable returns true if inactive records of this model must be
+// filtered out of searches.
+func (m *Model) isArchivable() bool {
+	if m.options&ArchivableModel > 0 {
+		return true
+	}
+	return false
+}
+
+// isMultiCompany returns true if the records of this model belong to companies.
+func (m *Model) isMultiCompany() bool {
+	if m.options&MultiCompanyModel > 0 {
+		return true
+	}
+	return false
+}
+
 func (m *Model) isTransient() bool {
-	return m.options == TransientModel
+	return m.options&TransientModel > 0
 }
 
 // hasParentField returns true if this model is recursive and has a Parent field.
@@ -332,10 +389,23 @@ func (m *Model) SetDefaultOrder(orders ...string) {
 	m.defaultOrderStr = orders
 }
 
+// FullTextRank returns an order by expression for OrderBy that sorts records
+// by decreasing relevance of the given field for the given full-text search.
+func FullTextRank(field FieldName, text string) string {
+	return fmt.Sprintf("%s%s, %s) DESC", rankOrderPrefix, field.Name(), strconv.Quote(text))
+}
+
+// rankOrderPrefix is the prefix of order by expressions returned by FullTextRank
+const rankOrderPrefix = "rank("
+
 // ordersFromStrings returns the given order by exprs as a slice of order structs
 func (m *Model) ordersFromStrings(exprs []string) []orderPredicate {
 	res := make([]orderPredicate, len(exprs))
 	for i, o := range exprs {
+		if strings.HasPrefix(o, rankOrderPrefix) {
+			res[i] = m.rankOrderFromString(o)
+			continue
+		}
 		toks := strings.Split(o, " ")
 		var desc bool
 		if len(toks) > 1 && strings.ToLower(toks[1]) == "desc" {
@@ -346,6 +416,28 @@ func (m *Model) ordersFromStrings(exprs []string) []orderPredicate {
 	return res
 }
 
+// rankOrderFromString returns the order struct of the given order by expression
+// returned by FullTextRank, i.e. 'rank(Field, "search text") DESC'.
+func (m *Model) rankOrderFromString(expr string) orderPredicate {
+	end := strings.LastIndex(expr, ")")
+	if end < len(rankOrderPrefix) {
+		log.Panic("Invalid full-text rank order expression", "model", m.name, "expr", expr)
+	}
+	toks := strings.SplitN(expr[len(rankOrderPrefix):end], ",", 2)
+	if len(toks) != 2 {
+		log.Panic("Invalid full-text rank order expression", "model", m.name, "expr", expr)
+	}
+	text, err := strconv.Unquote(strings.TrimSpace(toks[1]))
+	if err != nil {
+		log.Panic("Invalid search text in full-text rank order expression", "model", m.name, "expr", expr, "error", err)
+	}
+	return orderPredicate{
+		field: m.FieldName(strings.TrimSpace(toks[0])),
+		desc:  strings.ToLower(strings.TrimSpace(expr[end+1:])) == "desc",
+		rank:  text,
+	}
+}
+
 // JSONizeFieldName returns the json name of the given fieldName
 // If fieldName is already the json name, returns it without modifying it.
 // fieldName may be a dot separated path from this model.
@@ -424,6 +516,21 @@ func (m *Model) FieldsGet(fields ...FieldName) map[string]*FieldInfo {
 	return res
 }
 
+// AccessibleFieldsGet returns the definition of the fields of this model
+// that the user with the given uid can access, that is the fields that are
+// not restricted to groups this user does not belong to.
+//
+// The result map is indexed by the fields JSON names.
+func (m *Model) AccessibleFieldsGet(uid int64) map[string]*FieldInfo {
+	res := m.FieldsGet()
+	for jsonName := range res {
+		if !m.fields.MustGet(jsonName).isAccessibleBy(uid) {
+			delete(res, jsonName)
+		}
+	}
+	return res
+}
+
 // FilteredOn adds a condition with a table join on the given field and
 // filters the result with the given condition
 func (m *Model) FilteredOn(field FieldName, condition *Condition) *Condition {
@@ -471,6 +578,7 @@ func (m *Model) AddSQLConstraint(name, sql, errorString string) {
 		name:        constraintName,
 		sql:         sql,
 		errorString: errorString,
+		pkgPath:     declaringPackage(),
 	}
 }
 
@@ -479,6 +587,11 @@ func (m *Model) RemoveSQLConstraint(name string) {
 	delete(m.sqlConstraints, fmt.Sprintf("%s_mancon", name))
 }
 
+// Name returns the name of this model
+func (m *Model) Name() string {
+	return m.name
+}
+
 // TableName return the db table name
 func (m *Model) TableName() string {
 	return m.tableName
@@ -499,6 +612,16 @@ func NewModel(name string) *Model {
 	return model
 }
 
+// NewArchivableModel creates a new model with the given name whose
+// records have an Active field. Inactive records are filtered out of
+// searches unless the 'active_test' context key is set to false.
+func NewArchivableModel(name string) *Model {
+	model := createModel(name, ArchivableModel)
+	model.InheritModel(Registry.MustGet("ModelMixin"))
+	model.InheritModel(Registry.MustGet("ArchiveMixin"))
+	return model
+}
+
 // NewMixinModel creates a new mixin model with the given name and
 // extends it with the given struct pointer.
 func NewMixinModel(name string) *Model {
@@ -536,12 +659,14 @@ func createModel(name string, options Option) *Model {
 		name:            name,
 		options:         options,
 		rulesRegistry:   newRecordRuleRegistry(),
+		aclRegistry:     newAccessControlRegistry(),
 		tableName:       strutils.SnakeCase(name),
 		fields:          newFieldsCollection(),
 		methods:         newMethodsCollection(),
 		sqlConstraints:  make(map[string]sqlConstraint),
 		sqlErrors:       make(map[string]string),
 		defaultOrderStr: []string{"ID"},
+		pkgPath:         declaringPackage(),
 	}
 	pk := &Field{
 		name:      "ID",
@@ -0,0 +1,205 @@
+// Copyright 2019 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package models
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hexya-erp/hexya/src/models/security"
+	"github.com/hexya-erp/hexya/src/models/types/dates"
+	"github.com/hexya-erp/hexya/src/tools/cron"
+)
+
+const (
+	// scheduledActionModelName is the name of the model storing the runs of scheduled actions
+	scheduledActionModelName = "HexyaScheduledAction"
+	// maxCatchUpRuns is the maximum number of missed runs executed at once by CatchUpAll actions
+	maxCatchUpRuns = 100
+)
+
+var (
+	// scheduledActionsPeriod is the time between two checks of scheduled actions by the worker loop
+	scheduledActionsPeriod = 30 * time.Second
+	// missedRunTolerance is the delay after which a run of a scheduled action is considered missed
+	missedRunTolerance = 5 * time.Minute
+)
+
+// A CatchUpPolicy defines how the runs of a scheduled action that have been
+// missed, for instance because no server was running, are executed.
+type CatchUpPolicy int8
+
+// Catch up policies of scheduled actions
+const (
+	// CatchUpNone actions do not execute missed runs
+	CatchUpNone CatchUpPolicy = iota
+	// CatchUpOnce actions execute a single run for all missed runs
+	CatchUpOnce
+	// CatchUpAll actions execute each missed run
+	CatchUpAll
+)
+
+// A ScheduledAction is a function executed at the activation times of a cron schedule.
+type ScheduledAction struct {
+	// Name of the action. It must be unique.
+	Name string
+	// Schedule is a cron expression such as "0 2 * * *" for every night at 2:00.
+	// See cron.Parse for the syntax.
+	Schedule string
+	// Timezone in which the schedule is evaluated, such as "Europe/Paris".
+	// Defaults to UTC.
+	Timezone string
+	// CatchUp is the policy for runs missed while no server was running.
+	CatchUp CatchUpPolicy
+	// Fnct is the function to execute. It is called as superuser in a new transaction.
+	Fnct func(env Environment)
+
+	schedule *cron.Schedule
+	location *time.Location
+}
+
+// scheduledActions is the registry of all scheduled actions
+var scheduledActions = struct {
+	sync.RWMutex
+	actions map[string]*ScheduledAction
+}{
+	actions: make(map[string]*ScheduledAction),
+}
+
+// RegisterScheduledAction registers the given action so that it is executed by
+// the worker loop at each activation time of its schedule.
+//
+// The last and next runs of each action are stored in the database, so that
+// an action is run by a single server even if several servers are running.
+func RegisterScheduledAction(action ScheduledAction) {
+	if action.Name == "" || action.Fnct == nil {
+		log.Panic("Scheduled actions must have a name and a function", "name", action.Name)
+	}
+	var err error
+	if action.schedule, err = cron.Parse(action.Schedule); err != nil {
+		log.Panic("Invalid schedule for scheduled action", "name", action.Name, "error", err)
+	}
+	if action.location, err = dates.LoadLocation(action.Timezone); err != nil {
+		log.Panic("Invalid timezone for scheduled action", "name", action.Name, "timezone", action.Timezone, "error", err)
+	}
+	if action.schedule.Next(time.Now().In(action.location)).IsZero() {
+		log.Panic("Schedule of scheduled action never activates", "name", action.Name, "schedule", action.Schedule)
+	}
+	scheduledActions.Lock()
+	defer scheduledActions.Unlock()
+	if _, exists := scheduledActions.actions[action.Name]; exists {
+		log.Panic("Scheduled action already registered", "name", action.Name)
+	}
+	scheduledActions.actions[action.Name] = &action
+}
+
+// declareScheduledActionModel creates the system model that stores the runs of scheduled actions
+func declareScheduledActionModel() {
+	model := createModel(scheduledActionModelName, SystemModel)
+	model.AddFields(map[string]FieldDefinition{
+		"Name":    CharField{Required: true, Unique: true},
+		"LastRun": DateTimeField{},
+		"NextRun": DateTimeField{Required: true},
+	})
+	model.InheritModel(Registry.MustGet("CommonMixin"))
+	model.restrictToAdmins()
+}
+
+// RunScheduledActions executes the scheduled actions whose next run time is
+// reached and returns when they are finished.
+//
+// RunScheduledActions is called periodically by the worker loop.
+func RunScheduledActions() {
+	scheduledActions.RLock()
+	names := make([]string, 0, len(scheduledActions.actions))
+	for name := range scheduledActions.actions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	actions := make([]*ScheduledAction, len(names))
+	for i, name := range names {
+		actions[i] = scheduledActions.actions[name]
+	}
+	scheduledActions.RUnlock()
+
+	var wg sync.WaitGroup
+	for _, action := range actions {
+		wg.Add(1)
+		go func(a *ScheduledAction) {
+			defer wg.Done()
+			a.run()
+		}(action)
+	}
+	wg.Wait()
+}
+
+// run executes this action if its next run time is reached and schedules its next run.
+//
+// The row of this action is locked during the execution so that other servers skip it.
+func (a *ScheduledAction) run() {
+	err := ExecuteInNewEnvironment(security.SuperUserID, func(env Environment) {
+		adapter := adapters[db.DriverName()]
+		table := adapter.quoteTableName(Registry.MustGet(scheduledActionModelName).tableName)
+		now := time.Now().In(a.location)
+		var rows []struct {
+			NextRun dates.DateTime
+		}
+		env.cr.Select(&rows, fmt.Sprintf(`SELECT next_run FROM %s WHERE name = ? %s`, table, adapter.skipLockedSQL()), a.Name)
+		if len(rows) == 0 {
+			var count int
+			env.cr.Get(&count, fmt.Sprintf(`SELECT COUNT(*) FROM %s WHERE name = ?`, table), a.Name)
+			if count == 0 {
+				// First run of this action
+				env.cr.Execute(fmt.Sprintf(`INSERT INTO %s (name, next_run) VALUES (?, ?)`, table),
+					a.Name, dates.DateTime{Time: a.schedule.Next(now)})
+			}
+			return
+		}
+		nextRun := rows[0].NextRun.Time.In(a.location)
+		if nextRun.After(now) {
+			return
+		}
+		runs := a.runsToExecute(nextRun, now)
+		for i := 0; i < runs; i++ {
+			log.Debug("Executing scheduled action", "name", a.Name, "run", i+1, "runs", runs)
+			if err := ExecuteInNewEnvironment(security.SuperUserID, a.Fnct); err != nil {
+				log.Warn("Error while executing scheduled action", "name", a.Name, "error", err)
+			}
+		}
+		nextRun = a.schedule.Next(now)
+		if runs == 0 {
+			env.cr.Execute(fmt.Sprintf(`UPDATE %s SET next_run = ? WHERE name = ?`, table),
+				dates.DateTime{Time: nextRun}, a.Name)
+			return
+		}
+		env.cr.Execute(fmt.Sprintf(`UPDATE %s SET last_run = ?, next_run = ? WHERE name = ?`, table),
+			dates.DateTime{Time: now}, dates.DateTime{Time: nextRun}, a.Name)
+	})
+	if err != nil {
+		log.Warn("Unable to run scheduled action", "name", a.Name, "error", err)
+	}
+}
+
+// runsToExecute returns the number of times this action must be executed
+// given its next run time and the current time, according to its CatchUp policy.
+func (a *ScheduledAction) runsToExecute(nextRun, now time.Time) int {
+	var lastDue time.Time
+	var due int
+	for t := nextRun; !t.IsZero() && !t.After(now) && due < maxCatchUpRuns; t = a.schedule.Next(t) {
+		lastDue = t
+		due++
+	}
+	switch a.CatchUp {
+	case CatchUpAll:
+		return due
+	case CatchUpOnce:
+		return 1
+	}
+	if now.Sub(lastDue) > missedRunTolerance {
+		return 0
+	}
+	return 1
+}
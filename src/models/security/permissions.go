@@ -14,13 +14,38 @@
 
 package security
 
-// A Permission defines which of the read, write or unlink rights apply.
+import "strings"
+
+// A Permission defines which of the create, read, write or unlink rights apply.
 type Permission uint8
 
-// The four Permissions are Read, Write, Unlink and All.
+// The five Permissions are Read, Write, Unlink, Create and All.
 const (
 	Read = 1 << Permission(iota)
 	Write
 	Unlink
-	All = Read | Write | Unlink
+	Create
+	All = Read | Write | Unlink | Create
 )
+
+// permissionNames are the names of the single Permissions
+var permissionNames = []struct {
+	perm Permission
+	name string
+}{
+	{Create, "create"},
+	{Read, "read"},
+	{Write, "write"},
+	{Unlink, "unlink"},
+}
+
+// String returns the names of the rights of this Permission separated by '|'.
+func (p Permission) String() string {
+	var names []string
+	for _, pn := range permissionNames {
+		if p&pn.perm != 0 {
+			names = append(names, pn.name)
+		}
+	}
+	return strings.Join(names, "|")
+}
@@ -0,0 +1,240 @@
+// Copyright 2019 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package models
+
+import (
+	"encoding/csv"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/beevik/etree"
+	"github.com/hexya-erp/hexya/src/models/security"
+	"github.com/hexya-erp/hexya/src/tools/exceptions"
+)
+
+// An accessControlRegistry holds the permissions granted to each
+// group on a model. It is meant to be attached to a model.
+//
+// A model without any access control is not restricted.
+type accessControlRegistry struct {
+	sync.RWMutex
+	perms map[*security.Group]security.Permission
+}
+
+// allow grants the given permissions to the given group
+func (acr *accessControlRegistry) allow(group *security.Group, perms security.Permission) {
+	if perms == 0 {
+		return
+	}
+	acr.Lock()
+	defer acr.Unlock()
+	acr.perms[group] |= perms
+}
+
+// revoke removes the given permissions from the given group
+func (acr *accessControlRegistry) revoke(group *security.Group, perms security.Permission) {
+	acr.Lock()
+	defer acr.Unlock()
+	if _, exists := acr.perms[group]; !exists {
+		return
+	}
+	acr.perms[group] &^= perms
+	if acr.perms[group] == 0 {
+		delete(acr.perms, group)
+	}
+}
+
+// isAllowed returns true if the user with the given uid has all the given permissions.
+//
+// Models without access controls are allowed for all users and members
+// of the admin group are always allowed.
+func (acr *accessControlRegistry) isAllowed(uid int64, perms security.Permission) bool {
+	if acr == nil || uid == security.SuperUserID {
+		return true
+	}
+	acr.RLock()
+	defer acr.RUnlock()
+	if len(acr.perms) == 0 {
+		return true
+	}
+	for group := range security.Registry.UserGroups(uid) {
+		if group == security.GroupAdmin || acr.perms[group]&perms == perms {
+			return true
+		}
+	}
+	return false
+}
+
+// newAccessControlRegistry returns a pointer to a new accessControlRegistry instance
+func newAccessControlRegistry() *accessControlRegistry {
+	return &accessControlRegistry{
+		perms: make(map[*security.Group]security.Permission),
+	}
+}
+
+// AllowModelAccess grants the given permissions on this model to the given group.
+//
+// Once a model has been given an access control, only the groups that have
+// been granted a permission can perform the corresponding operations.
+// Members of the admin group are always allowed.
+func (m *Model) AllowModelAccess(group *security.Group, perms security.Permission) {
+	m.aclRegistry.allow(group, perms)
+}
+
+// RevokeModelAccess removes the given permissions on this model from the given group.
+func (m *Model) RevokeModelAccess(group *security.Group, perms security.Permission) {
+	m.aclRegistry.revoke(group, perms)
+}
+
+// restrictToAdmins grants all permissions on this model to the admin group
+// only, so that regular users cannot access its records through the ORM.
+// It is meant for system models that are only read by the framework itself.
+func (m *Model) restrictToAdmins() {
+	m.AllowModelAccess(security.GroupAdmin, security.All)
+}
+
+// CheckAccess returns true if the user with the given uid has the given
+// permissions on this model.
+func (m *Model) CheckAccess(uid int64, perms security.Permission) bool {
+	return m.aclRegistry.isAllowed(uid, perms)
+}
+
+// checkModelAccess panics with an AccessError if the user of this
+// RecordCollection has not the given permission on its model.
+func (rc *RecordCollection) checkModelAccess(perm security.Permission) {
+	if rc.model.CheckAccess(rc.env.uid, perm) {
+		return
+	}
+	log.Warn("Access denied", "model", rc.model.name, "operation", perm, "uid", rc.env.uid)
+	panic(exceptions.AccessError{
+		Model:     rc.model.name,
+		Operation: perm.String(),
+		UID:       rc.env.uid,
+	})
+}
+
+// withoutACL returns a copy of this RecordCollection whose Environment reads and
+// writes records regardless of the access controls of the models and fields.
+//
+// It is meant for the recomputation of stored fields and for onchange simulations,
+// which must not be prevented by the rights of the user who triggered them.
+func (rc *RecordCollection) withoutACL() *RecordCollection {
+	newEnv := rc.Env()
+	newEnv.bypassACL = true
+	return rc.WithEnv(newEnv)
+}
+
+// checkReadAccess panics with an AccessError if the user of this RecordCollection
+// is not allowed to read its model, unless its Environment bypasses access controls.
+func (rc *RecordCollection) checkReadAccess() {
+	if rc.env.bypassACL {
+		return
+	}
+	rc.checkModelAccess(security.Read)
+}
+
+// setModelAccess sets the access of the given group on the given model
+// from a definition of a resource file.
+func setModelAccess(id, modelName, groupID string, perms map[security.Permission]bool) {
+	model := Registry.MustGet(modelName)
+	group := security.Registry.GetGroup(groupID)
+	if group == nil {
+		log.Panic("Unknown group in access control", "id", id, "group", groupID)
+	}
+	var allowed, revoked security.Permission
+	for perm, ok := range perms {
+		if ok {
+			allowed |= perm
+			continue
+		}
+		revoked |= perm
+	}
+	model.RevokeModelAccess(group, revoked)
+	model.AllowModelAccess(group, allowed)
+}
+
+// accessControlColumns are the columns of an access control definition
+// with their permission.
+var accessControlColumns = map[string]security.Permission{
+	"perm_create": security.Create,
+	"perm_read":   security.Read,
+	"perm_write":  security.Write,
+	"perm_unlink": security.Unlink,
+}
+
+// LoadAccessControlCSVFile loads the model access controls defined in the given CSV file.
+//
+// The file must have the following headers: id, model, group, perm_create,
+// perm_read, perm_write and perm_unlink. Permission columns must be parsable
+// as booleans (e.g. 1 or 0).
+func LoadAccessControlCSVFile(fileName string) {
+	log.Info("Importing access control file", "fileName", fileName)
+	csvFile, err := os.Open(fileName)
+	if err != nil {
+		log.Panic("Unable to open CSV access control file", "error", err, "fileName", fileName)
+	}
+	defer csvFile.Close()
+
+	r := csv.NewReader(csvFile)
+	headers, err := r.Read()
+	if err != nil {
+		log.Panic("Unable to read CSV headers in access control file", "error", err, "fileName", fileName)
+	}
+	line := 1
+	for {
+		line++
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Panic("Unable to read access control file", "error", err, "fileName", fileName, "line", line)
+		}
+		var id, modelName, groupID string
+		perms := make(map[security.Permission]bool)
+		for i, header := range headers {
+			switch header {
+			case "id":
+				id = record[i]
+			case "model":
+				modelName = record[i]
+			case "group":
+				groupID = record[i]
+			default:
+				perm, ok := accessControlColumns[header]
+				if !ok {
+					log.Panic("Unknown column in access control file", "column", header, "fileName", fileName)
+				}
+				val, err := strconv.ParseBool(record[i])
+				if err != nil {
+					log.Panic("Invalid permission value", "error", err, "fileName", fileName, "line", line, "column", header)
+				}
+				perms[perm] = val
+			}
+		}
+		setModelAccess(id, modelName, groupID, perms)
+	}
+}
+
+// LoadAccessControlFromEtree loads the model access control defined
+// by the given 'access' element, such as:
+//
+//	<access id="access_partner_user" model="Partner" group="base_group_user"
+//	        perm_create="1" perm_read="1" perm_write="1" perm_unlink="0"/>
+//
+// Missing permission attributes default to "0".
+func LoadAccessControlFromEtree(element *etree.Element) {
+	perms := make(map[security.Permission]bool)
+	for attr, perm := range accessControlColumns {
+		val, err := strconv.ParseBool(element.SelectAttrValue(attr, "0"))
+		if err != nil {
+			log.Panic("Invalid permission value", "error", err, "id", element.SelectAttrValue("id", ""), "attribute", attr)
+		}
+		perms[perm] = val
+	}
+	setModelAccess(element.SelectAttrValue("id", ""), element.SelectAttrValue("model", ""),
+		element.SelectAttrValue("group", ""), perms)
+}
@@ -0,0 +1,512 @@
+// Copyright 2019 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package models
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hexya-erp/hexya/src/models/security"
+)
+
+const (
+	// sharedCacheChannel is the database notification channel of shared cache invalidations
+	sharedCacheChannel = "hexya_shared_cache"
+	// maxNotifiedIDs is the maximum number of ids sent in an invalidation notification.
+	// The whole model is invalidated above this number.
+	maxNotifiedIDs = 500
+)
+
+// A SharedCache stores the field values of records across transactions, so
+// that frequently read records are not fetched from the database each time.
+//
+// Values are stored by model, record id and context slug. Implementations must
+// be safe for concurrent access and must not keep references to the given maps.
+type SharedCache interface {
+	// Get returns the cached values of the record with the given model, id and context slug.
+	// The second returned value is false if the record is not in the cache.
+	Get(model string, id int64, ctxSlug string) (FieldMap, bool)
+	// Set adds the given values to the cached values of the record
+	// with the given model, id and context slug.
+	Set(model string, id int64, ctxSlug string, values FieldMap)
+	// Invalidate removes the records of the given model with the given ids from
+	// the cache, for all context slugs. All the records of the model are removed
+	// if no id is given.
+	Invalidate(model string, ids ...int64)
+	// Clear removes all the records from the cache.
+	Clear()
+}
+
+// SharedCacheStats are the metrics of the shared cache
+type SharedCacheStats struct {
+	Hits          uint64
+	Misses        uint64
+	Invalidations uint64
+}
+
+// sharedCacheRegistry holds the shared cache and its state
+type sharedCacheRegistry struct {
+	sync.RWMutex
+	cache SharedCache
+	// invalidatedAt is the generation of the last invalidation of each model
+	invalidatedAt map[string]uint64
+	generation    uint64
+	hits          uint64
+	misses        uint64
+	invalidations uint64
+	stopListener  func()
+}
+
+// sharedCache is the registry of the shared cache
+var sharedCache = &sharedCacheRegistry{
+	invalidatedAt: make(map[string]uint64),
+}
+
+// sharedCacheOrigin identifies this process in invalidation notifications
+var sharedCacheOrigin = fmt.Sprintf("%d-%d", os.Getpid(), time.Now().UnixNano())
+
+// SetSharedCache sets the given cache as the shared cache of the models that
+// have been enabled with EnableSharedCache. Setting nil disables the shared cache.
+//
+// When the database supports it, invalidations are propagated to the other
+// servers through database notifications.
+func SetSharedCache(cache SharedCache) {
+	sharedCache.Lock()
+	sharedCache.cache = cache
+	sharedCache.Unlock()
+	switch {
+	case cache == nil:
+		stopSharedCacheListener()
+	case db != nil:
+		startSharedCacheListener()
+	}
+}
+
+// SharedCacheMetrics returns the hits, misses and invalidations of the shared cache.
+//
+// A hit or a miss is counted for each record looked up in the shared cache.
+func SharedCacheMetrics() SharedCacheStats {
+	return SharedCacheStats{
+		Hits:          atomic.LoadUint64(&sharedCache.hits),
+		Misses:        atomic.LoadUint64(&sharedCache.misses),
+		Invalidations: atomic.LoadUint64(&sharedCache.invalidations),
+	}
+}
+
+// EnableSharedCache stores the records of this model in the shared cache set
+// by SetSharedCache, so that they are read from the database only once.
+//
+// The shared cache is meant for models that are often read and seldom modified,
+// such as currencies or configuration records. It is not used for models with
+// read record rules.
+func (m *Model) EnableSharedCache() {
+	m.sharedCached = true
+}
+
+// getCache returns the shared cache if it can be used for the given model or nil otherwise
+func (scr *sharedCacheRegistry) getCache(m *Model) SharedCache {
+	if !m.sharedCached || m.hasRecordRules(security.Read) {
+		return nil
+	}
+	scr.RLock()
+	defer scr.RUnlock()
+	return scr.cache
+}
+
+// invalidate removes the given records from the shared cache
+// and prevents older transactions from adding them again.
+func (scr *sharedCacheRegistry) invalidate(model string, ids ...int64) {
+	scr.Lock()
+	scr.generation++
+	scr.invalidatedAt[model] = scr.generation
+	cache := scr.cache
+	scr.Unlock()
+	if cache == nil {
+		return
+	}
+	atomic.AddUint64(&scr.invalidations, 1)
+	cache.Invalidate(model, ids...)
+}
+
+// currentGeneration returns the current invalidation generation
+func (scr *sharedCacheRegistry) currentGeneration() uint64 {
+	scr.RLock()
+	defer scr.RUnlock()
+	return scr.generation
+}
+
+// invalidatedSince returns true if the given model has been
+// invalidated after the given generation.
+func (scr *sharedCacheRegistry) invalidatedSince(model string, generation uint64) bool {
+	scr.RLock()
+	defer scr.RUnlock()
+	return scr.invalidatedAt[model] > generation
+}
+
+// A sharedCacheTx holds the shared cache state of a transaction
+type sharedCacheTx struct {
+	// generation is the invalidation generation at the start of the transaction
+	generation uint64
+	// invalidated are the ids of the records modified in the transaction by model.
+	// A nil slice means the whole model.
+	invalidated map[string][]int64
+}
+
+// newSharedCacheTx returns a new sharedCacheTx for a transaction starting now
+func newSharedCacheTx() *sharedCacheTx {
+	return &sharedCacheTx{
+		generation:  sharedCache.currentGeneration(),
+		invalidated: make(map[string][]int64),
+	}
+}
+
+// hasRecordRules returns true if this model has record rules for the given permission
+func (m *Model) hasRecordRules(perm security.Permission) bool {
+	m.rulesRegistry.RLock()
+	defer m.rulesRegistry.RUnlock()
+	for _, rule := range m.rulesRegistry.globalRules {
+		if rule.Perms&perm > 0 {
+			return true
+		}
+	}
+	for _, rules := range m.rulesRegistry.rulesByGroup {
+		for _, rule := range rules {
+			if rule.Perms&perm > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// sharedCacheable returns true if the given field path can be stored in the shared cache
+func (m *Model) sharedCacheable(path string) bool {
+	if strings.Contains(path, ExprSep) {
+		return false
+	}
+	fi, ok := m.fields.Get(path)
+	return ok && fi.isStored()
+}
+
+// loadFromSharedCache loads the given fields of the records of this RecordCollection
+// into the environment cache from the shared cache. It returns false if the shared cache
+// cannot be used or does not hold all the fields of all the records.
+func (rc *RecordCollection) loadFromSharedCache(fields []string) bool {
+	cache := sharedCache.getCache(rc.model)
+	if cache == nil || len(rc.ids) == 0 || rc.hasNegIds {
+		return false
+	}
+	if _, modified := rc.env.sharedCacheTx.invalidated[rc.model.name]; modified {
+		// This transaction modified the model, so that the shared cache is outdated
+		return false
+	}
+	for _, f := range fields {
+		if !rc.model.sharedCacheable(f) {
+			return false
+		}
+	}
+	ctxSlug := rc.query.ctxArgsSlug()
+	records := make(map[int64]FieldMap, len(rc.ids))
+	for _, id := range rc.ids {
+		values, ok := cache.Get(rc.model.name, id, ctxSlug)
+		if ok {
+			for _, f := range fields {
+				if _, exists := values[f]; !exists {
+					ok = false
+					break
+				}
+			}
+		}
+		if !ok {
+			atomic.AddUint64(&sharedCache.misses, 1)
+			return false
+		}
+		atomic.AddUint64(&sharedCache.hits, 1)
+		records[id] = values
+	}
+	for id, values := range records {
+		rc.env.cache.addRecord(rc.model, id, values, ctxSlug)
+	}
+	return true
+}
+
+// storeInSharedCache stores the given values of the record with the given id
+// loaded from the database in the shared cache if the model is cached.
+//
+// Values are not stored if they may be outdated, that is if the model has been
+// modified by this transaction or invalidated after the transaction started.
+func (rc *RecordCollection) storeInSharedCache(id int64, values FieldMap) {
+	cache := sharedCache.getCache(rc.model)
+	if cache == nil {
+		return
+	}
+	if _, modified := rc.env.sharedCacheTx.invalidated[rc.model.name]; modified {
+		return
+	}
+	if sharedCache.invalidatedSince(rc.model.name, rc.env.sharedCacheTx.generation) {
+		return
+	}
+	cached := make(FieldMap, len(values))
+	for f, v := range values {
+		if f == "id" || rc.model.sharedCacheable(f) {
+			cached[f] = v
+		}
+	}
+	cache.Set(rc.model.name, id, rc.query.ctxArgsSlug(), cached)
+}
+
+// invalidateSharedCache marks the given records of this RecordCollection's model
+// as modified in the current transaction. They will be removed from the shared cache
+// when the transaction is committed. The whole model is invalidated if no ids are given.
+func (rc *RecordCollection) invalidateSharedCache(ids ...int64) {
+	if !rc.model.sharedCached {
+		return
+	}
+	invalidated := rc.env.sharedCacheTx.invalidated
+	existing, ok := invalidated[rc.model.name]
+	switch {
+	case ok && existing == nil:
+		// Whole model already invalidated
+	case len(ids) == 0:
+		invalidated[rc.model.name] = nil
+	default:
+		invalidated[rc.model.name] = append(existing, ids...)
+	}
+}
+
+// invalidateSharedCacheOnUnlink marks the records of this RecordCollection as modified in
+// the current transaction, as well as the cached models that reference this model, since
+// their foreign keys may be modified by the database on deletion.
+func (rc *RecordCollection) invalidateSharedCacheOnUnlink(ids []int64) {
+	rc.invalidateSharedCache(ids...)
+	for _, model := range Registry.registryByName {
+		if !model.sharedCached {
+			continue
+		}
+		for _, fi := range model.fields.registryByJSON {
+			if fi.relatedModel == rc.model && fi.fieldType.IsFKRelationType() {
+				rc.env.Pool(model.name).invalidateSharedCache()
+				break
+			}
+		}
+	}
+}
+
+// A sharedCacheNotification is the payload of the database
+// notification of a shared cache invalidation.
+type sharedCacheNotification struct {
+	Origin string  `json:"origin"`
+	Model  string  `json:"model"`
+	IDs    []int64 `json:"ids"`
+}
+
+// notifySharedCacheInvalidations sends a database notification to the other servers
+// for each model invalidated in this Environment. Notifications are delivered by the
+// database only when the transaction is committed.
+func (env Environment) notifySharedCacheInvalidations() {
+	query := adapters[db.DriverName()].notifyQuery()
+	if query == "" {
+		return
+	}
+	for model, ids := range env.sharedCacheTx.invalidated {
+		if len(ids) > maxNotifiedIDs {
+			ids = nil
+		}
+		payload, _ := json.Marshal(sharedCacheNotification{
+			Origin: sharedCacheOrigin,
+			Model:  model,
+			IDs:    ids,
+		})
+		env.cr.Execute(query, sharedCacheChannel, string(payload))
+	}
+}
+
+// applySharedCacheInvalidations removes the records modified in this Environment from
+// the shared cache. It must be called after the transaction has been committed.
+func (env Environment) applySharedCacheInvalidations() {
+	for model, ids := range env.sharedCacheTx.invalidated {
+		sharedCache.invalidate(model, ids...)
+	}
+}
+
+// startSharedCacheListener listens to the invalidations notified by other
+// servers if a shared cache is set and the database supports notifications.
+func startSharedCacheListener() {
+	sharedCache.Lock()
+	defer sharedCache.Unlock()
+	if sharedCache.cache == nil || sharedCache.stopListener != nil {
+		return
+	}
+	stop, err := adapters[db.DriverName()].listen(sharedCacheChannel, handleSharedCacheNotification)
+	if err != nil {
+		log.Warn("Unable to listen to shared cache invalidations", "error", err)
+		return
+	}
+	sharedCache.stopListener = stop
+}
+
+// stopSharedCacheListener stops listening to shared cache invalidations
+func stopSharedCacheListener() {
+	sharedCache.Lock()
+	defer sharedCache.Unlock()
+	if sharedCache.stopListener == nil {
+		return
+	}
+	sharedCache.stopListener()
+	sharedCache.stopListener = nil
+}
+
+// handleSharedCacheNotification invalidates the shared cache according to the
+// given notification payload. The whole cache is cleared if the payload is empty,
+// which means that notifications may have been lost.
+func handleSharedCacheNotification(payload string) {
+	if payload == "" {
+		sharedCache.Lock()
+		sharedCache.generation++
+		for model := range sharedCache.invalidatedAt {
+			sharedCache.invalidatedAt[model] = sharedCache.generation
+		}
+		cache := sharedCache.cache
+		sharedCache.Unlock()
+		if cache != nil {
+			cache.Clear()
+		}
+		return
+	}
+	var notif sharedCacheNotification
+	if err := json.Unmarshal([]byte(payload), &notif); err != nil {
+		log.Warn("Invalid shared cache notification", "payload", payload, "error", err)
+		return
+	}
+	if notif.Origin == sharedCacheOrigin {
+		return
+	}
+	sharedCache.invalidate(notif.Model, notif.IDs...)
+}
+
+// An LRUCache is an in-memory SharedCache that holds at most a given
+// number of records, evicting the least recently used records first.
+type LRUCache struct {
+	sync.Mutex
+	size    int
+	entries map[lruKey]*list.Element
+	order   *list.List
+	byModel map[string]map[int64]bool
+}
+
+// lruKey is the key of a record in an LRUCache
+type lruKey struct {
+	model string
+	id    int64
+}
+
+// lruEntry is a record in an LRUCache
+type lruEntry struct {
+	key    lruKey
+	values map[string]FieldMap
+}
+
+// NewLRUCache returns a new LRUCache that holds at most size records
+func NewLRUCache(size int) *LRUCache {
+	if size < 1 {
+		log.Panic("LRU cache size must be at least 1", "size", size)
+	}
+	return &LRUCache{
+		size:    size,
+		entries: make(map[lruKey]*list.Element),
+		order:   list.New(),
+		byModel: make(map[string]map[int64]bool),
+	}
+}
+
+// Get returns the cached values of the given record
+func (c *LRUCache) Get(model string, id int64, ctxSlug string) (FieldMap, bool) {
+	c.Lock()
+	defer c.Unlock()
+	elt, ok := c.entries[lruKey{model: model, id: id}]
+	if !ok {
+		return nil, false
+	}
+	values, ok := elt.Value.(*lruEntry).values[ctxSlug]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(elt)
+	return values.Copy(), true
+}
+
+// Set adds the given values to the cached values of the given record
+func (c *LRUCache) Set(model string, id int64, ctxSlug string, values FieldMap) {
+	c.Lock()
+	defer c.Unlock()
+	key := lruKey{model: model, id: id}
+	elt, ok := c.entries[key]
+	if !ok {
+		elt = c.order.PushFront(&lruEntry{key: key, values: make(map[string]FieldMap)})
+		c.entries[key] = elt
+		if c.byModel[model] == nil {
+			c.byModel[model] = make(map[int64]bool)
+		}
+		c.byModel[model][id] = true
+		if c.order.Len() > c.size {
+			c.remove(c.order.Back())
+		}
+	}
+	c.order.MoveToFront(elt)
+	entry := elt.Value.(*lruEntry)
+	if entry.values[ctxSlug] == nil {
+		entry.values[ctxSlug] = make(FieldMap)
+	}
+	for f, v := range values {
+		entry.values[ctxSlug][f] = v
+	}
+}
+
+// Invalidate removes the given records from the cache
+func (c *LRUCache) Invalidate(model string, ids ...int64) {
+	c.Lock()
+	defer c.Unlock()
+	if len(ids) == 0 {
+		for id := range c.byModel[model] {
+			ids = append(ids, id)
+		}
+	}
+	for _, id := range ids {
+		if elt, ok := c.entries[lruKey{model: model, id: id}]; ok {
+			c.remove(elt)
+		}
+	}
+}
+
+// Clear removes all records from the cache
+func (c *LRUCache) Clear() {
+	c.Lock()
+	defer c.Unlock()
+	c.entries = make(map[lruKey]*list.Element)
+	c.order.Init()
+	c.byModel = make(map[string]map[int64]bool)
+}
+
+// Len returns the number of records in the cache
+func (c *LRUCache) Len() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.order.Len()
+}
+
+// remove the given element from the cache
+func (c *LRUCache) remove(elt *list.Element) {
+	key := elt.Value.(*lruEntry).key
+	c.order.Remove(elt)
+	delete(c.entries, key)
+	delete(c.byModel[key.model], key.id)
+}
+
+var _ SharedCache = new(LRUCache)
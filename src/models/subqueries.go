@@ -0,0 +1,188 @@
+// Copyright 2019 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package models
+
+import (
+	"fmt"
+
+	"github.com/hexya-erp/hexya/src/models/fieldtype"
+	"github.com/hexya-erp/hexya/src/models/operator"
+	"github.com/hexya-erp/hexya/src/tools/strutils"
+)
+
+// An aggregateSubquery is an aggregate of the related records of a
+// relation field that is compared to a value in a condition.
+type aggregateSubquery struct {
+	// function is the SQL aggregate function, such as COUNT or SUM
+	function string
+	// field is the aggregated field of the related model, or nil to count records
+	field FieldName
+	// cond restricts the aggregated records
+	cond *Condition
+}
+
+// String returns the string representation of this aggregate applied on the given field
+func (a aggregateSubquery) String(fieldName string) string {
+	if a.field == nil {
+		return fmt.Sprintf("%s(%s)", a.function, fieldName)
+	}
+	return fmt.Sprintf("%s(%s.%s)", a.function, fieldName, a.field.Name())
+}
+
+// mergeConditions returns a condition which is the AND of all the given conditions.
+func mergeConditions(conds []Conditioner) *Condition {
+	res := newCondition()
+	for _, cond := range conds {
+		if cond == nil {
+			continue
+		}
+		res = res.AndCond(cond.Underlying())
+	}
+	return res
+}
+
+// Exists appends the 'exists' operator to the current Condition.
+// Records match if at least one of the records of this relation field
+// matches the given condition. A nil condition matches all records.
+func (c ConditionField) Exists(cond Conditioner) *Condition {
+	return c.AddOperator(operator.Exists, mergeConditions([]Conditioner{cond}))
+}
+
+// NotExists appends the 'not exists' operator to the current Condition.
+// Records match if none of the records of this relation field matches
+// the given condition. A nil condition matches all records.
+func (c ConditionField) NotExists(cond Conditioner) *Condition {
+	return c.AddOperator(operator.NotExists, mergeConditions([]Conditioner{cond}))
+}
+
+// aggregate returns a ConditionField on the result of the given SQL aggregate
+// function applied to field for the records of this relation field that match
+// all the given conditions.
+func (c ConditionField) aggregate(function string, field FieldName, conds []Conditioner) *ConditionField {
+	if c.subquery != nil || len(c.jsonPath) > 0 || c.aggFunc != "" {
+		log.Panic("Aggregates can only be applied on relation fields", "field", c.Name())
+	}
+	c.subquery = &aggregateSubquery{
+		function: function,
+		field:    field,
+		cond:     mergeConditions(conds),
+	}
+	return &c
+}
+
+// Count returns a ConditionField on the number of records of this relation
+// field that match all the given conditions.
+//
+//	cond := partnerModel.Field(invoices).Count(unpaidCond).Greater(3)
+func (c ConditionField) Count(conds ...Conditioner) *ConditionField {
+	return c.aggregate("COUNT", nil, conds)
+}
+
+// Sum returns a ConditionField on the sum of the given field of the records
+// of this relation field that match all the given conditions.
+//
+// The sum is 0 if no record match.
+func (c ConditionField) Sum(field FieldName, conds ...Conditioner) *ConditionField {
+	return c.aggregate("SUM", field, conds)
+}
+
+// Avg returns a ConditionField on the average of the given field of the
+// records of this relation field that match all the given conditions.
+func (c ConditionField) Avg(field FieldName, conds ...Conditioner) *ConditionField {
+	return c.aggregate("AVG", field, conds)
+}
+
+// Min returns a ConditionField on the minimum of the given field of the
+// records of this relation field that match all the given conditions.
+func (c ConditionField) Min(field FieldName, conds ...Conditioner) *ConditionField {
+	return c.aggregate("MIN", field, conds)
+}
+
+// Max returns a ConditionField on the maximum of the given field of the
+// records of this relation field that match all the given conditions.
+func (c ConditionField) Max(field FieldName, conds ...Conditioner) *ConditionField {
+	return c.aggregate("MAX", field, conds)
+}
+
+// existsSQLClause returns the sql string and arguments of the given predicate
+// with the Exists or NotExists operator.
+func (q *Query) existsSQLClause(p predicate) (string, SQLParams) {
+	cond, ok := p.arg.(Conditioner)
+	if !ok {
+		log.Panic("The argument of the exists operator must be a condition", "field", p.Field().Name(), "arg", p.arg)
+	}
+	subSQL, args := q.subquerySQL(p.exprs, cond.Underlying())
+	sql := fmt.Sprintf("EXISTS (%s)", subSQL)
+	if p.operator == operator.NotExists {
+		sql = "NOT " + sql
+	}
+	return sql, args
+}
+
+// aggregateSQL returns the sql expression and arguments of the given aggregate
+// of the records of the relation field at the end of exprs.
+func (q *Query) aggregateSQL(exprs []FieldName, agg *aggregateSubquery) (string, SQLParams) {
+	fi := q.recordSet.model.getRelatedFieldInfo(joinFieldNames(exprs, ExprSep))
+	adapter := adapters[db.DriverName()]
+	subSQL, args := q.subquerySQL(exprs, agg.cond)
+	alias := adapter.quoteTableName(q.subqueryAlias() + "_agg")
+	column := "id"
+	if agg.field != nil {
+		aggFI := fi.relatedModel.getRelatedFieldInfo(agg.field)
+		if !aggFI.isStored() || aggFI.model != fi.relatedModel {
+			log.Panic("Only stored fields of the related model can be aggregated", "model", fi.relatedModel.name,
+				"field", agg.field.Name())
+		}
+		column = aggFI.json
+	}
+	aggSQL := fmt.Sprintf("%s(%s.%s)", agg.function, alias, column)
+	if agg.function == "SUM" {
+		aggSQL = fmt.Sprintf("COALESCE(%s, 0)", aggSQL)
+	}
+	return fmt.Sprintf("(SELECT %s FROM %s %s WHERE %s.id IN (%s))", aggSQL,
+		adapter.quoteTableName(fi.relatedModel.tableName), alias, alias, subSQL), args
+}
+
+// subqueryAlias returns the alias of the main table of the subqueries of this query
+func (q *Query) subqueryAlias() string {
+	if q.alias == "" {
+		return "sq"
+	}
+	return q.alias + "_sq"
+}
+
+// subquerySQL returns the sql string and arguments of a subquery correlated
+// with this query that selects the ids of the records of the relation field
+// at the end of exprs that match cond.
+func (q *Query) subquerySQL(exprs []FieldName, cond *Condition) (string, SQLParams) {
+	fi := q.recordSet.model.getRelatedFieldInfo(joinFieldNames(exprs, ExprSep))
+	if fi.relatedModel == nil {
+		log.Panic("Subquery conditions can only be used on relation fields", "model", q.recordSet.model.name,
+			"field", joinFieldNames(exprs, ExprSep).Name())
+	}
+	adapter := adapters[db.DriverName()]
+	sub := q.recordSet.env.Pool(fi.relatedModel.name).Search(cond).substituteRelatedInQuery()
+	sub.query.alias = q.subqueryAlias()
+	sub.query.substituteOperatorPredicates()
+	tablesSQL, joinsMap := sub.query.tablesSQL(append(sub.query.cond.getAllExpressions(fi.relatedModel), []FieldName{ID}))
+	whereSQL, args := sub.query.conditionSQLClause(sub.query.cond)
+
+	alias := adapter.quoteTableName(sub.query.alias)
+	var corrSQL string
+	switch fi.fieldType {
+	case fieldtype.Many2One, fieldtype.One2One:
+		fk, _, _ := q.joinedFieldExpression(exprs, false, 0)
+		corrSQL = fmt.Sprintf("%s.id = %s", alias, fk)
+	case fieldtype.One2Many, fieldtype.Rev2One:
+		corrSQL = fmt.Sprintf("%s.%s = %s", alias, fi.relatedModel.fields.MustGet(fi.reverseFK).json, q.ownerIDExpression(exprs))
+	case fieldtype.Many2Many:
+		corrSQL = fmt.Sprintf("%s.id IN (SELECT %s FROM %s WHERE %s = %s)", alias, fi.m2mTheirField.json,
+			adapter.quoteTableName(fi.m2mRelModel.tableName), fi.m2mOurField.json, q.ownerIDExpression(exprs))
+	}
+	if whereSQL != "" {
+		corrSQL = fmt.Sprintf("%s AND (%s)", corrSQL, whereSQL)
+	}
+	subSQL := fmt.Sprintf("SELECT %s.id FROM %sWHERE %s", alias, tablesSQL, corrSQL)
+	return strutils.Substitute(subSQL, joinsMap), args
+}
@@ -17,6 +17,7 @@ package models
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/hexya-erp/hexya/src/tools/logging"
@@ -72,10 +73,16 @@ func initializeTests() {
 	}
 	logging.Initialize()
 
-	admDB := sqlx.MustConnect(dbArgs.Driver, fmt.Sprintf("dbname=postgres sslmode=disable user=%s password=%s", dbArgs.User, dbArgs.Password))
-	admDB.MustExec(fmt.Sprintf("DROP DATABASE IF EXISTS %s", dbArgs.DB))
-	admDB.MustExec(fmt.Sprintf("CREATE DATABASE %s", dbArgs.DB))
-	admDB.Close()
+	switch dbArgs.Driver {
+	case "sqlite", "sqlite3":
+		dbArgs.DB = filepath.Join(os.TempDir(), fmt.Sprintf("%s.db", dbArgs.DB))
+		os.Remove(dbArgs.DB)
+	default:
+		admDB := sqlx.MustConnect(dbArgs.Driver, fmt.Sprintf("dbname=postgres sslmode=disable user=%s password=%s", dbArgs.User, dbArgs.Password))
+		admDB.MustExec(fmt.Sprintf("DROP DATABASE IF EXISTS %s", dbArgs.DB))
+		admDB.MustExec(fmt.Sprintf("CREATE DATABASE %s", dbArgs.DB))
+		admDB.Close()
+	}
 
 	DBConnect(dbArgs.Driver, ConnectionParams{
 		DBName:   dbArgs.DB,
@@ -93,7 +100,12 @@ func tearDownTests() {
 		return
 	}
 	fmt.Printf("Tearing down database for models\n")
-	admDB := sqlx.MustConnect(dbArgs.Driver, fmt.Sprintf("dbname=postgres sslmode=disable user=%s password=%s", dbArgs.User, dbArgs.Password))
-	admDB.MustExec(fmt.Sprintf("DROP DATABASE IF EXISTS %s", dbArgs.DB))
-	admDB.Close()
+	switch dbArgs.Driver {
+	case "sqlite", "sqlite3":
+		os.Remove(dbArgs.DB)
+	default:
+		admDB := sqlx.MustConnect(dbArgs.Driver, fmt.Sprintf("dbname=postgres sslmode=disable user=%s password=%s", dbArgs.User, dbArgs.Password))
+		admDB.MustExec(fmt.Sprintf("DROP DATABASE IF EXISTS %s", dbArgs.DB))
+		admDB.Close()
+	}
 }
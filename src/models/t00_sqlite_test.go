@@ -0,0 +1,11 @@
+// Copyright 2019 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+//go:build sqlite
+// +build sqlite
+
+package models
+
+// Run the models tests on SQLite with:
+//     HEXYA_DB_DRIVER=sqlite3 go test -tags sqlite
+import _ "github.com/mattn/go-sqlite3"
@@ -21,6 +21,7 @@ import (
 	"github.com/hexya-erp/hexya/src/models/security"
 	"github.com/hexya-erp/hexya/src/models/types"
 	"github.com/hexya-erp/hexya/src/models/types/dates"
+	"github.com/hexya-erp/hexya/src/tools/exceptions"
 	"github.com/hexya-erp/hexya/src/tools/nbutils"
 	. "github.com/smartystreets/goconvey/convey"
 )
@@ -37,6 +38,9 @@ func TestModelDeclaration(t *testing.T) {
 		activeMI := NewMixinModel("ActiveMixIn")
 		viewModel := NewManualModel("UserView")
 		wizard := NewTransientModel("Wizard")
+		label := NewArchivableModel("Label")
+		company := NewModel("Company")
+		branch := NewModel("Branch")
 
 		userModel.AddMethod("PrefixedUser", "",
 			func(rc *RecordCollection, prefix string) []string {
@@ -320,7 +324,7 @@ func TestModelDeclaration(t *testing.T) {
 			`CheckRate checks that the given RecordSet has a rate between 0 and 10`,
 			func(rc *RecordCollection) {
 				if rc.Get(rc.model.FieldName("Rate")).(float32) < 0 || rc.Get(rc.model.FieldName("Rate")).(float32) > 10 {
-					log.Panic("Tag rate must be between 0 and 10")
+					panic(exceptions.UserError{Message: "Tag rate must be between 0 and 10"})
 				}
 			})
 
@@ -328,10 +332,25 @@ func TestModelDeclaration(t *testing.T) {
 			`CheckNameDescription checks that the description of a tag is not equal to its name`,
 			func(rc *RecordCollection) {
 				if rc.Get(rc.model.FieldName("Name")).(string) == rc.Get(rc.model.FieldName("Description")).(string) {
-					log.Panic("Tag name and description must be different")
+					panic(exceptions.UserError{Message: "Tag name and description must be different"})
 				}
 			})
 
+		tag.AddMethod("CheckBroken",
+			`CheckBroken is a constraint method that fails with a programming error`,
+			func(rc *RecordCollection) {
+				log.Panic("Broken constraint")
+			})
+
+		tag.AddMethod("SetNoteFromJob", "Test method for queued jobs",
+			func(rc *RecordCollection, note string, parent *RecordCollection) {
+				if note == "" {
+					log.Panic("Tag note must not be empty")
+				}
+				rc.Set(rc.model.FieldName("Note"), note)
+				rc.Set(rc.model.FieldName("Parent"), parent)
+			})
+
 		tag.methods.AllowAllToGroup(security.GroupEveryone)
 		tag.methods.RevokeAllFromGroup(security.GroupEveryone)
 		tag.methods.AllowAllToGroup(security.GroupEveryone)
@@ -391,6 +410,7 @@ func TestModelDeclaration(t *testing.T) {
 			"City":     CharField{},
 			"Country":  CharField{},
 			"UserName": CharField{Related: "User.Name"},
+			"Settings": JSONField{},
 		})
 
 		post.AddFields(map[string]FieldDefinition{
@@ -422,6 +442,7 @@ func TestModelDeclaration(t *testing.T) {
 			"WriterMoney": FloatField{Related: "PostWriter.PMoney"},
 			"Text":        CharField{},
 		})
+		comment.EnableOptimisticLocking()
 
 		tag.AddFields(map[string]FieldDefinition{
 			"Name":        CharField{Constraint: tag.Methods().MustGet("CheckNameDescription")},
@@ -464,6 +485,24 @@ func TestModelDeclaration(t *testing.T) {
 			"Name":  CharField{},
 			"Value": IntegerField{},
 		})
+
+		company.AddFields(map[string]FieldDefinition{
+			"Name": CharField{},
+		})
+
+		label.AddFields(map[string]FieldDefinition{
+			"Name": CharField{},
+		})
+
+		branch.AddFields(map[string]FieldDefinition{
+			"Name":    CharField{},
+			"Color":   CharField{},
+			"Similar": Many2OneField{RelationModel: branch},
+		})
+		branch.EnableMultiCompany()
+		branch.methods.AllowAllToGroup(security.GroupEveryone)
+		post.Fields().MustGet("Content").SetFullTextIndex("english")
+		branch.Fields().MustGet("Color").SetCompanyDependent(true)
 	})
 }
 
@@ -567,6 +606,8 @@ func TestFieldModification(t *testing.T) {
 		checkUpdates(statusField, "invisibleFunc", nFunc)
 		statusField.SetRequiredFunc(nFunc)
 		checkUpdates(statusField, "requiredFunc", nFunc)
+		statusField.SetGroups()
+		So(statusField.updates[len(statusField.updates)-1], ShouldContainKey, "groups")
 	})
 }
 
@@ -6,6 +6,7 @@ package models
 import (
 	"fmt"
 	"reflect"
+	"sort"
 	"strings"
 	"testing"
 
@@ -225,6 +226,17 @@ func TestBootStrap(t *testing.T) {
 				So(Registry.registryByTableName, ShouldContainKey, dbTable)
 			}
 		})
+		Convey("Business models should not include mixins and system models", func() {
+			var names []string
+			for _, mi := range Registry.BusinessModels() {
+				names = append(names, mi.Name())
+			}
+			So(names, ShouldContain, "User")
+			So(names, ShouldContain, "Post")
+			So(names, ShouldNotContain, "CommonMixin")
+			So(names, ShouldNotContain, "AddressMixIn")
+			So(sort.StringsAreSorted(names), ShouldBeTrue)
+		})
 		Convey("Table constraints should have been created", func() {
 			So(testAdapter.constraints("%_mancon"), ShouldHaveLength, 1)
 			So(testAdapter.constraints("%_mancon")[0], ShouldEqual, "nums_premium_user_mancon")
@@ -84,6 +84,8 @@ var (
 	password                 = fieldName{name: "Password", json: "password"}
 	size                     = fieldName{name: "Size", json: "size"}
 	hexyaVersion             = fieldName{name: "HexyaVersion", json: "hexya_version"}
+	settings                 = fieldName{name: "Settings", json: "settings"}
+	lastRead                 = fieldName{name: "LastRead", json: "last_read"}
 )
 
 func TestConditions(t *testing.T) {
@@ -323,6 +325,90 @@ func TestConditions(t *testing.T) {
 					So(sql, ShouldEqual, `WHERE ("user".is_staff IS NULL OR "user".is_staff = ?)`)
 					So(args, ShouldContain, false)
 				})
+				Convey("Full-text search", func() {
+					rs = rs.Search(rs.Model().Field(Name).Search("John"))
+					sql, args := rs.query.sqlWhereClause(true)
+					So(sql, ShouldEqual, `WHERE to_tsvector('simple', "user".name) @@ plainto_tsquery('simple', ?)`)
+					So(args, ShouldContain, "John")
+					posts := env.Pool("Post")
+					posts = posts.Search(posts.Model().Field(content).Search("first post"))
+					sql, args = posts.query.sqlWhereClause(true)
+					So(sql, ShouldEqual, `WHERE to_tsvector('english', "post".content) @@ plainto_tsquery('english', ?)`)
+					So(args, ShouldContain, "first post")
+				})
+				Convey("Full-text rank order", func() {
+					posts := env.Pool("Post")
+					posts = posts.Search(posts.Model().Field(content).Search("post")).OrderBy(FullTextRank(content, "first post"))
+					sql, args, _ := posts.query.selectQuery([]FieldName{title})
+					So(sql, ShouldEndWith, `foo ORDER BY ts_rank(to_tsvector('english', content), plainto_tsquery('english', ?)) DESC `)
+					So(args, ShouldResemble, SQLParams{"post", "first post"})
+				})
+				Convey("Between", func() {
+					rs = rs.Search(rs.Model().Field(age).Between(18, 30))
+					sql, args := rs.query.sqlWhereClause(true)
+					So(sql, ShouldEqual, `WHERE "user".age BETWEEN ? AND ?`)
+					So(args, ShouldResemble, SQLParams{18, 30})
+				})
+				Convey("Regular expressions", func() {
+					rs1 := rs.Search(rs.Model().Field(Name).Regex("^J"))
+					sql, args := rs1.query.sqlWhereClause(true)
+					So(sql, ShouldEqual, `WHERE "user".name ~ ?`)
+					So(args, ShouldContain, "^J")
+					rs2 := rs.Search(rs.Model().Field(Name).IRegex("smith$"))
+					sql, args = rs2.query.sqlWhereClause(true)
+					So(sql, ShouldEqual, `WHERE "user".name ~* ?`)
+					So(args, ShouldContain, "smith$")
+				})
+				Convey("JSON path", func() {
+					profiles := env.Pool("Profile")
+					profiles1 := profiles.Search(profiles.Model().Field(settings).JSONPath("theme.color").Equals("dark"))
+					sql, args := profiles1.query.sqlWhereClause(true)
+					So(sql, ShouldEqual, `WHERE ("profile".settings #>> ?::text[]) = ?`)
+					So(args, ShouldResemble, SQLParams{`{"theme","color"}`, "dark"})
+					profiles2 := profiles.Search(profiles.Model().Field(settings).JSONPath("zoom").Greater(1))
+					sql, args = profiles2.query.sqlWhereClause(true)
+					So(sql, ShouldEqual, `WHERE ("profile".settings #>> ?::text[])::numeric > ?`)
+					So(args, ShouldResemble, SQLParams{`{"zoom"}`, 1})
+					profiles3 := profiles.Search(profiles.Model().Field(settings).JSONPath("zoom").IsNull())
+					sql, args = profiles3.query.sqlWhereClause(true)
+					So(sql, ShouldEqual, `WHERE ("profile".settings #>> ?::text[]) IS NULL`)
+					So(args, ShouldResemble, SQLParams{`{"zoom"}`})
+					So(func() { rs.Search(rs.Model().Field(Name).JSONPath("zoom").Equals(1)).Load() }, ShouldPanic)
+				})
+				Convey("Overlaps on many2many", func() {
+					posts := env.Pool("Post")
+					posts = posts.Search(posts.Model().Field(tags).Overlaps([]int64{1, 2}))
+					sql, args := posts.query.sqlWhereClause(true)
+					So(sql, ShouldEqual, `WHERE EXISTS (SELECT 1 FROM "post_tag_rel" rel WHERE rel.post_id = "post".id AND rel.tag_id IN (?))`)
+					So(args, ShouldResemble, SQLParams{[]int64{1, 2}})
+				})
+				Convey("Exists on one2many", func() {
+					postModel := Registry.MustGet("Post")
+					rs = rs.Search(rs.Model().Field(posts).Exists(postModel.Field(title).Equals("1st Post")))
+					sql, args := rs.query.sqlWhereClause(true)
+					So(sql, ShouldEqual, `WHERE EXISTS (SELECT "sq".id FROM "post" "sq"  WHERE "sq".user_id = "user".id AND ("sq".title = ?))`)
+					So(args, ShouldResemble, SQLParams{"1st Post"})
+				})
+				Convey("Not exists without condition", func() {
+					rs = rs.Search(rs.Model().Field(posts).NotExists(nil))
+					sql, args := rs.query.sqlWhereClause(true)
+					So(sql, ShouldEqual, `WHERE NOT EXISTS (SELECT "sq".id FROM "post" "sq"  WHERE "sq".user_id = "user".id)`)
+					So(args, ShouldBeEmpty)
+				})
+				Convey("Count aggregate", func() {
+					rs = rs.Search(rs.Model().Field(posts).Count().Greater(1))
+					sql, args := rs.query.sqlWhereClause(true)
+					So(sql, ShouldEqual, `WHERE (SELECT COUNT("sq_agg".id) FROM "post" "sq_agg" WHERE "sq_agg".id IN (SELECT "sq".id FROM "post" "sq"  WHERE "sq".user_id = "user".id)) > ?`)
+					So(args, ShouldResemble, SQLParams{1})
+				})
+				Convey("Grouped query by month with having clause", func() {
+					posts := env.Pool("Post").SearchAll().GroupByDate(lastRead, GranularityMonth).
+						Having(env.Pool("Post").Model().Field(ID).Aggregate(AggregateCount).Greater(1))
+					sql, args := posts.query.selectGroupQuery([]FieldName{lastRead}, map[string]string{})
+					So(sql, ShouldStartWith, `SELECT date_trunc('month', last_read::timestamp)::date AS last_read, count(1) AS __count FROM (`)
+					So(sql, ShouldContainSubstring, `GROUP BY date_trunc('month', last_read::timestamp)::date HAVING count(id) > ?`)
+					So(args, ShouldResemble, SQLParams{1})
+				})
 				Convey("Child Of without parent field", func() {
 					rs = rs.Search(rs.Model().Field(ID).ChildOf(101))
 					sql, args, _ := rs.query.selectQuery([]FieldName{Name})
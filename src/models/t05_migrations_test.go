@@ -0,0 +1,204 @@
+// Copyright 2019 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package models
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestMigrations(t *testing.T) {
+	Convey("Testing migrations", t, func() {
+		Convey("Synchronized database should have no schema changes", func() {
+			So(SchemaChanges(), ShouldBeEmpty)
+			So(PlanMigrations("nothing", nil), ShouldBeEmpty)
+		})
+		Convey("Schema changes should be listed without being executed", func() {
+			dbExecuteNoTx(`DROP INDEX IF EXISTS user_nums_index`)
+			Registry.MustGet("User").Fields().MustGet("Nums").index = true
+			changes := SchemaChanges()
+			Registry.MustGet("User").Fields().MustGet("Nums").index = false
+			So(changes, ShouldHaveLength, 1)
+			So(changes[0], ShouldStartWith, "CREATE INDEX user_nums_index")
+			So(testAdapter.indexExists("user", "user_nums_index"), ShouldBeFalse)
+		})
+		Convey("Planned migrations should belong to the module of the model and revert it", func() {
+			user := Registry.MustGet("User")
+			dbExecuteNoTx(`DROP INDEX IF EXISTS user_nums_index`)
+			user.Fields().MustGet("Nums").index = true
+			user.pkgPath = "example.com/project/sale"
+			migrations := PlanMigrations("index_nums", []MigrationModule{
+				{Name: "base", Package: "example.com/project/base"},
+				{Name: "sale", Package: "example.com/project/sale"},
+			})
+			user.pkgPath = ""
+			user.Fields().MustGet("Nums").index = false
+			So(migrations, ShouldHaveLength, 1)
+			So(migrations[0].Module, ShouldEqual, "sale")
+			So(migrations[0].Name, ShouldEqual, "index_nums")
+			So(migrations[0].UpSQL, ShouldStartWith, "CREATE INDEX user_nums_index")
+			So(migrations[0].DownSQL, ShouldEqual, "DROP INDEX IF EXISTS user_nums_index;")
+			So(testAdapter.indexExists("user", "user_nums_index"), ShouldBeFalse)
+		})
+		Convey("Statements should be attributed to the last module declaring their objects", func() {
+			rec := schemaRecorder{modules: []MigrationModule{
+				{Name: "base", Package: "example.com/project/base"},
+				{Name: "sale", Package: "example.com/project/sale"},
+				{Name: "sale_extra", Package: "example.com/project/sale/extra"},
+			}}
+			So(rec.rankOf(""), ShouldEqual, -1)
+			So(rec.rankOf("example.com/project/basement"), ShouldEqual, -1)
+			So(rec.rankOf("example.com/project/base/models"), ShouldEqual, 0)
+			So(rec.rankOf("example.com/project/sale", "example.com/project/base"), ShouldEqual, 1)
+			So(rec.rankOf("example.com/project/sale/extra"), ShouldEqual, 2)
+		})
+		Convey("Irreversible statements should be commented in down statements", func() {
+			So(joinSQLStatements([]string{"DROP TABLE a", "", "-- Irreversible: ALTER TABLE b DROP COLUMN c"}),
+				ShouldEqual, "DROP TABLE a;\n\n-- Irreversible: ALTER TABLE b DROP COLUMN c")
+		})
+		Convey("Sequence changes should be listed without being executed", func() {
+			testAdapter.dropSequence("test_sequence_bootseq")
+			changes := SchemaChanges()
+			So(changes, ShouldHaveLength, 1)
+			So(changes[0], ShouldContainSubstring, "test_sequence_bootseq")
+			So(testAdapter.sequences("%_bootseq"), ShouldBeEmpty)
+			SyncDatabase()
+			So(testAdapter.sequences("%_bootseq"), ShouldHaveLength, 1)
+			So(SchemaChanges(), ShouldBeEmpty)
+		})
+		Convey("Unmanaged tables should not be dropped", func() {
+			dbExecuteNoTx(`CREATE TABLE IF NOT EXISTS unmanaged_test (id integer)`)
+			RegisterUnmanagedTable("unmanaged_test")
+			So(SchemaChanges(), ShouldBeEmpty)
+			SyncDatabase()
+			So(testAdapter.tables(), ShouldContainKey, "unmanaged_test")
+			delete(unmanagedTables, "unmanaged_test")
+			dbExecuteNoTx(`DROP TABLE unmanaged_test`)
+		})
+		Convey("Changing the language of a full-text index should recreate it", func() {
+			content := Registry.MustGet("Post").Fields().MustGet("Content")
+			supported := testAdapter.fullTextIndexQuery("post_content_fts_french_index", "post", "content", "french") != ""
+			So(testAdapter.indexExists("post", "post_content_fts_english_index"), ShouldEqual, supported)
+			content.fullTextLang = "french"
+			SyncDatabase()
+			So(testAdapter.indexExists("post", "post_content_fts_french_index"), ShouldEqual, supported)
+			So(testAdapter.indexExists("post", "post_content_fts_english_index"), ShouldBeFalse)
+			content.fullTextLang = "english"
+			SyncDatabase()
+			So(testAdapter.indexExists("post", "post_content_fts_english_index"), ShouldEqual, supported)
+			So(testAdapter.indexExists("post", "post_content_fts_french_index"), ShouldBeFalse)
+		})
+		Convey("Full-text index names should be valid identifiers", func() {
+			So(fullTextIndexName("post", "content", "english"), ShouldEqual, "post_content_fts_english_index")
+			qualified := fullTextIndexName("post", "content", "pg_catalog.english")
+			So(qualified, ShouldStartWith, "post_content_fts_")
+			So(qualified, ShouldEndWith, "_index")
+			So(qualified, ShouldNotContainSubstring, ".")
+			So(qualified, ShouldNotEqual, fullTextIndexName("post", "content", "pg_catalog_english"))
+			longTable := strings.Repeat("long_table_name_", 4)
+			long := fullTextIndexName(longTable, "content", "english")
+			So(len(long), ShouldBeLessThanOrEqualTo, maxIdentifierLength)
+			So(long, ShouldStartWith, fullTextIndexPrefix(longTable, "content"))
+			So(long, ShouldEqual, fullTextIndexName(longTable, "content", "english"))
+			So(long, ShouldNotEqual, fullTextIndexName(longTable, "content", "french"))
+		})
+		Convey("Recorded statements should have their placeholders substituted", func() {
+			So(substitutePlaceholders(`ALTER TABLE "a?b" ALTER COLUMN c SET DEFAULT 'why?' WHERE d = ? AND e = ?`, "it's", 3),
+				ShouldEqual, `ALTER TABLE "a?b" ALTER COLUMN c SET DEFAULT 'why?' WHERE d = 'it''s' AND e = 3`)
+			So(substitutePlaceholders(`SELECT 'a''?' , ?`, true), ShouldEqual, `SELECT 'a''?' , TRUE`)
+		})
+		Convey("Parsing migration files", func() {
+			content := []byte(`-- Some comment
+-- +hexya Up
+CREATE TABLE migration_test (id integer);
+
+-- +hexya Down
+DROP TABLE migration_test;
+`)
+			m, err := ParseMigration("test", "20191015120000_create_test.sql", content)
+			So(err, ShouldBeNil)
+			So(m.Module, ShouldEqual, "test")
+			So(m.Version, ShouldEqual, "20191015120000")
+			So(m.Name, ShouldEqual, "create_test")
+			So(m.UpSQL, ShouldContainSubstring, "CREATE TABLE migration_test")
+			So(m.DownSQL, ShouldContainSubstring, "DROP TABLE migration_test")
+			_, err = ParseMigration("test", "create_test.sql", content)
+			So(err, ShouldNotBeNil)
+			_, err = ParseMigration("test", "20191015120000_create_test.sql", []byte("CREATE TABLE foo (id integer);"))
+			So(err, ShouldNotBeNil)
+		})
+		Convey("Writing, applying and rolling back migrations", func() {
+			dir, err := ioutil.TempDir("", "hexya-migrations")
+			So(err, ShouldBeNil)
+			defer os.RemoveAll(dir)
+			var hookCalls []string
+			RegisterMigrationHooks("test", "20191015120000",
+				func(env Environment) { hookCalls = append(hookCalls, "up") },
+				func(env Environment) { hookCalls = append(hookCalls, "down") })
+			m := &Migration{
+				Module:  "test",
+				Version: "20191015120000",
+				Name:    "create_test",
+				UpSQL:   "CREATE TABLE migration_test (id integer);",
+				DownSQL: "DROP TABLE migration_test;",
+			}
+			_, err = m.WriteFile(dir)
+			So(err, ShouldBeNil)
+			migrations, err := LoadMigrations(dir)
+			So(err, ShouldBeNil)
+			So(migrations, ShouldHaveLength, 1)
+			So(migrations[0].String(), ShouldEqual, "test/20191015120000_create_test")
+			So(PendingMigrations(migrations), ShouldHaveLength, 1)
+
+			applied, err := ApplyMigrations(migrations)
+			So(err, ShouldBeNil)
+			So(applied, ShouldHaveLength, 1)
+			So(testAdapter.tables(), ShouldContainKey, "migration_test")
+			So(PendingMigrations(migrations), ShouldBeEmpty)
+			applied, err = ApplyMigrations(migrations)
+			So(err, ShouldBeNil)
+			So(applied, ShouldBeEmpty)
+
+			rolledBack, err := RollbackMigration(migrations, "test")
+			So(err, ShouldBeNil)
+			So(rolledBack, ShouldNotBeNil)
+			So(testAdapter.tables(), ShouldNotContainKey, "migration_test")
+			So(PendingMigrations(migrations), ShouldHaveLength, 1)
+			rolledBack, err = RollbackMigration(migrations, "test")
+			So(err, ShouldBeNil)
+			So(rolledBack, ShouldBeNil)
+			So(hookCalls, ShouldResemble, []string{"up", "down"})
+		})
+		Convey("Migrations without Down statements nor hook should not be rolled back", func() {
+			m := &Migration{
+				Module:  "test",
+				Version: "20191016120000",
+				Name:    "no_down",
+				UpSQL:   "CREATE TABLE migration_no_down (id integer);",
+				DownSQL: "-- Write here the statements reverting this migration\n",
+			}
+			migrations := []*Migration{m}
+			_, err := ApplyMigrations(migrations)
+			So(err, ShouldBeNil)
+			rolledBack, err := RollbackMigration(migrations, "test")
+			So(err, ShouldNotBeNil)
+			So(rolledBack, ShouldBeNil)
+			So(PendingMigrations(migrations), ShouldBeEmpty)
+			So(testAdapter.tables(), ShouldContainKey, "migration_no_down")
+			m.DownSQL = "DROP TABLE migration_no_down;"
+			rolledBack, err = RollbackMigration(migrations, "test")
+			So(err, ShouldBeNil)
+			So(rolledBack, ShouldEqual, m)
+			So(testAdapter.tables(), ShouldNotContainKey, "migration_no_down")
+		})
+		Convey("Migrations table should not be dropped by SyncDatabase", func() {
+			So(SchemaChanges(), ShouldBeEmpty)
+			So(testAdapter.tables(), ShouldContainKey, migrationsTable)
+		})
+	})
+}
@@ -15,10 +15,14 @@
 package models
 
 import (
+	"errors"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/hexya-erp/hexya/src/models/security"
 	"github.com/hexya-erp/hexya/src/models/types"
+	"github.com/hexya-erp/hexya/src/models/types/dates"
 	"github.com/lib/pq"
 	. "github.com/smartystreets/goconvey/convey"
 )
@@ -288,3 +292,308 @@ X2M Links
 		})
 	})
 }
+
+// failingSink is an EventSink that never delivers events
+type failingSink struct{}
+
+// Send always returns an error
+func (failingSink) Send(ChangeEvent) error {
+	return errors.New("sink unavailable")
+}
+
+func TestChangeEvents(t *testing.T) {
+	Convey("Testing change events", t, func() {
+		var received []ChangeEvent
+		SubscribeChangeEvents("test", func(event ChangeEvent) {
+			received = append(received, event)
+		})
+		createAndDeleteTag := func(env Environment) {
+			tag := env.Pool("Tag").Call("Create", NewModelData(Registry.MustGet("Tag")).
+				Set(Name, "Event Tag")).(RecordSet).Collection()
+			tag.Call("Unlink")
+			So(received, ShouldBeEmpty)
+		}
+		Convey("Events should be dispatched after commit", func() {
+			So(ExecuteInNewEnvironment(security.SuperUserID, createAndDeleteTag), ShouldBeNil)
+			So(received, ShouldHaveLength, 2)
+			So(received[0].Model, ShouldEqual, "Tag")
+			So(received[0].Operation, ShouldEqual, EventCreate)
+			So(received[0].Fields, ShouldContain, "name")
+			So(received[0].UID, ShouldEqual, security.SuperUserID)
+			So(received[1].Operation, ShouldEqual, EventUnlink)
+			So(received[1].IDs, ShouldResemble, received[0].IDs)
+		})
+		Convey("Events should not be dispatched on rollback", func() {
+			So(ExecuteInNewEnvironment(security.SuperUserID, func(env Environment) {
+				createAndDeleteTag(env)
+				panic("rolling back")
+			}), ShouldNotBeNil)
+			So(SimulateInNewEnvironment(security.SuperUserID, createAndDeleteTag), ShouldBeNil)
+			So(received, ShouldBeEmpty)
+		})
+		Convey("Events should be stored in the outbox and sent to sinks", func() {
+			EnableOutbox(0)
+			events := make(chan ChangeEvent, 10)
+			RegisterEventSink("test", ChannelSink(events))
+			So(ExecuteInNewEnvironment(security.SuperUserID, createAndDeleteTag), ShouldBeNil)
+			So(events, ShouldBeEmpty)
+			So(DrainOutbox(), ShouldBeNil)
+			So(events, ShouldHaveLength, 2)
+			event := <-events
+			So(event.Model, ShouldEqual, "Tag")
+			So(event.Operation, ShouldEqual, EventCreate)
+			So(event.IDs, ShouldResemble, received[0].IDs)
+			var count int
+			dbGetNoTx(&count, "SELECT COUNT(*) FROM hexya_event_outbox")
+			So(count, ShouldEqual, 0)
+			UnregisterEventSink("test")
+			DisableOutbox()
+		})
+		Convey("Claimed outbox events should not be delivered twice and failed ones should be released", func() {
+			EnableOutbox(0)
+			So(ExecuteInNewEnvironment(security.SuperUserID, createAndDeleteTag), ShouldBeNil)
+			rows, err := claimOutboxEvents()
+			So(err, ShouldBeNil)
+			So(rows, ShouldHaveLength, 2)
+			again, err := claimOutboxEvents()
+			So(err, ShouldBeNil)
+			So(again, ShouldBeEmpty)
+			dbExecuteNoTx("UPDATE hexya_event_outbox SET claimed_at = NULL")
+			RegisterEventSink("failing", failingSink{})
+			So(DrainOutbox(), ShouldNotBeNil)
+			var count int
+			dbGetNoTx(&count, "SELECT COUNT(*) FROM hexya_event_outbox WHERE claimed_at IS NULL")
+			So(count, ShouldEqual, 2)
+			UnregisterEventSink("failing")
+			events := make(chan ChangeEvent, 10)
+			RegisterEventSink("test", ChannelSink(events))
+			So(DrainOutbox(), ShouldBeNil)
+			So(events, ShouldHaveLength, 2)
+			dbGetNoTx(&count, "SELECT COUNT(*) FROM hexya_event_outbox")
+			So(count, ShouldEqual, 0)
+			UnregisterEventSink("test")
+			DisableOutbox()
+		})
+		Convey("Webhook requests should time out before the claim of their batch expires", func() {
+			So(webhookClient.Timeout, ShouldBeGreaterThan, 0)
+			So(webhookClient.Timeout*outboxBatchSize, ShouldBeLessThan, outboxClaimTimeout)
+		})
+		UnsubscribeChangeEvents("test")
+	})
+}
+
+func TestJobQueue(t *testing.T) {
+	Convey("Testing the job queue", t, func() {
+		tagModel := Registry.MustGet("Tag")
+		var tagID, parentID int64
+		So(ExecuteInNewEnvironment(security.SuperUserID, func(env Environment) {
+			tags := env.Pool("Tag")
+			parentID = tags.Call("Create", NewModelData(tagModel).Set(Name, "Job Parent Tag")).(RecordSet).Ids()[0]
+			tagID = tags.Call("Create", NewModelData(tagModel).Set(Name, "Job Tag")).(RecordSet).Ids()[0]
+		}), ShouldBeNil)
+		jobState := func(id int64) (state string, attempts int) {
+			var job struct {
+				State    string
+				Attempts int
+			}
+			dbGetNoTx(&job, "SELECT state, attempts FROM hexya_job WHERE id = ?", id)
+			return job.State, job.Attempts
+		}
+		Convey("Jobs enqueued in a rolled back transaction should not be stored", func() {
+			var jobID int64
+			So(SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+				tag := env.Pool("Tag").withIds([]int64{tagID})
+				jobID = env.Enqueue("SetNoteFromJob", tag, []interface{}{"Simulated", env.Pool("Tag")}, JobOptions{})
+			}), ShouldBeNil)
+			var count int
+			dbGetNoTx(&count, "SELECT COUNT(*) FROM hexya_job WHERE id = ?", jobID)
+			So(count, ShouldEqual, 0)
+		})
+		Convey("Enqueued jobs should be executed with their arguments", func() {
+			var jobID int64
+			So(ExecuteInNewEnvironment(security.SuperUserID, func(env Environment) {
+				tags := env.Pool("Tag")
+				jobID = env.Enqueue("SetNoteFromJob", tags.withIds([]int64{tagID}),
+					[]interface{}{"Job Note", tags.withIds([]int64{parentID})}, JobOptions{})
+			}), ShouldBeNil)
+			state, _ := jobState(jobID)
+			So(state, ShouldEqual, JobPending)
+			ProcessJobs()
+			state, attempts := jobState(jobID)
+			So(state, ShouldEqual, JobDone)
+			So(attempts, ShouldEqual, 1)
+			So(SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+				tag := env.Pool("Tag").withIds([]int64{tagID})
+				So(tag.Get(tagModel.FieldName("Note")), ShouldEqual, "Job Note")
+				So(tag.Get(tagModel.FieldName("Parent")).(RecordSet).Ids(), ShouldResemble, []int64{parentID})
+			}), ShouldBeNil)
+		})
+		Convey("Delayed jobs should not be executed before their ETA", func() {
+			var jobID int64
+			So(ExecuteInNewEnvironment(security.SuperUserID, func(env Environment) {
+				tags := env.Pool("Tag")
+				jobID = env.Enqueue("SetNoteFromJob", tags.withIds([]int64{tagID}), []interface{}{"Delayed", tags},
+					JobOptions{ETA: dates.Now().Add(time.Hour)})
+			}), ShouldBeNil)
+			ProcessJobs()
+			state, attempts := jobState(jobID)
+			So(state, ShouldEqual, JobPending)
+			So(attempts, ShouldEqual, 0)
+			dbExecuteNoTx("DELETE FROM hexya_job WHERE id = ?", jobID)
+		})
+		Convey("Failed jobs should be retried and then marked as dead", func() {
+			var jobID int64
+			So(ExecuteInNewEnvironment(security.SuperUserID, func(env Environment) {
+				tags := env.Pool("Tag")
+				jobID = env.Enqueue("SetNoteFromJob", tags.withIds([]int64{tagID}), []interface{}{"", tags},
+					JobOptions{MaxRetries: 1, Channel: "test"})
+			}), ShouldBeNil)
+			ProcessJobs()
+			state, attempts := jobState(jobID)
+			So(state, ShouldEqual, JobPending)
+			So(attempts, ShouldEqual, 1)
+			ProcessJobs()
+			_, attempts = jobState(jobID)
+			So(attempts, ShouldEqual, 1)
+			dbExecuteNoTx("UPDATE hexya_job SET eta = ? WHERE id = ?", dates.Now().Add(-time.Minute), jobID)
+			ProcessJobs()
+			state, attempts = jobState(jobID)
+			So(state, ShouldEqual, JobDead)
+			So(attempts, ShouldEqual, 2)
+			var lastError string
+			dbGetNoTx(&lastError, "SELECT last_error FROM hexya_job WHERE id = ?", jobID)
+			So(lastError, ShouldContainSubstring, "Tag note must not be empty")
+		})
+		Convey("Retry delays should grow exponentially", func() {
+			So(jobRetryBackoff(1), ShouldEqual, jobRetryDelay)
+			So(jobRetryBackoff(3), ShouldEqual, 4*jobRetryDelay)
+			So(jobRetryBackoff(100), ShouldEqual, jobMaxRetryDelay)
+		})
+		So(ExecuteInNewEnvironment(security.SuperUserID, func(env Environment) {
+			env.Pool("Tag").withIds([]int64{tagID, parentID}).Call("Unlink")
+		}), ShouldBeNil)
+	})
+}
+
+func TestScheduledActions(t *testing.T) {
+	Convey("Testing scheduled actions", t, func() {
+		So(func() {
+			RegisterScheduledAction(ScheduledAction{Name: "invalid", Schedule: "* * *", Fnct: func(env Environment) {}})
+		}, ShouldPanic)
+		So(func() {
+			RegisterScheduledAction(ScheduledAction{Name: "invalid", Schedule: "@daily", Timezone: "Nowhere/Nocity", Fnct: func(env Environment) {}})
+		}, ShouldPanic)
+		var mu sync.Mutex
+		runs := make(map[string]int)
+		for name, policy := range map[string]CatchUpPolicy{"none": CatchUpNone, "once": CatchUpOnce, "all": CatchUpAll} {
+			name := name
+			RegisterScheduledAction(ScheduledAction{
+				Name:     name,
+				Schedule: "0 0 1 1 *",
+				Timezone: "Europe/Paris",
+				CatchUp:  policy,
+				Fnct: func(env Environment) {
+					mu.Lock()
+					defer mu.Unlock()
+					runs[name]++
+				},
+			})
+		}
+		So(func() {
+			RegisterScheduledAction(ScheduledAction{Name: "all", Schedule: "@daily", Fnct: func(env Environment) {}})
+		}, ShouldPanic)
+		paris, _ := dates.LoadLocation("Europe/Paris")
+		now := time.Now().In(paris)
+		nextRun := time.Date(now.Year()+1, 1, 1, 0, 0, 0, 0, paris)
+		Convey("First call should schedule the next run without executing the actions", func() {
+			RunScheduledActions()
+			So(runs, ShouldBeEmpty)
+			var next dates.DateTime
+			dbGetNoTx(&next, "SELECT next_run FROM hexya_scheduled_action WHERE name = ?", "all")
+			So(next.Equal(dates.DateTime{Time: nextRun}), ShouldBeTrue)
+			Convey("Actions should not be executed before their next run", func() {
+				RunScheduledActions()
+				So(runs, ShouldBeEmpty)
+			})
+			Convey("Missed runs should be executed according to the catch up policy", func() {
+				threeYearsAgo := dates.DateTime{Time: time.Date(now.Year()-3, 1, 1, 0, 0, 0, 0, paris)}
+				dbExecuteNoTx("UPDATE hexya_scheduled_action SET next_run = ?", threeYearsAgo)
+				RunScheduledActions()
+				So(runs["none"], ShouldEqual, 0)
+				So(runs["once"], ShouldEqual, 1)
+				So(runs["all"], ShouldEqual, 4)
+				var lastRun, next dates.DateTime
+				dbGetNoTx(&lastRun, "SELECT last_run FROM hexya_scheduled_action WHERE name = ?", "once")
+				So(lastRun.Greater(threeYearsAgo), ShouldBeTrue)
+				dbGetNoTx(&next, "SELECT next_run FROM hexya_scheduled_action WHERE name = ?", "none")
+				So(next.Equal(dates.DateTime{Time: nextRun}), ShouldBeTrue)
+			})
+		})
+		scheduledActions.Lock()
+		scheduledActions.actions = make(map[string]*ScheduledAction)
+		scheduledActions.Unlock()
+		dbExecuteNoTx("DELETE FROM hexya_scheduled_action")
+	})
+}
+
+func TestSharedCache(t *testing.T) {
+	Convey("Testing the shared cache", t, func() {
+		tagModel := Registry.MustGet("Tag")
+		var tagID int64
+		So(ExecuteInNewEnvironment(security.SuperUserID, func(env Environment) {
+			tagID = env.Pool("Tag").Call("Create", NewModelData(tagModel).Set(Name, "Cached Tag")).(RecordSet).Ids()[0]
+		}), ShouldBeNil)
+		cache := NewLRUCache(100)
+		SetSharedCache(cache)
+		tagModel.EnableSharedCache()
+		readName := func() (name string) {
+			So(ExecuteInNewEnvironment(security.SuperUserID, func(env Environment) {
+				name = env.Pool("Tag").withIds([]int64{tagID}).Get(Name).(string)
+			}), ShouldBeNil)
+			return
+		}
+		Convey("Records should be read from the shared cache once loaded", func() {
+			So(readName(), ShouldEqual, "Cached Tag")
+			So(cache.Len(), ShouldEqual, 1)
+			before := SharedCacheMetrics()
+			So(readName(), ShouldEqual, "Cached Tag")
+			So(SharedCacheMetrics().Hits, ShouldEqual, before.Hits+1)
+		})
+		Convey("Modified records should be invalidated on commit only", func() {
+			So(readName(), ShouldEqual, "Cached Tag")
+			So(SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+				tag := env.Pool("Tag").withIds([]int64{tagID})
+				tag.Set(Name, "Simulated Tag")
+				So(tag.Get(Name), ShouldEqual, "Simulated Tag")
+			}), ShouldBeNil)
+			So(cache.Len(), ShouldEqual, 1)
+			So(readName(), ShouldEqual, "Cached Tag")
+			So(ExecuteInNewEnvironment(security.SuperUserID, func(env Environment) {
+				env.Pool("Tag").withIds([]int64{tagID}).Set(Name, "Modified Tag")
+			}), ShouldBeNil)
+			So(cache.Len(), ShouldEqual, 0)
+			So(readName(), ShouldEqual, "Modified Tag")
+		})
+		Convey("Least recently used records should be evicted", func() {
+			lru := NewLRUCache(2)
+			lru.Set("Tag", 1, "", FieldMap{"name": "One"})
+			lru.Set("Tag", 2, "", FieldMap{"name": "Two"})
+			_, ok := lru.Get("Tag", 1, "")
+			So(ok, ShouldBeTrue)
+			lru.Set("Tag", 3, "", FieldMap{"name": "Three"})
+			So(lru.Len(), ShouldEqual, 2)
+			_, ok = lru.Get("Tag", 2, "")
+			So(ok, ShouldBeFalse)
+			values, ok := lru.Get("Tag", 1, "")
+			So(ok, ShouldBeTrue)
+			So(values["name"], ShouldEqual, "One")
+			lru.Invalidate("Tag")
+			So(lru.Len(), ShouldEqual, 0)
+		})
+		tagModel.sharedCached = false
+		SetSharedCache(nil)
+		So(ExecuteInNewEnvironment(security.SuperUserID, func(env Environment) {
+			env.Pool("Tag").withIds([]int64{tagID}).Call("Unlink")
+		}), ShouldBeNil)
+	})
+}
@@ -4,11 +4,13 @@
 package models
 
 import (
+	"context"
 	"fmt"
 	"testing"
 	"time"
 
 	"github.com/hexya-erp/hexya/src/models/fieldtype"
+	"github.com/hexya-erp/hexya/src/models/operator"
 	"github.com/hexya-erp/hexya/src/models/security"
 	"github.com/hexya-erp/hexya/src/models/types/dates"
 	. "github.com/smartystreets/goconvey/convey"
@@ -503,6 +505,120 @@ func TestBaseModelMethods(t *testing.T) {
 	})
 }
 
+func TestArchivableModels(t *testing.T) {
+	Convey("Testing archivable models", t, func() {
+		So(SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			labelModel := Registry.MustGet("Label")
+			labels := env.Pool("Label")
+			red := labels.Call("Create", NewModelData(labelModel).Set(Name, "Red")).(RecordSet).Collection()
+			blue := labels.Call("Create", NewModelData(labelModel).Set(Name, "Blue")).(RecordSet).Collection()
+			Convey("New records should be active", func() {
+				So(red.Get(active), ShouldBeTrue)
+				So(labels.Call("SearchAll").(RecordSet).Len(), ShouldEqual, 2)
+			})
+			Convey("Archived records should not be searched", func() {
+				So(red.Call("Archive").(bool), ShouldBeTrue)
+				So(red.Get(active), ShouldBeFalse)
+				So(labels.Call("SearchAll").(RecordSet).Collection().Ids(), ShouldResemble, []int64{blue.Ids()[0]})
+				So(labels.Call("Search", labelModel.Field(Name).Equals("Red")).(RecordSet).IsEmpty(), ShouldBeTrue)
+				So(labels.Call("SearchCount").(int), ShouldEqual, 1)
+				So(labels.Call("SearchByName", "Red", operator.Equals, labelModel.Field(Name).IsNotNull(), 0).(RecordSet).IsEmpty(), ShouldBeTrue)
+				Convey("Archived records should be searched with active_test set to false", func() {
+					inactive := labels.WithContext("active_test", false)
+					So(inactive.Call("Search", labelModel.Field(Name).Equals("Red")).(RecordSet).Len(), ShouldEqual, 1)
+					So(inactive.Call("SearchCount").(int), ShouldEqual, 2)
+				})
+				Convey("Archived records should be searched when filtering on Active", func() {
+					So(labels.Call("Search", labelModel.Field(active).Equals(false)).(RecordSet).Collection().Ids(), ShouldResemble, red.Ids())
+				})
+				Convey("Archived records should be browsed", func() {
+					So(labels.Call("BrowseOne", red.Ids()[0]).(RecordSet).Len(), ShouldEqual, 1)
+				})
+				Convey("Unarchived records should be searched again", func() {
+					red.Call("Unarchive")
+					So(red.Get(active), ShouldBeTrue)
+					So(labels.Call("SearchCount").(int), ShouldEqual, 2)
+				})
+			})
+			Convey("Models that are not archivable should not be filtered", func() {
+				So(labelModel.isArchivable(), ShouldBeTrue)
+				So(Registry.MustGet("User").isArchivable(), ShouldBeFalse)
+			})
+		}), ShouldBeNil)
+	})
+}
+
+func TestMultiCompany(t *testing.T) {
+	Convey("Testing multi-company models", t, func() {
+		So(SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			branchModel := Registry.MustGet("Branch")
+			companyField := branchModel.FieldName("Company")
+			colorField := branchModel.FieldName("Color")
+			similarField := branchModel.FieldName("Similar")
+			companies := env.Pool("Company")
+			c1 := companies.Call("Create", NewModelData(companies.model).Set(Name, "Company 1")).(RecordSet).Collection()
+			c2 := companies.Call("Create", NewModelData(companies.model).Set(Name, "Company 2")).(RecordSet).Collection()
+			branches := env.Pool("Branch")
+			branches1 := branches.WithContext("allowed_company_ids", c1.Ids())
+			branches2 := branches.WithContext("allowed_company_ids", c2.Ids())
+			branches12 := branches.WithContext("allowed_company_ids", []int64{c1.Ids()[0], c2.Ids()[0]})
+			b1 := branches1.Call("Create", NewModelData(branchModel).Set(Name, "B1").Set(colorField, "Blue")).(RecordSet).Collection()
+			b2 := branches2.Call("Create", NewModelData(branchModel).Set(Name, "B2")).(RecordSet).Collection()
+			shared := branches.Call("Create", NewModelData(branchModel).Set(Name, "Shared")).(RecordSet).Collection()
+			Convey("New records should belong to the current company", func() {
+				So(b1.Get(companyField).(RecordSet).Collection().Ids(), ShouldResemble, c1.Ids())
+				So(b2.Get(companyField).(RecordSet).Collection().Ids(), ShouldResemble, c2.Ids())
+				So(shared.Get(companyField).(RecordSet).IsEmpty(), ShouldBeTrue)
+			})
+			Convey("Searches should be restricted to allowed companies", func() {
+				So(branches1.Call("SearchAll").(RecordSet).Len(), ShouldEqual, 2)
+				So(branches1.Call("Search", branchModel.Field(Name).Equals("B2")).(RecordSet).IsEmpty(), ShouldBeTrue)
+				So(branches2.Call("SearchCount").(int), ShouldEqual, 2)
+				So(branches12.Call("SearchCount").(int), ShouldEqual, 3)
+				So(branches.Call("SearchCount").(int), ShouldEqual, 3)
+			})
+			Convey("Allowed companies should be restricted to the companies of the user", func() {
+				SetUserCompaniesFunc(func(env Environment, uid int64) []int64 {
+					So(env.Uid(), ShouldEqual, security.SuperUserID)
+					if uid == 2 {
+						return c1.Ids()
+					}
+					return nil
+				})
+				defer SetUserCompaniesFunc(nil)
+				user2Branches := branches.Sudo(2)
+				So(allowedCompanies(user2Branches.Env()), ShouldResemble, c1.Ids())
+				So(user2Branches.Call("SearchCount").(int), ShouldEqual, 2)
+				So(allowedCompanies(user2Branches.WithContext("allowed_company_ids", c2.Ids()).Env()), ShouldResemble, c1.Ids())
+				So(user2Branches.WithContext("allowed_company_ids", c2.Ids()).Call("Search",
+					branchModel.Field(Name).Equals("B2")).(RecordSet).IsEmpty(), ShouldBeTrue)
+				So(allowedCompanies(user2Branches.WithContext("allowed_company_ids", []int64{c2.Ids()[0], c1.Ids()[0]}).Env()),
+					ShouldResemble, c1.Ids())
+				So(branches.Sudo(3).Call("SearchCount").(int), ShouldEqual, 1)
+				So(branches12.Call("SearchCount").(int), ShouldEqual, 3)
+			})
+			Convey("Users should only access records without company if no UserCompaniesFunc is set", func() {
+				user2Branches := branches12.Sudo(2)
+				So(allowedCompanies(user2Branches.Env()), ShouldBeEmpty)
+				So(user2Branches.Call("SearchCount").(int), ShouldEqual, 1)
+				So(user2Branches.Call("Search", branchModel.Field(Name).Equals("B1")).(RecordSet).IsEmpty(), ShouldBeTrue)
+				So(branches12.Call("SearchCount").(int), ShouldEqual, 3)
+			})
+			Convey("Linking records of different companies should fail", func() {
+				So(func() { b1.Set(similarField, b2) }, ShouldPanic)
+				So(func() { b1.Set(similarField, shared) }, ShouldNotPanic)
+				So(func() { shared.Set(similarField, b1) }, ShouldNotPanic)
+				So(func() { shared.Set(companyField, c2) }, ShouldPanic)
+			})
+			Convey("Company dependent fields should have a value per company", func() {
+				b1.WithContext("allowed_company_ids", c2.Ids()).Set(colorField, "Green")
+				So(b1.WithContext("allowed_company_ids", c1.Ids()).Get(colorField), ShouldEqual, "Blue")
+				So(b1.WithContext("allowed_company_ids", c2.Ids()).Get(colorField), ShouldEqual, "Green")
+			})
+		}), ShouldBeNil)
+	})
+}
+
 func TestPostBootSequences(t *testing.T) {
 	Convey("Testing manual sequences after bootstrap", t, func() {
 		testSeq := Registry.MustGetSequence("Test")
@@ -557,8 +673,34 @@ func TestFreeTransientModels(t *testing.T) {
 			})
 		}), ShouldBeNil)
 	})
-	StopWorkerLoop()
+	if err := StopWorkerLoop(context.Background()); err != nil {
+		t.Fail()
+	}
 	if workerStop != nil {
 		t.Fail()
 	}
 }
+
+func TestStopWorkerLoopTimeout(t *testing.T) {
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	workerFunctions = []WorkerFunction{NewWorkerFunction(func() {
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-release
+	}, 10*time.Millisecond)}
+	RunWorkerLoop()
+	Convey("Stopping the worker loop should not wait longer than its context", t, func() {
+		<-started
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		So(StopWorkerLoop(ctx), ShouldEqual, context.DeadlineExceeded)
+		So(workerLoopStopping(), ShouldBeTrue)
+	})
+	close(release)
+	workerGroup.Wait()
+	workerStop = nil
+	workerFunctions = nil
+}
@@ -126,6 +126,18 @@ func TestDataLoading(t *testing.T) {
 				So(func() { LoadCSVDataFile("testdata/001Post.csv") }, ShouldPanic)
 				So(func() { LoadCSVDataFile("testdata/002Post.csv") }, ShouldPanic)
 			})
+			Convey("Checking versioned imports on models with optimistic locking", func() {
+				commentObj := env.Pool("Comment")
+				text := commentObj.Model().FieldName("Text")
+				LoadCSVDataFile("testdata/Comment.csv")
+				comment := commentObj.Search(commentObj.Model().Field(commentObj.Model().FieldName("HexyaExternalID")).Equals("comment_external_1"))
+				So(comment.Get(text), ShouldEqual, "First comment")
+				So(func() { LoadCSVDataFile("testdata/Comment_2.csv") }, ShouldNotPanic)
+				comment.Load()
+				So(comment.Get(text), ShouldEqual, "First comment updated")
+				So(comment.Get(hexyaVersion), ShouldEqual, 2)
+				So(comment.Get(commentObj.Model().FieldName("LockVersion")), ShouldEqual, 1)
+			})
 		}), ShouldBeNil)
 	})
 }
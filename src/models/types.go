@@ -135,10 +135,18 @@ func (f *FieldNames) UnmarshalJSON(data []byte) error {
 // - Values holds the values of the actual query
 // - Count is the number of lines aggregated into this one
 // - Condition can be used to query the aggregated rows separately if needed
+// - Aggregates holds the results of the aggregates of the query by their String()
 type GroupAggregateRow struct {
-	Values    *ModelData
-	Count     int
-	Condition *Condition
+	Values     *ModelData
+	Count      int
+	Condition  *Condition
+	Aggregates map[string]interface{}
+}
+
+// AggregateValue returns the result of the given aggregate for this row,
+// which must have been requested with WithAggregates.
+func (g GroupAggregateRow) AggregateValue(agg Aggregate) interface{} {
+	return g.Aggregates[agg.String()]
 }
 
 // FieldContexts define the different contexts for a field, that will define different
@@ -169,9 +169,16 @@ func addIDIfNotPresent(fields []FieldName) []FieldName {
 
 // getGroupCondition returns the condition to retrieve the individual aggregated rows in vals
 // knowing that they were grouped by groups and that we had the given initial condition
-func getGroupCondition(groups []FieldName, vals map[string]interface{}, initialCondition *Condition) *Condition {
+//
+// If a group has a value in ends, the condition matches the values
+// between the group value included and this value excluded.
+func getGroupCondition(groups []FieldName, vals map[string]interface{}, ends map[string]interface{}, initialCondition *Condition) *Condition {
 	res := initialCondition
 	for _, group := range groups {
+		if end, ok := ends[group.JSON()]; ok && end != nil {
+			res = res.And().Field(group).GreaterOrEqual(vals[group.JSON()]).And().Field(group).Lower(end)
+			continue
+		}
 		res = res.And().Field(group).Equals(vals[group.JSON()])
 	}
 	return res
@@ -237,7 +244,12 @@ func appendPredicateToSerial(res []interface{}, predicate predicate) []interface
 	if predicate.isCond {
 		res = append(res, serializePredicates(predicate.cond.predicates)...)
 	} else {
-		res = append(res, []interface{}{joinFieldNames(predicate.exprs, ExprSep).JSON(), predicate.operator, predicate.arg})
+		arg := predicate.arg
+		if cond, ok := arg.(Conditioner); ok {
+			// Any operator
+			arg = cond.Underlying().Serialize()
+		}
+		res = append(res, []interface{}{joinFieldNames(predicate.exprs, ExprSep).JSON(), predicate.operator, arg})
 	}
 	return res
 }
@@ -4,6 +4,7 @@
 package models
 
 import (
+	"context"
 	"sync"
 	"time"
 )
@@ -79,9 +80,33 @@ func RunWorkerLoop() {
 
 // StopWorkerLoop stops the hexya core worker loop.
 //
+// It returns after all running worker functions have returned, or with the
+// context's error if ctx expires before. In the latter case, the remaining
+// worker functions keep running in the background until they return.
 // Calling this method if the core worker loop is not running will cause panic.
-func StopWorkerLoop() {
+func StopWorkerLoop(ctx context.Context) error {
 	close(workerStop)
-	workerGroup.Wait()
-	workerStop = nil
+	done := make(chan struct{})
+	go func() {
+		workerGroup.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		workerStop = nil
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// workerLoopStopping returns true if StopWorkerLoop has been called, so that
+// long running worker functions can return before having completed their work.
+func workerLoopStopping() bool {
+	select {
+	case <-workerStop:
+		return true
+	default:
+		return false
+	}
 }
@@ -5,14 +5,12 @@ package server
 
 import (
 	"encoding/json"
-	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
 
 	"github.com/gin-contrib/sessions"
 	"github.com/gin-gonic/gin"
-	"github.com/hexya-erp/hexya/src/tools/exceptions"
 	"github.com/hexya-erp/hexya/src/tools/hweb"
 )
 
@@ -23,60 +21,79 @@ type Context struct {
 }
 
 // RPC serializes the given struct as JSON-RPC into the response body.
+//
+// If an error is given, a JSON-RPC error response is sent instead, with the
+// error code and exception type of the Go type of the error. Nothing is sent
+// back if the request is a notification.
 func (c *Context) RPC(code int, obj interface{}, err ...error) {
 	id, ok := c.Get("id")
 	if !ok {
-		var req RequestRPC
-		if err2 := c.BindJSON(&req); err2 != nil {
+		body, err2 := c.GetRawData()
+		if err2 != nil {
 			c.AbortWithError(http.StatusBadRequest, err2)
 			return
 		}
+		req, err2 := parseRPCRequest(body)
+		if err2 != nil {
+			c.abortRPC(http.StatusBadRequest, nil, err2)
+			return
+		}
 		id = req.ID
 	}
+	rpcID, _ := id.(json.RawMessage)
+	if rpcID == nil {
+		// Notifications have no response
+		c.AbortWithStatus(http.StatusNoContent)
+		return
+	}
 	if len(err) > 0 && err[0] != nil {
-		userError, ok2 := err[0].(exceptions.UserError)
-		if !ok2 {
-			c.AbortWithError(http.StatusInternalServerError, errors.New("error is of unknown type"))
-			return
-		}
-		respErr := ResponseError{
+		c.JSON(code, ResponseError{
 			JsonRPC: "2.0",
-			ID:      id.(int64),
-			Error: JSONRPCError{
-				Code:    code,
-				Message: "Hexya Server Error",
-				Data: JSONRPCErrorData{
-					Arguments:     []string{userError.Message},
-					ExceptionType: "user_error",
-					Debug:         userError.Debug,
-				},
-			},
-		}
-		c.JSON(code, respErr)
+			ID:      rpcID,
+			Error:   newJSONRPCError(err[0]),
+		})
 		return
 	}
 	resp := ResponseRPC{
 		JsonRPC: "2.0",
-		ID:      id.(int64),
+		ID:      rpcID,
 		Result:  obj,
 	}
 	c.JSON(code, resp)
 }
 
 // BindRPCParams binds the RPC parameters to the given data object.
+//
+// It aborts the request with a JSON-RPC error response if the request
+// is not a valid JSON-RPC request or if the parameters cannot be bound.
 func (c *Context) BindRPCParams(data interface{}) {
-	var req RequestRPC
-	if err := c.BindJSON(&req); err != nil {
+	body, err := c.GetRawData()
+	if err != nil {
 		c.AbortWithError(http.StatusBadRequest, err)
 		return
 	}
+	req, err := parseRPCRequest(body)
+	if err != nil {
+		c.abortRPC(http.StatusBadRequest, nil, err)
+		return
+	}
 	c.Set("id", req.ID)
 	if err := json.Unmarshal(req.Params, data); err != nil {
-		c.AbortWithError(http.StatusBadRequest, err)
+		c.abortRPC(http.StatusBadRequest, req.ID, RPCError{Code: RPCInvalidParamsCode, Message: "Invalid params"})
 		return
 	}
 }
 
+// abortRPC aborts the request with a JSON-RPC error response
+// for the given error and request id.
+func (c *Context) abortRPC(code int, id json.RawMessage, err error) {
+	c.AbortWithStatusJSON(code, ResponseError{
+		JsonRPC: "2.0",
+		ID:      id,
+		Error:   newJSONRPCError(err),
+	})
+}
+
 // Session returns the current Session instance
 func (c *Context) Session() sessions.Session {
 	return sessions.Default(c.Context)
@@ -98,9 +115,9 @@ func (c *Context) HTTPGet(uri string) (*http.Response, error) {
 	targetUrl := fmt.Sprintf("%s://%s%s", scheme, c.Request.Host, sanitizedURI.RequestURI())
 
 	req, _ := http.NewRequest(http.MethodGet, targetUrl, nil)
-	sessionCookie, _ := c.Cookie("hexya-session")
+	sessionCookie, _ := c.Cookie(sessionCookieName)
 	req.AddCookie(&http.Cookie{
-		Name:  "hexya-session",
+		Name:  sessionCookieName,
 		Value: sessionCookie,
 	})
 	client := http.Client{}
@@ -0,0 +1,257 @@
+// Copyright 2019 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hexya-erp/hexya/src/tools/exceptions"
+)
+
+// JSON-RPC 2.0 error codes
+const (
+	// RPCParseErrorCode is returned when the request is not valid JSON
+	RPCParseErrorCode = -32700
+	// RPCInvalidRequestCode is returned when the request is not a valid JSON-RPC request
+	RPCInvalidRequestCode = -32600
+	// RPCMethodNotFoundCode is returned when the requested method does not exist
+	RPCMethodNotFoundCode = -32601
+	// RPCInvalidParamsCode is returned when the parameters of the request are invalid
+	RPCInvalidParamsCode = -32602
+	// RPCInternalErrorCode is returned for errors of unknown type
+	RPCInternalErrorCode = -32603
+	// RPCUserErrorCode is returned for exceptions.UserError errors
+	RPCUserErrorCode = -32000
+	// RPCAccessErrorCode is returned for exceptions.AccessError errors
+	RPCAccessErrorCode = -32001
+	// RPCValidationErrorCode is returned for exceptions.ValidationError errors
+	RPCValidationErrorCode = -32002
+	// RPCConcurrentUpdateErrorCode is returned for exceptions.ConcurrentUpdateError errors
+	RPCConcurrentUpdateErrorCode = -32003
+)
+
+// hexyaServerErrorMessage is the message of the errors returned for Go errors
+const hexyaServerErrorMessage = "Hexya Server Error"
+
+// rpcMaxBatchSize is the maximum number of requests of a JSON-RPC batch
+const rpcMaxBatchSize = 100
+
+// An RPCError is an error with a JSON-RPC error code, such as RPCMethodNotFoundCode.
+// It can be returned by a controller to the client through Context.RPC.
+type RPCError struct {
+	Code    int
+	Message string
+}
+
+// Error method for the RPCError type
+func (e RPCError) Error() string {
+	return e.Message
+}
+
+// An rpcErrorType is the JSON-RPC error code and exception type
+// returned to clients for errors of a given Go type.
+type rpcErrorType struct {
+	code          int
+	exceptionType string
+}
+
+// rpcErrorTypes maps Go error types to their rpcErrorType
+var rpcErrorTypes = map[reflect.Type]rpcErrorType{
+	reflect.TypeOf(exceptions.UserError{}):             {code: RPCUserErrorCode, exceptionType: "user_error"},
+	reflect.TypeOf(exceptions.AccessError{}):           {code: RPCAccessErrorCode, exceptionType: "access_error"},
+	reflect.TypeOf(exceptions.ValidationError{}):       {code: RPCValidationErrorCode, exceptionType: "validation_error"},
+	reflect.TypeOf(exceptions.ConcurrentUpdateError{}): {code: RPCConcurrentUpdateErrorCode, exceptionType: "concurrent_update_error"},
+}
+
+// RegisterRPCError registers the JSON-RPC error code and exception type
+// returned to clients for the errors of the same Go type as err.
+//
+// Errors of unregistered types are returned with the RPCInternalErrorCode
+// code and the "internal_error" exception type.
+func RegisterRPCError(err error, code int, exceptionType string) {
+	rpcErrorTypes[reflect.TypeOf(err)] = rpcErrorType{code: code, exceptionType: exceptionType}
+}
+
+// newJSONRPCError returns the JSONRPCError to send to the client for the given error
+func newJSONRPCError(err error) JSONRPCError {
+	if rpcErr, ok := err.(RPCError); ok {
+		return JSONRPCError{
+			Code:    rpcErr.Code,
+			Message: rpcErr.Message,
+		}
+	}
+	errType, ok := rpcErrorTypes[reflect.TypeOf(err)]
+	if !ok {
+		errType = rpcErrorType{code: RPCInternalErrorCode, exceptionType: "internal_error"}
+	}
+	data := JSONRPCErrorData{
+		Arguments:     []string{err.Error()},
+		ExceptionType: errType.exceptionType,
+	}
+	if userError, ok := err.(exceptions.UserError); ok {
+		data.Arguments = []string{userError.Message}
+		data.Debug = userError.Debug
+	}
+	return JSONRPCError{
+		Code:    errType.code,
+		Message: hexyaServerErrorMessage,
+		Data:    data,
+	}
+}
+
+// parseRPCRequest parses the given body as a JSON-RPC request.
+// It returns an RPCError with a parse error or an invalid request code on failure.
+func parseRPCRequest(body []byte) (RequestRPC, error) {
+	var req RequestRPC
+	if !json.Valid(body) {
+		return req, RPCError{Code: RPCParseErrorCode, Message: "Parse error"}
+	}
+	if err := json.Unmarshal(body, &req); err != nil || req.JsonRPC != "2.0" || !isValidRPCID(req.ID) {
+		return RequestRPC{}, RPCError{Code: RPCInvalidRequestCode, Message: "Invalid Request"}
+	}
+	return req, nil
+}
+
+// isValidRPCID returns true if the given raw JSON id of a request is missing,
+// null, a string or a number.
+func isValidRPCID(id json.RawMessage) bool {
+	if len(id) == 0 {
+		return true
+	}
+	switch id[0] {
+	case 'n', '"', '-', '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
+		return true
+	}
+	return false
+}
+
+// rpcBatchMiddleware processes JSON-RPC batch requests, i.e. JSON arrays of
+// JSON-RPC requests. Each request of the batch is served in order as if it
+// was sent alone to the same URL, and the responses are sent back as an array.
+// Responses to notifications are omitted and nothing is sent back if all the
+// requests are notifications.
+//
+// Session cookies set while serving a request are passed on to the following
+// requests of the batch and to the response.
+func rpcBatchMiddleware(c *gin.Context) {
+	if c.Request.Method != http.MethodPost || c.ContentType() != gin.MIMEJSON {
+		return
+	}
+	body, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	c.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+	var batch []json.RawMessage
+	if json.Unmarshal(body, &batch) != nil || !isRPCBatch(batch) {
+		return
+	}
+	if len(batch) > rpcMaxBatchSize {
+		c.AbortWithStatusJSON(http.StatusBadRequest, ResponseError{
+			JsonRPC: "2.0",
+			Error: newJSONRPCError(RPCError{
+				Code:    RPCInvalidRequestCode,
+				Message: fmt.Sprintf("Invalid Request: batches cannot have more than %d requests", rpcMaxBatchSize),
+			}),
+		})
+		return
+	}
+	cookies := make(map[string]*http.Cookie)
+	for _, cookie := range c.Request.Cookies() {
+		cookies[cookie.Name] = cookie
+	}
+	var responses []json.RawMessage
+	for _, item := range batch {
+		req, err := parseRPCRequest(item)
+		if err != nil {
+			responses = append(responses, mustMarshalJSON(ResponseError{JsonRPC: "2.0", Error: newJSONRPCError(err)}))
+			continue
+		}
+		subReq := c.Request.Clone(c.Request.Context())
+		subReq.Body = ioutil.NopCloser(bytes.NewReader(item))
+		subReq.ContentLength = int64(len(item))
+		subReq.Header.Del("Cookie")
+		for _, cookie := range cookies {
+			subReq.AddCookie(cookie)
+		}
+		recorder := httptest.NewRecorder()
+		hexyaServer.ServeHTTP(recorder, subReq)
+		for _, cookie := range recorder.Result().Cookies() {
+			cookies[cookie.Name] = cookie
+		}
+		for _, setCookie := range recorder.Header()["Set-Cookie"] {
+			c.Writer.Header().Add("Set-Cookie", setCookie)
+		}
+		if req.ID == nil {
+			continue
+		}
+		resp := bytes.TrimSpace(recorder.Body.Bytes())
+		if !json.Valid(resp) {
+			resp = mustMarshalJSON(ResponseError{
+				JsonRPC: "2.0",
+				ID:      req.ID,
+				Error:   JSONRPCError{Code: RPCInternalErrorCode, Message: http.StatusText(recorder.Code)},
+			})
+		}
+		responses = append(responses, resp)
+	}
+	if len(responses) == 0 {
+		c.AbortWithStatus(http.StatusNoContent)
+		return
+	}
+	c.AbortWithStatusJSON(http.StatusOK, responses)
+}
+
+// rpcNoRoute answers JSON-RPC requests sent to an unknown route with a
+// method not found error. Notifications and other requests get an empty
+// 404 response.
+func rpcNoRoute(c *gin.Context) {
+	if c.Request.Method != http.MethodPost || c.ContentType() != gin.MIMEJSON {
+		return
+	}
+	body, err := c.GetRawData()
+	if err != nil {
+		return
+	}
+	req, err := parseRPCRequest(body)
+	if err != nil || req.ID == nil {
+		return
+	}
+	c.AbortWithStatusJSON(http.StatusNotFound, ResponseError{
+		JsonRPC: "2.0",
+		ID:      req.ID,
+		Error:   newJSONRPCError(RPCError{Code: RPCMethodNotFoundCode, Message: "Method not found"}),
+	})
+}
+
+// isRPCBatch returns true if the given JSON array is a batch of JSON-RPC requests,
+// that is if its first item is a JSON object with a "jsonrpc" member.
+func isRPCBatch(batch []json.RawMessage) bool {
+	if len(batch) == 0 {
+		return false
+	}
+	var first map[string]json.RawMessage
+	if json.Unmarshal(batch[0], &first) != nil {
+		return false
+	}
+	_, ok := first["jsonrpc"]
+	return ok
+}
+
+// mustMarshalJSON returns the JSON encoding of v. It panics on error.
+func mustMarshalJSON(v interface{}) json.RawMessage {
+	res, err := json.Marshal(v)
+	if err != nil {
+		log.Panic("Unable to marshal JSON", "error", err)
+	}
+	return res
+}
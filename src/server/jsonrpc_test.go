@@ -0,0 +1,138 @@
+// Copyright 2019 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hexya-erp/hexya/src/tools/exceptions"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// rpcTestResponse is a JSON-RPC response as received by a client
+type rpcTestResponse struct {
+	JsonRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  interface{}     `json:"result"`
+	Error   *JSONRPCError   `json:"error"`
+}
+
+func TestJSONRPC(t *testing.T) {
+	hexyaServer.POST("/test/rpc/echo", func(c *gin.Context) {
+		ctx := &Context{Context: c}
+		var params []interface{}
+		ctx.BindRPCParams(&params)
+		if c.IsAborted() {
+			return
+		}
+		ctx.RPC(http.StatusOK, params)
+	})
+	hexyaServer.POST("/test/rpc/invalid", func(c *gin.Context) {
+		ctx := &Context{Context: c}
+		ctx.RPC(http.StatusOK, nil, exceptions.ValidationError{Model: "Partner", Field: "email", Message: "Invalid email"})
+	})
+	post := func(path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		hexyaServer.ServeHTTP(w, req)
+		return w
+	}
+	decode := func(w *httptest.ResponseRecorder) rpcTestResponse {
+		var resp rpcTestResponse
+		So(json.Unmarshal(w.Body.Bytes(), &resp), ShouldBeNil)
+		So(resp.JsonRPC, ShouldEqual, "2.0")
+		return resp
+	}
+	Convey("Testing JSON-RPC requests", t, func() {
+		Convey("Responses should have the id of the request", func() {
+			for _, id := range []string{`"abc"`, `42`, `-1.5`, `null`} {
+				w := post("/test/rpc/echo", `{"jsonrpc": "2.0", "id": `+id+`, "method": "call", "params": [1, "a"]}`)
+				So(w.Code, ShouldEqual, http.StatusOK)
+				resp := decode(w)
+				So(string(resp.ID), ShouldEqual, id)
+				So(resp.Error, ShouldBeNil)
+				So(resp.Result, ShouldResemble, []interface{}{1.0, "a"})
+			}
+		})
+		Convey("Invalid ids should be rejected", func() {
+			resp := decode(post("/test/rpc/echo", `{"jsonrpc": "2.0", "id": {"a": 1}, "method": "call", "params": []}`))
+			So(resp.Error, ShouldNotBeNil)
+			So(resp.Error.Code, ShouldEqual, RPCInvalidRequestCode)
+		})
+		Convey("Notifications should have no response", func() {
+			w := post("/test/rpc/echo", `{"jsonrpc": "2.0", "method": "call", "params": []}`)
+			So(w.Code, ShouldEqual, http.StatusNoContent)
+			So(w.Body.Len(), ShouldEqual, 0)
+		})
+		Convey("Invalid JSON should return a parse error", func() {
+			w := post("/test/rpc/echo", `{"jsonrpc": "2.0", "id": 1, "method"`)
+			So(w.Code, ShouldEqual, http.StatusBadRequest)
+			resp := decode(w)
+			So(string(resp.ID), ShouldEqual, "null")
+			So(resp.Error.Code, ShouldEqual, RPCParseErrorCode)
+		})
+		Convey("Invalid params should return an invalid params error", func() {
+			resp := decode(post("/test/rpc/echo", `{"jsonrpc": "2.0", "id": 1, "method": "call", "params": {"a": 1}}`))
+			So(string(resp.ID), ShouldEqual, "1")
+			So(resp.Error.Code, ShouldEqual, RPCInvalidParamsCode)
+		})
+		Convey("Unknown routes should return a method not found error", func() {
+			w := post("/test/rpc/unknown", `{"jsonrpc": "2.0", "id": 3, "method": "call", "params": []}`)
+			So(w.Code, ShouldEqual, http.StatusNotFound)
+			resp := decode(w)
+			So(string(resp.ID), ShouldEqual, "3")
+			So(resp.Error.Code, ShouldEqual, RPCMethodNotFoundCode)
+		})
+		Convey("Validation errors should have their own code and exception type", func() {
+			resp := decode(post("/test/rpc/invalid", `{"jsonrpc": "2.0", "id": 1, "method": "call", "params": []}`))
+			So(resp.Error.Code, ShouldEqual, RPCValidationErrorCode)
+			data := resp.Error.Data.(map[string]interface{})
+			So(data["exception_type"], ShouldEqual, "validation_error")
+			So(data["arguments"], ShouldResemble, []interface{}{"Invalid email"})
+		})
+	})
+	Convey("Testing JSON-RPC batches", t, func() {
+		Convey("Mixed batches should return the responses of requests with an id in order", func() {
+			w := post("/test/rpc/echo", `[
+				{"jsonrpc": "2.0", "id": "first", "method": "call", "params": [1]},
+				{"jsonrpc": "2.0", "method": "call", "params": [2]},
+				{"jsonrpc": "1.0", "id": 3, "method": "call", "params": [3]},
+				{"jsonrpc": "2.0", "id": 4, "method": "call", "params": [4]}
+			]`)
+			So(w.Code, ShouldEqual, http.StatusOK)
+			var resps []rpcTestResponse
+			So(json.Unmarshal(w.Body.Bytes(), &resps), ShouldBeNil)
+			So(resps, ShouldHaveLength, 3)
+			So(string(resps[0].ID), ShouldEqual, `"first"`)
+			So(resps[0].Result, ShouldResemble, []interface{}{1.0})
+			So(resps[1].Error.Code, ShouldEqual, RPCInvalidRequestCode)
+			So(string(resps[2].ID), ShouldEqual, "4")
+			So(resps[2].Result, ShouldResemble, []interface{}{4.0})
+		})
+		Convey("Batches of notifications should have no response", func() {
+			w := post("/test/rpc/echo", `[
+				{"jsonrpc": "2.0", "method": "call", "params": [1]},
+				{"jsonrpc": "2.0", "method": "call", "params": [2]}
+			]`)
+			So(w.Code, ShouldEqual, http.StatusNoContent)
+			So(w.Body.Len(), ShouldEqual, 0)
+		})
+		Convey("Too large batches should be rejected", func() {
+			items := make([]string, rpcMaxBatchSize+1)
+			for i := range items {
+				items[i] = `{"jsonrpc": "2.0", "id": 1, "method": "call", "params": []}`
+			}
+			w := post("/test/rpc/echo", "["+strings.Join(items, ",")+"]")
+			So(w.Code, ShouldEqual, http.StatusBadRequest)
+			resp := decode(w)
+			So(resp.Error.Code, ShouldEqual, RPCInvalidRequestCode)
+		})
+	})
+}
@@ -18,6 +18,8 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"reflect"
+	"regexp"
 	"sort"
 	"strings"
 
@@ -27,6 +29,7 @@ import (
 	"github.com/hexya-erp/hexya/src/menus"
 	"github.com/hexya-erp/hexya/src/models"
 	"github.com/hexya-erp/hexya/src/templates"
+	"github.com/hexya-erp/hexya/src/tools"
 	"github.com/hexya-erp/hexya/src/views"
 )
 
@@ -37,9 +40,25 @@ var ResourceDir string
 // A Module is a go package that implements business features.
 // This struct is used to register modules.
 type Module struct {
-	Name     string
-	PreInit  func() // Function to be run before bootstrap but after all calls to init
-	PostInit func() // Function to be run after initialisation is complete and before server starts
+	Name        string
+	Version     string   // Semantic version of the module, such as "1.2.0"
+	Description string   // Short description of the module
+	Depends     []string // Names of the modules this module depends on
+	Data        []string // CSV files of the module's data directory to load in this order. Defaults to all files in alphabetical order
+	Demo        []string // CSV files of the module's demo directory to load in this order. Defaults to all files in alphabetical order
+	PreInit     func()   // Function to be run before bootstrap but after all calls to init and the database connection
+	PostInit    func()   // Function to be run after initialisation is complete and before server starts
+	PreShutdown func()   // Function to be run when the server stops, before the database is closed
+	// PreMigrate is run when the module is installed or upgraded, before the database schema is updated
+	PreMigrate func(env models.Environment)
+	// PostMigrate is run when the module is installed or upgraded, after the database schema
+	// is updated and the data is loaded. fromVersion is the previously installed version of the
+	// module, or the empty string if the module is being installed.
+	PostMigrate func(env models.Environment, fromVersion string)
+	// Uninstall is run when the module is uninstalled
+	Uninstall func(env models.Environment)
+	// pkgPath is the import path of the package which registered the module
+	pkgPath string
 }
 
 // A ModulesList is a list of Module objects
@@ -54,35 +73,147 @@ func (ml *ModulesList) Names() []string {
 	return res
 }
 
-// Modules is the list of activated modules in the application
+// Get returns the module with the given name in this ModulesList or nil if there is none.
+func (ml *ModulesList) Get(name string) *Module {
+	for _, module := range *ml {
+		if module.Name == name {
+			return module
+		}
+	}
+	return nil
+}
+
+// Modules is the list of activated modules in the application.
+// Modules are sorted so that each module comes after its dependencies.
 var Modules ModulesList
 
+// registeredModules is the list of activated modules in registration order
+var registeredModules ModulesList
+
+// semVerRegexp matches semantic versions as defined in https://semver.org
+var semVerRegexp = regexp.MustCompile(`^(0|[1-9]\d*)\.(0|[1-9]\d*)\.(0|[1-9]\d*)(-[0-9A-Za-z-]+(\.[0-9A-Za-z-]+)*)?(\+[0-9A-Za-z-]+(\.[0-9A-Za-z-]+)*)?$`)
+
 // RegisterModule registers the given module in the server
 // This function should be called in the init() function of
 // all Hexya Addons.
+//
+// It panics if the manifest of the module is invalid or if
+// its dependencies form a cycle.
 func RegisterModule(mod *Module) {
-	Modules = append(Modules, mod)
+	checkModuleManifest(mod)
+	mod.pkgPath = tools.CallerPackage(reflect.TypeOf(Module{}).PkgPath())
+	registeredModules = append(registeredModules, mod)
+	Modules = sortModules(registeredModules)
+}
+
+// MigrationModules returns the modules in the order of Modules, with
+// the packages that registered them, for models.PlanMigrations.
+func MigrationModules() []models.MigrationModule {
+	res := make([]models.MigrationModule, len(Modules))
+	for i, mod := range Modules {
+		res[i] = models.MigrationModule{
+			Name:    mod.Name,
+			Package: mod.pkgPath,
+		}
+	}
+	return res
+}
+
+// checkModuleManifest panics if the manifest of the given module is invalid
+// or if a module with the same name is already registered.
+func checkModuleManifest(mod *Module) {
+	if mod.Name == "" {
+		log.Panic("Modules must have a name")
+	}
+	if registeredModules.Get(mod.Name) != nil {
+		log.Panic("Module already registered", "module", mod.Name)
+	}
+	if mod.Version != "" && !semVerRegexp.MatchString(mod.Version) {
+		log.Panic("Module version is not a semantic version", "module", mod.Name, "version", mod.Version)
+	}
+	deps := make(map[string]bool)
+	for _, dep := range mod.Depends {
+		switch {
+		case dep == mod.Name:
+			log.Panic("Module cannot depend on itself", "module", mod.Name)
+		case deps[dep]:
+			log.Panic("Duplicate module dependency", "module", mod.Name, "dependency", dep)
+		}
+		deps[dep] = true
+	}
+	for _, file := range append(append([]string{}, mod.Data...), mod.Demo...) {
+		if filepath.IsAbs(file) || strings.HasPrefix(filepath.Clean(file), "..") || filepath.Ext(file) != ".csv" {
+			log.Panic("Module data files must be CSV files relative to the module's directory", "module", mod.Name, "file", file)
+		}
+	}
+}
+
+// sortModules returns the given modules sorted so that each module comes after
+// its registered dependencies. Modules without dependencies between them keep
+// their relative order. It panics if there is a dependency cycle.
+func sortModules(modules ModulesList) ModulesList {
+	res := make(ModulesList, 0, len(modules))
+	placed := make(map[string]bool)
+	remaining := append(ModulesList{}, modules...)
+	for len(remaining) > 0 {
+		next := -1
+	modLoop:
+		for i, mod := range remaining {
+			for _, dep := range mod.Depends {
+				if !placed[dep] && modules.Get(dep) != nil {
+					continue modLoop
+				}
+			}
+			next = i
+			break
+		}
+		if next < 0 {
+			log.Panic("Dependency cycle between modules", "modules", remaining.Names())
+		}
+		res = append(res, remaining[next])
+		placed[remaining[next].Name] = true
+		remaining = append(remaining[:next], remaining[next+1:]...)
+	}
+	return res
+}
+
+// checkModuleDependencies panics if a module depends on a module that has not been registered
+func checkModuleDependencies() {
+	for _, mod := range Modules {
+		for _, dep := range mod.Depends {
+			if Modules.Get(dep) == nil {
+				log.Panic("Module dependency is not registered", "module", mod.Name, "dependency", dep)
+			}
+		}
+	}
 }
 
 // LoadInternalResources loads all data in the 'resources' directory, that are
 // - views,
 // - actions,
 // - menu items
+// - model access controls
 // Internal resources are defined in XML files.
 func LoadInternalResources(resourceDir string) {
-	loadData(resourceDir, "resources", "xml", loadXMLResourceFile)
+	loadData(Modules, resourceDir, "resources", "xml", nil, loadXMLResourceFile)
+}
+
+// LoadAccessControls loads all the model access controls in the 'security' directory.
+// Access controls are defined in CSV files.
+func LoadAccessControls(resourceDir string) {
+	loadData(Modules, resourceDir, "security", "csv", nil, models.LoadAccessControlCSVFile)
 }
 
 // LoadDataRecords loads all the data records in the 'data' directory into the database.
-// Data records are defined in CSV files.
+// Data records are defined in CSV files, loaded in the order of the Data list of each module.
 func LoadDataRecords(resourceDir string) {
-	loadData(resourceDir, "data", "csv", models.LoadCSVDataFile)
+	loadData(Modules, resourceDir, "data", "csv", moduleDataFiles, models.LoadCSVDataFile)
 }
 
 // LoadDemoRecords loads all the data records in the 'demo' directory into the database.
-// Demo records are defined in CSV files.
+// Demo records are defined in CSV files, loaded in the order of the Demo list of each module.
 func LoadDemoRecords(resourceDir string) {
-	loadData(resourceDir, "demo", "csv", models.LoadCSVDataFile)
+	loadData(Modules, resourceDir, "demo", "csv", moduleDemoFiles, models.LoadCSVDataFile)
 }
 
 // LoadTranslations loads all translation data from the PO files in the 'i18n' directory
@@ -121,11 +252,25 @@ func LoadModuleTranslations(i18nDir string, langs []string) {
 	}
 }
 
-// loadData loads the files in the given dir with the given extension (without .)
-// using the loader function.
-func loadData(resourceDir, dir, ext string, loader func(string)) {
-	for _, mod := range Modules {
+// loadData loads the files of the given modules in the given dir with the given
+// extension (without .) using the loader function.
+//
+// Modules are loaded in the order of the given list. The files of each module are those
+// returned by the files function in this order if any, otherwise all the files
+// of the module's directory in alphabetical order.
+func loadData(modules ModulesList, resourceDir, dir, ext string, files func(*Module) []string, loader func(string)) {
+	for _, mod := range modules {
 		dataDir := filepath.Join(resourceDir, dir, mod.Name)
+		if files != nil && len(files(mod)) > 0 {
+			for _, file := range files(mod) {
+				dataFile := filepath.Join(dataDir, file)
+				if _, err := os.Stat(dataFile); err != nil {
+					log.Panic("Unable to find module data file", "module", mod.Name, "file", dataFile, "error", err)
+				}
+				loader(dataFile)
+			}
+			continue
+		}
 		if _, err := os.Stat(dataDir); err != nil {
 			// No resources dir in this module
 			continue
@@ -142,6 +287,16 @@ func loadData(resourceDir, dir, ext string, loader func(string)) {
 	}
 }
 
+// moduleDataFiles returns the data files of the given module
+func moduleDataFiles(mod *Module) []string {
+	return mod.Data
+}
+
+// moduleDemoFiles returns the demo files of the given module
+func moduleDemoFiles(mod *Module) []string {
+	return mod.Demo
+}
+
 // loadXMLResourceFile loads the data from an XML data file into memory.
 func loadXMLResourceFile(fileName string) {
 	doc := etree.NewDocument()
@@ -159,6 +314,8 @@ func loadXMLResourceFile(fileName string) {
 				menus.LoadFromEtree(object)
 			case "template":
 				templates.LoadFromEtree(object)
+			case "access":
+				models.LoadAccessControlFromEtree(object)
 			default:
 				log.Panic("Unknown XML tag", "filename", fileName, "tag", object.Tag)
 			}
@@ -0,0 +1,299 @@
+// Copyright 2019 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package server
+
+import (
+	"fmt"
+
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/models/security"
+)
+
+// modulesTable is the name of the table storing the state of the modules in the database
+const modulesTable = "hexya_module"
+
+func init() {
+	models.RegisterUnmanagedTable(modulesTable)
+}
+
+// A ModuleState is the installation state of a module in a database
+type ModuleState string
+
+// Available module states
+const (
+	// ModuleToInstall modules are installed by the next UpdateModules call
+	ModuleToInstall ModuleState = "to install"
+	// ModuleInstalled modules are active in the database
+	ModuleInstalled ModuleState = "installed"
+	// ModuleToUpgrade modules are upgraded by the next UpdateModules call
+	ModuleToUpgrade ModuleState = "to upgrade"
+	// ModuleUninstalled modules are compiled in but not active in the database
+	ModuleUninstalled ModuleState = "uninstalled"
+)
+
+// A moduleRecord is the row of a module in the modules table
+type moduleRecord struct {
+	Name    string
+	State   ModuleState
+	Version string
+}
+
+// createModulesTable creates the modules table if it does not exist
+func createModulesTable(env models.Environment) {
+	env.Cr().Execute(fmt.Sprintf(`
+CREATE TABLE IF NOT EXISTS %s (
+	name varchar PRIMARY KEY,
+	state varchar NOT NULL,
+	version varchar NOT NULL DEFAULT ''
+)`, modulesTable))
+}
+
+// moduleRecords returns the rows of the modules table by module name
+func moduleRecords(env models.Environment) map[string]moduleRecord {
+	createModulesTable(env)
+	var records []moduleRecord
+	env.Cr().Select(&records, fmt.Sprintf("SELECT name, state, version FROM %s", modulesTable))
+	res := make(map[string]moduleRecord)
+	for _, rec := range records {
+		res[rec.Name] = rec
+	}
+	return res
+}
+
+// setModuleState sets the state and version of the given module in the modules table
+func setModuleState(env models.Environment, name string, state ModuleState, version string) {
+	env.Cr().Execute(fmt.Sprintf(`
+INSERT INTO %s (name, state, version) VALUES (?, ?, ?)
+ON CONFLICT (name) DO UPDATE SET state = EXCLUDED.state, version = EXCLUDED.version`, modulesTable),
+		name, string(state), version)
+}
+
+// ModuleStates returns the state in the database of each registered module.
+//
+// Registered modules that have never been installed in this database
+// are returned with the ModuleToInstall state.
+func ModuleStates() (map[string]ModuleState, error) {
+	res := make(map[string]ModuleState)
+	err := models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+		records := moduleRecords(env)
+		for _, mod := range Modules {
+			res[mod.Name] = ModuleToInstall
+			if rec, ok := records[mod.Name]; ok {
+				res[mod.Name] = rec.State
+			}
+		}
+	})
+	return res, err
+}
+
+// activeModules returns the registered modules that are not uninstalled
+// given the rows of the modules table, in dependency order.
+func activeModules(records map[string]moduleRecord) ModulesList {
+	var res ModulesList
+	for _, mod := range Modules {
+		if records[mod.Name].State == ModuleUninstalled {
+			continue
+		}
+		res = append(res, mod)
+	}
+	return res
+}
+
+// databaseActiveModules returns the registered modules that are not
+// uninstalled in the database, in dependency order.
+func databaseActiveModules() ModulesList {
+	var res ModulesList
+	err := models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+		res = activeModules(moduleRecords(env))
+	})
+	if err != nil {
+		log.Panic("Unable to read modules states", "error", err)
+	}
+	return res
+}
+
+// ActivateInstalledModules removes the modules that are uninstalled in the
+// database from the Modules list, so that their resources are not loaded and
+// their hooks are not run.
+//
+// It must be called after the database connection.
+func ActivateInstalledModules() {
+	Modules = databaseActiveModules()
+}
+
+// getModule returns the registered module with the given name or an error if there is none
+func getModule(name string) (*Module, error) {
+	mod := Modules.Get(name)
+	if mod == nil {
+		return nil, fmt.Errorf("unknown module %s", name)
+	}
+	return mod, nil
+}
+
+// checkDependenciesRegistered returns an error if the given module or
+// one of its dependencies depends on a module that is not registered.
+func checkDependenciesRegistered(mod *Module, checked map[string]bool) error {
+	if checked[mod.Name] {
+		return nil
+	}
+	checked[mod.Name] = true
+	for _, dep := range mod.Depends {
+		depMod := Modules.Get(dep)
+		if depMod == nil {
+			return fmt.Errorf("module %s depends on unknown module %s", mod.Name, dep)
+		}
+		if err := checkDependenciesRegistered(depMod, checked); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// InstallModule marks the given module and its uninstalled dependencies as to
+// be installed by the next UpdateModules call.
+//
+// It returns an error if one of these modules depends on a module that is not registered.
+func InstallModule(name string) error {
+	mod, err := getModule(name)
+	if err != nil {
+		return err
+	}
+	if err := checkDependenciesRegistered(mod, make(map[string]bool)); err != nil {
+		return err
+	}
+	return models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+		records := moduleRecords(env)
+		if rec, ok := records[name]; ok && rec.State != ModuleUninstalled {
+			log.Panic("Module is already installed", "module", name, "state", rec.State)
+		}
+		var markToInstall func(m *Module)
+		markToInstall = func(m *Module) {
+			if rec, ok := records[m.Name]; ok && rec.State != ModuleUninstalled {
+				return
+			}
+			setModuleState(env, m.Name, ModuleToInstall, records[m.Name].Version)
+			records[m.Name] = moduleRecord{Name: m.Name, State: ModuleToInstall}
+			for _, dep := range m.Depends {
+				markToInstall(Modules.Get(dep))
+			}
+		}
+		markToInstall(mod)
+	})
+}
+
+// UpgradeModule marks the given installed module as to be upgraded by the next
+// UpdateModules call.
+func UpgradeModule(name string) error {
+	if _, err := getModule(name); err != nil {
+		return err
+	}
+	return models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+		rec, ok := moduleRecords(env)[name]
+		if !ok || rec.State != ModuleInstalled {
+			log.Panic("Only installed modules can be upgraded", "module", name, "state", rec.State)
+		}
+		setModuleState(env, name, ModuleToUpgrade, rec.Version)
+	})
+}
+
+// UninstallModule runs the Uninstall hook of the given module and marks it as
+// uninstalled, in a single transaction.
+//
+// It returns an error if another active module depends on it. The tables and
+// columns of the module's models are not dropped, see UpdateModules.
+func UninstallModule(name string) error {
+	mod, err := getModule(name)
+	if err != nil {
+		return err
+	}
+	return models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+		records := moduleRecords(env)
+		rec := records[name]
+		if rec.State == ModuleUninstalled {
+			log.Panic("Module is not installed", "module", name)
+		}
+		for _, m := range activeModules(records) {
+			for _, dep := range m.Depends {
+				if dep == name {
+					log.Panic("Module is required by another installed module", "module", name, "requiredBy", m.Name)
+				}
+			}
+		}
+		if mod.Uninstall != nil {
+			mod.Uninstall(env)
+		}
+		setModuleState(env, name, ModuleUninstalled, rec.Version)
+	})
+}
+
+// UpdateModules synchronizes the database with all the active modules,
+// installing and upgrading the modules that need to be.
+//
+// A module needs to be installed if it has no state in the database yet or
+// if it is marked to be installed. It needs to be upgraded if it is marked
+// to be upgraded or if its version differs from the installed one.
+//
+// UpdateModules:
+// - runs the PreMigrate hook of each module to install or upgrade,
+// - synchronizes the database schema with the models,
+// - loads the data records of all active modules (and the demo records if demo is true),
+// - runs the PostMigrate hook of each module to install or upgrade,
+// - marks these modules as installed with their current version.
+//
+// Each hook is run in its own transaction. UpdateModules stops at the first failing hook.
+//
+// The schema is synchronized with all the models compiled in the project,
+// including those of uninstalled modules. Their models and fields are still
+// registered and queried by the ORM, so their tables and columns are kept up
+// to date, and their data is kept if the module is installed again.
+func UpdateModules(resourceDir string, demo bool) error {
+	var records map[string]moduleRecord
+	if err := models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+		records = moduleRecords(env)
+	}); err != nil {
+		return err
+	}
+	active := activeModules(records)
+	fromVersions := make(map[string]string)
+	var toMigrate ModulesList
+	for _, mod := range active {
+		rec, ok := records[mod.Name]
+		switch {
+		case !ok, rec.State == ModuleToInstall:
+			fromVersions[mod.Name] = ""
+		case rec.State == ModuleToUpgrade, rec.Version != mod.Version:
+			fromVersions[mod.Name] = rec.Version
+		default:
+			continue
+		}
+		toMigrate = append(toMigrate, mod)
+	}
+	for _, mod := range toMigrate {
+		if mod.PreMigrate == nil {
+			continue
+		}
+		if err := models.ExecuteInNewEnvironment(security.SuperUserID, mod.PreMigrate); err != nil {
+			return fmt.Errorf("pre-migration of module %s failed: %s", mod.Name, err)
+		}
+	}
+	models.SyncDatabase()
+	loadData(active, resourceDir, "data", "csv", moduleDataFiles, models.LoadCSVDataFile)
+	if demo {
+		log.Info("Demo mode detected: loading demo data")
+		loadData(active, resourceDir, "demo", "csv", moduleDemoFiles, models.LoadCSVDataFile)
+	}
+	for _, mod := range toMigrate {
+		err := models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			if mod.PostMigrate != nil {
+				mod.PostMigrate(env, fromVersions[mod.Name])
+			}
+			setModuleState(env, mod.Name, ModuleInstalled, mod.Version)
+		})
+		if err != nil {
+			return fmt.Errorf("post-migration of module %s failed: %s", mod.Name, err)
+		}
+		log.Info("Module updated", "module", mod.Name, "fromVersion", fromVersions[mod.Name], "version", mod.Version)
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+// Copyright 2019 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package server
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSortModules(t *testing.T) {
+	Convey("Testing modules sorting", t, func() {
+		for _, tc := range []struct {
+			name     string
+			modules  ModulesList
+			expected []string
+		}{
+			{
+				name: "Modules should come after their dependencies",
+				modules: ModulesList{
+					{Name: "sale", Depends: []string{"account", "base"}},
+					{Name: "account", Depends: []string{"base"}},
+					{Name: "base"},
+				},
+				expected: []string{"base", "account", "sale"},
+			},
+			{
+				name: "Independent modules should keep their registration order",
+				modules: ModulesList{
+					{Name: "web"},
+					{Name: "base"},
+					{Name: "stock", Depends: []string{"base"}},
+					{Name: "hr"},
+				},
+				expected: []string{"web", "base", "stock", "hr"},
+			},
+			{
+				name: "Unregistered dependencies should be ignored",
+				modules: ModulesList{
+					{Name: "sale", Depends: []string{"account"}},
+					{Name: "base"},
+				},
+				expected: []string{"sale", "base"},
+			},
+		} {
+			Convey(tc.name, func() {
+				sorted := sortModules(tc.modules)
+				So(sorted.Names(), ShouldResemble, tc.expected)
+			})
+		}
+		Convey("Dependency cycles should panic", func() {
+			So(func() {
+				sortModules(ModulesList{
+					{Name: "a", Depends: []string{"c"}},
+					{Name: "b", Depends: []string{"a"}},
+					{Name: "c", Depends: []string{"b"}},
+				})
+			}, ShouldPanic)
+		})
+	})
+}
+
+func TestCheckModuleManifest(t *testing.T) {
+	Convey("Testing modules manifest checks", t, func() {
+		registered := registeredModules
+		registeredModules = ModulesList{{Name: "base"}}
+		defer func() { registeredModules = registered }()
+		for _, tc := range []struct {
+			name  string
+			mod   *Module
+			valid bool
+		}{
+			{name: "Valid manifest", valid: true, mod: &Module{Name: "sale", Version: "1.2.0-beta.1+build.5",
+				Depends: []string{"base"}, Data: []string{"010-Tax.csv", "data/020-Journal.csv"}, Demo: []string{"./Partner.csv"}}},
+			{name: "Missing version", valid: true, mod: &Module{Name: "sale"}},
+			{name: "Missing name", mod: &Module{}},
+			{name: "Already registered", mod: &Module{Name: "base"}},
+			{name: "Bad semantic version", mod: &Module{Name: "sale", Version: "1.2"}},
+			{name: "Leading zero in version", mod: &Module{Name: "sale", Version: "01.2.0"}},
+			{name: "Self dependency", mod: &Module{Name: "sale", Depends: []string{"base", "sale"}}},
+			{name: "Duplicate dependency", mod: &Module{Name: "sale", Depends: []string{"base", "base"}}},
+			{name: "Absolute data path", mod: &Module{Name: "sale", Data: []string{"/etc/Tax.csv"}}},
+			{name: "Data path outside the module", mod: &Module{Name: "sale", Data: []string{"../other/Tax.csv"}}},
+			{name: "Demo path outside the module", mod: &Module{Name: "sale", Demo: []string{"demo/../../Partner.csv"}}},
+			{name: "Data file that is not a CSV file", mod: &Module{Name: "sale", Data: []string{"Tax.xml"}}},
+		} {
+			Convey(tc.name, func() {
+				if tc.valid {
+					So(func() { checkModuleManifest(tc.mod) }, ShouldNotPanic)
+					return
+				}
+				So(func() { checkModuleManifest(tc.mod) }, ShouldPanic)
+			})
+		}
+	})
+}
+
+func TestCheckModuleDependencies(t *testing.T) {
+	Convey("Testing modules dependencies checks", t, func() {
+		modules := Modules
+		defer func() { Modules = modules }()
+		for _, tc := range []struct {
+			name    string
+			modules ModulesList
+			valid   bool
+		}{
+			{name: "All dependencies registered", valid: true, modules: ModulesList{
+				{Name: "base"},
+				{Name: "sale", Depends: []string{"base"}},
+			}},
+			{name: "No dependencies", valid: true, modules: ModulesList{{Name: "base"}}},
+			{name: "Unregistered dependency", modules: ModulesList{
+				{Name: "base"},
+				{Name: "sale", Depends: []string{"base", "account"}},
+			}},
+		} {
+			Convey(tc.name, func() {
+				Modules = tc.modules
+				if tc.valid {
+					So(checkModuleDependencies, ShouldNotPanic)
+					return
+				}
+				So(checkModuleDependencies, ShouldPanic)
+			})
+		}
+	})
+}
+
+func TestCheckDependenciesRegistered(t *testing.T) {
+	Convey("Testing that modules to install only depend on registered modules", t, func() {
+		modules := Modules
+		defer func() { Modules = modules }()
+		Modules = ModulesList{
+			{Name: "base"},
+			{Name: "account", Depends: []string{"base"}},
+			{Name: "sale", Depends: []string{"account"}},
+			{Name: "stock", Depends: []string{"base", "product"}},
+			{Name: "mrp", Depends: []string{"stock"}},
+		}
+		for _, tc := range []struct {
+			module string
+			valid  bool
+		}{
+			{module: "base", valid: true},
+			{module: "sale", valid: true},
+			{module: "stock"},
+			{module: "mrp"},
+		} {
+			Convey(tc.module, func() {
+				err := checkDependenciesRegistered(Modules.Get(tc.module), make(map[string]bool))
+				if tc.valid {
+					So(err, ShouldBeNil)
+					return
+				}
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, "product")
+			})
+		}
+		Convey("Installing a module with an unregistered dependency should fail without panicking", func() {
+			var err error
+			So(func() { err = InstallModule("mrp") }, ShouldNotPanic)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -15,14 +15,16 @@
 package server
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"net/http"
 	"path/filepath"
+	"sync"
 
 	"github.com/gin-contrib/sessions"
-	"github.com/gin-contrib/sessions/cookie"
 	"github.com/gin-gonic/gin"
+	"github.com/gorilla/securecookie"
 	"github.com/hexya-erp/hexya/src/templates"
 	"github.com/hexya-erp/hexya/src/tools/logging"
 	"github.com/spf13/viper"
@@ -33,6 +35,9 @@ import (
 // It is internally a wrapper around a gin.Engine
 type Server struct {
 	*gin.Engine
+	mu          sync.Mutex
+	httpServers []*http.Server
+	shutDown    bool
 }
 
 // Group creates a new router group. You should add all the routes that have common middlwares or the same path prefix.
@@ -44,33 +49,34 @@ func (s *Server) Group(relativePath string, handlers ...HandlerFunc) *RouterGrou
 }
 
 // Run attaches the router to a http.Server and starts listening and serving HTTP requests.
-// It is a shortcut for http.ListenAndServe(addr, router)
-// Note: this method will block the calling goroutine indefinitely unless an error happens.
+// Note: this method will block the calling goroutine indefinitely unless an error happens
+// or the server is shut down, in which case it returns http.ErrServerClosed.
 func (s *Server) Run(addr string) (err error) {
-	defer func() { log.Error("HTTP server stopped", "error", err) }()
+	defer func() { logServerStop("HTTP server stopped", err) }()
 
 	log.Info("Hexya is up and running HTTP", "address", addr)
-	err = http.ListenAndServe(addr, s)
+	err = s.newHTTPServer(addr, nil).ListenAndServe()
 	return
 }
 
 // RunTLS attaches the router to a http.Server and starts listening and serving HTTPS (secure) requests.
-// It is a shortcut for http.ListenAndServeTLS(addr, certFile, keyFile, router)
-// Note: this method will block the calling goroutine indefinitely unless an error happens.
+// Note: this method will block the calling goroutine indefinitely unless an error happens
+// or the server is shut down, in which case it returns http.ErrServerClosed.
 func (s *Server) RunTLS(addr string, certFile string, keyFile string) (err error) {
-	defer func() { log.Error("HTTPS server stopped", err) }()
+	defer func() { logServerStop("HTTPS server stopped", err) }()
 
 	log.Info("Hexya is up and running HTTPS", "address", addr, "cert", certFile, "key", keyFile)
-	err = http.ListenAndServeTLS(addr, certFile, keyFile, s)
+	err = s.newHTTPServer(addr, nil).ListenAndServeTLS(certFile, keyFile)
 	return
 }
 
 // RunAutoTLS attaches the router to a http.Server and starts listening and serving HTTPS (secure) requests on port 443
 // for all interfaces.
 // It automatically gets certificate for the given domain from Letsencrypt.
-// Note: this method will block the calling goroutine indefinitely unless an error happens.
+// Note: this method will block the calling goroutine indefinitely unless an error happens
+// or the server is shut down, in which case it returns http.ErrServerClosed.
 func (s *Server) RunAutoTLS(domain string) (err error) {
-	defer func() { log.Error("HTTPS server stopped", err) }()
+	defer func() { logServerStop("HTTPS server stopped", err) }()
 
 	log.Info("Hexya is up and running HTTPS auto", "domain", domain)
 
@@ -80,20 +86,80 @@ func (s *Server) RunAutoTLS(domain string) (err error) {
 		Prompt:     autocert.AcceptTOS,
 		HostPolicy: autocert.HostWhitelist(domain),
 	}
-	go http.ListenAndServe(":http", m.HTTPHandler(nil))
+	challengeServer := &http.Server{
+		Addr:    ":http",
+		Handler: m.HTTPHandler(nil),
+	}
+	s.registerHTTPServer(challengeServer)
+	go challengeServer.ListenAndServe()
+	err = s.newHTTPServer(":https", &tls.Config{GetCertificate: m.GetCertificate}).ListenAndServeTLS("", "")
+	return
+}
+
+// newHTTPServer returns a new http.Server serving this Server's router
+// on the given address. The http.Server is closed by Shutdown.
+func (s *Server) newHTTPServer(addr string, tlsConfig *tls.Config) *http.Server {
 	srv := &http.Server{
-		Addr:      ":https",
-		TLSConfig: &tls.Config{GetCertificate: m.GetCertificate},
+		Addr:      addr,
 		Handler:   s,
+		TLSConfig: tlsConfig,
 	}
-	err = srv.ListenAndServeTLS("", "")
-	return
+	s.registerHTTPServer(srv)
+	return srv
 }
 
-// A RequestRPC is the message format expected from a client
+// registerHTTPServer adds the given http.Server to the servers closed by Shutdown.
+//
+// If Shutdown has already been called, the http.Server is closed right away so
+// that it returns http.ErrServerClosed instead of starting to listen.
+func (s *Server) registerHTTPServer(srv *http.Server) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.shutDown {
+		srv.Close()
+		return
+	}
+	s.httpServers = append(s.httpServers, srv)
+}
+
+// Shutdown gracefully shuts down the server: it stops accepting new connections
+// and waits for the requests in progress to complete. If the given context expires
+// before, the remaining connections are closed and the context's error is returned.
+//
+// Servers started after Shutdown has been called stop immediately.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	servers := s.httpServers
+	s.httpServers = nil
+	s.shutDown = true
+	s.mu.Unlock()
+	var res error
+	for _, srv := range servers {
+		if err := srv.Shutdown(ctx); err != nil {
+			srv.Close()
+			res = err
+		}
+	}
+	return res
+}
+
+// logServerStop logs that the server stopped with the given message,
+// as an error unless it has been shut down.
+func logServerStop(msg string, err error) {
+	if err == http.ErrServerClosed {
+		log.Info(msg)
+		return
+	}
+	log.Error(msg, "error", err)
+}
+
+// A RequestRPC is the message format expected from a client.
+//
+// ID is the raw JSON value of the request id, which can be a string, a number
+// or null. It is nil if the request is a notification, i.e. if it has no id.
 type RequestRPC struct {
 	JsonRPC string          `json:"jsonrpc"`
-	ID      int64           `json:"id"`
+	ID      json.RawMessage `json:"id"`
 	Method  string          `json:"method"`
 	Params  json.RawMessage `json:"params"`
 }
@@ -101,17 +167,17 @@ type RequestRPC struct {
 // A ResponseRPC is the message format sent back to a client
 // in case of success
 type ResponseRPC struct {
-	JsonRPC string      `json:"jsonrpc"`
-	ID      int64       `json:"id"`
-	Result  interface{} `json:"result"`
+	JsonRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  interface{}     `json:"result"`
 }
 
 // A ResponseError is the message format sent back to a
 // client in case of failure
 type ResponseError struct {
-	JsonRPC string       `json:"jsonrpc"`
-	ID      int64        `json:"id"`
-	Error   JSONRPCError `json:"error"`
+	JsonRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Error   JSONRPCError    `json:"error"`
 }
 
 // JSONRPCErrorData is the format of the Data field of an Error Response
@@ -121,14 +187,19 @@ type JSONRPCErrorData struct {
 	Debug         string   `json:"debug"`
 }
 
+// ConcurrentUpdateErrorCode is the code of the JSONRPCError returned when
+// records have been modified by another user since the client read them.
+const ConcurrentUpdateErrorCode = RPCConcurrentUpdateErrorCode
+
 // JSONRPCError is the format of an Error in a ResponseError
 type JSONRPCError struct {
 	Code    int         `json:"code"`
 	Message string      `json:"message"`
-	Data    interface{} `json:"data"`
+	Data    interface{} `json:"data,omitempty"`
 }
 
 var hexyaServer *Server
+var hexyaSessionStore *sessionStore
 var log logging.Logger
 
 // GetServer return the http server instance
@@ -140,26 +211,33 @@ func init() {
 	log = logging.GetLogger("server")
 	// Set to ReleaseMode now for tests and is overridden later (hexya/cmd/server.go)
 	gin.SetMode(gin.ReleaseMode)
-	hexyaServer = &Server{gin.New()}
-	store := cookie.NewStore([]byte(">r&5#5T/sG-jnf=EW8$(WQX'-m2R6Gk*^qqr`CxEtG'wQ[/'G@`NYn^on?b!4G`9"),
-		[]byte("!WY9Q|}09!4Ke=@w0HS|]$u,p1f^k(5T"))
+	hexyaServer = &Server{Engine: gin.New()}
+	// Random keys until the session store is configured in PostInit
+	hexyaSessionStore = newSessionStore(securecookie.GenerateRandomKey(32), securecookie.GenerateRandomKey(32))
 	hexyaServer.Use(gin.Recovery())
-	hexyaServer.Use(sessions.Sessions("hexya-session", store))
+	hexyaServer.Use(sessions.Sessions(sessionCookieName, hexyaSessionStore))
 	hexyaServer.Use(logging.LogForGin(log))
+	hexyaServer.Use(rpcBatchMiddleware)
+	hexyaServer.NoRoute(rpcNoRoute)
 	hexyaServer.HTMLRender = templates.Registry
 }
 
 // PreInit runs all actions that need to be done after we get the configuration,
 // but before bootstrap.
 //
-// This function runs successively all PreInit() func of modules
+// This function checks that the dependencies of all modules are registered
+// and runs successively all PreInit() func of modules.
+//
+// It must be called after the database connection.
 func PreInit() {
+	checkModuleDependencies()
 	PreInitModules()
 }
 
-// PreInitModules calls successively all PreInit functions of all installed modules
+// PreInitModules calls successively all PreInit functions of the modules
+// that are not uninstalled in the database.
 func PreInitModules() {
-	for _, module := range Modules {
+	for _, module := range databaseActiveModules() {
 		if module.PreInit != nil {
 			module.PreInit()
 		}
@@ -169,8 +247,10 @@ func PreInitModules() {
 // PostInit runs all actions that need to be done after all modules have been loaded.
 // This is typically all actions that need to be done after bootstrapping the models.
 // This function:
+// - configures the session store,
 // - runs successively all PostInit() func of all modules,
 func PostInit() {
+	setupSessionStore()
 	PostInitModules()
 }
 
@@ -182,3 +262,19 @@ func PostInitModules() {
 		}
 	}
 }
+
+// PreShutdown runs all actions that need to be done before the server stops,
+// after the HTTP server and the worker loop have been stopped.
+func PreShutdown() {
+	PreShutdownModules()
+}
+
+// PreShutdownModules calls successively all PreShutdown functions of all
+// installed modules, in the reverse order of their registration.
+func PreShutdownModules() {
+	for i := len(Modules) - 1; i >= 0; i-- {
+		if Modules[i].PreShutdown != nil {
+			Modules[i].PreShutdown()
+		}
+	}
+}
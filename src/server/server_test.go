@@ -0,0 +1,43 @@
+// Copyright 2019 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package server
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestServerShutdown(t *testing.T) {
+	Convey("Testing server shutdown", t, func() {
+		Convey("A server shut down before running should stop right away", func() {
+			srv := &Server{Engine: gin.New()}
+			So(srv.Shutdown(context.Background()), ShouldBeNil)
+			So(srv.Run("127.0.0.1:0"), ShouldEqual, http.ErrServerClosed)
+			So(srv.httpServers, ShouldBeEmpty)
+		})
+		Convey("Shutting down a running server should make Run return", func() {
+			srv := &Server{Engine: gin.New()}
+			stopped := make(chan error, 1)
+			go func() {
+				stopped <- srv.Run("127.0.0.1:0")
+			}()
+			for {
+				srv.mu.Lock()
+				running := len(srv.httpServers) > 0
+				srv.mu.Unlock()
+				if running {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			So(srv.Shutdown(context.Background()), ShouldBeNil)
+			So(<-stopped, ShouldEqual, http.ErrServerClosed)
+		})
+	})
+}
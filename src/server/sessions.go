@@ -0,0 +1,408 @@
+// Copyright 2019 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gorilla/securecookie"
+	gsessions "github.com/gorilla/sessions"
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/models/security"
+	"github.com/spf13/viper"
+)
+
+const (
+	// sessionCookieName is the name of the cookie holding the session
+	sessionCookieName = "hexya-session"
+	// cookieSessionStore is the name of the session store keeping the session values in the cookie itself
+	cookieSessionStore = "cookie"
+	// minSessionKeyLength is the minimum recommended length of session secrets
+	minSessionKeyLength = 32
+	// SessionUIDKey is the session key holding the ID of the logged in user.
+	// Server-side session stores index sessions on this value so that they can be revoked.
+	SessionUIDKey = "uid"
+)
+
+// ErrSessionNotFound is returned by SessionBackend.Save when the session
+// does not exist anymore, for instance because it has been revoked.
+var ErrSessionNotFound = errors.New("session not found")
+
+// A SessionBackend stores the values of sessions server-side, the session cookie
+// only holding the session ID.
+type SessionBackend interface {
+	// Init is called once on startup, after the database connection.
+	Init()
+	// Load returns the serialized values of the session with the given ID,
+	// or nil if the session does not exist or has expired.
+	Load(id string) ([]byte, error)
+	// Create stores the serialized values of a new session with the given ID,
+	// belonging to the user with the given uid, until the given expiry time.
+	Create(id string, uid int64, data []byte, expiry time.Time) error
+	// Save updates the serialized values, the uid and the expiry time of the
+	// existing session with the given ID. It must not recreate a deleted or
+	// expired session and return ErrSessionNotFound instead.
+	Save(id string, uid int64, data []byte, expiry time.Time) error
+	// Delete removes the session with the given ID.
+	Delete(id string) error
+	// DeleteUser removes all the sessions of the user with the given uid.
+	DeleteUser(uid int64) error
+}
+
+// sessionBackends is the registry of the server-side session stores
+var sessionBackends = map[string]SessionBackend{
+	"postgres": new(postgresSessionBackend),
+}
+
+// RegisterSessionBackend registers the given server-side session store under the given
+// name, so that it can be selected with the Server.SessionStore configuration key.
+func RegisterSessionBackend(name string, backend SessionBackend) {
+	if name == cookieSessionStore {
+		log.Panic("Session store name is reserved", "name", name)
+	}
+	sessionBackends[name] = backend
+}
+
+// sessionStore is the sessions.Store of the server.
+//
+// Session values are kept in the cookie itself if it has no backend.
+// Otherwise the cookie only holds the session ID and values are stored by the backend.
+type sessionStore struct {
+	codecs   []securecookie.Codec
+	options  *gsessions.Options
+	sameSite http.SameSite
+	backend  SessionBackend
+}
+
+var _ sessions.Store = new(sessionStore)
+
+// newSessionStore returns a new sessionStore keeping the values in the cookie
+// and using the given authentication and encryption key pairs.
+func newSessionStore(keyPairs ...[]byte) *sessionStore {
+	s := &sessionStore{
+		codecs: securecookie.CodecsFromPairs(keyPairs...),
+		options: &gsessions.Options{
+			Path:     "/",
+			MaxAge:   86400 * 30,
+			HttpOnly: true,
+		},
+		sameSite: http.SameSiteLaxMode,
+	}
+	s.setMaxAge(s.options.MaxAge)
+	return s
+}
+
+// Get returns the session with the given name for the given request,
+// creating it if it does not exist yet.
+func (s *sessionStore) Get(r *http.Request, name string) (*gsessions.Session, error) {
+	return gsessions.GetRegistry(r).Get(s, name)
+}
+
+// New returns the session with the given name decoded from the cookie of
+// the given request. It returns a new session if the cookie is missing,
+// invalid or if the session has expired.
+func (s *sessionStore) New(r *http.Request, name string) (*gsessions.Session, error) {
+	session := gsessions.NewSession(s, name)
+	opts := *s.options
+	session.Options = &opts
+	session.IsNew = true
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+	if s.backend == nil {
+		if securecookie.DecodeMulti(name, cookie.Value, &session.Values, s.codecs...) == nil {
+			session.IsNew = false
+		}
+		return session, nil
+	}
+	if securecookie.DecodeMulti(name, cookie.Value, &session.ID, s.codecs...) != nil {
+		return session, nil
+	}
+	data, err := s.backend.Load(session.ID)
+	if err != nil || data == nil {
+		session.ID = ""
+		return session, err
+	}
+	if err := (securecookie.GobEncoder{}).Deserialize(data, &session.Values); err != nil {
+		session.ID = ""
+		return session, err
+	}
+	session.IsNew = false
+	return session, nil
+}
+
+// Save writes the given session in the response and in the backend if any.
+// The session is deleted if its MaxAge is negative.
+//
+// If the backend does not know the session anymore, because it has been
+// revoked during the request, the session cookie is deleted.
+func (s *sessionStore) Save(r *http.Request, w http.ResponseWriter, session *gsessions.Session) error {
+	if s.backend == nil {
+		if session.Options.MaxAge < 0 {
+			s.setCookie(w, session.Name(), "", session.Options)
+			return nil
+		}
+		encoded, err := securecookie.EncodeMulti(session.Name(), session.Values, s.codecs...)
+		if err != nil {
+			return err
+		}
+		s.setCookie(w, session.Name(), encoded, session.Options)
+		return nil
+	}
+	if session.Options.MaxAge < 0 {
+		if session.ID != "" {
+			if err := s.backend.Delete(session.ID); err != nil {
+				return err
+			}
+		}
+		s.setCookie(w, session.Name(), "", session.Options)
+		return nil
+	}
+	data, err := securecookie.GobEncoder{}.Serialize(session.Values)
+	if err != nil {
+		return err
+	}
+	expiry := time.Now().Add(time.Duration(session.Options.MaxAge) * time.Second)
+	if session.ID == "" {
+		session.ID = strings.TrimRight(base32.StdEncoding.EncodeToString(securecookie.GenerateRandomKey(32)), "=")
+		err = s.backend.Create(session.ID, sessionUID(session), data, expiry)
+	} else {
+		err = s.backend.Save(session.ID, sessionUID(session), data, expiry)
+	}
+	switch err {
+	case nil:
+	case ErrSessionNotFound:
+		opts := *session.Options
+		opts.MaxAge = -1
+		s.setCookie(w, session.Name(), "", &opts)
+		return nil
+	default:
+		return err
+	}
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, s.codecs...)
+	if err != nil {
+		return err
+	}
+	s.setCookie(w, session.Name(), encoded, session.Options)
+	return nil
+}
+
+// Options sets the cookie options of the sessions of this store
+func (s *sessionStore) Options(options sessions.Options) {
+	s.options = &gsessions.Options{
+		Path:     options.Path,
+		Domain:   options.Domain,
+		MaxAge:   options.MaxAge,
+		Secure:   options.Secure,
+		HttpOnly: options.HttpOnly,
+	}
+	s.setMaxAge(options.MaxAge)
+}
+
+// setMaxAge sets the maximum age of the cookies signed by this store
+func (s *sessionStore) setMaxAge(maxAge int) {
+	for _, codec := range s.codecs {
+		if sc, ok := codec.(*securecookie.SecureCookie); ok {
+			sc.MaxAge(maxAge)
+		}
+	}
+}
+
+// setCookie adds the session cookie with the given name, value and options to the response
+func (s *sessionStore) setCookie(w http.ResponseWriter, name, value string, options *gsessions.Options) {
+	cookie := gsessions.NewCookie(name, value, options)
+	cookie.SameSite = s.sameSite
+	http.SetCookie(w, cookie)
+}
+
+// sessionUID returns the ID of the user logged in the given session, or 0 if there is none.
+func sessionUID(session *gsessions.Session) int64 {
+	switch uid := session.Values[SessionUIDKey].(type) {
+	case int64:
+		return uid
+	case int:
+		return int64(uid)
+	}
+	return 0
+}
+
+// sessionKeyPairs returns the authentication and encryption key pairs derived
+// from the secrets of the Server.SessionKeys configuration key.
+//
+// The first secret signs and encrypts new cookies, the following ones are only
+// used to read existing cookies so that secrets can be rotated without logging
+// out users. Random keys are used if no secret is configured.
+func sessionKeyPairs() [][]byte {
+	secrets := viper.GetStringSlice("Server.SessionKeys")
+	if len(secrets) == 0 {
+		log.Warn("No session keys configured, using random keys. Sessions will not survive a server restart")
+		return [][]byte{securecookie.GenerateRandomKey(32), securecookie.GenerateRandomKey(32)}
+	}
+	res := make([][]byte, 0, 2*len(secrets))
+	for i, secret := range secrets {
+		if len(secret) < minSessionKeyLength {
+			log.Warn("Session key is too short", "index", i, "length", len(secret), "minimum", minSessionKeyLength)
+		}
+		res = append(res, deriveSessionKey(secret, "authentication"), deriveSessionKey(secret, "encryption"))
+	}
+	return res
+}
+
+// deriveSessionKey returns a 32 bytes key for the given usage derived from the given secret
+func deriveSessionKey(secret, usage string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(usage))
+	return mac.Sum(nil)
+}
+
+// setupSessionStore configures the session store of the server
+// from the Server.SessionKeys, Server.SessionStore and Server.SessionMaxAge
+// configuration keys.
+//
+// Session cookies are always HttpOnly and SameSite=Lax. They are Secure
+// when the server runs HTTPS, i.e. when Server.Certificate or Server.Domain is set.
+func setupSessionStore() {
+	store := newSessionStore(sessionKeyPairs()...)
+	maxAge := viper.GetDuration("Server.SessionMaxAge")
+	if maxAge <= 0 {
+		maxAge = 30 * 24 * time.Hour
+	}
+	store.Options(sessions.Options{
+		Path:     "/",
+		MaxAge:   int(maxAge.Seconds()),
+		Secure:   viper.GetString("Server.Certificate") != "" || viper.GetString("Server.Domain") != "",
+		HttpOnly: true,
+	})
+	switch name := viper.GetString("Server.SessionStore"); name {
+	case "", cookieSessionStore:
+	default:
+		backend, ok := sessionBackends[name]
+		if !ok {
+			log.Panic("Unknown session store", "name", name)
+		}
+		backend.Init()
+		store.backend = backend
+	}
+	*hexyaSessionStore = *store
+}
+
+// RevokeSessions deletes all the sessions of the user with the given uid,
+// logging this user out of all its browsers.
+//
+// Sessions can only be revoked with a server-side session store,
+// since cookie sessions are only held by the browsers.
+func RevokeSessions(uid int64) error {
+	if hexyaSessionStore.backend == nil {
+		return fmt.Errorf("sessions cannot be revoked with the %s session store", cookieSessionStore)
+	}
+	return hexyaSessionStore.backend.DeleteUser(uid)
+}
+
+// postgresSessionBackend is a SessionBackend storing sessions in a
+// table of the PostgreSQL database.
+type postgresSessionBackend struct{}
+
+// postgresSessionsTable is the name of the table of the postgresSessionBackend
+const postgresSessionsTable = "hexya_session"
+
+func init() {
+	models.RegisterUnmanagedTable(postgresSessionsTable)
+}
+
+// Init creates the sessions table if it does not exist and registers
+// a scheduled action deleting expired sessions every hour.
+//
+// It panics if the database is not a PostgreSQL database.
+func (b *postgresSessionBackend) Init() {
+	if driver := models.DBDriverName(); driver != "postgres" {
+		log.Panic("The postgres session store requires a PostgreSQL database", "driver", driver)
+	}
+	err := models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+		env.Cr().Execute(fmt.Sprintf(`
+CREATE TABLE IF NOT EXISTS %s (
+	id varchar PRIMARY KEY,
+	uid bigint NOT NULL DEFAULT 0,
+	data bytea NOT NULL,
+	expires_at timestamp without time zone NOT NULL
+)`, postgresSessionsTable))
+		env.Cr().Execute(fmt.Sprintf(`CREATE INDEX IF NOT EXISTS %[1]s_uid_index ON %[1]s (uid)`, postgresSessionsTable))
+	})
+	if err != nil {
+		log.Panic("Unable to create sessions table", "error", err)
+	}
+	models.RegisterScheduledAction(models.ScheduledAction{
+		Name:     "hexya.server.deleteExpiredSessions",
+		Schedule: "0 * * * *",
+		Fnct: func(env models.Environment) {
+			env.Cr().Execute(fmt.Sprintf(`DELETE FROM %s WHERE expires_at <= ?`, postgresSessionsTable), time.Now().UTC())
+		},
+	})
+}
+
+// Load returns the serialized values of the session with the given ID
+func (b *postgresSessionBackend) Load(id string) ([]byte, error) {
+	var rows [][]byte
+	err := models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+		env.Cr().Select(&rows, fmt.Sprintf(`SELECT data FROM %s WHERE id = ? AND expires_at > ?`, postgresSessionsTable),
+			id, time.Now().UTC())
+	})
+	if err != nil || len(rows) == 0 {
+		return nil, err
+	}
+	return rows[0], nil
+}
+
+// Create inserts a new session with the given ID
+func (b *postgresSessionBackend) Create(id string, uid int64, data []byte, expiry time.Time) error {
+	return models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+		env.Cr().Execute(fmt.Sprintf(`INSERT INTO %s (id, uid, data, expires_at) VALUES (?, ?, ?, ?)`, postgresSessionsTable),
+			id, uid, data, expiry.UTC())
+	})
+}
+
+// Save updates the session with the given ID if it exists and has not expired
+func (b *postgresSessionBackend) Save(id string, uid int64, data []byte, expiry time.Time) error {
+	var updated int64
+	err := models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+		res := env.Cr().Execute(fmt.Sprintf(`
+UPDATE %s SET uid = ?, data = ?, expires_at = ? WHERE id = ? AND expires_at > ?`, postgresSessionsTable),
+			uid, data, expiry.UTC(), id, time.Now().UTC())
+		var err error
+		if updated, err = res.RowsAffected(); err != nil {
+			log.Panic("Unable to get the number of updated sessions", "error", err)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+// Delete removes the session with the given ID
+func (b *postgresSessionBackend) Delete(id string) error {
+	return models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+		env.Cr().Execute(fmt.Sprintf(`DELETE FROM %s WHERE id = ?`, postgresSessionsTable), id)
+	})
+}
+
+// DeleteUser removes all the sessions of the user with the given uid
+func (b *postgresSessionBackend) DeleteUser(uid int64) error {
+	return models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+		env.Cr().Execute(fmt.Sprintf(`DELETE FROM %s WHERE uid = ?`, postgresSessionsTable), uid)
+	})
+}
+
+var _ SessionBackend = new(postgresSessionBackend)
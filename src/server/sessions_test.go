@@ -0,0 +1,205 @@
+// Copyright 2019 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	gsessions "github.com/gorilla/sessions"
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/jmoiron/sqlx"
+	_ "github.com/lib/pq"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/viper"
+)
+
+// newTestSession returns a new session of the given store
+func newTestSession(store *sessionStore) *gsessions.Session {
+	session, err := store.New(httptest.NewRequest(http.MethodGet, "/", nil), sessionCookieName)
+	So(err, ShouldBeNil)
+	return session
+}
+
+// saveTestSession saves the given session with the given store and returns the cookie of the response
+func saveTestSession(store *sessionStore, session *gsessions.Session) *http.Cookie {
+	w := httptest.NewRecorder()
+	So(store.Save(httptest.NewRequest(http.MethodGet, "/", nil), w, session), ShouldBeNil)
+	cookies := w.Result().Cookies()
+	So(cookies, ShouldHaveLength, 1)
+	return cookies[0]
+}
+
+// loadTestSession returns the session read by the given store from a request with the given cookie
+func loadTestSession(store *sessionStore, cookie *http.Cookie) *gsessions.Session {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(cookie)
+	session, err := store.New(req, sessionCookieName)
+	So(err, ShouldBeNil)
+	return session
+}
+
+func TestSessionKeysRotation(t *testing.T) {
+	defer viper.Set("Server.SessionKeys", []string{})
+	Convey("Testing session keys rotation", t, func() {
+		oldSecret := strings.Repeat("o", minSessionKeyLength)
+		newSecret := strings.Repeat("n", minSessionKeyLength)
+		viper.Set("Server.SessionKeys", []string{oldSecret})
+		oldStore := newSessionStore(sessionKeyPairs()...)
+		viper.Set("Server.SessionKeys", []string{newSecret, oldSecret})
+		rotatedStore := newSessionStore(sessionKeyPairs()...)
+		viper.Set("Server.SessionKeys", []string{newSecret})
+		newStore := newSessionStore(sessionKeyPairs()...)
+
+		session := newTestSession(oldStore)
+		session.Values[SessionUIDKey] = int64(2)
+		oldCookie := saveTestSession(oldStore, session)
+		Convey("Cookies signed with the old key should still be read after rotation", func() {
+			session := loadTestSession(rotatedStore, oldCookie)
+			So(session.IsNew, ShouldBeFalse)
+			So(sessionUID(session), ShouldEqual, 2)
+		})
+		Convey("Cookies should be signed with the new key after rotation", func() {
+			newCookie := saveTestSession(rotatedStore, loadTestSession(rotatedStore, oldCookie))
+			session := loadTestSession(newStore, newCookie)
+			So(session.IsNew, ShouldBeFalse)
+			So(sessionUID(session), ShouldEqual, 2)
+			So(loadTestSession(oldStore, newCookie).IsNew, ShouldBeTrue)
+		})
+		Convey("Cookies signed with a removed key should not be read", func() {
+			So(loadTestSession(newStore, oldCookie).IsNew, ShouldBeTrue)
+		})
+	})
+}
+
+func TestSessionCookieFlags(t *testing.T) {
+	savedStore := *hexyaSessionStore
+	defer func() {
+		*hexyaSessionStore = savedStore
+		viper.Set("Server.Certificate", "")
+		viper.Set("Server.Domain", "")
+	}()
+	Convey("Testing session cookie flags", t, func() {
+		for _, tc := range []struct {
+			name        string
+			certificate string
+			domain      string
+			secure      bool
+		}{
+			{name: "Cookies should not be secure over HTTP"},
+			{name: "Cookies should be secure with a certificate", certificate: "/etc/hexya/server.crt", secure: true},
+			{name: "Cookies should be secure with an automatic certificate", domain: "hexya.example.com", secure: true},
+		} {
+			Convey(tc.name, func() {
+				viper.Set("Server.Certificate", tc.certificate)
+				viper.Set("Server.Domain", tc.domain)
+				setupSessionStore()
+				cookie := saveTestSession(hexyaSessionStore, newTestSession(hexyaSessionStore))
+				So(cookie.Secure, ShouldEqual, tc.secure)
+				So(cookie.HttpOnly, ShouldBeTrue)
+				So(cookie.SameSite, ShouldEqual, http.SameSiteLaxMode)
+			})
+		}
+	})
+}
+
+// connectTestDB creates the database of the server tests and connects to it.
+// The returned function closes the connection and drops the database.
+func connectTestDB() func() {
+	user := os.Getenv("HEXYA_DB_USER")
+	if user == "" {
+		user = "hexya"
+	}
+	password := os.Getenv("HEXYA_DB_PASSWORD")
+	if password == "" {
+		password = "hexya"
+	}
+	prefix := os.Getenv("HEXYA_DB_PREFIX")
+	if prefix == "" {
+		prefix = "hexya"
+	}
+	dbName := fmt.Sprintf("%s_server_tests", prefix)
+	admDB := sqlx.MustConnect("postgres", fmt.Sprintf("dbname=postgres sslmode=disable user=%s password=%s", user, password))
+	admDB.MustExec(fmt.Sprintf("DROP DATABASE IF EXISTS %s", dbName))
+	admDB.MustExec(fmt.Sprintf("CREATE DATABASE %s", dbName))
+	admDB.Close()
+	models.DBConnect("postgres", models.ConnectionParams{
+		DBName:   dbName,
+		User:     user,
+		Password: password,
+		SSLMode:  "disable",
+	})
+	return func() {
+		models.DBClose()
+		admDB := sqlx.MustConnect("postgres", fmt.Sprintf("dbname=postgres sslmode=disable user=%s password=%s", user, password))
+		admDB.MustExec(fmt.Sprintf("DROP DATABASE IF EXISTS %s", dbName))
+		admDB.Close()
+	}
+}
+
+func TestPostgresSessionBackend(t *testing.T) {
+	defer connectTestDB()()
+	backend := new(postgresSessionBackend)
+	backend.Init()
+	load := func(id string) []byte {
+		data, err := backend.Load(id)
+		So(err, ShouldBeNil)
+		return data
+	}
+	data := []byte("session data")
+	Convey("Testing the postgres session store", t, func() {
+		Convey("Sessions should be loaded until they expire", func() {
+			So(backend.Create("valid", 2, data, time.Now().Add(time.Hour)), ShouldBeNil)
+			So(backend.Create("expired", 2, data, time.Now().Add(-time.Second)), ShouldBeNil)
+			So(load("valid"), ShouldResemble, data)
+			So(load("expired"), ShouldBeNil)
+			So(load("unknown"), ShouldBeNil)
+		})
+		Convey("Saving a session should update its values and expiry", func() {
+			So(backend.Create("saved", 2, data, time.Now().Add(time.Hour)), ShouldBeNil)
+			So(backend.Save("saved", 2, []byte("new data"), time.Now().Add(time.Hour)), ShouldBeNil)
+			So(load("saved"), ShouldResemble, []byte("new data"))
+			So(backend.Save("saved", 2, data, time.Now().Add(-time.Second)), ShouldBeNil)
+			So(load("saved"), ShouldBeNil)
+		})
+		Convey("Saving should not recreate deleted, expired or unknown sessions", func() {
+			So(backend.Create("deleted", 2, data, time.Now().Add(time.Hour)), ShouldBeNil)
+			So(backend.Delete("deleted"), ShouldBeNil)
+			So(backend.Create("stale", 2, data, time.Now().Add(-time.Second)), ShouldBeNil)
+			for _, id := range []string{"deleted", "stale", "unknown"} {
+				So(backend.Save(id, 2, data, time.Now().Add(time.Hour)), ShouldEqual, ErrSessionNotFound)
+				So(load(id), ShouldBeNil)
+			}
+		})
+		Convey("Revoking sessions should log the user out of all its sessions", func() {
+			savedStore := *hexyaSessionStore
+			defer func() {
+				*hexyaSessionStore = savedStore
+			}()
+			hexyaSessionStore.backend = nil
+			So(RevokeSessions(5), ShouldNotBeNil)
+
+			hexyaSessionStore.backend = backend
+			session := newTestSession(hexyaSessionStore)
+			session.Values[SessionUIDKey] = int64(5)
+			cookie := saveTestSession(hexyaSessionStore, session)
+			So(loadTestSession(hexyaSessionStore, cookie).IsNew, ShouldBeFalse)
+			So(backend.Create("other", 6, data, time.Now().Add(time.Hour)), ShouldBeNil)
+			So(RevokeSessions(5), ShouldBeNil)
+			So(loadTestSession(hexyaSessionStore, cookie).IsNew, ShouldBeTrue)
+			So(load("other"), ShouldResemble, data)
+			Convey("A session revoked during a request should not be saved back", func() {
+				cookie := saveTestSession(hexyaSessionStore, session)
+				So(cookie.Value, ShouldBeEmpty)
+				So(cookie.MaxAge, ShouldBeLessThan, 0)
+				So(load(session.ID), ShouldBeNil)
+			})
+		})
+	})
+}
@@ -0,0 +1,163 @@
+// Copyright 2019 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package tests
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/hexya-erp/hexya/src/controllers"
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/models/security"
+	"github.com/hexya-erp/hexya/src/models/types"
+	"github.com/hexya-erp/hexya/src/server"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// restTestBackend authenticates the "admin" and "demo" users of the REST API tests
+type restTestBackend struct{}
+
+// Authenticate returns the uid of the given login if secret is "secret"
+func (restTestBackend) Authenticate(login, secret string, context *types.Context) (int64, error) {
+	uid, ok := map[string]int64{"admin": security.SuperUserID, "demo": 2}[login]
+	if !ok {
+		return 0, security.UserNotFoundError(login)
+	}
+	if secret != "secret" {
+		return 0, security.InvalidCredentialsError(login)
+	}
+	return uid, nil
+}
+
+func TestRESTAPI(t *testing.T) {
+	security.AuthenticationRegistry.RegisterBackend(restTestBackend{})
+	controllers.AddRESTGroup("/api")
+	controllers.BootStrap()
+	request := func(method, path, login, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if login != "" {
+			req.SetBasicAuth(login, "secret")
+		}
+		w := httptest.NewRecorder()
+		server.GetServer().ServeHTTP(w, req)
+		return w
+	}
+	decode := func(w *httptest.ResponseRecorder) map[string]interface{} {
+		var res map[string]interface{}
+		So(json.Unmarshal(w.Body.Bytes(), &res), ShouldBeNil)
+		return res
+	}
+	errorType := func(w *httptest.ResponseRecorder) interface{} {
+		return decode(w)["error"].(map[string]interface{})["type"]
+	}
+	search := func(filter string) float64 {
+		w := request(http.MethodGet, "/api/Tag?filter="+url.QueryEscape(filter), "admin", "")
+		So(w.Code, ShouldEqual, http.StatusOK)
+		return decode(w)["count"].(float64)
+	}
+	Convey("Testing the REST API", t, func() {
+		Convey("Requests without valid authentication should be rejected", func() {
+			for _, path := range []string{"/api/", "/api/Tag", "/api/Tag/1"} {
+				w := request(http.MethodGet, path, "", "")
+				So(w.Code, ShouldEqual, http.StatusUnauthorized)
+				So(w.Header().Get("WWW-Authenticate"), ShouldNotBeBlank)
+				So(errorType(w), ShouldEqual, "unauthorized")
+			}
+			So(request(http.MethodGet, "/api/Tag", "nobody", "").Code, ShouldEqual, http.StatusUnauthorized)
+		})
+		Convey("Creating, reading, updating and deleting a record", func() {
+			w := request(http.MethodPost, "/api/Tag", "admin", `{"name": "REST Tag", "description": "Created with REST", "rate": 5}`)
+			So(w.Code, ShouldEqual, http.StatusCreated)
+			tag := decode(w)
+			So(tag["name"], ShouldEqual, "REST Tag")
+			So(tag["description"], ShouldEqual, "Created with REST")
+			path := fmt.Sprintf("/api/Tag/%d", int64(tag["id"].(float64)))
+
+			w = request(http.MethodGet, path+"?fields=name,rate", "admin", "")
+			So(w.Code, ShouldEqual, http.StatusOK)
+			tag = decode(w)
+			So(tag["name"], ShouldEqual, "REST Tag")
+			So(tag["rate"], ShouldEqual, 5)
+			So(tag, ShouldNotContainKey, "description")
+
+			w = request(http.MethodPatch, path, "admin", `{"rate": 8}`)
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(decode(w)["rate"], ShouldEqual, 8)
+
+			w = request(http.MethodPatch, path, "admin", `{"description": "REST Tag"}`)
+			So(w.Code, ShouldEqual, http.StatusUnprocessableEntity)
+			So(errorType(w), ShouldEqual, "validation_error")
+
+			So(search(`[["Name", "=", "REST Tag"]]`), ShouldEqual, 1)
+
+			w = request(http.MethodDelete, path, "admin", "")
+			So(w.Code, ShouldEqual, http.StatusNoContent)
+			So(request(http.MethodGet, path, "admin", "").Code, ShouldEqual, http.StatusNotFound)
+			So(search(`[["Name", "=", "REST Tag"]]`), ShouldEqual, 0)
+		})
+		Convey("Models and records denied by access control should be forbidden", func() {
+			group := security.Registry.NewGroup("rest_group", "REST Group")
+			tagModel := models.Registry.MustGet("Tag")
+			tagModel.AllowModelAccess(group, security.All)
+			w := request(http.MethodGet, "/api/Tag", "demo", "")
+			So(w.Code, ShouldEqual, http.StatusForbidden)
+			So(errorType(w), ShouldEqual, "access_error")
+			w = request(http.MethodPost, "/api/Tag", "demo", `{"name": "Forbidden Tag"}`)
+			So(w.Code, ShouldEqual, http.StatusForbidden)
+			So(search(`[["Name", "=", "Forbidden Tag"]]`), ShouldEqual, 0)
+			tagModel.RevokeModelAccess(group, security.All)
+			security.Registry.UnregisterGroup(group)
+		})
+		Convey("The OpenAPI document should only describe the models the user can read", func() {
+			schemas := func(login string) map[string]interface{} {
+				w := request(http.MethodGet, "/api/", login, "")
+				So(w.Code, ShouldEqual, http.StatusOK)
+				return decode(w)["components"].(map[string]interface{})["schemas"].(map[string]interface{})
+			}
+			So(schemas("demo"), ShouldContainKey, "Tag")
+			group := security.Registry.NewGroup("rest_group", "REST Group")
+			tagModel := models.Registry.MustGet("Tag")
+			tagModel.AllowModelAccess(group, security.All)
+			So(schemas("demo"), ShouldNotContainKey, "Tag")
+			So(schemas("demo"), ShouldContainKey, "User")
+			So(schemas("admin"), ShouldContainKey, "Tag")
+			tagModel.RevokeModelAccess(group, security.All)
+			security.Registry.UnregisterGroup(group)
+		})
+		Convey("Filters in polish notation", func() {
+			var paths []string
+			for i, name := range []string{"REST A", "REST B", "REST C"} {
+				w := request(http.MethodPost, "/api/Tag", "admin", fmt.Sprintf(`{"name": %q, "rate": %d}`, name, i+1))
+				So(w.Code, ShouldEqual, http.StatusCreated)
+				paths = append(paths, fmt.Sprintf("/api/Tag/%d", int64(decode(w)["id"].(float64))))
+			}
+			So(search(`[["Name", "ilike", "REST "]]`), ShouldEqual, 3)
+			So(search(`[["Name", "ilike", "REST "], ["Rate", ">", 1]]`), ShouldEqual, 2)
+			So(search(`["|", ["Name", "=", "REST A"], ["Name", "=", "REST B"]]`), ShouldEqual, 2)
+			So(search(`["|", ["Name", "=", "REST A"], ["Name", "=", "REST B"], ["Rate", ">", 1]]`), ShouldEqual, 1)
+			So(search(`["!", ["Name", "=", "REST A"], ["Name", "ilike", "REST "]]`), ShouldEqual, 2)
+			So(search(`["&", ["Name", "ilike", "REST "], "|", ["Rate", "=", 1], ["Rate", "=", 3]]`), ShouldEqual, 2)
+			for _, filter := range []string{
+				`{"Name": "REST A"}`,
+				`["|", ["Name", "=", "REST A"]]`,
+				`[["Name", "unknown", "REST A"]]`,
+				`[["Name", "="]]`,
+				`["?"]`,
+			} {
+				w := request(http.MethodGet, "/api/Tag?filter="+url.QueryEscape(filter), "admin", "")
+				So(w.Code, ShouldEqual, http.StatusBadRequest)
+				So(errorType(w), ShouldEqual, "user_error")
+			}
+			for _, path := range paths {
+				So(request(http.MethodDelete, path, "admin", "").Code, ShouldEqual, http.StatusNoContent)
+			}
+		})
+	})
+}
@@ -99,13 +99,13 @@ func InitializeTests(moduleName string) {
 	}
 	db.Close()
 
-	server.PreInit()
 	models.DBConnect(driver, models.ConnectionParams{
 		DBName:   dbName,
 		User:     user,
 		Password: password,
 		SSLMode:  "disable",
 	})
+	server.PreInit()
 	models.BootStrap()
 	resourceDir, _ := filepath.Abs(filepath.Join(".", "res"))
 	server.ResourceDir = resourceDir
@@ -16,12 +16,12 @@ package testmodule
 
 import (
 	"fmt"
-	"log"
 
 	"github.com/hexya-erp/hexya/src/actions"
 	"github.com/hexya-erp/hexya/src/models"
 	"github.com/hexya-erp/hexya/src/models/security"
 	"github.com/hexya-erp/hexya/src/models/types"
+	"github.com/hexya-erp/hexya/src/tools/exceptions"
 	"github.com/hexya-erp/pool/h"
 	"github.com/hexya-erp/pool/m"
 	"github.com/hexya-erp/pool/q"
@@ -226,7 +226,7 @@ func init() {
 		`CheckRate checks that the given RecordSet has a rate between 0 and 10`,
 		func(rs m.TagSet) {
 			if rs.Rate() < 0 || rs.Rate() > 10 {
-				log.Panic("Tag rate must be between 0 and 10")
+				panic(exceptions.UserError{Message: "Tag rate must be between 0 and 10"})
 			}
 		}).AllowGroup(security.GroupEveryone)
 
@@ -234,7 +234,7 @@ func init() {
 		`CheckNameDescription checks that the description of a tag is not equal to its name`,
 		func(rs m.TagSet) {
 			if rs.Name() == rs.Description() {
-				log.Panic("Tag name and description must be different")
+				panic(exceptions.UserError{Message: "Tag name and description must be different"})
 			}
 		})
 
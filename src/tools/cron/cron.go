@@ -0,0 +1,230 @@
+// Copyright 2019 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+// Package cron parses cron schedule expressions and computes their
+// activation times.
+package cron
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxSearchYears is the number of years after which Next gives up
+// looking for an activation time that never occurs (e.g. 30 February).
+const maxSearchYears = 5
+
+// A bound is the range of allowed values of a schedule field
+type bound struct {
+	min, max uint
+	names    map[string]uint
+}
+
+var (
+	minutes = bound{0, 59, nil}
+	hours   = bound{0, 23, nil}
+	days    = bound{1, 31, nil}
+	months  = bound{1, 12, map[string]uint{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}}
+	weekDays = bound{0, 6, map[string]uint{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}}
+)
+
+// macros are the predefined schedules
+var macros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// A Schedule is a parsed cron expression.
+//
+// Each field is a bit set of the allowed values.
+type Schedule struct {
+	spec                          string
+	minute, hour, dom, month, dow uint64
+	// domStar and dowStar are true if the day of month or the day of week field
+	// was "*". As in standard cron, if both fields are restricted, a day matches
+	// if it matches any of them.
+	domStar, dowStar bool
+}
+
+// String returns the expression this Schedule was parsed from
+func (s *Schedule) String() string {
+	return s.spec
+}
+
+// Parse parses the given cron expression.
+//
+// Expressions have five fields separated by spaces: minute, hour, day of month,
+// month and day of week, such as "30 2 * * mon-fri". Each field accepts '*',
+// single values, ranges ("1-5"), lists ("1,15") and steps ("*/15", "0-30/10").
+// Months and days of week can be given by their three-letter English names,
+// and 7 is accepted for Sunday. The following macros are also accepted:
+// @yearly, @annually, @monthly, @weekly, @daily, @midnight and @hourly.
+func Parse(spec string) (*Schedule, error) {
+	expr := strings.TrimSpace(spec)
+	if macro, ok := macros[strings.ToLower(expr)]; ok {
+		expr = macro
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression %q must have 5 fields, got %d", spec, len(fields))
+	}
+	s := Schedule{
+		spec:    spec,
+		domStar: fields[2] == "*" || fields[2] == "?",
+		dowStar: fields[4] == "*" || fields[4] == "?",
+	}
+	var err error
+	if s.minute, err = parseField(fields[0], minutes); err != nil {
+		return nil, fmt.Errorf("invalid minute in %q: %s", spec, err)
+	}
+	if s.hour, err = parseField(fields[1], hours); err != nil {
+		return nil, fmt.Errorf("invalid hour in %q: %s", spec, err)
+	}
+	if s.dom, err = parseField(fields[2], days); err != nil {
+		return nil, fmt.Errorf("invalid day of month in %q: %s", spec, err)
+	}
+	if s.month, err = parseField(fields[3], months); err != nil {
+		return nil, fmt.Errorf("invalid month in %q: %s", spec, err)
+	}
+	// Sunday can be given as 7
+	dowBound := weekDays
+	dowBound.max = 7
+	if s.dow, err = parseField(fields[4], dowBound); err != nil {
+		return nil, fmt.Errorf("invalid day of week in %q: %s", spec, err)
+	}
+	if s.dow&(1<<7) != 0 {
+		s.dow = s.dow&^(1<<7) | 1
+	}
+	return &s, nil
+}
+
+// MustParse parses the given cron expression and panics if it is invalid.
+func MustParse(spec string) *Schedule {
+	s, err := Parse(spec)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// parseField returns the bit set of the values allowed by the given field
+func parseField(field string, b bound) (uint64, error) {
+	var res uint64
+	for _, part := range strings.Split(field, ",") {
+		rangeExpr, step := part, uint(1)
+		if i := strings.Index(part, "/"); i >= 0 {
+			rangeExpr = part[:i]
+			st, err := strconv.ParseUint(part[i+1:], 10, 8)
+			if err != nil || st == 0 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+			step = uint(st)
+		}
+		start, end := b.min, b.max
+		switch {
+		case rangeExpr == "*" || rangeExpr == "?":
+		case strings.Contains(rangeExpr, "-"):
+			i := strings.Index(rangeExpr, "-")
+			var err error
+			if start, err = parseValue(rangeExpr[:i], b); err != nil {
+				return 0, err
+			}
+			if end, err = parseValue(rangeExpr[i+1:], b); err != nil {
+				return 0, err
+			}
+			if start > end {
+				return 0, fmt.Errorf("invalid range %q", rangeExpr)
+			}
+		default:
+			val, err := parseValue(rangeExpr, b)
+			if err != nil {
+				return 0, err
+			}
+			start = val
+			if step == 1 {
+				end = val
+			}
+		}
+		for v := start; v <= end; v += step {
+			res |= 1 << v
+		}
+	}
+	return res, nil
+}
+
+// parseValue returns the value of the given number or name
+func parseValue(expr string, b bound) (uint, error) {
+	if val, ok := b.names[strings.ToLower(expr)]; ok {
+		return val, nil
+	}
+	val, err := strconv.ParseUint(expr, 10, 8)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q", expr)
+	}
+	if uint(val) < b.min || uint(val) > b.max {
+		return 0, fmt.Errorf("value %d out of range [%d-%d]", val, b.min, b.max)
+	}
+	return uint(val), nil
+}
+
+// has returns true if the given value is in the given bit set
+func has(set uint64, value int) bool {
+	return set&(1<<uint(value)) != 0
+}
+
+// dayMatches returns true if the day of t matches this Schedule
+func (s *Schedule) dayMatches(t time.Time) bool {
+	domMatch := has(s.dom, t.Day())
+	dowMatch := has(s.dow, int(t.Weekday()))
+	if s.domStar || s.dowStar {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
+
+// Next returns the first activation time of this Schedule strictly after t,
+// evaluated in the location of t. It returns the zero time if no activation
+// time could be found within the next years.
+func (s *Schedule) Next(t time.Time) time.Time {
+	loc := t.Location()
+	t = t.Add(time.Minute - time.Duration(t.Second())*time.Second - time.Duration(t.Nanosecond()))
+	yearLimit := t.Year() + maxSearchYears
+
+	for t.Year() <= yearLimit {
+		if !has(s.month, int(t.Month())) {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if !s.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if !has(s.hour, t.Hour()) {
+			next := time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+			if !next.After(t) {
+				// The next hour does not exist or is repeated because of a DST change
+				next = t.Add(time.Duration(60-t.Minute()) * time.Minute)
+			}
+			t = next
+			continue
+		}
+		if !has(s.minute, t.Minute()) {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
@@ -0,0 +1,73 @@
+// Copyright 2019 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package cron
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestParse(t *testing.T) {
+	Convey("Testing cron expressions parsing", t, func() {
+		Convey("Valid expressions should be parsed", func() {
+			s, err := Parse("*/15 2,14 1-5 jan-mar mon")
+			So(err, ShouldBeNil)
+			So(s.minute, ShouldEqual, 1|1<<15|1<<30|1<<45)
+			So(s.hour, ShouldEqual, 1<<2|1<<14)
+			So(s.dom, ShouldEqual, 1<<1|1<<2|1<<3|1<<4|1<<5)
+			So(s.month, ShouldEqual, 1<<1|1<<2|1<<3)
+			So(s.dow, ShouldEqual, 1<<1)
+			So(s.domStar, ShouldBeFalse)
+			So(s.String(), ShouldEqual, "*/15 2,14 1-5 jan-mar mon")
+		})
+		Convey("Sunday can be given as 7", func() {
+			So(MustParse("0 0 * * 7").dow, ShouldEqual, 1)
+		})
+		Convey("Macros should be expanded", func() {
+			So(MustParse("@daily").hour, ShouldEqual, 1)
+			So(MustParse("@weekly").dowStar, ShouldBeFalse)
+		})
+		Convey("Invalid expressions should return an error", func() {
+			for _, spec := range []string{"* * *", "61 * * * *", "*/0 * * * *", "5-1 * * * *", "* * * foo *"} {
+				_, err := Parse(spec)
+				So(err, ShouldNotBeNil)
+			}
+			So(func() { MustParse("* * * * * *") }, ShouldPanic)
+		})
+	})
+}
+
+func TestNext(t *testing.T) {
+	Convey("Testing next activation times", t, func() {
+		paris, err := time.LoadLocation("Europe/Paris")
+		So(err, ShouldBeNil)
+		base := time.Date(2019, 3, 30, 23, 10, 20, 0, paris)
+		Convey("Activation times should be strictly after the given time", func() {
+			So(MustParse("*/15 * * * *").Next(base).Equal(time.Date(2019, 3, 30, 23, 15, 0, 0, paris)), ShouldBeTrue)
+			So(MustParse("10 23 * * *").Next(base).Equal(time.Date(2019, 3, 31, 23, 10, 0, 0, paris)), ShouldBeTrue)
+		})
+		Convey("Days of month and days of week should be combined as in cron", func() {
+			So(MustParse("0 9 * * mon-fri").Next(base).Equal(time.Date(2019, 4, 1, 9, 0, 0, 0, paris)), ShouldBeTrue)
+			So(MustParse("0 9 5 * sun").Next(base).Equal(time.Date(2019, 3, 31, 9, 0, 0, 0, paris)), ShouldBeTrue)
+			So(MustParse("@monthly").Next(base).Equal(time.Date(2019, 4, 1, 0, 0, 0, 0, paris)), ShouldBeTrue)
+		})
+		Convey("Times skipped by a DST change should be skipped", func() {
+			So(MustParse("30 2 * * *").Next(base).Equal(time.Date(2019, 4, 1, 2, 30, 0, 0, paris)), ShouldBeTrue)
+			So(MustParse("0 3 * * *").Next(base).Equal(time.Date(2019, 3, 31, 3, 0, 0, 0, paris)), ShouldBeTrue)
+		})
+		Convey("DST changes should be handled in zones with non whole hour offsets", func() {
+			stJohns, err := time.LoadLocation("America/St_Johns")
+			So(err, ShouldBeNil)
+			nBase := time.Date(2019, 3, 10, 0, 10, 0, 0, stJohns)
+			So(MustParse("0 3 * * *").Next(nBase).Equal(time.Date(2019, 3, 10, 3, 0, 0, 0, stJohns)), ShouldBeTrue)
+			So(MustParse("0 * * * *").Next(nBase.Add(time.Hour)).Equal(time.Date(2019, 3, 10, 3, 0, 0, 0, stJohns)), ShouldBeTrue)
+		})
+		Convey("Rare and impossible dates should be handled", func() {
+			So(MustParse("0 0 29 2 *").Next(base).Equal(time.Date(2020, 2, 29, 0, 0, 0, 0, paris)), ShouldBeTrue)
+			So(MustParse("0 0 30 2 *").Next(base).IsZero(), ShouldBeTrue)
+		})
+	})
+}
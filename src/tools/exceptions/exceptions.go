@@ -18,3 +18,50 @@ type UserError struct {
 func (u UserError) Error() string {
 	return fmt.Sprintf("%s\n----------------------------------\n%s", u.Message, u.Debug)
 }
+
+// AccessError is an error raised when a user tries to perform an
+// operation on a model without having been granted the access rights.
+//
+// Field is set if the access to a specific field of the model was denied.
+type AccessError struct {
+	Model     string
+	Field     string
+	Operation string
+	UID       int64
+}
+
+// Error method for the AccessError type.
+func (a AccessError) Error() string {
+	if a.Field != "" {
+		return fmt.Sprintf("You are not allowed to %s field %s of model %s (uid: %d)", a.Operation, a.Field, a.Model, a.UID)
+	}
+	return fmt.Sprintf("You are not allowed to %s records of model %s (uid: %d)", a.Operation, a.Model, a.UID)
+}
+
+// ConcurrentUpdateError is an error raised when a user tries to update
+// records that have been modified by another user since they were read.
+type ConcurrentUpdateError struct {
+	Model string
+	IDs   []int64
+}
+
+// Error method for the ConcurrentUpdateError type.
+func (c ConcurrentUpdateError) Error() string {
+	return fmt.Sprintf("Records %v of model %s have been modified by another user since you read them. Please reload and try again.", c.IDs, c.Model)
+}
+
+// ValidationError is an error raised when the values of records do not
+// satisfy the constraints of their model, typically by constraint methods.
+//
+// Field is set if the constraint applies on a specific field of the model.
+type ValidationError struct {
+	Model   string
+	Field   string
+	Message string
+}
+
+// Error method for the ValidationError type.
+// Returns the message.
+func (v ValidationError) Error() string {
+	return v.Message
+}
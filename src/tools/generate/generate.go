@@ -16,6 +16,7 @@ import (
 	"text/template"
 
 	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/models/fieldtype"
 	"github.com/hexya-erp/hexya/src/tools/strutils"
 )
 
@@ -30,6 +31,7 @@ type fieldData struct {
 	SanType     string
 	ImportPath  string
 	IsRS        bool
+	IsJSON      bool
 	MixinField  bool
 	EmbedField  bool
 }
@@ -51,17 +53,26 @@ type methodData struct {
 }
 
 // an operatorDef defines an operator func
+//
+// Range operators take a low and a high value and Cond
+// operators take a condition on the related model.
 type operatorDef struct {
 	Name  string
 	Multi bool
+	Range bool
+	Cond  bool
 }
 
 // An fieldType holds the name and valid operators on a field type
 type fieldType struct {
-	Type      string
-	SanType   string
-	IsRS      bool
-	Operators []operatorDef
+	Type       string
+	SanType    string
+	RelModel   string
+	IsRS       bool
+	IsJSON     bool
+	IsValue    bool
+	Operators  []operatorDef
+	Aggregates []string
 }
 
 // A modelData describes a RecordSet model
@@ -263,6 +274,7 @@ func addFieldsToModelData(modelASTData ModelASTData, modelData *modelData, depsM
 			Type:       typStr,
 			IType:      iTypStr,
 			IsRS:       fieldASTData.IsRS,
+			IsJSON:     fieldASTData.FType == fieldtype.JSON,
 			RelModel:   fieldASTData.RelModel,
 			SanType:    createTypeIdent(typStr),
 			MixinField: fieldASTData.MixinField,
@@ -276,6 +288,24 @@ func addFieldsToModelData(modelASTData ModelASTData, modelData *modelData, depsM
 	}
 }
 
+// valueSanType is the SanType of the condition fields on values of any type,
+// such as values inside JSON fields or aggregates of related records. It must
+// match the type returned by JSONPath and Count in poolModelsQueryTemplate.
+const valueSanType = "Value"
+
+// aggregateFuncs are the aggregate functions with a field argument
+// that can be compared in conditions on relation fields.
+var aggregateFuncs = []string{"Sum", "Avg", "Min", "Max"}
+
+// comparisonOperators returns the operators that apply to all field types
+func comparisonOperators() []operatorDef {
+	return []operatorDef{
+		{Name: "Equals"}, {Name: "NotEquals"}, {Name: "Greater"}, {Name: "GreaterOrEqual"}, {Name: "Lower"},
+		{Name: "LowerOrEqual"}, {Name: "Like"}, {Name: "Contains"}, {Name: "NotContains"}, {Name: "IContains"},
+		{Name: "NotIContains"}, {Name: "ILike"}, {Name: "In", Multi: true}, {Name: "NotIn", Multi: true},
+	}
+}
+
 // addFieldTypesToModelData extracts field types from mData.Fields
 // and add them to mData.Types
 func addFieldTypesToModelData(mData *modelData) {
@@ -287,18 +317,38 @@ func addFieldTypesToModelData(mData *modelData) {
 		}
 		fTypes[f.IType] = true
 		tDeps[f.ImportPath] = true
-		mData.Types = append(mData.Types, fieldType{
-			Type:    f.IType,
-			SanType: f.SanType,
-			IsRS:    f.IsRS,
-			Operators: []operatorDef{
-				{Name: "Equals"}, {Name: "NotEquals"}, {Name: "Greater"}, {Name: "GreaterOrEqual"}, {Name: "Lower"},
-				{Name: "LowerOrEqual"}, {Name: "Like"}, {Name: "Contains"}, {Name: "NotContains"}, {Name: "IContains"},
-				{Name: "NotIContains"}, {Name: "ILike"}, {Name: "In", Multi: true}, {Name: "NotIn", Multi: true},
-				{Name: "ChildOf"},
-			},
-		})
+		operators := append(comparisonOperators(), operatorDef{Name: "ChildOf"}, operatorDef{Name: "ParentOf"})
+		switch {
+		case f.IsRS:
+			operators = append(operators, operatorDef{Name: "Overlaps", Multi: true}, operatorDef{Name: "Any", Cond: true},
+				operatorDef{Name: "Exists", Cond: true}, operatorDef{Name: "NotExists", Cond: true})
+		case f.IType == "string":
+			// Full-text search and regular expressions only apply to text fields
+			operators = append(operators, operatorDef{Name: "Between", Range: true}, operatorDef{Name: "Regex"},
+				operatorDef{Name: "IRegex"}, operatorDef{Name: "Search"})
+		default:
+			operators = append(operators, operatorDef{Name: "Between", Range: true})
+		}
+		fType := fieldType{
+			Type:      f.IType,
+			SanType:   f.SanType,
+			RelModel:  f.RelModel,
+			IsRS:      f.IsRS,
+			IsJSON:    f.IsJSON,
+			Operators: operators,
+		}
+		if f.IsRS {
+			fType.Aggregates = aggregateFuncs
+		}
+		mData.Types = append(mData.Types, fType)
 	}
+	mData.Types = append(mData.Types, fieldType{
+		Type:    "interface{}",
+		SanType: valueSanType,
+		IsValue: true,
+		Operators: append(comparisonOperators(), operatorDef{Name: "Between", Range: true},
+			operatorDef{Name: "Regex"}, operatorDef{Name: "IRegex"}),
+	})
 	for dep := range tDeps {
 		if dep == "" {
 			continue
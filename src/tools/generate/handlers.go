@@ -11,6 +11,7 @@ import (
 // for specific methods.
 var specificMethodsHandlers = map[string]func(modelData *modelData, depsMap *map[string]bool){
 	"Search":           searchMethodHandler,
+	"Having":           havingMethodHandler,
 	"SearchByName":     searchByNameMethodHandler,
 	"Create":           createMethodHandler,
 	"New":              newMethodHandler,
@@ -51,6 +52,31 @@ func searchMethodHandler(modelData *modelData, _ *map[string]bool) {
 	})
 }
 
+// havingMethodHandler returns the specific methodData for the Having method.
+func havingMethodHandler(modelData *modelData, _ *map[string]bool) {
+	name := "Having"
+	iReturnString := fmt.Sprintf("%sSet", modelData.Name)
+	returnString := fmt.Sprintf("%s.%sSet", PoolInterfacesPackage, modelData.Name)
+	modelData.AllMethods = append(modelData.AllMethods, methodData{
+		Name:             name,
+		ParamsTypes:      fmt.Sprintf("%s.%sCondition", PoolQueryPackage, modelData.Name),
+		IParamsWithTypes: fmt.Sprintf("condition %s.%sCondition", PoolQueryPackage, modelData.Name),
+		ReturnString:     returnString,
+		IReturnString:    iReturnString,
+	})
+	modelData.Methods = append(modelData.Methods, methodData{
+		Name:           name,
+		Doc:            fmt.Sprintf("// Having returns a new %sSet which grouped query only returns the groups matching the given Condition", modelData.Name),
+		ToDeclare:      false,
+		Params:         "condition",
+		ParamsWithType: fmt.Sprintf("condition %s.%sCondition", PoolQueryPackage, modelData.Name),
+		ReturnAsserts:  fmt.Sprintf("resTyped := res.(models.RecordSet).Collection().Wrap(\"%s\").(%s)", modelData.Name, returnString),
+		Returns:        "resTyped",
+		ReturnString:   returnString,
+		Call:           "Call",
+	})
+}
+
 // createMethodHandler returns the specific methodData for the Create method.
 func createMethodHandler(modelData *modelData, _ *map[string]bool) {
 	name := "Create"
@@ -31,6 +31,7 @@ var (
 		"CommonMixin":    true,
 		"BaseMixin":      true,
 		"ModelMixin":     true,
+		"ArchiveMixin":   true,
 		"TransientMixin": true,
 	}
 )
@@ -24,6 +24,7 @@ import (
 	"go/types"
 	"strings"
 
+	"github.com/hexya-erp/hexya/src/models"
 	"github.com/hexya-erp/hexya/src/models/fieldtype"
 	"github.com/hexya-erp/hexya/src/tools/strutils"
 	"golang.org/x/tools/go/packages"
@@ -189,6 +190,8 @@ func GetModelsASTDataForModules(modInfos []*ModuleInfo, validate bool) map[strin
 						parseMixInModel(node, modInfo, &modelsData)
 					case fnctName == "AddFields":
 						parseAddFields(node, modInfo, &modelsData)
+					case fnctName == "EnableMultiCompany":
+						parseEnableMultiCompany(node, modInfo, &modelsData)
 					case strutils.StartsAndEndsWith(fnctName, "Declare", "Model"):
 						parseDeclareModel(node, modInfo, &modelsData)
 					case strutils.StartsAndEndsWith(fnctName, "New", "Model"):
@@ -304,6 +307,10 @@ func setModelData(modelsData *map[string]ModelASTData, modelName string, modelTy
 	case "":
 		model.Mixins["BaseMixin"] = true
 		model.Mixins["ModelMixin"] = true
+	case "Archivable":
+		model.Mixins["BaseMixin"] = true
+		model.Mixins["ModelMixin"] = true
+		model.Mixins["ArchiveMixin"] = true
 	case "Transient":
 		model.Mixins["BaseMixin"] = true
 	}
@@ -381,6 +388,28 @@ func parseAddFields(node *ast.CallExpr, modInfo *ModuleInfo, modelsData *map[str
 	}
 }
 
+// parseEnableMultiCompany adds the Company field to the model of the
+// given node which is an EnableMultiCompany function
+func parseEnableMultiCompany(node *ast.CallExpr, modInfo *ModuleInfo, modelsData *map[string]ModelASTData) {
+	fNode := node.Fun.(*ast.SelectorExpr)
+	modelName, err := extractModel(fNode.X, modInfo)
+	if err != nil {
+		log.Panic("Unable to extract model while visiting AST", "error", err)
+	}
+	if _, exists := (*modelsData)[modelName]; !exists {
+		(*modelsData)[modelName] = newModelASTData(modelName)
+	}
+	(*modelsData)[modelName].Fields["Company"] = FieldASTData{
+		Name:     "Company",
+		FType:    fieldtype.Many2One,
+		RelModel: models.CompanyModelName,
+		IsRS:     true,
+		Type: TypeData{
+			Type: fieldtype.Many2One.DefaultGoType().String(),
+		},
+	}
+}
+
 // parseFieldAttribute parses the given KeyValueExpr of a field definition
 func parseFieldAttribute(fElem *ast.KeyValueExpr, fData FieldASTData, modInfo *ModuleInfo) FieldASTData {
 	switch fElem.Key.(*ast.Ident).Name {
@@ -533,7 +562,7 @@ func extractModel(ident ast.Expr, modInfo *ModuleInfo) (string, error) {
 					fnIdent = ft.Sel
 				}
 				switch fnIdent.Name {
-				case "MustGet", "NewModel", "NewMixinModel", "NewTransientModel", "NewManualModel":
+				case "MustGet", "NewModel", "NewArchivableModel", "NewMixinModel", "NewTransientModel", "NewManualModel":
 					return strings.Trim(rd.Args[0].(*ast.BasicLit).Value, "\"`"), nil
 				case "createModel":
 					// This is a call from inside a NewXXXXModel function
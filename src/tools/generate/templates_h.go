@@ -314,10 +314,12 @@ var _ {{ .InterfacesPackageName }}.{{ $.Name }}Data = {{ .Name }}Data{}
 // - Values holds the values of the actual query
 // - Count is the number of lines aggregated into this one
 // - Condition can be used to query the aggregated rows separately if needed
+// - AggregateValue returns the results of the aggregates of the query
 type {{ .Name }}GroupAggregateRow struct {
-	values    {{ .InterfacesPackageName }}.{{ .Name }}Data
-	count     int
-	condition {{ $.QueryPackageName }}.{{ .Name }}Condition
+	values     {{ .InterfacesPackageName }}.{{ .Name }}Data
+	count      int
+	condition  {{ $.QueryPackageName }}.{{ .Name }}Condition
+	aggregates map[string]interface{}
 }
 
 // Values returns the values of the actual query
@@ -335,6 +337,12 @@ func (a {{ .Name }}GroupAggregateRow) Condition() {{ $.QueryPackageName }}.{{ .N
 	return a.condition
 }
 
+// AggregateValue returns the result of the given aggregate for this row,
+// which must have been requested with WithAggregates
+func (a {{ .Name }}GroupAggregateRow) AggregateValue(agg models.Aggregate) interface{} {
+	return a.aggregates[agg.String()]
+}
+
 // ------- RECORD SET ---------
 
 // {{ .Name }}Set is an autogenerated type to handle {{ .Name }} objects.
@@ -376,6 +384,29 @@ func (s {{ .Name }}Set) Records() []{{ .InterfacesPackageName }}.{{ .Name }}Set
 	return res
 }
 
+// CreateMulti inserts a {{ .Name }} record in the database for each of the given data,
+// using multi-row INSERT queries. Returns the created {{ .Name }}Set.
+//
+// CreateMulti does not call the Create method. See models.RecordCollection.CreateMulti.
+func (s {{ .Name }}Set) CreateMulti(data []{{ .InterfacesPackageName }}.{{ .Name }}Data) {{ .InterfacesPackageName }}.{{ .Name }}Set {
+	recsData := make([]models.RecordData, len(data))
+	for i, d := range data {
+		recsData[i] = d
+	}
+	return s.RecordCollection.CreateMulti(recsData).Wrap("{{ .Name }}").({{ .InterfacesPackageName }}.{{ .Name }}Set)
+}
+
+// Iterate calls fnct successively with {{ .Name }}Sets of at most batchSize records
+// of this RecordSet, until all records have been processed or fnct returns false.
+//
+// Records are loaded by batches and evicted from the cache once processed, so
+// that large RecordSets can be processed without loading them into memory.
+func (s {{ .Name }}Set) Iterate(batchSize int, fnct func({{ .InterfacesPackageName }}.{{ .Name }}Set) bool) {
+	s.RecordCollection.Iterate(batchSize, func(rs models.RecordSet) bool {
+		return fnct(rs.Collection().Wrap("{{ .Name }}").({{ .InterfacesPackageName }}.{{ .Name }}Set))
+	})
+}
+
 // CartesianProduct returns the cartesian product of this {{ .Name }}Set with others.
 func (s {{ .Name }}Set) CartesianProduct(others ...{{ .InterfacesPackageName }}.{{ .Name }}Set) []{{ .InterfacesPackageName }}.{{ .Name }}Set {
 	otherSet := make([]models.RecordSet, len(others))
@@ -443,6 +474,7 @@ func (s {{ .Name }}Set) Aggregates(fieldNames ...models.FieldName) []{{ .Interfa
 			condition: {{ $.QueryPackageName }}.{{ .Name }}Condition {
 				Condition: l.Condition,
 			},
+			aggregates: l.Aggregates,
 		}
 	}
 	return res
@@ -64,6 +64,12 @@ type {{ .Name }}Set interface {
 	ModelData(fMap models.FieldMap) {{ .Name }}Data
 	// Records returns a slice with all the records of this RecordSet, as singleton RecordSets
 	Records() []{{ .Name }}Set
+	// CreateMulti inserts a {{ .Name }} record in the database for each of the given data,
+	// using multi-row INSERT queries. Returns the created {{ .Name }}Set.
+	CreateMulti(data []{{ .Name }}Data) {{ .Name }}Set
+	// Iterate calls fnct successively with {{ .Name }}Sets of at most batchSize records
+	// of this RecordSet, until all records have been processed or fnct returns false.
+	Iterate(batchSize int, fnct func({{ .Name }}Set) bool)
 	// First returns the values of the first Record of the RecordSet as a pointer to a {{ .Name }}Data.
 	//
 	// If this RecordSet is empty, it returns an empty {{ .Name }}Data.
@@ -140,6 +146,8 @@ type {{ .Name }}GroupAggregateRow interface {
 	Count() int
 	// Condition can be used to query the aggregated rows separately if needed
 	Condition() {{ $.QueryPackageName }}.{{ .Name }}Condition
+	// AggregateValue returns the result of the given aggregate for this row
+	AggregateValue(agg models.Aggregate) interface{}
 }
 
 `))
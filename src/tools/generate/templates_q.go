@@ -134,6 +134,40 @@ type p{{ $typ.SanType }}ConditionField struct {
 }
 
 {{ range $typ.Operators }}
+{{ if .Cond }}
+// {{ .Name }} adds a condition on the related records to the ConditionPath
+func (c p{{ $typ.SanType }}ConditionField) {{ .Name }}(cond {{ $typ.RelModel }}Condition) Condition {
+	return Condition{
+		Condition: c.ConditionField.{{ .Name }}(cond),
+	}
+}
+{{ else if .Range }}
+// {{ .Name }} adds a range of values to the ConditionPath
+func (c p{{ $typ.SanType }}ConditionField) {{ .Name }}(low, high {{ $typ.Type }}) Condition {
+	return Condition{
+		Condition: c.ConditionField.{{ .Name }}(low, high),
+	}
+}
+
+// {{ .Name }}Func adds a range of function values to the ConditionPath.
+// The functions will be evaluated when the query is performed and
+// they will be given the RecordSet on which the query is made as parameter
+func (c p{{ $typ.SanType }}ConditionField) {{ .Name }}Func(low, high func (models.RecordSet) {{ $typ.Type }}) Condition {
+	return Condition{
+		Condition: c.ConditionField.{{ .Name }}(low, high),
+	}
+}
+
+// {{ .Name }}Eval adds a range of expression values to the ConditionPath.
+// The expression values will be evaluated by the client with the
+// corresponding execution context. The resulting Condition cannot
+// be used server-side.
+func (c p{{ $typ.SanType }}ConditionField) {{ .Name }}Eval(low, high string) Condition {
+	return Condition{
+		Condition: c.ConditionField.{{ .Name }}(models.ClientEvaluatedString(low), models.ClientEvaluatedString(high)),
+	}
+}
+{{ else }}
 // {{ .Name }} adds a condition value to the ConditionPath
 func (c p{{ $typ.SanType }}ConditionField) {{ .Name }}(arg {{ if and .Multi (not $typ.IsRS) }}[]{{ end }}{{ $typ.Type }}) Condition {
 	return Condition{
@@ -159,7 +193,7 @@ func (c p{{ $typ.SanType }}ConditionField) {{ .Name }}Eval(expression string) Co
 		Condition: c.ConditionField.{{ .Name }}(models.ClientEvaluatedString(expression)),
 	}
 }
-
+{{ end }}
 {{ end }}
 
 // IsNull checks if the current condition field is null
@@ -176,6 +210,51 @@ func (c p{{ $typ.SanType }}ConditionField) IsNotNull() Condition {
 	}
 }
 
+{{ if not $typ.IsValue }}
+// Aggregate selects the result of the given aggregate function applied on this field
+// for the records of a group. It can only be used in Having conditions.
+func (c p{{ $typ.SanType }}ConditionField) Aggregate(function models.AggregateFunction) pValueConditionField {
+	return pValueConditionField{
+		ConditionField: c.ConditionField.Aggregate(function),
+	}
+}
+{{ end }}
+
+{{ if $typ.IsJSON }}
+// JSONPath selects the value at the given dot separated path inside this JSON field
+func (c p{{ $typ.SanType }}ConditionField) JSONPath(path string) pValueConditionField {
+	return pValueConditionField{
+		ConditionField: c.ConditionField.JSONPath(path),
+	}
+}
+{{ end }}
+
+{{ if $typ.IsRS }}
+// Count selects the number of related records that match all the given conditions
+func (c p{{ $typ.SanType }}ConditionField) Count(conds ...{{ $typ.RelModel }}Condition) pValueConditionField {
+	mConds := make([]models.Conditioner, len(conds))
+	for i, cond := range conds {
+		mConds[i] = cond
+	}
+	return pValueConditionField{
+		ConditionField: c.ConditionField.Count(mConds...),
+	}
+}
+{{ end }}
+
+{{ range $typ.Aggregates }}
+// {{ . }} selects the {{ . }} of the given field of the related records that match all the given conditions
+func (c p{{ $typ.SanType }}ConditionField) {{ . }}(field models.FieldName, conds ...{{ $typ.RelModel }}Condition) pValueConditionField {
+	mConds := make([]models.Conditioner, len(conds))
+	for i, cond := range conds {
+		mConds[i] = cond
+	}
+	return pValueConditionField{
+		ConditionField: c.ConditionField.{{ . }}(field, mConds...),
+	}
+}
+{{ end }}
+
 // AddOperator adds a condition value to the condition with the given operator and data
 // If multi is true, a recordset will be converted into a slice of int64
 // otherwise, it will return an int64 and panic if the recordset is not a singleton.
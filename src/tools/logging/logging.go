@@ -180,10 +180,21 @@ func GetLogger(moduleName string) Logger {
 // error with the panic message. This function is separated from
 // LogAndPanic so that unwanted panics can still be logged with
 // this function.
+//
+// AccessError, ConcurrentUpdateError and ValidationError panics are returned as is.
 func LogPanicData(panicData interface{}) error {
 	msg := fmt.Sprintf("%v", panicData)
 	log.Error("Hexya panicked", "msg", msg)
 
+	if accessErr, ok := panicData.(exceptions.AccessError); ok {
+		return accessErr
+	}
+	if concurrentErr, ok := panicData.(exceptions.ConcurrentUpdateError); ok {
+		return concurrentErr
+	}
+	if validationErr, ok := panicData.(exceptions.ValidationError); ok {
+		return validationErr
+	}
 	stackTrace := stack(1)
 	fullMsg := fmt.Sprintf("%s\n\n%s", msg, stackTrace)
 	return exceptions.UserError{
@@ -17,6 +17,8 @@ package tools
 import (
 	"io/ioutil"
 	"path/filepath"
+	"runtime"
+	"strings"
 )
 
 // ListStaticFiles get all file names of the static files that are in
@@ -41,3 +43,45 @@ func ListStaticFiles(resourceDir, subDir string, modules []string, diskPath bool
 	}
 	return res
 }
+
+// CallerPackage returns the import path of the package of the first function
+// of the call stack of its caller which does not belong to one of the given
+// packages or to their subpackages. Functions of the runtime are always skipped.
+//
+// It returns the empty string if there is no such function.
+func CallerPackage(skipPackages ...string) string {
+	skipPackages = append(skipPackages, "runtime")
+	pcs := make([]uintptr, 64)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(2, pcs)])
+	for {
+		frame, more := frames.Next()
+		pkg := functionPackage(frame.Function)
+		if pkg != "" && !inPackages(pkg, skipPackages) {
+			return pkg
+		}
+		if !more {
+			return ""
+		}
+	}
+}
+
+// functionPackage returns the import path of the package of the
+// function with the given fully qualified name.
+func functionPackage(funcName string) string {
+	lastSlash := strings.LastIndex(funcName, "/")
+	dot := strings.Index(funcName[lastSlash+1:], ".")
+	if dot < 0 {
+		return ""
+	}
+	return funcName[:lastSlash+1+dot]
+}
+
+// inPackages returns true if pkg is one of the given packages or one of their subpackages
+func inPackages(pkg string, packages []string) bool {
+	for _, p := range packages {
+		if pkg == p || strings.HasPrefix(pkg, p+"/") {
+			return true
+		}
+	}
+	return false
+}